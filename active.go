@@ -0,0 +1,108 @@
+package main
+
+/*
+ * active.go
+ * Only run during a daily time window
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/* activeWindow is a daily window of time, which may cross midnight, during
+which the chain and listeners should be up. */
+type activeWindow struct {
+	sh, sm int /* Start hour and minute */
+	eh, em int /* End hour and minute */
+	loc    *time.Location
+}
+
+/* ParseActiveWindow parses a window of the form HH:MM-HH:MM, in the timezone
+named tz, or the local timezone if tz is empty.  If the end is earlier than
+the start, the window crosses midnight. */
+func ParseActiveWindow(s, tz string) (*activeWindow, error) {
+	var (
+		w   activeWindow
+		err error
+	)
+	parts := strings.SplitN(s, "-", 2)
+	if 2 != len(parts) {
+		return nil, fmt.Errorf("not of the form HH:MM-HH:MM")
+	}
+	if w.sh, w.sm, err = parseClock(parts[0]); nil != err {
+		return nil, err
+	}
+	if w.eh, w.em, err = parseClock(parts[1]); nil != err {
+		return nil, err
+	}
+	w.loc = time.Local
+	if "" != tz {
+		if w.loc, err = time.LoadLocation(tz); nil != err {
+			return nil, err
+		}
+	}
+	return &w, nil
+}
+
+/* parseClock parses a time of day of the form HH:MM */
+func parseClock(s string) (int, int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if nil != err {
+		return 0, 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+/* bounds returns the start and end of the window which starts on the day
+(in w's timezone) d days after t. */
+func (w *activeWindow) bounds(t time.Time, d int) (time.Time, time.Time) {
+	y, m, day := t.In(w.loc).Date()
+	s := time.Date(y, m, day+d, w.sh, w.sm, 0, 0, w.loc)
+	e := time.Date(y, m, day+d, w.eh, w.em, 0, 0, w.loc)
+	if !e.After(s) {
+		e = e.AddDate(0, 0, 1)
+	}
+	return s, e
+}
+
+/* Until returns whether the window is open at t and the time at which that
+will change. */
+func (w *activeWindow) Until(t time.Time) (bool, time.Time) {
+	/* The window from yesterday might not be closed yet */
+	for _, d := range []int{-1, 0} {
+		s, e := w.bounds(t, d)
+		if !t.Before(s) && t.Before(e) {
+			return true, e
+		}
+	}
+	s, _ := w.bounds(t, 0)
+	if t.Before(s) {
+		return false, s
+	}
+	s, _ = w.bounds(t, 1)
+	return false, s
+}
+
+/* Wait waits until the window is open, or ctx is done.  It returns the time
+at which the window will close. */
+func (w *activeWindow) Wait(ctx context.Context) time.Time {
+	for nil == ctx.Err() {
+		open, next := w.Until(time.Now())
+		if open {
+			return next
+		}
+		log.Printf(
+			"Outside of active window, waiting until %v",
+			next.Format(time.RFC3339),
+		)
+		sleepContext(ctx, time.Until(next))
+	}
+	return time.Time{}
+}
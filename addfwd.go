@@ -0,0 +1,161 @@
+package main
+
+/*
+ * addfwd.go
+ * Add forwards from a file on a signal
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+/* ReadAddedForwards reads the forwarding specifications in the file named
+fname, one per line, and removes the file.  Blank lines and comments starting
+with # are ignored, as are specifications which are invalid, use stdio or named
+pipe targets, are already in have, or, unless allowPublic is true, listen on
+every interface. */
+func ReadAddedForwards(
+	fname string,
+	have []fwdspec,
+	allowPublic bool,
+) []fwdspec {
+	/* Move the file out of the way first, so we don't lose lines written
+	while we read it. */
+	rname := fname + ".reading"
+	if err := os.Rename(fname, rname); nil != err {
+		if os.IsNotExist(err) {
+			log.Printf("No forwards to add in %v", fname)
+		} else {
+			log.Printf("Unable to take %v: %v", fname, err)
+		}
+		return nil
+	}
+	defer os.Remove(rname)
+	b, err := ioutil.ReadFile(rname)
+	if nil != err {
+		log.Printf("Unable to read forwards to add: %v", err)
+		return nil
+	}
+
+	/* Work out which forwards are new */
+	seen := make(map[string]bool)
+	for _, f := range have {
+		seen[f.spec] = true
+	}
+	var fs []fwdspec
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if seen[l] {
+			log.Printf("Already forwarding %q", l)
+			continue
+		}
+		f, err := ParseForward(l)
+		if nil != err {
+			log.Printf(
+				"Invalid forwarding specification %q: %v",
+				l,
+				err,
+			)
+			continue
+		}
+		if f.local {
+			log.Printf(
+				"Not adding %q: %v and %v targets are only "+
+					"for the command line",
+				l,
+				TARGETSTDIO,
+				TARGETPIPE,
+			)
+			continue
+		}
+		if err := f.checkScope(); nil != err {
+			log.Printf("Not adding %q: %v", l, err)
+			continue
+		}
+		if !allowPublic && isPublicListen(f) {
+			log.Printf(
+				"Not adding %q: listening on %v needs "+
+					"-allow-public-listen",
+				l,
+				describePublicListen(f),
+			)
+			continue
+		}
+		seen[l] = true
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+/* AddForwards sets up the forwards in fs, as ForwardPorts and ForwardUDP
+would, via c or, for forwards in a group, the group's chain in gcs.  Forwards
+which can't be set up are logged and skipped.  The new listeners and
+PacketConns are returned, as are the forwards which were set up. */
+func AddForwards(
+	ctx context.Context,
+	c *Chain,
+	gcs map[string]*Chain,
+	h *helperClient,
+	fs []fwdspec,
+	errChan chan<- error,
+) ([]net.Listener, []net.PacketConn, []fwdspec) {
+	var (
+		ls    []net.Listener
+		pcs   []net.PacketConn
+		added []fwdspec
+	)
+	for _, f := range fs {
+		fl := []fwdspec{f}
+		if f.needsHelper() && nil == h {
+			log.Printf("Not adding %q: no helper", f.spec)
+			continue
+		}
+		fc := c
+		if "" != f.group {
+			var ok bool
+			if fc, ok = gcs[f.group]; !ok {
+				log.Printf(
+					"Not adding %q: no chain for group %v",
+					f.spec,
+					f.group,
+				)
+				continue
+			}
+		}
+		if f.isUDP && c.Dry {
+			log.Printf("Not adding %q: UDP in a dry run", f.spec)
+			continue
+		} else if f.isUDP {
+			p, err := ForwardUDP(ctx, h, fl, errChan)
+			if nil != err {
+				log.Printf("Unable to add %q: %v", f.spec, err)
+				continue
+			}
+			pcs = append(pcs, p...)
+		} else {
+			l, err := ForwardPorts(ctx, fc, fl, errChan)
+			if nil != err {
+				log.Printf(
+					"Unable to add %q: %v",
+					f.spec,
+					Hinted(err),
+				)
+				continue
+			}
+			ls = append(ls, l...)
+		}
+		added = append(added, f)
+	}
+	return ls, pcs, added
+}
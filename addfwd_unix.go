@@ -0,0 +1,24 @@
+//go:build !windows
+
+package main
+
+/*
+ * addfwd_unix.go
+ * Watch for SIGUSR2
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/* NotifyAddForwards sends a value on ch when we get a SIGUSR2, which means
+there's forwards to add */
+func NotifyAddForwards(ch chan<- os.Signal) bool {
+	signal.Notify(ch, syscall.SIGUSR2)
+	return true
+}
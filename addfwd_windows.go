@@ -0,0 +1,17 @@
+package main
+
+/*
+ * addfwd_windows.go
+ * No SIGUSR2 on Windows
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import "os"
+
+/* NotifyAddForwards is a no-op, as Windows has no SIGUSR2.  It returns
+false. */
+func NotifyAddForwards(ch chan<- os.Signal) bool {
+	return false
+}
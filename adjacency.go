@@ -0,0 +1,118 @@
+package main
+
+/*
+ * adjacency.go
+ * Only try jumps the previous jump can reach
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+/* ADJLOCAL names us, in the adjacency file, to list the jumps which may be
+first */
+const ADJLOCAL = "local"
+
+/* adjacency holds which jumps each jump can reach, by name.  Jumps which
+aren't listed can reach every jump.  A nil adjacency allows everything. */
+type adjacency map[string]map[string]bool
+
+/* ReadAdjacency reads an adjacency file, in which each line is a jump (or
+ADJLOCAL) followed by the jumps it can reach, all separated by spaces.  Jumps
+may be named by host, host:port, user@host, user@host:port, or label.  Blank
+lines and comments starting with # are ignored.  Lines for the same jump are
+merged. */
+func ReadAdjacency(fname string) (adjacency, error) {
+	b, err := ioutil.ReadFile(fname)
+	if nil != err {
+		return nil, err
+	}
+	a := make(adjacency)
+	for n, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fs := strings.Fields(l)
+		if 2 > len(fs) {
+			return nil, fmt.Errorf(
+				"line %v: %v reaches nothing",
+				n+1,
+				fs[0],
+			)
+		}
+		if nil == a[fs[0]] {
+			a[fs[0]] = make(map[string]bool)
+		}
+		for _, t := range fs[1:] {
+			a[fs[0]][t] = true
+		}
+	}
+	return a, nil
+}
+
+/* jumpNames returns the names by which j may be given in the adjacency
+file */
+func jumpNames(j jump) []string {
+	ns := []string{j.host, j.username + "@" + j.host}
+	if h, _, err := net.SplitHostPort(j.host); nil == err {
+		ns = append(ns, h, j.username+"@"+h)
+	}
+	if "" != j.alias {
+		ns = append(ns, jumpNames(jump{
+			username: j.username,
+			host:     j.alias,
+		})...)
+	}
+	if "" != j.label {
+		ns = append(ns, j.label)
+	}
+	return ns
+}
+
+/* Reaches returns true if from can reach to.  If from is nil, it's us. */
+func (a adjacency) Reaches(from *jump, to jump) bool {
+	if nil == a {
+		return true
+	}
+	fns := []string{ADJLOCAL}
+	if nil != from {
+		fns = jumpNames(*from)
+	}
+	listed := false
+	for _, fn := range fns {
+		ts, ok := a[fn]
+		if !ok {
+			continue
+		}
+		listed = true
+		for _, tn := range jumpNames(to) {
+			if ts[tn] {
+				return true
+			}
+		}
+	}
+	return !listed
+}
+
+/* Depths returns, for each jump in js, the number of jumps in the longest
+chain which starts with it and continues with jumps later in js, as chains are
+built in order. */
+func (a adjacency) Depths(js []jump) []int {
+	ds := make([]int, len(js))
+	for i := len(js) - 1; 0 <= i; i-- {
+		ds[i] = 1
+		for k := i + 1; k < len(js); k++ {
+			if ds[k]+1 > ds[i] && a.Reaches(&js[i], js[k]) {
+				ds[i] = ds[k] + 1
+			}
+		}
+	}
+	return ds
+}
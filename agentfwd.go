@@ -0,0 +1,222 @@
+package main
+
+/*
+ * agentfwd.go
+ * Forward ssh-agent to the jumps
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+/* Which jumps get ssh-agent forwarded, with -forwardagent */
+const (
+	AGENTFWDEXIT = "exit" /* Just the exit jump */
+	AGENTFWDALL  = "all"  /* Every jump */
+)
+
+/* AGENTHOLDCMD is run in a session on each jump to which ssh-agent is
+forwarded, to keep the jump's agent socket around and tell us where it is */
+const AGENTHOLDCMD = `echo "$SSH_AUTH_SOCK"; exec cat >/dev/null`
+
+/* AGENTFWDTIMEOUT is how long a jump has to set up agent forwarding and tell
+us where its agent socket is */
+const AGENTFWDTIMEOUT = 15 * time.Second
+
+/* TARGETAGENT as an R forward's target means the local ssh-agent, so clients
+of the forward can use our keys */
+const TARGETAGENT = "agent:"
+
+/* agentFwds holds the jumps to which ssh-agent is forwarded */
+var agentFwds = struct {
+	l  sync.Mutex
+	cs map[*ssh.Client]bool
+}{cs: make(map[*ssh.Client]bool)}
+
+/* ForwardAgent forwards the ssh-agent listening on sock to the jumps in cs
+named by which, one of the AGENTFWD* constants, in place of those of any
+previous chain.  Each jump gets a session which keeps its agent socket open for
+as long as the jump's connected, so commands run on the jump by other means may
+use it with the logged SSH_AUTH_SOCK.  Sessions opened by exec-all and -cleanup
+get the agent as well.  Jumps which won't take the agent are logged and
+skipped.  The jumps are set up in parallel, each given AGENTFWDTIMEOUT,
+and ForwardAgent returns once they're all done or ctx is. */
+func ForwardAgent(ctx context.Context, cs []*ssh.Client, which, sock string) {
+	agentFwds.l.Lock()
+	agentFwds.cs = make(map[*ssh.Client]bool)
+	agentFwds.l.Unlock()
+	first := len(cs) - 1
+	if AGENTFWDALL == which {
+		first = 0
+	}
+	var wg sync.WaitGroup
+	for i := first; i < len(cs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := forwardAgentTo(ctx, cs[i], sock)
+			if nil != err {
+				log.Printf(
+					"Unable to forward ssh-agent to "+
+						"jump %v: %v",
+					i+1,
+					err,
+				)
+				return
+			}
+			if "" == p {
+				log.Printf(
+					"Forwarded ssh-agent to jump %v",
+					i+1,
+				)
+				return
+			}
+			log.Printf(
+				"Forwarded ssh-agent to jump %v, "+
+					"SSH_AUTH_SOCK=%v",
+				i+1,
+				p,
+			)
+		}(i)
+	}
+	wg.Wait()
+}
+
+/* forwardAgentTo forwards the agent listening on sock to c and starts a
+session to hold open c's agent socket, whose path is returned if c's shell
+tells us before AGENTFWDTIMEOUT.  If the session isn't started in time or ctx
+is done first, it's closed and an error returned. */
+func forwardAgentTo(
+	ctx context.Context,
+	c *ssh.Client,
+	sock string,
+) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, AGENTFWDTIMEOUT)
+	defer cancel()
+
+	if err := agent.ForwardToRemote(c, sock); nil != err {
+		return "", err
+	}
+	agentFwds.l.Lock()
+	agentFwds.cs[c] = true
+	agentFwds.l.Unlock()
+
+	/* Hold the agent socket open.  The session ends with the jump.  A
+	jump which takes too long to open a session is left alone. */
+	type opened struct {
+		s   *ssh.Session
+		err error
+	}
+	och := make(chan opened, 1)
+	go func() {
+		s, err := c.NewSession()
+		och <- opened{s: s, err: err}
+	}()
+	var s *ssh.Session
+	select {
+	case o := <-och:
+		if nil != o.err {
+			return "", o.err
+		}
+		s = o.s
+	case <-ctx.Done():
+		go func() {
+			if o := <-och; nil == o.err {
+				o.s.Close()
+			}
+		}()
+		return "", fmt.Errorf("opening session: %w", ctx.Err())
+	}
+	/* Requests on the session can hang too */
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+	if err := agent.RequestAgentForwarding(s); nil != err {
+		s.Close()
+		return "", err
+	}
+	if _, err := s.StdinPipe(); nil != err {
+		s.Close()
+		return "", err
+	}
+	o, err := s.StdoutPipe()
+	if nil != err {
+		s.Close()
+		return "", err
+	}
+	if err := s.Start(AGENTHOLDCMD); nil != err {
+		s.Close()
+		return "", err
+	}
+	go s.Wait()
+	/* The session's started, so the agent's forwarded even if we never
+	find out where its socket is */
+	if !stop() {
+		return "", fmt.Errorf("starting session: %w", ctx.Err())
+	}
+	lch := make(chan string, 1)
+	go func() {
+		l, _ := bufio.NewReader(o).ReadString('\n')
+		lch <- strings.TrimSpace(l)
+	}()
+	select {
+	case l := <-lch:
+		return l, nil
+	case <-ctx.Done():
+		return "", nil
+	}
+}
+
+/* requestAgent requests agent forwarding for s, a session on c, if ssh-agent
+is forwarded to c.  Failure is logged but not fatal. */
+func requestAgent(c *ssh.Client, s *ssh.Session) {
+	agentFwds.l.Lock()
+	ok := agentFwds.cs[c]
+	agentFwds.l.Unlock()
+	if !ok {
+		return
+	}
+	if err := agent.RequestAgentForwarding(s); nil != err {
+		log.Printf("Unable to forward ssh-agent to session: %v", err)
+	}
+}
+
+/* agentDialer connects R forwards' clients to the local ssh-agent, for
+TARGETAGENT targets. */
+type agentDialer struct{}
+
+/* Dial calls d.DialContext with context.Background() */
+func (d agentDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext connects to the ssh-agent named by AGENTSOCKENV.  network and
+addr are ignored. */
+func (d agentDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	sock := os.Getenv(AGENTSOCKENV)
+	if "" == sock {
+		return nil, fmt.Errorf(
+			"no ssh-agent (%v not set)",
+			AGENTSOCKENV,
+		)
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, "unix", sock)
+}
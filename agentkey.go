@@ -0,0 +1,195 @@
+package main
+
+/*
+ * agentkey.go
+ * Use keys held by ssh-agent, e.g. FIDO2 security keys
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+/* AGENTSOCKENV names the environment variable holding ssh-agent's socket */
+const AGENTSOCKENV = "SSH_AUTH_SOCK"
+
+/* AGENTCRED in place of a password means to try every key ssh-agent holds */
+const AGENTCRED = "agent:"
+
+/* openSSHMagic starts the decoded body of an OpenSSH private key file */
+const openSSHMagic = "openssh-key-v1\x00"
+
+/* errNotSKKey is returned by skPublicKey when a file doesn't hold a security
+key */
+var errNotSKKey = errors.New("not a security key")
+
+/* isSKKeyType returns true if t is a FIDO2 security key's type */
+func isSKKeyType(t string) bool {
+	return strings.HasPrefix(t, "sk-")
+}
+
+/* skPublicKey gets the public half of the security key in b, which may be
+either an OpenSSH private key file (whose public key isn't encrypted, even if
+the rest is) or a public key in authorized_keys format. */
+func skPublicKey(b []byte) (ssh.PublicKey, error) {
+	/* Public key file */
+	if pub, _, _, _, err := ssh.ParseAuthorizedKey(b); nil == err {
+		if !isSKKeyType(pub.Type()) {
+			return nil, errNotSKKey
+		}
+		return pub, nil
+	}
+
+	/* Private key file */
+	blk, _ := pem.Decode(b)
+	if nil == blk || "OPENSSH PRIVATE KEY" != blk.Type ||
+		!strings.HasPrefix(string(blk.Bytes), openSSHMagic) {
+		return nil, errNotSKKey
+	}
+	var k struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+		Rest         []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(
+		blk.Bytes[len(openSSHMagic):],
+		&k,
+	); nil != err {
+		return nil, err
+	}
+	pub, err := ssh.ParsePublicKey(k.PubKey)
+	if nil != err {
+		return nil, err
+	}
+	if !isSKKeyType(pub.Type()) {
+		return nil, errNotSKKey
+	}
+	return pub, nil
+}
+
+/* agentSigner signs with a key held by ssh-agent.  The agent's connected to
+anew for every signature, as signatures are only needed during
+authentication, and the agent may well have been restarted between chain
+rebuilds. */
+type agentSigner struct {
+	pub   ssh.PublicKey
+	fname string /* For logging */
+}
+
+/* newAgentSigner returns a signer which uses the key in ssh-agent which
+matches pub, which was read from fname.  An error is returned if there's no
+agent or it doesn't have the key. */
+func newAgentSigner(pub ssh.PublicKey, fname string) (*agentSigner, error) {
+	err := withAgent(func(a agent.ExtendedAgent) error {
+		ks, err := a.List()
+		if nil != err {
+			return err
+		}
+		for _, k := range ks {
+			if string(k.Marshal()) == string(pub.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf(
+			"key not in ssh-agent (try ssh-add %v)",
+			fname,
+		)
+	})
+	if nil != err {
+		return nil, err
+	}
+	return &agentSigner{pub: pub, fname: fname}, nil
+}
+
+/* agentSigners returns signers for every key ssh-agent holds, in the order
+the agent lists them */
+func agentSigners() ([]ssh.Signer, error) {
+	var ss []ssh.Signer
+	err := withAgent(func(a agent.ExtendedAgent) error {
+		ks, err := a.List()
+		if nil != err {
+			return err
+		}
+		for _, k := range ks {
+			pub, err := ssh.ParsePublicKey(k.Blob)
+			if nil != err {
+				return err
+			}
+			ss = append(ss, &agentSigner{
+				pub:   pub,
+				fname: k.Comment,
+			})
+		}
+		return nil
+	})
+	return ss, err
+}
+
+/* PublicKey returns the signer's public key */
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+/* Sign asks the agent to sign data with the key's default algorithm */
+func (s *agentSigner) Sign(
+	rand io.Reader,
+	data []byte,
+) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+/* SignWithAlgorithm asks the agent to sign data with the given algorithm.
+For security keys, this is where the token wants to be touched. */
+func (s *agentSigner) SignWithAlgorithm(
+	rand io.Reader,
+	data []byte,
+	algorithm string,
+) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+	if isSKKeyType(s.pub.Type()) {
+		log.Printf("Confirm presence on security key %v", s.fname)
+	}
+	var sig *ssh.Signature
+	err := withAgent(func(a agent.ExtendedAgent) error {
+		var err error
+		sig, err = a.SignWithFlags(s.pub, data, flags)
+		return err
+	})
+	return sig, err
+}
+
+/* withAgent connects to ssh-agent and calls f with it */
+func withAgent(f func(a agent.ExtendedAgent) error) error {
+	sock := os.Getenv(AGENTSOCKENV)
+	if "" == sock {
+		return fmt.Errorf("no ssh-agent (%v not set)", AGENTSOCKENV)
+	}
+	c, err := net.Dial("unix", sock)
+	if nil != err {
+		return fmt.Errorf("connecting to ssh-agent: %w", err)
+	}
+	defer c.Close()
+	return f(agent.NewClient(c))
+}
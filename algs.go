@@ -0,0 +1,154 @@
+package main
+
+/*
+ * algs.go
+ * Choose the algorithms offered to each jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* Kinds of algorithms, which are also jumpfile options and flags */
+const (
+	ALGKEX      = "kex"
+	ALGCIPHERS  = "ciphers"
+	ALGMACS     = "macs"
+	ALGHOSTKEYS = "hostkeyalgs"
+)
+
+/* ALGADD starts an algorithm list which adds to x/crypto/ssh's defaults, as
+with OpenSSH */
+const ALGADD = "+"
+
+/* algKinds describes each kind of algorithm */
+var algKinds = []struct {
+	name    string
+	openssh string /* OpenSSH config keyword */
+	known   func(ssh.Algorithms) []string
+	dst     func(*ssh.ClientConfig) *[]string
+}{{
+	ALGKEX,
+	"KexAlgorithms",
+	func(a ssh.Algorithms) []string { return a.KeyExchanges },
+	func(c *ssh.ClientConfig) *[]string { return &c.KeyExchanges },
+}, {
+	ALGCIPHERS,
+	"Ciphers",
+	func(a ssh.Algorithms) []string { return a.Ciphers },
+	func(c *ssh.ClientConfig) *[]string { return &c.Ciphers },
+}, {
+	ALGMACS,
+	"MACs",
+	func(a ssh.Algorithms) []string { return a.MACs },
+	func(c *ssh.ClientConfig) *[]string { return &c.MACs },
+}, {
+	ALGHOSTKEYS,
+	"HostKeyAlgorithms",
+	func(a ssh.Algorithms) []string { return a.HostKeys },
+	func(c *ssh.ClientConfig) *[]string { return &c.HostKeyAlgorithms },
+}}
+
+/* defaultAlgs are the algorithm lists, by kind, used by jumps without their
+own, from -kex, -ciphers, -macs, and -hostkeyalgs */
+var defaultAlgs = make(map[string]string)
+
+/* isAlgKind returns true if k is one of the kinds of algorithm */
+func isAlgKind(k string) bool {
+	for _, ak := range algKinds {
+		if k == ak.name {
+			return true
+		}
+	}
+	return false
+}
+
+/* ParseAlgs parses s, a comma-separated list of algorithms of the given kind,
+e.g. ALGKEX.  If s starts with ALGADD, the algorithms are added to
+x/crypto/ssh's defaults, which is handy for old devices which only have
+insecure algorithms. */
+func ParseAlgs(kind, s string) ([]string, error) {
+	for _, ak := range algKinds {
+		if kind != ak.name {
+			continue
+		}
+		var as []string
+		sa := ak.known(ssh.SupportedAlgorithms())
+		if strings.HasPrefix(s, ALGADD) {
+			s = strings.TrimPrefix(s, ALGADD)
+			as = append(as, sa...)
+		}
+		ok := make(map[string]bool)
+		for _, a := range append(
+			sa,
+			ak.known(ssh.InsecureAlgorithms())...,
+		) {
+			ok[a] = true
+		}
+		for _, a := range strings.Split(s, ",") {
+			if !ok[a] {
+				return nil, fmt.Errorf("unknown %v %q", kind, a)
+			}
+			as = append(as, a)
+		}
+		return as, nil
+	}
+	return nil, fmt.Errorf("unknown kind of algorithm %q", kind)
+}
+
+/* ApplyAlgs sets the algorithms offered in c to those in j's algorithm
+options, or defaultAlgs for kinds j doesn't have.  The lists should have been
+checked with ParseAlgs. */
+func ApplyAlgs(c *ssh.ClientConfig, j jump) {
+	for _, ak := range algKinds {
+		s, ok := j.algs[ak.name]
+		if !ok {
+			s = defaultAlgs[ak.name]
+		}
+		if "" == s {
+			continue
+		}
+		as, err := ParseAlgs(ak.name, s)
+		if nil != err {
+			continue
+		}
+		*ak.dst(c) = as
+	}
+}
+
+/* formatAlgOpts returns j's algorithm options, as in the jumpfile */
+func formatAlgOpts(j jump) string {
+	ks := make([]string, 0, len(j.algs))
+	for k := range j.algs {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	var s string
+	for _, k := range ks {
+		s += " " + k + "=" + j.algs[k]
+	}
+	return s
+}
+
+/* sshConfigAlgs returns OpenSSH config lines for j's algorithm options, or
+defaultAlgs.  OpenSSH's algorithm names are the same as x/crypto/ssh's. */
+func sshConfigAlgs(j jump) []string {
+	var ls []string
+	for _, ak := range algKinds {
+		s, ok := j.algs[ak.name]
+		if !ok {
+			s = defaultAlgs[ak.name]
+		}
+		if "" != s {
+			ls = append(ls, ak.openssh+" "+s)
+		}
+	}
+	return ls
+}
@@ -0,0 +1,243 @@
+package main
+
+/*
+ * aliases.go
+ * Expand jump host aliases to one of several addresses
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* How an alias picks its next address */
+const (
+	PICKROUNDROBIN = "roundrobin" /* In order, wrapping around */
+	PICKRANDOM     = "random"     /* Randomly, every time */
+)
+
+/* aliasAddr is one of an alias's addresses and how well it's done */
+type aliasAddr struct {
+	addr string
+	ok   uint /* Handshakes which worked */
+	fail uint /* Dials or handshakes which didn't */
+}
+
+/* hostAlias is an alias and its addresses */
+type hostAlias struct {
+	pick  string
+	addrs []*aliasAddr
+	next  int /* Next address, for PICKROUNDROBIN */
+}
+
+/* hostAliases maps names used as jumps' hosts to several addresses, one of
+which is used each time the jump's tried.  A nil hostAliases expands
+nothing. */
+type hostAliases struct {
+	l       sync.Mutex
+	aliases map[string]*hostAlias
+}
+
+/* ReadAliases reads aliases from the file named fname, one per line, of the
+form name [pick=roundrobin|random] address [address...].  Addresses may have
+ports. */
+func ReadAliases(fname string) (*hostAliases, error) {
+	b, err := ioutil.ReadFile(fname)
+	if nil != err {
+		return nil, err
+	}
+	as := &hostAliases{aliases: make(map[string]*hostAlias)}
+	for n, l := range strings.Split(string(b), "\n") {
+		fs := strings.Fields(l)
+		/* Ignore blanks and comments */
+		if 0 == len(fs) || strings.HasPrefix(fs[0], "#") {
+			continue
+		}
+		a := &hostAlias{pick: PICKROUNDROBIN}
+		name := fs[0]
+		fs = fs[1:]
+		if 0 != len(fs) && strings.HasPrefix(fs[0], "pick=") {
+			a.pick = strings.TrimPrefix(fs[0], "pick=")
+			fs = fs[1:]
+		}
+		switch a.pick {
+		case PICKROUNDROBIN, PICKRANDOM:
+		default:
+			return nil, fmt.Errorf(
+				"unknown pick %q on line %v",
+				a.pick,
+				n+1,
+			)
+		}
+		if 0 == len(fs) {
+			return nil, fmt.Errorf(
+				"no addresses for %v on line %v",
+				name,
+				n+1,
+			)
+		}
+		if _, ok := as.aliases[name]; ok {
+			return nil, fmt.Errorf(
+				"duplicate alias %v on line %v",
+				name,
+				n+1,
+			)
+		}
+		for _, f := range fs {
+			a.addrs = append(a.addrs, &aliasAddr{addr: f})
+		}
+		as.aliases[name] = a
+	}
+	if 0 == len(as.aliases) {
+		return nil, fmt.Errorf("no aliases in %v", fname)
+	}
+	return as, nil
+}
+
+/* Expand returns the address to try for host, which is returned as-is if
+it's not an alias.  If host has a port, addresses without one get it.
+Addresses for which allow, which is passed the address with a port, returns
+false are passed over unless none are allowed. */
+func (as *hostAliases) Expand(
+	host string,
+	allow func(addr string) bool,
+) string {
+	if nil == as {
+		return host
+	}
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); nil == err {
+		name, port = h, p
+	}
+	as.l.Lock()
+	defer as.l.Unlock()
+	a, ok := as.aliases[name]
+	if !ok {
+		return host
+	}
+	/* Try each address once, in whichever order */
+	order := make([]int, len(a.addrs))
+	for i := range order {
+		order[i] = (a.next + i) % len(a.addrs)
+	}
+	if PICKRANDOM == a.pick {
+		rand.Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	}
+	pick := withAliasPort(a.addrs[order[0]].addr, port)
+	for _, i := range order {
+		addr := withAliasPort(a.addrs[i].addr, port)
+		if allow(addr) {
+			pick = addr
+			a.next = i + 1
+			break
+		}
+	}
+	return pick
+}
+
+/* Addrs returns all of host's addresses, or just host if it's not an
+alias. */
+func (as *hostAliases) Addrs(host string) []string {
+	if nil == as {
+		return []string{host}
+	}
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); nil == err {
+		name, port = h, p
+	}
+	as.l.Lock()
+	defer as.l.Unlock()
+	a, ok := as.aliases[name]
+	if !ok {
+		return []string{host}
+	}
+	addrs := make([]string, len(a.addrs))
+	for i, aa := range a.addrs {
+		addrs[i] = withAliasPort(aa.addr, port)
+	}
+	return addrs
+}
+
+/* withAliasPort adds port, or DEFPORT if port is empty, to addr if it hasn't
+got a port. */
+func withAliasPort(addr, port string) string {
+	if _, p, err := net.SplitHostPort(addr); nil == err && "" != p {
+		return addr
+	}
+	if "" == port {
+		port = DEFPORT
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+/* Result notes whether addr, picked by Expand for host, worked. */
+func (as *hostAliases) Result(host, addr string, ok bool) {
+	if nil == as {
+		return
+	}
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); nil == err {
+		name, port = h, p
+	}
+	as.l.Lock()
+	defer as.l.Unlock()
+	a, found := as.aliases[name]
+	if !found {
+		return
+	}
+	for _, aa := range a.addrs {
+		if addr != withAliasPort(aa.addr, port) {
+			continue
+		}
+		if ok {
+			aa.ok++
+		} else {
+			aa.fail++
+		}
+		return
+	}
+}
+
+/* WriteStatus writes how well each alias's addresses have done to w. */
+func (as *hostAliases) WriteStatus(w io.Writer) {
+	if nil == as {
+		return
+	}
+	as.l.Lock()
+	defer as.l.Unlock()
+	ns := make([]string, 0, len(as.aliases))
+	for n := range as.aliases {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	for _, n := range ns {
+		a := as.aliases[n]
+		fmt.Fprintf(
+			w,
+			"Alias %v: %v addresses, %v\n",
+			n,
+			len(a.addrs),
+			a.pick,
+		)
+		for _, aa := range a.addrs {
+			fmt.Fprintf(
+				w,
+				"  %v: %v worked, %v failed\n",
+				aa.addr,
+				aa.ok,
+				aa.fail,
+			)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+/*
+ * askpass.go
+ * Ask for secrets on the terminal or with an askpass program
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"golang.org/x/term"
+)
+
+/* ASKPASSENV names the environment variable holding the askpass program */
+const ASKPASSENV = "SSH_ASKPASS"
+
+/* ASKPASSREQUIREENV names the environment variable which, as with OpenSSH,
+may be ASKPASSFORCE to always use the askpass program or ASKPASSNEVER to never
+use it. */
+const ASKPASSREQUIREENV = "SSH_ASKPASS_REQUIRE"
+
+/* Values for ASKPASSREQUIREENV */
+const (
+	ASKPASSFORCE = "force"
+	ASKPASSNEVER = "never"
+)
+
+/* useTerminal returns true if secrets should be read from the terminal */
+func useTerminal() bool {
+	return ASKPASSFORCE != os.Getenv(ASKPASSREQUIREENV) &&
+		term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+/* useAskpass returns true if secrets should be read from the askpass
+program */
+func useAskpass() bool {
+	return "" != os.Getenv(ASKPASSENV) &&
+		ASKPASSNEVER != os.Getenv(ASKPASSREQUIREENV)
+}
+
+/* CanReadSecret returns true if ReadSecret has a way to ask for a secret */
+func CanReadSecret() bool {
+	return useTerminal() || useAskpass()
+}
+
+/* ReadSecret asks the operator for a secret, with prompt.  If stdin's a
+terminal, the secret's read from it with echo off.  Otherwise, the askpass
+program named in the environment is run with prompt as its argument and the
+secret is read from its stdout. */
+func ReadSecret(prompt string) ([]byte, error) {
+	if useTerminal() {
+		fmt.Fprintf(os.Stderr, "%v", prompt)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintf(os.Stderr, "\n")
+		return b, err
+	}
+	if !useAskpass() {
+		return nil, fmt.Errorf(
+			"stdin is not a terminal and %v isn't set",
+			ASKPASSENV,
+		)
+	}
+	cmd := exec.Command(os.Getenv(ASKPASSENV), prompt)
+	cmd.Stderr = os.Stderr
+	o, err := cmd.Output()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return nil, errors.New("askpass program cancelled")
+	} else if nil != err {
+		return nil, fmt.Errorf("running askpass program: %w", err)
+	}
+	return bytes.TrimRight(o, "\r\n"), nil
+}
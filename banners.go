@@ -0,0 +1,181 @@
+package main
+
+/*
+ * banners.go
+ * Grab banners from the jumps without authenticating
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* errBannerDone is used to stop authentication once we know enough */
+var errBannerDone = errors.New("banner grabbed")
+
+/* bannerInfo is what's learned about a jump without authenticating */
+type bannerInfo struct {
+	version string   /* Server version string */
+	methods []string /* Offered authentication methods */
+	key     ssh.PublicKey
+	banner  string /* Pre-auth banner, if any */
+}
+
+/* BannersMain is the entry point for the banners subcommand.  It connects to
+each jump in a jumpfile and prints what it can learn without authenticating.
+The connections may optionally be made through a chain of jumps. */
+func BannersMain(args []string) {
+	fs := flag.NewFlagSet("banners", flag.ExitOnError)
+	jumpfile := fs.String(
+		"jumps",
+		"",
+		"Name of `file` containing SSH jumps to check",
+	)
+	via := addChainFlags(fs, "via")
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v banners [options]
+
+Connects to each jump in the jumpfile and prints its version string, offered
+authentication methods, and host key, without authenticating.  Results are
+written to stdout, one tab-separated line per jump.  If -via is given, a chain
+is made through the jumps in that jumpfile first.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	ShowSecrets(*via.showSecrets)
+	SetLogOutput(os.Stderr)
+
+	/* Jumps to check */
+	if "" == *jumpfile {
+		log.Fatalf("No jumpfile given with -jumps")
+	}
+	jumps, _, err := ReadJumps(*jumpfile, *via.keyDir)
+	if nil != err {
+		log.Fatalf("Unable to read jumpfile: %v", err)
+	}
+
+	/* Work out how to get to them */
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var d Dialer = &net.Dialer{}
+	if "" != *via.jumpfile {
+		cs, err := via.makeChain(ctx, cancel)
+		if nil != err {
+			log.Fatalf("Unable to make SSH connections: %v", err)
+		}
+		defer CloseJumps(cs)
+		d = cs[len(cs)-1]
+	}
+
+	/* Grab ALL the banners */
+	for _, j := range jumps {
+		if nil != ctx.Err() {
+			break
+		}
+		host := j.host
+		if _, p, err := net.SplitHostPort(host); "" == p || nil != err {
+			host = net.JoinHostPort(host, DEFPORT)
+		}
+		bi, err := grabBanner(
+			ctx,
+			d,
+			host,
+			j,
+			*via.connto,
+			*via.hsto,
+		)
+		if nil != err {
+			fmt.Printf("%v\terror: %v\n", host, err)
+			continue
+		}
+		fmt.Printf(
+			"%v\t%v\t%v\t%v\t%v\n",
+			host,
+			bi.version,
+			strings.Join(bi.methods, ","),
+			bi.key.Type(),
+			ssh.FingerprintSHA256(bi.key),
+		)
+		if "" != bi.banner {
+			log.Printf("Banner from %v: %q", host, bi.banner)
+		}
+	}
+}
+
+/* grabBanner connects to the jump j at addr via d and gets as far as learning
+which authentication methods are offered. */
+func grabBanner(
+	ctx context.Context,
+	d Dialer,
+	addr string,
+	j jump,
+	connto time.Duration,
+	hsto time.Duration,
+) (bannerInfo, error) {
+	var bi bannerInfo
+	c, err := dialWithTimeout(ctx, d, addr, connto)
+	if nil != err {
+		return bi, err
+	}
+	defer c.Close()
+	/* Don't wait forever for the handshake */
+	t := time.AfterFunc(hsto, func() { c.Close() })
+	defer t.Stop()
+
+	conf := &ssh.ClientConfig{
+		User:          j.username,
+		ClientVersion: j.version,
+		HostKeyCallback: func(
+			hostname string,
+			remote net.Addr,
+			key ssh.PublicKey,
+		) error {
+			bi.key = key
+			return nil
+		},
+		BannerCallback: func(message string) error {
+			bi.banner = message
+			return nil
+		},
+		/* Called after the none method, which gives us the list */
+		AuthCallback: func(
+			actx *ssh.ClientAuthContext,
+		) (ssh.AuthMethod, error) {
+			bi.version = string(actx.Metadata.ServerVersion())
+			bi.methods = actx.AllowedMethods
+			return nil, errBannerDone
+		},
+	}
+	ApplyAlgs(conf, j)
+	sc, chans, reqs, err := ssh.NewClientConn(c, addr, conf)
+	/* If none auth worked, that's something to know */
+	if nil == err {
+		bi.version = string(sc.ServerVersion())
+		bi.methods = []string{"none"}
+		ssh.NewClient(sc, chans, reqs).Close()
+		return bi, nil
+	}
+	if nil == bi.key || "" == bi.version {
+		return bi, err
+	}
+	return bi, nil
+}
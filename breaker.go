@@ -0,0 +1,134 @@
+package main
+
+/*
+ * breaker.go
+ * Skip jumps which keep timing out
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/* circuitBreaker keeps track of hosts which time out.  Once a host has timed
+out enough times in a row, it's skipped until the cooldown period has passed.
+A nil circuitBreaker allows everything. */
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	l     sync.Mutex
+	fails map[string]int       /* Consecutive timeouts */
+	until map[string]time.Time /* Skip until */
+}
+
+/* NewCircuitBreaker returns a circuitBreaker which skips a host for cooldown
+after threshold consecutive timeouts.  If threshold is 0, nil is returned. */
+func NewCircuitBreaker(threshold uint, cooldown time.Duration) *circuitBreaker {
+	if 0 == threshold {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: int(threshold),
+		cooldown:  cooldown,
+		fails:     make(map[string]int),
+		until:     make(map[string]time.Time),
+	}
+}
+
+/* Allow returns true if host should be tried. */
+func (b *circuitBreaker) Allow(host string) bool {
+	if nil == b {
+		return true
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	u, ok := b.until[host]
+	if !ok {
+		return true
+	}
+	if time.Now().Before(u) {
+		return false
+	}
+	/* Cooldown's over, give it another chance */
+	delete(b.until, host)
+	return true
+}
+
+/* Timeout notes that host timed out.  If host's to be skipped, it's logged
+here, once, rather than every time it's skipped. */
+func (b *circuitBreaker) Timeout(host string) {
+	if nil == b {
+		return
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.fails[host]++
+	if b.fails[host] < b.threshold {
+		return
+	}
+	delete(b.fails, host)
+	b.until[host] = time.Now().Add(b.cooldown)
+	log.Printf(
+		"Skipping %v for %v after repeated timeouts",
+		host,
+		b.cooldown,
+	)
+}
+
+/* Success notes that host didn't time out. */
+func (b *circuitBreaker) Success(host string) {
+	if nil == b {
+		return
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	delete(b.fails, host)
+}
+
+/* Load reads skipped hosts saved by Save from the file named fname.  It's not
+an error for the file not to exist. */
+func (b *circuitBreaker) Load(fname string) error {
+	if nil == b {
+		return nil
+	}
+	j, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+	var until map[string]time.Time
+	if err := json.Unmarshal(j, &until); nil != err {
+		return err
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	for h, u := range until {
+		if time.Now().Before(u) {
+			b.until[h] = u
+		}
+	}
+	return nil
+}
+
+/* Save writes the hosts currently being skipped to the file named fname. */
+func (b *circuitBreaker) Save(fname string) error {
+	if nil == b {
+		return nil
+	}
+	b.l.Lock()
+	j, err := json.Marshal(b.until)
+	b.l.Unlock()
+	if nil != err {
+		return err
+	}
+	return ioutil.WriteFile(fname, j, 0600)
+}
@@ -4,7 +4,7 @@
 # Build a project
 # By J. Stuart McMurray
 # Created 20160221
-# Last Modified 20160625
+# Last Modified 20261017
 
 set -e
 
@@ -12,6 +12,11 @@ PROG=$(basename $(pwd))
 
 echo "Building $PROG"
 
+# Version information for -version
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+BUILDDATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+LDFLAGS="-X main.Commit=$COMMIT -X main.BuildDate=$BUILDDATE"
+
 go vet
 
 for GOOS in windows linux openbsd darwin; do
@@ -22,7 +27,7 @@ for GOOS in windows linux openbsd darwin; do
                 if [ "windows" == $GOOS ]; then
                         N=$N.exe
                 fi
-                go build -o "$N"
+                go build -ldflags "$LDFLAGS" -o "$N"
                 ls -l $N
         done
 done
@@ -0,0 +1,108 @@
+package main
+
+/*
+ * buildinfo.go
+ * Version and build metadata
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+/* These may be set at build time with -ldflags -X, see build.sh */
+var (
+	Version   = "0.2.0"
+	Commit    = ""
+	BuildDate = ""
+)
+
+/* buildInfo describes the running binary */
+type buildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features"`
+}
+
+/* BuildInfo returns information about the running binary.  If the commit and
+build date weren't set at build time, the VCS information Go embeds is used, if
+there is any. */
+func BuildInfo() buildInfo {
+	bi := buildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	/* Optional features, which depend on the platform and build tags */
+	for _, f := range []struct {
+		name string
+		ok   bool
+	}{
+		{"netns", netnsSupported},
+		{"peercred", peerCredSupported},
+		{"pkcs11", pkcs11Supported},
+		{"tcp-md5", tcpMD5Supported},
+		{"tun", tunSupported},
+	} {
+		if f.ok {
+			bi.Features = append(bi.Features, f.name)
+		}
+	}
+	/* Fill in the blanks if we can */
+	if dbi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range dbi.Settings {
+			switch {
+			case "vcs.revision" == s.Key && "" == bi.Commit:
+				bi.Commit = s.Value
+			case "vcs.time" == s.Key && "" == bi.BuildDate:
+				bi.BuildDate = s.Value
+			}
+		}
+	}
+	if "" == bi.Commit {
+		bi.Commit = "unknown"
+	}
+	if "" == bi.BuildDate {
+		bi.BuildDate = "unknown"
+	}
+	if nil == bi.Features {
+		bi.Features = []string{}
+	}
+	return bi
+}
+
+/* PrintVersion writes the build information to w */
+func PrintVersion(w io.Writer) {
+	bi := BuildInfo()
+	fs := strings.Join(bi.Features, " ")
+	if "" == fs {
+		fs = "none"
+	}
+	fmt.Fprintf(
+		w,
+		`sshjump %v
+Commit:     %v
+Build date: %v
+Go version: %v
+Platform:   %v
+Features:   %v
+`,
+		bi.Version,
+		bi.Commit,
+		bi.BuildDate,
+		bi.GoVersion,
+		bi.Platform,
+		fs,
+	)
+}
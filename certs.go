@@ -0,0 +1,452 @@
+package main
+
+/*
+ * certs.go
+ * Provision certificates for TLS listeners
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	/* CERTDIR is the name of the directory in the state directory in which
+	certificates are cached */
+	CERTDIR = "certs"
+	/* ACMEKEYFILE is the name of the ACME account key in CERTDIR */
+	ACMEKEYFILE = "acme.key"
+	/* SELFSIGNEDLIFETIME is how long self-signed certificates are good
+	for */
+	SELFSIGNEDLIFETIME = 365 * 24 * time.Hour
+	/* CERTRENEWBEFORE is how long before it expires a certificate is
+	replaced */
+	CERTRENEWBEFORE = 30 * 24 * time.Hour
+	/* ACMETIMEOUT is how long getting a certificate via ACME may take */
+	ACMETIMEOUT = 5 * time.Minute
+	/* ACMEHOOKTIMEOUT is how long the -acmedns command may take */
+	ACMEHOOKTIMEOUT = 2 * time.Minute
+)
+
+/* CERTNAMERE matches the names for which certificates may be made, which
+may be wildcards */
+var CERTNAMERE = regexp.MustCompile(
+	`^(?i:(?:\*\.)?` +
+		`[a-z0-9](?:[a-z0-9-]*[a-z0-9])?` +
+		`(?:\.[a-z0-9](?:[a-z0-9-]*[a-z0-9])?)*)$`,
+)
+
+/* certSource makes, caches, and renews certificates for TLS listeners.  They're
+self-signed unless an ACME directory's given, in which case they're got with
+DNS-01 challenges, with TXT records set by a command. */
+type certSource struct {
+	l       sync.Mutex
+	certs   map[string]*tls.Certificate
+	dir     string /* Cache directory, or "" for none */
+	acmeURL string /* ACME directory URL, or "" to self-sign */
+	dnsCmd  string /* Sets and removes TXT records */
+	email   string /* ACME account contact */
+	client  *acme.Client
+}
+
+/* certs provides certificates for tls= forwards */
+var certs = &certSource{certs: make(map[string]*tls.Certificate)}
+
+/* Configure sets where certificates are cached and how they're got.  If
+acmeURL is empty, certificates are self-signed.  Otherwise, dnsCmd is run
+with add or del, the name of a TXT record, and its value, and must only
+return once the record's set or removed. */
+func (s *certSource) Configure(dir, acmeURL, dnsCmd, email string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if "" != acmeURL && "" == dnsCmd {
+		return errors.New("ACME needs a command to set DNS records")
+	}
+	s.dir, s.acmeURL, s.dnsCmd, s.email = dir, acmeURL, dnsCmd, email
+	return nil
+}
+
+/* TLSConfig returns a TLS config which serves a certificate for name. */
+func (s *certSource) TLSConfig(name string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(
+			*tls.ClientHelloInfo,
+		) (*tls.Certificate, error) {
+			return s.Get(name)
+		},
+	}
+}
+
+/* Get returns a certificate for name, from the cache if there's one which
+isn't close to expiring. */
+func (s *certSource) Get(name string) (*tls.Certificate, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	/* Try the caches */
+	if c, ok := s.certs[name]; ok && !certExpiring(c) {
+		return c, nil
+	}
+	if c, err := s.load(name); nil == err && !certExpiring(c) {
+		s.certs[name] = c
+		return c, nil
+	} else if nil != err && !errors.Is(err, os.ErrNotExist) {
+		log.Printf(
+			"Unable to load cached certificate for %v: %v",
+			name,
+			err,
+		)
+	}
+	/* Make a new one */
+	var (
+		chain [][]byte
+		key   *ecdsa.PrivateKey
+		err   error
+	)
+	if "" == s.acmeURL {
+		chain, key, err = selfSign(name)
+	} else {
+		chain, key, err = s.acmeCert(name)
+	}
+	if nil != err {
+		return nil, err
+	}
+	c := &tls.Certificate{Certificate: chain, PrivateKey: key}
+	if c.Leaf, err = x509.ParseCertificate(chain[0]); nil != err {
+		return nil, err
+	}
+	s.certs[name] = c
+	if err := s.save(name, c); nil != err {
+		log.Printf("Unable to cache certificate for %v: %v", name, err)
+	}
+	how := "Self-signed"
+	if "" != s.acmeURL {
+		how = "Got"
+	}
+	log.Printf(
+		"%v a certificate for %v, good until %v",
+		how,
+		name,
+		c.Leaf.NotAfter.Format(time.RFC3339),
+	)
+	return c, nil
+}
+
+/* certExpiring returns true if c's within CERTRENEWBEFORE of expiring, or,
+for a short-lived certificate, a third of the way through its lifetime. */
+func certExpiring(c *tls.Certificate) bool {
+	before := CERTRENEWBEFORE
+	if life := c.Leaf.NotAfter.Sub(c.Leaf.NotBefore); life < 3*before {
+		before = life / 3
+	}
+	return time.Now().Add(before).After(c.Leaf.NotAfter)
+}
+
+/* certFile returns the name of the file in which name's certificate is
+cached, or "" if there's no cache directory. */
+func (s *certSource) certFile(name string) string {
+	if "" == s.dir {
+		return ""
+	}
+	return filepath.Join(s.dir, name+".pem")
+}
+
+/* load reads name's certificate from the cache directory. */
+func (s *certSource) load(name string) (*tls.Certificate, error) {
+	fn := s.certFile(name)
+	if "" == fn {
+		return nil, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	defer wipe(b)
+	c, err := tls.X509KeyPair(b, b)
+	if nil != err {
+		return nil, err
+	}
+	/* Don't serve an ACME cert when self-signing, or vice versa */
+	if self := c.Leaf.Issuer.String() == c.Leaf.Subject.String(); self !=
+		("" == s.acmeURL) {
+		return nil, os.ErrNotExist
+	}
+	return &c, nil
+}
+
+/* save writes c, with its key, to name's file in the cache directory. */
+func (s *certSource) save(name string, c *tls.Certificate) error {
+	fn := s.certFile(name)
+	if "" == fn {
+		return nil
+	}
+	kd, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if nil != err {
+		return err
+	}
+	defer wipe(kd)
+	if err := os.MkdirAll(s.dir, 0700); nil != err {
+		return err
+	}
+	var b []byte
+	for _, d := range c.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: d,
+		})...)
+	}
+	b = append(b, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: kd,
+	})...)
+	defer wipe(b)
+	return ioutil.WriteFile(fn, b, 0600)
+}
+
+/* selfSign makes a self-signed certificate for name */
+func selfSign(name string) ([][]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		return nil, nil, err
+	}
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if nil != err {
+		return nil, nil, err
+	}
+	now := time.Now()
+	t := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SELFSIGNEDLIFETIME),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	t.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if ip := net.ParseIP(name); nil != ip {
+		t.IPAddresses = []net.IP{ip}
+	} else {
+		t.DNSNames = []string{name}
+	}
+	d, err := x509.CreateCertificate(rand.Reader, t, t, &key.PublicKey, key)
+	if nil != err {
+		return nil, nil, err
+	}
+	return [][]byte{d}, key, nil
+}
+
+/* acmeCert gets a certificate for name from the ACME directory, answering
+the DNS-01 challenge with s.dnsCmd. */
+func (s *certSource) acmeCert(name string) (
+	[][]byte,
+	*ecdsa.PrivateKey,
+	error,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), ACMETIMEOUT)
+	defer cancel()
+	c, err := s.acmeClient(ctx)
+	if nil != err {
+		return nil, nil, fmt.Errorf("setting up ACME account: %w", err)
+	}
+
+	/* Prove we own the name */
+	o, err := c.AuthorizeOrder(ctx, acme.DomainIDs(name))
+	if nil != err {
+		return nil, nil, fmt.Errorf("ordering certificate: %w", err)
+	}
+	for _, u := range o.AuthzURLs {
+		if err := s.acmeAuthorize(ctx, c, u); nil != err {
+			return nil, nil, err
+		}
+	}
+	if o, err = c.WaitOrder(ctx, o.URI); nil != err {
+		return nil, nil, fmt.Errorf("waiting for order: %w", err)
+	}
+
+	/* Get the certificate */
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(
+		rand.Reader,
+		&x509.CertificateRequest{DNSNames: []string{name}},
+		key,
+	)
+	if nil != err {
+		return nil, nil, err
+	}
+	chain, _, err := c.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if nil != err {
+		return nil, nil, fmt.Errorf("finalizing order: %w", err)
+	}
+	return chain, key, nil
+}
+
+/* acmeAuthorize completes the authorization at u with a DNS-01
+challenge. */
+func (s *certSource) acmeAuthorize(
+	ctx context.Context,
+	c *acme.Client,
+	u string,
+) error {
+	z, err := c.GetAuthorization(ctx, u)
+	if nil != err {
+		return fmt.Errorf("getting authorization: %w", err)
+	}
+	if acme.StatusValid == z.Status {
+		return nil
+	}
+	var ch *acme.Challenge
+	for _, zc := range z.Challenges {
+		if "dns-01" == zc.Type {
+			ch = zc
+			break
+		}
+	}
+	if nil == ch {
+		return fmt.Errorf(
+			"no DNS-01 challenge for %v",
+			z.Identifier.Value,
+		)
+	}
+	v, err := c.DNS01ChallengeRecord(ch.Token)
+	if nil != err {
+		return err
+	}
+	rec := "_acme-challenge." + z.Identifier.Value
+	if err := s.runDNSCmd(ctx, "add", rec, v); nil != err {
+		return err
+	}
+	defer func() {
+		if err := s.runDNSCmd(ctx, "del", rec, v); nil != err {
+			log.Printf("Unable to remove %v: %v", rec, err)
+		}
+	}()
+	if _, err := c.Accept(ctx, ch); nil != err {
+		return fmt.Errorf("accepting challenge: %w", err)
+	}
+	if _, err := c.WaitAuthorization(ctx, z.URI); nil != err {
+		return fmt.Errorf("waiting for authorization: %w", err)
+	}
+	return nil
+}
+
+/* runDNSCmd runs s.dnsCmd with the shell (cmd.exe on Windows) to add or
+delete (action) the TXT record rec with the value v. */
+func (s *certSource) runDNSCmd(
+	ctx context.Context,
+	action string,
+	rec string,
+	v string,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, ACMEHOOKTIMEOUT)
+	defer cancel()
+	/* The record and value are only letters, digits, and punctuation
+	which is safe in the shell. */
+	c := fmt.Sprintf("%v %v %v %v", s.dnsCmd, action, rec, v)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c)
+	if "windows" == runtime.GOOS {
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/C", c)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); nil != err {
+		return fmt.Errorf("running %q: %w", c, err)
+	}
+	return nil
+}
+
+/* acmeClient returns an ACME client with a registered account, making one
+if need be.  The account key's kept in the cache directory, if there is
+one. */
+func (s *certSource) acmeClient(ctx context.Context) (*acme.Client, error) {
+	if nil != s.client {
+		return s.client, nil
+	}
+	key, err := s.acmeKey()
+	if nil != err {
+		return nil, err
+	}
+	c := &acme.Client{Key: key, DirectoryURL: s.acmeURL}
+	a := &acme.Account{}
+	if "" != s.email {
+		a.Contact = []string{"mailto:" + s.email}
+	}
+	if _, err := c.Register(
+		ctx,
+		a,
+		acme.AcceptTOS,
+	); nil != err && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+	s.client = c
+	return c, nil
+}
+
+/* acmeKey loads the ACME account key from the cache directory, or makes and
+saves a new one. */
+func (s *certSource) acmeKey() (crypto.Signer, error) {
+	fn := ""
+	if "" != s.dir {
+		fn = filepath.Join(s.dir, ACMEKEYFILE)
+	}
+	if "" != fn {
+		b, err := ioutil.ReadFile(fn)
+		if nil == err {
+			defer wipe(b)
+			p, _ := pem.Decode(b)
+			if nil == p {
+				return nil, fmt.Errorf("no key in %v", fn)
+			}
+			return x509.ParseECPrivateKey(p.Bytes)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		return nil, err
+	}
+	if "" == fn {
+		return key, nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); nil != err {
+		return nil, err
+	}
+	d, err := x509.MarshalECPrivateKey(key)
+	if nil != err {
+		return nil, err
+	}
+	defer wipe(d)
+	if err := ioutil.WriteFile(fn, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: d,
+	}), 0600); nil != err {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+/*
+ * chain.go
+ * Dial through a chain of jumps
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* Chain is a chain of jumps, made by MakeSSHConns, through the last of which
+connections are made. */
+type Chain struct {
+	clients []*ssh.Client
+
+	/* DialTimeout limits how long Dial waits for the exit jump to open a
+	connection.  Zero means forever. */
+	DialTimeout time.Duration
+
+	/* Proxy, if not nil, is connected to from the exit jump and used to
+	make connections. */
+	Proxy *exitProxy
+
+	/* Helper, if not nil, is the helper running on the exit jump. */
+	Helper *helperClient
+
+	/* Policy, if not nil, decides whether each connection's allowed and
+	from which jump it's made. */
+	Policy *routePolicy
+
+	/* Dry, if true, makes dials only pretend to connect, for -dryproxy. */
+	Dry bool
+
+	/* RetryRemote, if true, makes ForwardPorts keep re-requesting R
+	forwards' listens which fail, rather than failing, for rebuilt
+	chains. */
+	RetryRemote bool
+
+	/* Handoff, if not empty, is the control socket of the instance from
+	which R forwards are being taken over.  Each is released by the old
+	instance just before it's listened for. */
+	Handoff string
+}
+
+/* NewChain wraps the jumps in cs, which must not be empty */
+func NewChain(cs []*ssh.Client, dialTimeout time.Duration) *Chain {
+	return &Chain{clients: cs, DialTimeout: dialTimeout}
+}
+
+/* Exit returns the chain's last jump */
+func (c *Chain) Exit() *ssh.Client {
+	return c.clients[len(c.clients)-1]
+}
+
+/* Dial connects to addr from the exit jump, or c.Proxy if set, giving up after
+c.DialTimeout. */
+func (c *Chain) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext connects to addr from the exit jump, or c.Proxy if set, giving
+up after c.DialTimeout or when ctx is done.  Targets outside the -scope aren't
+connected to.  If there's a c.Policy, it may pick another jump from which to
+connect, or deny the connection.  The SSH channel open can't itself be
+canceled, so it's raced against ctx; if ctx finishes first, its error is
+returned and the connection is closed if it's ever opened. */
+func (c *Chain) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	return c.DialContextFrom(ctx, network, addr, "")
+}
+
+/* DialContextFrom is like DialContext, but if src isn't empty, it's sent to
+the jump as the address from which to connect, which few servers honor.  src
+isn't used with c.Proxy. */
+func (c *Chain) DialContextFrom(
+	ctx context.Context,
+	network string,
+	addr string,
+	src string,
+) (net.Conn, error) {
+	if 0 != c.DialTimeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	if err := scope.Check(addr); nil != err {
+		return nil, err
+	}
+	from := len(c.clients)
+	if nil != c.Policy {
+		var err error
+		if from, err = c.Policy.Route(
+			c.clients,
+			network,
+			addr,
+		); nil != err {
+			return nil, err
+		}
+	}
+	if c.Dry {
+		return dryDialer{}.DialContext(ctx, network, addr)
+	}
+	type dialed struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan dialed)
+	go func() {
+		var (
+			oc  net.Conn
+			err error
+		)
+		chanOpens.Add(1)
+		if "" != src && (nil == c.Proxy || len(c.clients) != from) {
+			oc, err = dialFrom(c.clients[from-1], addr, src)
+		} else if nil == c.Proxy || len(c.clients) != from {
+			oc, err = c.clients[from-1].Dial(network, addr)
+		} else {
+			oc, err = c.Proxy.DialContext(
+				ctx,
+				c.Exit(),
+				network,
+				addr,
+			)
+		}
+		chanOpens.Add(-1)
+		select {
+		case ch <- dialed{oc, err}:
+		case <-ctx.Done():
+			if nil != oc {
+				oc.Close()
+			}
+		}
+	}()
+	select {
+	case d := <-ch:
+		if nil != d.err {
+			return nil, d.err
+		}
+		return CountUsage(d.c, c.clients[:from]), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/* Listen asks the exit jump to listen on addr.  Listening never goes through
+c.Proxy.  Accepted connections are counted against every jump. */
+func (c *Chain) Listen(network, addr string) (net.Listener, error) {
+	l, err := c.Exit().Listen(network, addr)
+	if nil != err {
+		return nil, err
+	}
+	return &usageListener{Listener: l, cs: c.clients}, nil
+}
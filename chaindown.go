@@ -0,0 +1,157 @@
+package main
+
+/*
+ * chaindown.go
+ * Take the chain down and bring it back up, from the control socket
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/* downRequest asks runChain to take the chain down.  Progress is written to
+w, and done is closed once the chain's down. */
+type downRequest struct {
+	w    io.Writer
+	done chan struct{}
+}
+
+var (
+	/* downChan passes down requests from the control socket to runChain */
+	downChan = make(chan downRequest)
+	/* upChan passes up requests from the control socket to WaitChainUp */
+	upChan = make(chan struct{})
+)
+
+/* paused holds the local listeners closed while the chain's down, by fwdspec,
+so they can be listened on again on the same address */
+var paused = struct {
+	sync.Mutex
+	ls   map[string]net.Listener
+	down bool
+}{ls: make(map[string]net.Listener)}
+
+func init() {
+	RegisterControlCommand(
+		"down",
+		"Take the chain down, closing local listeners, until up",
+		func(w io.Writer, args []string) error {
+			req := downRequest{w: w, done: make(chan struct{})}
+			select {
+			case downChan <- req:
+			case <-time.After(CONTROLTIMEOUT):
+				return errors.New("chain isn't up")
+			}
+			<-req.done
+			return nil
+		},
+	)
+	RegisterControlCommand(
+		"up",
+		"Bring the chain back up after down",
+		func(w io.Writer, args []string) error {
+			select {
+			case upChan <- struct{}{}:
+			case <-time.After(CONTROLTIMEOUT):
+				return errors.New("chain isn't down")
+			}
+			fmt.Fprintf(w, "Bringing the chain up\n")
+			return nil
+		},
+	)
+}
+
+/* PauseListeners closes the local listeners in fls, so clients are refused
+rather than left waiting on a chain which isn't there, and notes their
+addresses for ResumeAddr.  The listeners which weren't paused, i.e. those on
+the exit jump, are returned for closing. */
+func PauseListeners(fls []fwdListener) []net.Listener {
+	var rest []net.Listener
+	paused.Lock()
+	defer paused.Unlock()
+	for _, fl := range fls {
+		if !fl.f.isFwd || Released(fl.l) {
+			rest = append(rest, fl.l)
+			continue
+		}
+		paused.ls[fl.f.spec] = fl.l
+		if err := fl.l.Close(); nil != err &&
+			!errors.Is(err, net.ErrClosed) {
+			log.Printf("Unable to pause %v: %v", fl.f.spec, err)
+		}
+	}
+	return rest
+}
+
+/* Paused returns true if l was paused by PauseListeners */
+func Paused(l net.Listener) bool {
+	paused.Lock()
+	defer paused.Unlock()
+	for _, pl := range paused.ls {
+		if pl == l {
+			return true
+		}
+	}
+	return false
+}
+
+/* ResumeAddr returns the address on which the listener paused for the
+fwdspec spec was listening, or the empty string if there wasn't one. */
+func ResumeAddr(spec string) string {
+	paused.Lock()
+	defer paused.Unlock()
+	l, ok := paused.ls[spec]
+	if !ok {
+		return ""
+	}
+	delete(paused.ls, spec)
+	return l.Addr().String()
+}
+
+/* ChainDown returns true if the chain's been taken down with down */
+func ChainDown() bool {
+	paused.Lock()
+	defer paused.Unlock()
+	return paused.down
+}
+
+/* WaitChainUp waits for an up request after the chain was taken down by req,
+which is told the chain's down.  It returns false if ctx is done or a shutdown
+is requested first. */
+func WaitChainUp(ctx context.Context, req downRequest) bool {
+	paused.Lock()
+	paused.down = true
+	n := len(paused.ls)
+	paused.Unlock()
+	defer func() {
+		paused.Lock()
+		defer paused.Unlock()
+		paused.down = false
+	}()
+	log.Printf("Chain down, %v listeners paused", n)
+	fmt.Fprintf(req.w, "Chain down, %v listeners paused\n", n)
+	close(req.done)
+
+	select {
+	case <-upChan:
+		log.Printf("Bringing the chain up")
+		return true
+	case <-ctx.Done():
+		return false
+	case sreq := <-shutdownChan:
+		/* The paused listeners are already closed */
+		CascadeShutdown(sreq.w, nil, nil, nil, "", sreq.drain)
+		close(sreq.done)
+		return false
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+/*
+ * cmdcred.go
+ * Get passwords and keys from external commands
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+/* CMDPREFIX is the password prefix to indicate a command whose output is the
+password or key */
+const CMDPREFIX = "cmd:"
+
+/* CMDTIMEOUT is how long a credential command has to finish */
+const CMDTIMEOUT = time.Minute
+
+func init() {
+	RegisterSecretBackend(CMDPREFIX, cmdSecret)
+}
+
+/* cmdSecret runs the command c with the shell (cmd.exe on Windows) and
+returns its output.  The command's stdin and stderr are ours, so it can ask the
+operator for things. */
+func cmdSecret(ctx context.Context, c string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, CMDTIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c)
+	if "windows" == runtime.GOOS {
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/C", c)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	o, err := cmd.Output()
+	if nil != err {
+		return nil, fmt.Errorf("running %q: %w", c, err)
+	}
+	return o, nil
+}
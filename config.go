@@ -0,0 +1,168 @@
+package main
+
+/*
+ * config.go
+ * Save and load the runtime configuration
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* unsavedFlags aren't put in dumped configs, as they don't make sense to
+reload.  The control socket and state directory belong to the instance which
+dumped the config, so another instance taking over with -handoff mustn't get
+them. */
+var unsavedFlags = map[string]bool{
+	"config":       true,
+	"control":      true,
+	"controlperm":  true,
+	"controltoken": true,
+	"handoff":      true,
+	"handofftoken": true,
+	"selftest":     true,
+	"statedir":     true,
+	"version":      true,
+}
+
+func init() {
+	RegisterControlCommand(
+		"config",
+		"Dump the effective configuration, for use with -config",
+		func(w io.Writer, args []string) error {
+			return DumpConfig(w)
+		},
+	)
+}
+
+/* DumpConfig writes the effective configuration to w, in a form suitable for
+use with -config.  Jumps and the current chain are written as comments, without
+secrets. */
+func DumpConfig(w io.Writer) error {
+	fmt.Fprintf(
+		w,
+		"# sshjump %v configuration, dumped %v\n",
+		Version,
+		time.Now().Format(time.RFC3339),
+	)
+
+	/* Flags */
+	fmt.Fprintf(w, "\n# Options\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		if unsavedFlags[f.Name] {
+			return
+		}
+		fmt.Fprintf(w, "-%v %v\n", f.Name, quoteConfigValue(
+			f.Value.String(),
+		))
+	})
+
+	/* Forwards */
+	fmt.Fprintf(w, "\n# Forwards\n")
+	for _, f := range state.Forwards() {
+		fmt.Fprintf(w, "%v\n", f.spec)
+	}
+
+	/* Jumps and the chain, for reference */
+	fmt.Fprintf(w, "\n# Jumps (secrets omitted)\n")
+	for _, j := range state.Jumps() {
+		fmt.Fprintf(w, "#   %v\n", withLabel(fmt.Sprintf(
+			"%v@%v %v",
+			j.username,
+			j.host,
+			j.version,
+		), j.label))
+	}
+	fmt.Fprintf(w, "\n# Current chain\n")
+	for i, c := range state.Chain() {
+		fmt.Fprintf(w, "#   %v: %v\n", i+1, describeJump(c))
+	}
+	return nil
+}
+
+/* quoteConfigValue quotes s if it's empty or has spaces */
+func quoteConfigValue(s string) string {
+	if "" == s || strings.ContainsAny(s, " \t\"") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+/* ParseConfig parses a configuration as written by DumpConfig.  Lines of
+the form -flag value are returned in flags, ready for parsing, and other
+non-comment lines are returned as forwarding specifications. */
+func ParseConfig(b []byte) (flags, fwds []string, err error) {
+	for i, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		/* Ignore blanks and comments */
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		/* Forwarding specifications */
+		if !strings.HasPrefix(l, "-") {
+			fwds = append(fwds, l)
+			continue
+		}
+		/* Flags */
+		parts := strings.SplitN(l, " ", 2)
+		if 1 == len(parts) {
+			flags = append(flags, parts[0])
+			continue
+		}
+		v := strings.TrimSpace(parts[1])
+		if strings.HasPrefix(v, `"`) {
+			if v, err = strconv.Unquote(v); nil != err {
+				return nil, nil, fmt.Errorf(
+					"line %v: %v",
+					i+1,
+					err,
+				)
+			}
+		}
+		flags = append(flags, parts[0]+"="+v)
+	}
+	return flags, fwds, nil
+}
+
+/* ApplyConfig parses the flags from the config file fname, without
+overriding any already set.  The config file's forwarding specifications are
+returned along with those in args. */
+func ApplyConfig(fname string, args []string) ([]string, error) {
+	b, err := ioutil.ReadFile(fname)
+	if nil != err {
+		return nil, err
+	}
+	return applyConfig(b, args)
+}
+
+/* applyConfig applies the configuration in b, as ApplyConfig does */
+func applyConfig(b []byte, args []string) ([]string, error) {
+	flags, fwds, err := ParseConfig(b)
+	if nil != err {
+		return nil, err
+	}
+	/* Save what's already set */
+	set := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	/* Apply the config, then the command line again */
+	if err := flag.CommandLine.Parse(flags); nil != err {
+		return nil, err
+	}
+	for n, v := range set {
+		if err := flag.Set(n, v); nil != err {
+			return nil, err
+		}
+	}
+	return append(fwds, args...), nil
+}
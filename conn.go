@@ -5,7 +5,7 @@ package main
  * Handle forwarding of connections
  * By J. Stuart McMurray
  * Created 20170401
- * Last Modified 20170401
+ * Last Modified 20261017
  */
 
 import (
@@ -17,11 +17,15 @@ import (
 var conns = make(map[net.Conn]struct{})
 var connL = &sync.Mutex{}
 
-/* RegisterConn keeps hold of a conn so it can be closed before termination */
+/* RegisterConn keeps hold of a conn so it can be closed before termination.
+If the chain's already been lost, the conn's closed. */
 func RegisterConn(c net.Conn) {
 	connL.Lock()
 	defer connL.Unlock()
 	conns[c] = struct{}{}
+	if KillSwitchTripped() {
+		closeConn(c)
+	}
 }
 
 /* CloseConn closes the conn and removes it from the set to be closed on
@@ -32,6 +36,13 @@ func CloseConn(c net.Conn) error {
 	return closeConn(c)
 }
 
+/* ConnCount returns the number of registered conns */
+func ConnCount() int {
+	connL.Lock()
+	defer connL.Unlock()
+	return len(conns)
+}
+
 /* CloseConns closes all the registered conns */
 func CloseConns() {
 	log.Printf("Closing proxied connections")
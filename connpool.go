@@ -0,0 +1,146 @@
+package main
+
+/*
+ * connpool.go
+ * Limit how many connections are proxied at once
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+/* What to do with clients when too many connections are being proxied */
+const (
+	OVERFLOWQUEUE  = "queue"  /* Wait for a connection to finish */
+	OVERFLOWREJECT = "reject" /* Close the client's connection */
+)
+
+var (
+	/* globalConns limits connections proxied by every forward, with
+	-maxconns */
+	globalConns *connPool
+
+	/* defaultOverflow is what's done by forwards without overflow=, from
+	-overflow */
+	defaultOverflow = OVERFLOWQUEUE
+)
+
+/* connPool limits how many connections are proxied at once.  When it's full,
+the start is logged, as is how many clients were rejected once there's room
+again, rather than a line per client.  A nil connPool is unlimited. */
+type connPool struct {
+	slots chan struct{}
+	name  string /* For logging */
+
+	l        sync.Mutex
+	full     bool /* Logged as full */
+	rejected int  /* Clients rejected while full */
+}
+
+/* newConnPool returns a connPool allowing n connections at once, described
+in logs as name.  If n is less than 1, the returned connPool is nil. */
+func newConnPool(n int, name string) *connPool {
+	if 1 > n {
+		return nil
+	}
+	return &connPool{slots: make(chan struct{}, n), name: name}
+}
+
+/* Get takes a slot in p.  If p's full and queue is true, Get waits for a slot
+until ctx is done; otherwise it returns false straight away. */
+func (p *connPool) Get(ctx context.Context, queue bool) bool {
+	if nil == p {
+		return true
+	}
+	/* Easy if there's room */
+	select {
+	case p.slots <- struct{}{}:
+		p.noteRoom()
+		return true
+	default:
+	}
+
+	/* Note we're full, and maybe wait for room */
+	p.l.Lock()
+	if !p.full {
+		how := "rejecting"
+		if queue {
+			how = "queuing"
+		}
+		log.Printf(
+			"Proxying %v connections %v, %v clients until one "+
+				"finishes",
+			cap(p.slots),
+			p.name,
+			how,
+		)
+		p.full = true
+	}
+	if !queue {
+		p.rejected++
+	}
+	p.l.Unlock()
+	if !queue {
+		return false
+	}
+	select {
+	case p.slots <- struct{}{}:
+		p.noteRoom()
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/* Put returns a slot taken by Get. */
+func (p *connPool) Put() {
+	if nil == p {
+		return
+	}
+	<-p.slots
+}
+
+/* noteRoom logs the end of p being full, if it was. */
+func (p *connPool) noteRoom() {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if !p.full {
+		return
+	}
+	if 0 != p.rejected {
+		log.Printf(
+			"Rejected %v clients while proxying too many "+
+				"connections %v",
+			p.rejected,
+			p.name,
+		)
+	}
+	p.full = false
+	p.rejected = 0
+}
+
+/* getConnSlots takes a slot for a connection to f from f's pool, if it has
+one, and the global pool, queuing or rejecting as f says.  If slots were
+taken, the returned function gives them back. */
+func getConnSlots(ctx context.Context, f fwdspec) (func(), bool) {
+	queue := OVERFLOWREJECT != f.overflow
+	if "" == f.overflow {
+		queue = OVERFLOWREJECT != defaultOverflow
+	}
+	if !f.pool.Get(ctx, queue) {
+		return nil, false
+	}
+	if !globalConns.Get(ctx, queue) {
+		f.pool.Put()
+		return nil, false
+	}
+	return func() {
+		globalConns.Put()
+		f.pool.Put()
+	}, true
+}
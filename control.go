@@ -0,0 +1,311 @@
+package main
+
+/*
+ * control.go
+ * Control socket
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/* CONTROLTIMEOUT is how long a control client has to send its
+	command */
+	CONTROLTIMEOUT = 10 * time.Second
+	/* CONTROLSOCK is the default name of the control socket */
+	CONTROLSOCK = "sshjump.sock"
+)
+
+/* controlCommand handles a command sent to the control socket.  Output should
+be written to w.  A returned error will be sent to the client. */
+type controlCommand struct {
+	help    string
+	handler func(w io.Writer, args []string) error
+}
+
+var (
+	controlCommands  = make(map[string]controlCommand)
+	controlCommandsL sync.Mutex
+)
+
+/* RegisterControlCommand makes a command available on the control socket */
+func RegisterControlCommand(
+	name string,
+	help string,
+	handler func(w io.Writer, args []string) error,
+) {
+	controlCommandsL.Lock()
+	defer controlCommandsL.Unlock()
+	controlCommands[name] = controlCommand{help: help, handler: handler}
+}
+
+func init() {
+	RegisterControlCommand(
+		"help",
+		"List control commands",
+		func(w io.Writer, args []string) error {
+			controlCommandsL.Lock()
+			defer controlCommandsL.Unlock()
+			ns := make([]string, 0, len(controlCommands))
+			for n := range controlCommands {
+				ns = append(ns, n)
+			}
+			sort.Strings(ns)
+			for _, n := range ns {
+				fmt.Fprintf(
+					w,
+					"%-10v %v\n",
+					n,
+					controlCommands[n].help,
+				)
+			}
+			return nil
+		},
+	)
+}
+
+/* ReadControlToken reads a control socket token from the file named fname.
+Leading and trailing whitespace is ignored. */
+func ReadControlToken(fname string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fname)
+	if nil != err {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if 0 == len(b) {
+		return nil, errors.New("empty token")
+	}
+	return b, nil
+}
+
+/* permFlag is a flag.Value holding file permissions, which are given and shown
+in octal. */
+type permFlag os.FileMode
+
+/* String returns p in octal, e.g. 0600 */
+func (p *permFlag) String() string {
+	if nil == p {
+		return "0"
+	}
+	return fmt.Sprintf("%#o", os.FileMode(*p))
+}
+
+/* Set parses s as octal permissions, with or without a leading 0. */
+func (p *permFlag) Set(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if nil != err || 0777 < n {
+		return fmt.Errorf("invalid octal permissions %q", s)
+	}
+	*p = permFlag(n)
+	return nil
+}
+
+/* umaskL serializes changes to the umask */
+var umaskL sync.Mutex
+
+/* listenUnix listens on a Unix socket at path with permissions perm.  Any
+stale socket at path is removed first.  The socket's made under a umask which
+only allows perm, so it never has other permissions, even briefly. */
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); nil == err &&
+		0 != fi.Mode()&os.ModeSocket {
+		os.Remove(path)
+	}
+	umaskL.Lock()
+	old := setUmask(int(0777 &^ perm.Perm()))
+	l, err := net.Listen("unix", path)
+	setUmask(old)
+	umaskL.Unlock()
+	if nil != err {
+		return nil, err
+	}
+	/* The umask can only take permissions away */
+	if err := os.Chmod(path, perm); nil != err {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+/* ListenControl listens on the Unix socket at path for control commands.  Any
+stale socket at path is removed first.  The socket's permissions are perm.  If
+token isn't nil, clients must send it before their command. */
+func ListenControl(
+	path string,
+	perm os.FileMode,
+	token []byte,
+) (net.Listener, error) {
+	l, err := listenUnix(path, perm)
+	if nil != err {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go handleControl(c, token)
+		}
+	}()
+	log.Printf("Listening for control commands on %v", path)
+	return l, nil
+}
+
+/* handleControl reads a single command from c and runs it.  If token isn't
+nil, it must be sent first, as auth token. */
+func handleControl(c net.Conn, token []byte) {
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(CONTROLTIMEOUT))
+	r := bufio.NewReader(c)
+	l, err := r.ReadString('\n')
+	if nil != err && "" == l {
+		return
+	}
+	if nil != token {
+		t := strings.TrimSpace(strings.TrimPrefix(l, "auth "))
+		if !strings.HasPrefix(l, "auth ") ||
+			1 != subtle.ConstantTimeCompare([]byte(t), token) {
+			log.Printf("Rejected unauthenticated control client")
+			fmt.Fprintf(c, "Error: authentication failed\n")
+			return
+		}
+		if l, err = r.ReadString('\n'); nil != err && "" == l {
+			return
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+	args := strings.Fields(l)
+	if 0 == len(args) {
+		return
+	}
+	controlCommandsL.Lock()
+	cmd, ok := controlCommands[args[0]]
+	controlCommandsL.Unlock()
+	if !ok {
+		fmt.Fprintf(c, "Error: unknown command %q\n", args[0])
+		return
+	}
+	log.Printf("Control command: %v", args[0])
+	if err := cmd.handler(c, args[1:]); nil != err {
+		fmt.Fprintf(c, "Error: %v\n", err)
+	}
+}
+
+/* SendControl sends the command made of args to the control socket at path
+and copies the response to w.  If token isn't nil, it's sent first. */
+func SendControl(path string, token []byte, w io.Writer, args []string) error {
+	c, err := net.Dial("unix", path)
+	if nil != err {
+		return err
+	}
+	defer c.Close()
+	if nil != token {
+		if _, err := fmt.Fprintf(c, "auth %s\n", token); nil != err {
+			return err
+		}
+	}
+	cmd := strings.Join(args, " ")
+	if _, err := fmt.Fprintf(c, "%v\n", cmd); nil != err {
+		return err
+	}
+	_, err = io.Copy(w, c)
+	return err
+}
+
+/* addControlFlags adds flags to fs which say where to find the control socket
+and how to authenticate.  The returned function returns the socket's path and
+token once fs is parsed. */
+func addControlFlags(fs *flag.FlagSet) func() (string, []byte) {
+	path := fs.String(
+		"control",
+		"",
+		"Control socket `path` (default "+CONTROLSOCK+
+			", or in -statedir)",
+	)
+	dir := fs.String(
+		"statedir",
+		"",
+		"State `directory` of the instance to control",
+	)
+	tokenFile := fs.String(
+		"token",
+		"",
+		"Optional `file` containing the control socket's token",
+	)
+	return func() (string, []byte) {
+		var token []byte
+		if "" != *tokenFile {
+			var err error
+			token, err = ReadControlToken(*tokenFile)
+			if nil != err {
+				fmt.Fprintf(
+					os.Stderr,
+					"Unable to read token: %v\n",
+					err,
+				)
+				os.Exit(1)
+			}
+		}
+		switch {
+		case "" != *path:
+			return *path, token
+		case "" != *dir:
+			return filepath.Join(*dir, CONTROLSOCK), token
+		default:
+			return CONTROLSOCK, token
+		}
+	}
+}
+
+/* ControlMain is the entry point for the control subcommand, which sends a
+command to a running instance's control socket. */
+func ControlMain(args []string) {
+	fs := flag.NewFlagSet("control", flag.ExitOnError)
+	sock := addControlFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v control [options] command [args...]
+
+Sends a command to a running instance's control socket.  The help command lists
+the available commands.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 0 == fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+	path, token := sock()
+	err := SendControl(path, token, os.Stdout, fs.Args())
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
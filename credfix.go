@@ -0,0 +1,136 @@
+package main
+
+/*
+ * credfix.go
+ * Ask the operator for new credentials when auth fails
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+/* credFixer asks the operator on the terminal for new credentials for jumps
+which fail authentication, and optionally saves them to the jumpfile.  A nil
+credFixer never asks. */
+type credFixer struct {
+	jumpfile string
+	keydir   string
+}
+
+/* NewCredFixer returns a credFixer which saves credentials to jumpfile and
+looks for keys in keydir.  Stdin must be a terminal. */
+func NewCredFixer(jumpfile, keydir string) (*credFixer, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("stdin is not a terminal")
+	}
+	return &credFixer{jumpfile: jumpfile, keydir: keydir}, nil
+}
+
+/* isAuthErr returns true if err indicates a jump didn't like our
+credentials. */
+func isAuthErr(err error) bool {
+	return nil != err &&
+		strings.Contains(err.Error(), "unable to authenticate")
+}
+
+/* Fix asks for a new password or key for j, which failed authentication.  If
+one is given, it's put in j and, if the operator agrees, saved to the
+jumpfile, and true is returned. */
+func (f *credFixer) Fix(j *jump) bool {
+	if nil == f {
+		return false
+	}
+	for {
+		fmt.Fprintf(
+			os.Stderr,
+			"Authentication to %v@%v failed.  New password, or "+
+				"%vfile for a key (blank to skip): ",
+			j.username,
+			j.host,
+			KEYPREFIX,
+		)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintf(os.Stderr, "\n")
+		if nil != err || 0 == len(b) {
+			return false
+		}
+		nj := *j
+		if bytes.HasPrefix(b, []byte(KEYPREFIX)) {
+			nj.password, nj.secret = string(b), nil
+		} else {
+			nj.password, nj.secret = "", append([]byte{}, b...)
+		}
+		wipe(b)
+		AddCredSecret(nj)
+		if err := setJumpKey(&nj, f.keydir); nil != err {
+			fmt.Fprintf(os.Stderr, "Unable to load key %v\n", err)
+			continue
+		}
+		*j = nj
+		break
+	}
+
+	/* Maybe remember it for next time */
+	if !confirm("Save to " + f.jumpfile + "?") {
+		return true
+	}
+	if err := f.save(*j); nil != err {
+		fmt.Fprintf(os.Stderr, "Unable to save: %v\n", err)
+	}
+	return true
+}
+
+/* confirm asks a yes or no question on the terminal, and returns true for
+yes */
+func confirm(q string) bool {
+	fmt.Fprintf(os.Stderr, "%v [y/N] ", q)
+	var (
+		a string
+		b = make([]byte, 1)
+	)
+	/* Read byte-by-byte so as not to eat anything after the newline */
+	for {
+		n, err := os.Stdin.Read(b)
+		if 0 == n || nil != err || '\n' == b[0] {
+			break
+		}
+		a += string(b)
+	}
+	a = strings.ToLower(strings.TrimSpace(a))
+	return "y" == a || "yes" == a
+}
+
+/* save replaces j's line in the jumpfile with j */
+func (f *credFixer) save(j jump) error {
+	if 0 == j.line {
+		return errors.New("unknown jumpfile line")
+	}
+	fi, err := os.Stat(f.jumpfile)
+	if nil != err {
+		return err
+	}
+	b, err := ioutil.ReadFile(f.jumpfile)
+	if nil != err {
+		return err
+	}
+	ls := strings.Split(string(b), "\n")
+	if len(ls) < j.line {
+		return fmt.Errorf("jumpfile has fewer than %v lines", j.line)
+	}
+	ls[j.line-1] = formatJumpLine(j)
+	return ioutil.WriteFile(
+		f.jumpfile,
+		[]byte(strings.Join(ls, "\n")),
+		fi.Mode().Perm(),
+	)
+}
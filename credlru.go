@@ -0,0 +1,297 @@
+package main
+
+/*
+ * credlru.go
+ * Spread authentication across accounts on the same jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* credUse is when an account last worked and last failed */
+type credUse struct {
+	Used   time.Time
+	Failed time.Time
+}
+
+/* credUsage keeps track of when each account on each jump, and each of a
+jumpfile line's credentials, was last used, so jumpfile lines for the same
+host and each line's credentials can be tried least-recently-used first.  A
+nil credUsage leaves the jumpfile's order alone. */
+type credUsage struct {
+	l    sync.Mutex
+	uses map[string]credUse /* user@host:port[#cred] -> use */
+}
+
+/* NewCredUsage returns a new credUsage. */
+func NewCredUsage() *credUsage {
+	return &credUsage{uses: make(map[string]credUse)}
+}
+
+/* credKey returns the key for j's account in a credUsage. */
+func credKey(j jump) string {
+	return j.username + "@" + credHost(j)
+}
+
+/* credCredKey returns the key for j's credential c in a credUsage.
+Credentials are known by their place on the jumpfile line, not their
+secrets. */
+func credCredKey(j, c jump) string {
+	return fmt.Sprintf("%v#%v", credKey(j), c.cred)
+}
+
+/* credHost returns j's address, with a port.  Addresses from an alias all
+count as the alias. */
+func credHost(j jump) string {
+	if "" != j.alias {
+		return credHost(jump{host: j.alias})
+	}
+	if _, p, err := net.SplitHostPort(j.host); nil == err && "" != p {
+		return j.host
+	}
+	return net.JoinHostPort(j.host, DEFPORT)
+}
+
+/* Order reorders, in place, the jumps in js with the same address so that
+the account which worked least recently comes first, followed by accounts
+which haven't been tried, and accounts which failed last time they were
+tried.  Jumps with different addresses keep their places.  Each jump's
+credentials, its password and cred= credentials, are reordered the same
+way, unless its password is to be asked for. */
+func (u *credUsage) Order(js []jump) {
+	if nil == u {
+		return
+	}
+	u.l.Lock()
+	defer u.l.Unlock()
+
+	/* Find the slots for each address */
+	slots := make(map[string][]int)
+	for i, j := range js {
+		h := credHost(j)
+		slots[h] = append(slots[h], i)
+	}
+
+	/* Shuffle each address's jumps within its slots */
+	for _, is := range slots {
+		if 2 > len(is) {
+			continue
+		}
+		g := make([]jump, len(is))
+		for n, i := range is {
+			g[n] = js[i]
+		}
+		sort.SliceStable(g, func(a, b int) bool {
+			return u.before(g[a], g[b])
+		})
+		for n, i := range is {
+			js[i] = g[n]
+		}
+	}
+
+	/* Shuffle each jump's credentials */
+	for i := range js {
+		u.orderCreds(&js[i])
+	}
+}
+
+/* orderCreds reorders j's credentials least-recently-used first, as Order
+does jumps.  u must be locked. */
+func (u *credUsage) orderCreds(j *jump) {
+	if 0 == len(j.alts) || PROMPTPASSWORD == j.password {
+		return
+	}
+	cs := append([]jump{{
+		password: j.password,
+		secret:   j.secret,
+		key:      j.key,
+		cred:     j.cred,
+	}}, j.alts...)
+	sort.SliceStable(cs, func(a, b int) bool {
+		return u.useBefore(
+			u.uses[credCredKey(*j, cs[a])],
+			u.uses[credCredKey(*j, cs[b])],
+		)
+	})
+	j.password, j.secret = cs[0].password, cs[0].secret
+	j.key, j.cred = cs[0].key, cs[0].cred
+	j.alts = cs[1:]
+}
+
+/* before returns true if a should be tried before b.  u must be locked. */
+func (u *credUsage) before(a, b jump) bool {
+	return u.useBefore(u.uses[credKey(a)], u.uses[credKey(b)])
+}
+
+/* useBefore returns true if whatever was used as ua should be tried before
+whatever was used as ub. */
+func (u *credUsage) useBefore(ua, ub credUse) bool {
+	fa, fb := ua.Failed.After(ua.Used), ub.Failed.After(ub.Used)
+	if fa != fb {
+		return fb
+	}
+	return ua.Used.Before(ub.Used)
+}
+
+/* Used notes that j's account just worked, with the credential whose cred is
+cred, if it's not -1. */
+func (u *credUsage) Used(j jump, cred int) {
+	if nil == u {
+		return
+	}
+	u.l.Lock()
+	defer u.l.Unlock()
+	now := time.Now()
+	ks := []string{credKey(j)}
+	if -1 != cred {
+		ks = append(ks, credCredKey(j, jump{cred: cred}))
+	}
+	for _, k := range ks {
+		cu := u.uses[k]
+		cu.Used = now
+		u.uses[k] = cu
+	}
+}
+
+/* Failed notes that j's account, and so all of its credentials, just failed
+to authenticate. */
+func (u *credUsage) Failed(j jump) {
+	if nil == u {
+		return
+	}
+	u.l.Lock()
+	defer u.l.Unlock()
+	now := time.Now()
+	ks := []string{credKey(j)}
+	for _, c := range append([]jump{j}, j.alts...) {
+		ks = append(ks, credCredKey(j, c))
+	}
+	for _, k := range ks {
+		cu := u.uses[k]
+		cu.Failed = now
+		u.uses[k] = cu
+	}
+}
+
+/* Load reads account usage saved by Save from the file named fname.  It's not
+an error for the file not to exist. */
+func (u *credUsage) Load(fname string) error {
+	if nil == u {
+		return nil
+	}
+	j, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+	var uses map[string]credUse
+	if err := json.Unmarshal(j, &uses); nil != err {
+		return err
+	}
+	u.l.Lock()
+	defer u.l.Unlock()
+	for k, v := range uses {
+		u.uses[k] = v
+	}
+	return nil
+}
+
+/* Save writes account usage to the file named fname. */
+func (u *credUsage) Save(fname string) error {
+	if nil == u {
+		return nil
+	}
+	u.l.Lock()
+	j, err := json.Marshal(u.uses)
+	u.l.Unlock()
+	if nil != err {
+		return err
+	}
+	return ioutil.WriteFile(fname, j, 0600)
+}
+
+/* noteSigns wraps s so f is called whenever s signs, which during
+authentication means the server's taking its key.  Whichever of
+ssh.AlgorithmSigner and ssh.MultiAlgorithmSigner s implements, so does the
+returned signer. */
+func noteSigns(s ssh.Signer, f func()) ssh.Signer {
+	as, ok := s.(ssh.AlgorithmSigner)
+	if !ok {
+		return notingSigner{Signer: s, f: f}
+	}
+	ns := notingAlgorithmSigner{AlgorithmSigner: as, f: f}
+	if ms, ok := s.(ssh.MultiAlgorithmSigner); ok {
+		return notingMultiAlgorithmSigner{
+			notingAlgorithmSigner: ns,
+			algs:                  ms.Algorithms(),
+		}
+	}
+	return ns
+}
+
+/* notingSigner calls f before signing */
+type notingSigner struct {
+	ssh.Signer
+	f func()
+}
+
+/* Sign calls s.f and then s.Signer.Sign */
+func (s notingSigner) Sign(
+	rand io.Reader,
+	data []byte,
+) (*ssh.Signature, error) {
+	s.f()
+	return s.Signer.Sign(rand, data)
+}
+
+/* notingAlgorithmSigner calls f before signing */
+type notingAlgorithmSigner struct {
+	ssh.AlgorithmSigner
+	f func()
+}
+
+/* Sign calls s.f and then s.AlgorithmSigner.Sign */
+func (s notingAlgorithmSigner) Sign(
+	rand io.Reader,
+	data []byte,
+) (*ssh.Signature, error) {
+	s.f()
+	return s.AlgorithmSigner.Sign(rand, data)
+}
+
+/* SignWithAlgorithm calls s.f and then s.AlgorithmSigner.SignWithAlgorithm */
+func (s notingAlgorithmSigner) SignWithAlgorithm(
+	rand io.Reader,
+	data []byte,
+	algorithm string,
+) (*ssh.Signature, error) {
+	s.f()
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+/* notingMultiAlgorithmSigner is a notingAlgorithmSigner which knows which
+algorithms it may use */
+type notingMultiAlgorithmSigner struct {
+	notingAlgorithmSigner
+	algs []string
+}
+
+/* Algorithms returns the algorithms the wrapped signer may use */
+func (s notingMultiAlgorithmSigner) Algorithms() []string {
+	return s.algs
+}
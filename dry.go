@@ -0,0 +1,83 @@
+package main
+
+/*
+ * dry.go
+ * Pretend to connect to targets, for training and checking fwdspecs
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+/* dryDialer pretends to connect to targets, with -dryproxy.  Nothing is
+dialed. */
+type dryDialer struct{}
+
+/* Dial calls d.DialContext with context.Background() */
+func (d dryDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext logs the connection which would have been made to addr and
+returns a dryConn in its place. */
+func (d dryDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	log.Printf("Dry run: would have connected to %v", addr)
+	return &dryConn{addr: dryAddr{network: network, addr: addr}}, nil
+}
+
+/* dryConn stands in for a connection to a target, with -dryproxy.  Writes
+are thrown away and reads return io.EOF, so the bytes sent by the client are
+counted and the client's connection is kept until it's closed. */
+type dryConn struct {
+	addr dryAddr
+}
+
+/* Read returns io.EOF */
+func (c *dryConn) Read(b []byte) (int, error) { return 0, io.EOF }
+
+/* Write discards b */
+func (c *dryConn) Write(b []byte) (int, error) { return len(b), nil }
+
+/* Close is a no-op */
+func (c *dryConn) Close() error { return nil }
+
+/* LocalAddr returns the address of the target */
+func (c *dryConn) LocalAddr() net.Addr { return c.addr }
+
+/* RemoteAddr returns the address of the target */
+func (c *dryConn) RemoteAddr() net.Addr { return c.addr }
+
+/* SetDeadline is a no-op */
+func (c *dryConn) SetDeadline(t time.Time) error { return nil }
+
+/* SetReadDeadline is a no-op */
+func (c *dryConn) SetReadDeadline(t time.Time) error { return nil }
+
+/* SetWriteDeadline is a no-op */
+func (c *dryConn) SetWriteDeadline(t time.Time) error { return nil }
+
+/* dryAddr is the address of a target which wasn't connected to */
+type dryAddr struct {
+	network string
+	addr    string
+}
+
+/* Network returns the network which would have been used */
+func (a dryAddr) Network() string { return a.network }
+
+/* String returns the target's address */
+func (a dryAddr) String() string { return a.addr }
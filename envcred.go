@@ -0,0 +1,35 @@
+package main
+
+/*
+ * envcred.go
+ * Get passwords and keys from the environment
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+/* ENVPREFIX is the password prefix to indicate an environment variable which
+holds the password, key, or key:file */
+const ENVPREFIX = "env:"
+
+func init() {
+	RegisterSecretBackend(ENVPREFIX, envSecret)
+}
+
+/* envSecret returns the value of the environment variable v, which must be
+set and not empty. */
+func envSecret(_ context.Context, v string) ([]byte, error) {
+	s, ok := os.LookupEnv(v)
+	if !ok {
+		return nil, fmt.Errorf("%v not set", v)
+	} else if "" == s {
+		return nil, fmt.Errorf("%v is empty", v)
+	}
+	return []byte(s), nil
+}
@@ -0,0 +1,206 @@
+package main
+
+/*
+ * execall.go
+ * Run a command on every jump in the chain
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* EXECALLTIMEOUT is how long a command run by exec-all has on each jump */
+const EXECALLTIMEOUT = time.Minute
+
+/* HOPSPREFIX starts exec-all's optional list of jumps */
+const HOPSPREFIX = "hops="
+
+func init() {
+	RegisterControlCommand(
+		"exec-all",
+		"Run a command on every jump, or those in hops=N,M,...",
+		func(w io.Writer, args []string) error {
+			return ExecAll(w, args)
+		},
+	)
+}
+
+/* ExecAll runs the command in args on each of the chain's jumps, and writes
+each jump's output to w, in order.  If args starts with hops=N,M,..., only
+those jumps are used. */
+func ExecAll(w io.Writer, args []string) error {
+	cs := state.Chain()
+	if 0 == len(cs) {
+		return errors.New("no chain")
+	}
+
+	/* Work out where to run */
+	hops := make([]int, len(cs))
+	for i := range hops {
+		hops[i] = i + 1
+	}
+	if 0 != len(args) && strings.HasPrefix(args[0], HOPSPREFIX) {
+		var err error
+		hops, err = parseHops(
+			strings.TrimPrefix(args[0], HOPSPREFIX),
+			len(cs),
+		)
+		if nil != err {
+			return err
+		}
+		args = args[1:]
+	}
+	if 0 == len(args) {
+		return errors.New("no command")
+	}
+	cmd := strings.Join(args, " ")
+
+	/* Run everywhere at once, and report in order */
+	outs := make([]bytes.Buffer, len(hops))
+	errs := make([]error, len(hops))
+	var wg sync.WaitGroup
+	for i, h := range hops {
+		wg.Add(1)
+		go func(i int, c *ssh.Client) {
+			defer wg.Done()
+			errs[i] = execOnJump(c, cmd, &outs[i])
+		}(i, cs[h-1])
+	}
+	wg.Wait()
+	for i, h := range hops {
+		fmt.Fprintf(w, "== Jump %v: %v ==\n", h, describeJump(cs[h-1]))
+		w.Write(outs[i].Bytes())
+		if 0 != outs[i].Len() &&
+			!bytes.HasSuffix(outs[i].Bytes(), []byte("\n")) {
+			fmt.Fprintf(w, "\n")
+		}
+		if nil != errs[i] {
+			fmt.Fprintf(w, "== Jump %v failed: %v ==\n", h, errs[i])
+		}
+	}
+	return nil
+}
+
+/* parseHops parses a comma-separated list of jump numbers, each of which must
+be between 1 and n. */
+func parseHops(s string, n int) ([]int, error) {
+	var hops []int
+	for _, p := range strings.Split(s, ",") {
+		h, err := strconv.Atoi(p)
+		if nil != err {
+			return nil, fmt.Errorf("invalid jump number %q", p)
+		}
+		if 1 > h || n < h {
+			return nil, fmt.Errorf(
+				"no jump %v, chain has %v jumps",
+				h,
+				n,
+			)
+		}
+		hops = append(hops, h)
+	}
+	return hops, nil
+}
+
+/* execOnJump runs cmd on c, putting its stdout and stderr in w.  The command
+is given up on after EXECALLTIMEOUT. */
+func execOnJump(c *ssh.Client, cmd string, w io.Writer) error {
+	s, err := c.NewSession()
+	if nil != err {
+		return err
+	}
+	defer s.Close()
+	requestAgent(c, s)
+	s.Stdout = w
+	s.Stderr = w
+	t := time.AfterFunc(EXECALLTIMEOUT, func() { s.Close() })
+	defer t.Stop()
+	if err := s.Run(cmd); nil != err {
+		if !t.Stop() {
+			return fmt.Errorf("timed out after %v", EXECALLTIMEOUT)
+		}
+		return err
+	}
+	return nil
+}
+
+/* execAllCommand returns the command line for exec-all to send for the
+arguments in args.  A single argument is a command line already, but several
+are quoted individually, so the jumps' shells see the same arguments.  It
+exits if an argument has a newline, which would end the control command. */
+func execAllCommand(args []string) []string {
+	for _, a := range args {
+		if strings.ContainsAny(a, "\r\n") {
+			fmt.Fprintf(os.Stderr, "Error: newline in %q\n", a)
+			os.Exit(1)
+		}
+	}
+	if 1 == len(args) {
+		return args
+	}
+	qs := make([]string, len(args))
+	for i, a := range args {
+		qs[i] = shellQuote(a)
+	}
+	return qs
+}
+
+/* ExecAllMain is the entry point for the exec-all subcommand, which runs a
+command on each jump in a running instance's chain, via its control socket. */
+func ExecAllMain(args []string) {
+	fs := flag.NewFlagSet("exec-all", flag.ExitOnError)
+	sock := addControlFlags(fs)
+	hops := fs.String(
+		"hops",
+		"",
+		"Comma-separated `list` of jump numbers on which to run the "+
+			"command (default all)",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v exec-all [options] command
+
+Runs a command on each jump in a running instance's chain, via its control
+socket, and prints each jump's output.  The command is run by each jump's
+shell.  A single argument is given to the shell as-is, e.g. 'uname -a; id'.
+More than one is taken as a command and its arguments, each quoted for the
+shell, so nothing in them is special.  Whitespace in an argument is sent as a
+single space, and newlines aren't allowed.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 0 == fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cargs := []string{"exec-all"}
+	if "" != *hops {
+		cargs = append(cargs, HOPSPREFIX+*hops)
+	}
+	cargs = append(cargs, execAllCommand(fs.Args())...)
+	path, token := sock()
+	if err := SendControl(path, token, os.Stdout, cargs); nil != err {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
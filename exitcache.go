@@ -0,0 +1,68 @@
+package main
+
+/*
+ * exitcache.go
+ * Don't repeat exit tests through the same exit during rapid rebuilds
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/* exitCache remembers passed exit tests by exit jump and target, so
+rebuilding the chain through the same exit doesn't mean another, conspicuous,
+connection to the test target.  Failures aren't remembered, as they're often
+the target or exit having a moment, and a remembered failure would keep a good
+exit out of the chain.  A nil exitCache remembers nothing. */
+type exitCache struct {
+	ttl time.Duration
+
+	l      sync.Mutex
+	passed map[string]time.Time /* By user@host target */
+}
+
+/* NewExitCache returns an exitCache which remembers passes for ttl.  If ttl
+is 0, nil is returned. */
+func NewExitCache(ttl time.Duration) *exitCache {
+	if 0 == ttl {
+		return nil
+	}
+	return &exitCache{ttl: ttl, passed: make(map[string]time.Time)}
+}
+
+/* Test returns the result of test, an exit test of target through the exit
+jump hop.  If the test passed for hop and target less than the cache's TTL
+ago, true is returned instead of calling test. */
+func (c *exitCache) Test(hop, target string, test func() bool) bool {
+	if nil == c {
+		return test()
+	}
+	k := hop + " " + target
+	c.l.Lock()
+	when, ok := c.passed[k]
+	c.l.Unlock()
+	if ok && time.Since(when) < c.ttl {
+		log.Printf(
+			"Exit test to %v via %v passed %v ago, not testing "+
+				"again",
+			target,
+			hop,
+			time.Since(when).Round(time.Second),
+		)
+		return true
+	}
+	ok = test()
+	c.l.Lock()
+	defer c.l.Unlock()
+	if ok {
+		c.passed[k] = time.Now()
+	} else {
+		delete(c.passed, k)
+	}
+	return ok
+}
@@ -0,0 +1,189 @@
+package main
+
+/*
+ * exitcontent.go
+ * Make sure exit tests get what they should, not just a connection
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/* EXITCONTENTTIMEOUT is how long an exit test has to finish once it's
+connected */
+const EXITCONTENTTIMEOUT = 30 * time.Second
+
+/* EXITBODYMAX is the most of an exit test URL's body which is hashed */
+const EXITBODYMAX = 16 * 1024 * 1024
+
+/* exitContent says what an exit test should find once it's connected, to
+catch egress which is intercepted or mangled.  The zero exitContent only
+connects to host:port targets. */
+type exitContent struct {
+	cert string /* SHA256 of the target's TLS certificate, hex */
+	body string /* SHA256 of the target URL's body, hex */
+}
+
+/* NewExitContent returns an exitContent for the exit test to target wanting
+the TLS certificate and body with the SHA256 hashes cert and body, either of
+which may be empty to not check it.  Hashes are hex, optionally with colons. */
+func NewExitContent(target, cert, body string) (exitContent, error) {
+	var (
+		w   exitContent
+		err error
+	)
+	if _, ok := exitURL(target); !ok && "" != body {
+		return w, errors.New("body hash needs an http or https URL")
+	}
+	if strings.HasPrefix(target, ICMPPREFIX) && "" != cert {
+		return w, errors.New("ICMP exit tests have no certificate")
+	}
+	if w.cert, err = normalizeSHA256(cert); nil != err {
+		return w, fmt.Errorf("certificate hash: %w", err)
+	}
+	if w.body, err = normalizeSHA256(body); nil != err {
+		return w, fmt.Errorf("body hash: %w", err)
+	}
+	return w, nil
+}
+
+/* normalizeSHA256 returns h, a hex SHA256 hash which may have colons, in
+lowercase without colons.  An empty h is returned as-is. */
+func normalizeSHA256(h string) (string, error) {
+	if "" == h {
+		return "", nil
+	}
+	h = strings.ToLower(strings.ReplaceAll(h, ":", ""))
+	b, err := hex.DecodeString(h)
+	if nil != err {
+		return "", err
+	}
+	if sha256.Size != len(b) {
+		return "", fmt.Errorf("%v bytes, not %v", len(b), sha256.Size)
+	}
+	return h, nil
+}
+
+/* exitURL returns target parsed as a URL, if it's an http or https URL. */
+func exitURL(target string) (*url.URL, bool) {
+	if !strings.HasPrefix(target, "http://") &&
+		!strings.HasPrefix(target, "https://") {
+		return nil, false
+	}
+	u, err := url.Parse(target)
+	if nil != err {
+		return nil, false
+	}
+	return u, true
+}
+
+/* ExitDialAddr returns the host:port to which to connect for the exit test
+to target, which may be a URL. */
+func ExitDialAddr(target string) string {
+	u, ok := exitURL(target)
+	if !ok {
+		return target
+	}
+	if "" != u.Port() {
+		return u.Host
+	}
+	if "https" == u.Scheme {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+/* Check makes the rest of the exit test to target over c, which is connected
+to ExitDialAddr(target).  If target's a URL, it's fetched and must return a
+2xx.  TLS certificates are checked against w.cert if it's set, or the system
+roots for https URLs otherwise, and the body against w.body.  c is closed. */
+func (w exitContent) Check(c net.Conn, target string) error {
+	defer c.Close()
+	u, isURL := exitURL(target)
+	if !isURL && "" == w.cert {
+		return nil
+	}
+	/* SSH channels don't do deadlines */
+	t := time.AfterFunc(EXITCONTENTTIMEOUT, func() { c.Close() })
+	defer t.Stop()
+
+	/* Check the certificate */
+	if "" != w.cert || (isURL && "https" == u.Scheme) {
+		h, _, err := net.SplitHostPort(ExitDialAddr(target))
+		if nil != err {
+			return err
+		}
+		tc := tls.Client(c, &tls.Config{
+			ServerName:         h,
+			InsecureSkipVerify: "" != w.cert,
+		})
+		if err := tc.Handshake(); nil != err {
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+		if "" != w.cert {
+			cs := tc.ConnectionState().PeerCertificates
+			if 0 == len(cs) {
+				return errors.New("no TLS certificate")
+			}
+			s := sha256.Sum256(cs[0].Raw)
+			if got := hex.EncodeToString(s[:]); got != w.cert {
+				return fmt.Errorf(
+					"TLS certificate SHA256 %v, not %v",
+					got,
+					w.cert,
+				)
+			}
+		}
+		c = tc
+	}
+	if !isURL {
+		return nil
+	}
+
+	/* Fetch the URL */
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if nil != err {
+		return err
+	}
+	req.Header.Set("User-Agent", "") /* Don't advertise Go */
+	req.Close = true
+	if err := req.Write(c); nil != err {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c), req)
+	if nil != err {
+		return fmt.Errorf("reading response: %w", err)
+	}
+	defer res.Body.Close()
+	if 200 > res.StatusCode || 299 < res.StatusCode {
+		return fmt.Errorf("HTTP status %v", res.Status)
+	}
+	if "" == w.body {
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(
+		h,
+		io.LimitReader(res.Body, EXITBODYMAX),
+	); nil != err {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != w.body {
+		return fmt.Errorf("body SHA256 %v, not %v", got, w.body)
+	}
+	return nil
+}
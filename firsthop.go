@@ -0,0 +1,369 @@
+package main
+
+/*
+ * firsthop.go
+ * Dialer for the first jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+/* DNSCACHETTL is how long resolved jump addresses are cached */
+const DNSCACHETTL = 10 * time.Minute
+
+/* TORDETECTTIMEOUT is how long we wait to connect to each of TORSOCKSADDRS
+when looking for Tor */
+const TORDETECTTIMEOUT = time.Second
+
+/* TORSOCKSADDRS are where Tor's SOCKS port usually is, for the tor daemon and
+Tor Browser */
+var TORSOCKSADDRS = []string{"127.0.0.1:9050", "127.0.0.1:9150"}
+
+/* firstHopDialer dials the first jump directly.  It caches DNS lookups and
+can optionally use TCP Fast Open and a different network namespace.  Only the
+first jump is resolved locally; later jumps are resolved by the jump before
+them.  A first jump with a .onion address is dialed via Tor.  With an upstream
+SOCKS proxy, usually another sshjump's -socksunix socket, every first jump is
+dialed through it and nothing's resolved locally. */
+type firstHopDialer struct {
+	fastOpen bool
+	netns    string /* Network namespace, or "" for ours */
+	tor      string /* Tor's SOCKS address, or "" to look for it */
+	upstream string /* Upstream SOCKS address or socket, or "" for none */
+	resolver hostResolver
+
+	l     sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+/* dnsCacheEntry holds resolved addresses */
+type dnsCacheEntry struct {
+	addrs []string
+	until time.Time
+}
+
+/* NewFirstHopDialer returns a new firstHopDialer, which will use TCP Fast
+Open if fastOpen is true and connect from the network namespace netns if it's
+not empty.  Onion services are reached via the Tor SOCKS port at tor, or one
+of TORSOCKSADDRS if tor is empty.  If upstream isn't empty, it's the address
+of a SOCKS5 proxy, or the path to a Unix socket serving SOCKS5, through which
+all first jumps are dialed instead.  Names are resolved with resolver or, if
+it's nil, the system resolver. */
+func NewFirstHopDialer(
+	fastOpen bool,
+	netns string,
+	tor string,
+	upstream string,
+	resolver hostResolver,
+) *firstHopDialer {
+	if nil == resolver {
+		resolver = net.DefaultResolver
+	}
+	return &firstHopDialer{
+		fastOpen: fastOpen,
+		netns:    netns,
+		tor:      tor,
+		upstream: upstream,
+		resolver: resolver,
+		cache:    make(map[string]dnsCacheEntry),
+	}
+}
+
+/* vrfDialer dials the first jump from a particular VRF */
+type vrfDialer struct {
+	f   *firstHopDialer
+	vrf string
+}
+
+/* ForVRF returns a Dialer which dials like f, but from the VRF vrf. */
+func (f *firstHopDialer) ForVRF(vrf string) Dialer {
+	return vrfDialer{f: f, vrf: vrf}
+}
+
+/* Dial dials addr on network from v.vrf */
+func (v vrfDialer) Dial(network, addr string) (net.Conn, error) {
+	return v.f.dial(context.Background(), network, addr, v.vrf)
+}
+
+/* DialContext dials addr on network from v.vrf */
+func (v vrfDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	return v.f.dial(ctx, network, addr, v.vrf)
+}
+
+/* Dial dials addr on network */
+func (f *firstHopDialer) Dial(network, addr string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext dials addr on network, using cached addresses for addr's host
+if we have them.  Nagle's algorithm is disabled on the resulting conn. */
+func (f *firstHopDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	return f.dial(ctx, network, addr, "")
+}
+
+/* dial dials addr on network, as DialContext does.  If vrf isn't empty, the
+socket is bound to it. */
+func (f *firstHopDialer) dial(
+	ctx context.Context,
+	network string,
+	addr string,
+	vrf string,
+) (net.Conn, error) {
+	h, p, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+	if "" != f.upstream {
+		return f.dialUpstream(ctx, network, addr)
+	}
+	if isOnion(h) {
+		return f.dialTor(ctx, network, addr, vrf)
+	}
+	ips, err := f.resolve(ctx, h)
+	if nil != err {
+		return nil, err
+	}
+	d := f.netDialer(vrf, f.fastOpen)
+	/* Try each address in turn */
+	for _, ip := range ips {
+		var c net.Conn
+		c, err = d.DialContext(ctx, network, net.JoinHostPort(ip, p))
+		if nil != err {
+			continue
+		}
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetNoDelay(true)
+		}
+		return c, nil
+	}
+	return nil, err
+}
+
+/* netDialer returns a Dialer which dials from f's network namespace and binds
+to vrf, if it's not empty, and uses TCP Fast Open if fastOpen is true. */
+func (f *firstHopDialer) netDialer(vrf string, fastOpen bool) Dialer {
+	return nsDialer{d: &net.Dialer{Control: func(
+		network string,
+		address string,
+		c syscall.RawConn,
+	) error {
+		if fastOpen {
+			if err := setFastOpen(network, address, c); nil != err {
+				return err
+			}
+		}
+		if "" != vrf {
+			if err := bindToDevice(c, vrf); nil != err {
+				return fmt.Errorf("binding to %v: %v", vrf, err)
+			}
+		}
+		return nil
+	}}, netns: f.netns}
+}
+
+/* nsDialer dials with d from the network namespace netns, or ours if netns is
+empty. */
+type nsDialer struct {
+	d     *net.Dialer
+	netns string
+}
+
+/* Dial calls n.DialContext with context.Background() */
+func (n nsDialer) Dial(network, addr string) (net.Conn, error) {
+	return n.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext dials addr on network with n.d, from n.netns */
+func (n nsDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	if "" == n.netns {
+		return n.d.DialContext(ctx, network, addr)
+	}
+	var c net.Conn
+	err := inNetNS(n.netns, func() error {
+		var derr error
+		c, derr = n.d.DialContext(ctx, network, addr)
+		return derr
+	})
+	return c, err
+}
+
+/* Resolve looks up the addresses for all of the hosts, concurrently, and
+caches them.  Failures are logged but not fatal, as a host may only be
+resolvable from another jump.  With an upstream proxy, nothing's resolved. */
+func (f *firstHopDialer) Resolve(ctx context.Context, hosts []string) {
+	if "" != f.upstream {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		if hh, _, err := net.SplitHostPort(h); nil == err {
+			h = hh
+		}
+		if isOnion(h) {
+			continue
+		}
+		wg.Add(1)
+		go func(h string) {
+			defer wg.Done()
+			if _, err := f.resolve(ctx, h); nil != err {
+				log.Printf("Unable to resolve %v: %v", h, err)
+			}
+		}(h)
+	}
+	wg.Wait()
+}
+
+/* resolve returns the addresses for h, from the cache if possible. */
+func (f *firstHopDialer) resolve(
+	ctx context.Context,
+	h string,
+) ([]string, error) {
+	/* IP addresses are easy */
+	if nil != net.ParseIP(h) {
+		return []string{h}, nil
+	}
+	/* Try the cache */
+	f.l.Lock()
+	e, ok := f.cache[h]
+	f.l.Unlock()
+	if ok && time.Now().Before(e.until) {
+		return e.addrs, nil
+	}
+	/* Ask DNS */
+	addrs, err := f.resolver.LookupHost(ctx, h)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(addrs) {
+		return nil, fmt.Errorf("no addresses for %v", h)
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.cache[h] = dnsCacheEntry{
+		addrs: addrs,
+		until: time.Now().Add(DNSCACHETTL),
+	}
+	return addrs, nil
+}
+
+/* isOnion returns true if h is a Tor onion service's name */
+func isOnion(h string) bool {
+	return strings.HasSuffix(
+		strings.ToLower(strings.TrimSuffix(h, ".")),
+		".onion",
+	)
+}
+
+/* dialTor dials addr, an onion service, via Tor's SOCKS port.  The name's
+given to Tor as-is, as it can't be resolved anywhere else.  The SOCKS port is
+connected to from f's network namespace and vrf, if it's not empty, as the
+first jump would be if it weren't an onion service. */
+func (f *firstHopDialer) dialTor(
+	ctx context.Context,
+	network string,
+	addr string,
+	vrf string,
+) (net.Conn, error) {
+	d := f.netDialer(vrf, false)
+	ta, err := f.torAddr(ctx, d)
+	if nil != err {
+		return nil, err
+	}
+	c, err := dialSOCKS(ctx, d, "tcp", ta, network, addr)
+	if nil != err {
+		return nil, fmt.Errorf("via Tor at %v: %w", ta, err)
+	}
+	return c, nil
+}
+
+/* dialUpstream dials addr via the upstream SOCKS proxy, which is a Unix
+socket if it has a slash.  The name's given to the proxy as-is, to be resolved
+wherever the proxy's connections come out. */
+func (f *firstHopDialer) dialUpstream(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	pn := "tcp"
+	if strings.Contains(f.upstream, "/") {
+		pn = "unix"
+	}
+	c, err := dialSOCKS(ctx, &net.Dialer{}, pn, f.upstream, network, addr)
+	if nil != err {
+		return nil, fmt.Errorf("via upstream %v: %w", f.upstream, err)
+	}
+	return c, nil
+}
+
+/* dialSOCKS dials addr on network via the SOCKS5 proxy at paddr on pnet,
+which is connected to with d. */
+func dialSOCKS(
+	ctx context.Context,
+	d Dialer,
+	pnet string,
+	paddr string,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	sd, err := xproxy.SOCKS5(pnet, paddr, nil, d)
+	if nil != err {
+		return nil, err
+	}
+	return sd.(xproxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+/* torAddr returns the address of Tor's SOCKS port.  If it wasn't given to
+NewFirstHopDialer, the first of TORSOCKSADDRS which accepts a connection made
+with d is used from then on. */
+func (f *firstHopDialer) torAddr(
+	ctx context.Context,
+	d Dialer,
+) (string, error) {
+	f.l.Lock()
+	ta := f.tor
+	f.l.Unlock()
+	if "" != ta {
+		return ta, nil
+	}
+	for _, a := range TORSOCKSADDRS {
+		dctx, cancel := context.WithTimeout(ctx, TORDETECTTIMEOUT)
+		c, err := d.DialContext(dctx, "tcp", a)
+		cancel()
+		if nil != err {
+			continue
+		}
+		c.Close()
+		log.Printf("Found Tor's SOCKS port at %v", a)
+		f.l.Lock()
+		defer f.l.Unlock()
+		f.tor = a
+		return a, nil
+	}
+	return "", errors.New("no Tor SOCKS port found")
+}
@@ -5,50 +5,481 @@ package main
  * Handle forwarding of connections
  * By J. Stuart McMurray
  * Created 20170401
- * Last Modified 20170401
+ * Last Modified 20261017
  */
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+)
+
+/* RETRYINTERVAL is how often R forwards' targets are redialed, with retry= */
+const RETRYINTERVAL = 500 * time.Millisecond
+
+/* retryInterval is RETRYINTERVAL, unless changed by -profile */
+var retryInterval = RETRYINTERVAL
 
-	"golang.org/x/crypto/ssh"
+/* What to do with a client when its target can't be reached */
+const (
+	ONFAILCLOSE = "close" /* Just close the connection */
+	ONFAILRST   = "rst"   /* Reset the connection */
+	ONFAILHTTP  = "http"  /* Send an HTTP 502 */
 )
 
 /* FWDRE parses forwarding specifications */
-var FWDRE = regexp.MustCompile(`^(L|R)([^,]+),(\d+),([^,]+),(\d+)$`)
+var FWDRE = regexp.MustCompile(
+	`^(L|R|U)([^,]*),(\d+),([^,]+?)(?:,(\d+))?((?:,[^,=]+=[^,]*)*)$`,
+)
 
 /* fwdspec holds a specification for a forward */
 type fwdspec struct {
-	isFwd bool   /* True for L, false for R */
+	spec  string /* As given */
+	isFwd bool   /* True for L and U, false for R */
+	isUDP bool   /* True for U */
 	laddr string /* Listen address */
 	caddr string /* Connect address */
+	local bool   /* True if caddr is a TARGETSTDIO or TARGETPIPE target */
+
+	/* HTTP rewriting */
+	httpHost string /* Host header override */
+	httpXFF  string /* X-Forwarded-For handling, XFFADD or XFFSTRIP */
+
+	allow []*net.IPNet  /* Allowed client networks, all if empty */
+	prio  string        /* Priority class, PRIOINTERACTIVE or PRIOBULK */
+	limit *byteLimit    /* Byte limit, shared by the forward's conns */
+	retry time.Duration /* How long to retry dialing R targets */
+	storm *stormLimit   /* Per-peer connection rate limit */
+	neg   *negCache     /* Recent dial failure, to fail fast */
+
+	mdnsType string /* DNS-SD service type to advertise, e.g. _http._tcp */
+	tlsName  string /* Name for which to serve TLS to clients, or "" */
+
+	md5Key string /* TCP MD5 signature key for connections to the target */
+
+	src    string /* Address from which to connect to the target */
+	srcVia string /* How src is used by L forwards, e.g. SRCVIAHELPER */
+
+	onFail string /* What to do on dial failure, e.g. ONFAILRST */
+
+	pool     *connPool /* Limit on connections proxied at once */
+	overflow string    /* What to do when pool's full, e.g. OVERFLOWQUEUE */
+
+	label string /* Operator's note, for humans */
+	group string /* Group with its own chain, or "" for the main chain */
+}
+
+/* checkScope returns an error wrapping errOutOfScope if the forward's target
+is reached through the chain and isn't in the -scope. */
+func (f fwdspec) checkScope() error {
+	if !f.isFwd || f.local {
+		return nil
+	}
+	return scope.Check(f.caddr)
+}
+
+/* allowed returns true if a client from a may use the forward */
+func (f fwdspec) allowed(a net.Addr) bool {
+	if 0 == len(f.allow) {
+		return true
+	}
+	h, _, err := net.SplitHostPort(a.String())
+	if nil != err {
+		return false
+	}
+	ip := net.ParseIP(h)
+	if nil == ip {
+		return false
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/* toAgent returns true if f is an R forward to the local ssh-agent */
+func (f fwdspec) toAgent() bool {
+	return !f.isFwd && TARGETAGENT == f.caddr
+}
+
+/* rewritesHTTP returns true if f requires HTTP requests to be rewritten */
+func (f fwdspec) rewritesHTTP() bool {
+	return "" != f.httpHost || "" != f.httpXFF
+}
+
+/* needsHelper returns true if f's traffic to its target goes via the
+helper */
+func (f fwdspec) needsHelper() bool {
+	return f.isUDP || (f.isFwd &&
+		("" != f.md5Key || SRCVIAHELPER == f.srcVia))
 }
 
 /* ParseForwards parses the forwarding specifications on the command line */
 func ParseForwards(specs []string) []fwdspec {
 	fs := make([]fwdspec, 0)
+	nStdio := 0
 	for _, s := range specs {
-		ms := FWDRE.FindStringSubmatch(s)
-		if nil == ms {
-			log.Fatalf("Invalid forwarding specification %q", s)
-		}
-		fs = append(fs, fwdspec{
-			isFwd: "L" == ms[1],
-			laddr: net.JoinHostPort(ms[2], ms[3]),
-			caddr: net.JoinHostPort(ms[4], ms[5]),
-		})
+		f, err := ParseForward(s)
+		if nil != err {
+			log.Fatalf(
+				"Invalid forwarding specification %q: %v",
+				s,
+				err,
+			)
+		}
+		if f.local && TARGETSTDIO == f.caddr {
+			nStdio++
+		}
+		fs = append(fs, f)
+	}
+	if 1 < nStdio {
+		log.Fatalf("Only one forward may use %v", TARGETSTDIO)
 	}
 	return fs
 }
 
+/* ParseForward parses a single forwarding specification */
+func ParseForward(s string) (fwdspec, error) {
+	ms := FWDRE.FindStringSubmatch(s)
+	if nil == ms {
+		return fwdspec{}, errors.New("unparseable")
+	}
+	f := fwdspec{
+		spec:  s,
+		isFwd: "R" != ms[1],
+		isUDP: "U" == ms[1],
+		laddr: net.JoinHostPort(unbracket(ms[2]), ms[3]),
+		caddr: net.JoinHostPort(unbracket(ms[4]), ms[5]),
+	}
+	/* Only R forwards' targets are local enough for stdio, named pipes,
+	and ssh-agent. */
+	if "" == ms[5] && TARGETAGENT == ms[4] {
+		if f.isFwd {
+			return f, fmt.Errorf(
+				"%v targets are only for R forwards",
+				TARGETAGENT,
+			)
+		}
+		f.caddr = TARGETAGENT
+	} else if "" == ms[5] {
+		if !isLocalTarget(ms[4]) {
+			return f, errors.New("target needs a port")
+		}
+		if f.isFwd {
+			return f, fmt.Errorf(
+				"%v and %v targets are only for R forwards",
+				TARGETSTDIO,
+				TARGETPIPE,
+			)
+		}
+		f.caddr = ms[4]
+		f.local = true
+	}
+	if !f.isFwd {
+		f.laddr = net.JoinHostPort(remoteBindAddr(ms[2]), ms[3])
+	} else if "" == ms[2] {
+		return f, errors.New(
+			"only R forwards may have an empty address",
+		)
+	}
+	err := parseFwdOpts(&f, ms[6])
+	if nil == err && f.isUDP && nil != f.limit {
+		err = fmt.Errorf("maxbytes is only for TCP")
+	}
+	if nil == err && f.isFwd && 0 != f.retry {
+		err = fmt.Errorf("retry is only for R forwards")
+	}
+	if nil == err && f.isFwd && nil != f.storm {
+		err = fmt.Errorf("storm is only for R forwards")
+	}
+	if nil == err && (!f.isFwd || f.isUDP) && "" != f.tlsName {
+		err = fmt.Errorf("tls is only for L forwards")
+	}
+	if nil == err && (!f.isFwd || f.isUDP) && "" != f.mdnsType {
+		err = fmt.Errorf("mdns is only for L forwards")
+	}
+	if nil == err && "" != f.md5Key && (f.isUDP || f.local || f.toAgent()) {
+		err = fmt.Errorf("md5 is only for TCP targets")
+	}
+	if nil == err && "" != f.src && (f.isUDP || f.local || f.toAgent()) {
+		err = fmt.Errorf("src is only for TCP targets")
+	}
+	if nil == err && "" != f.srcVia && (!f.isFwd || "" == f.src) {
+		err = fmt.Errorf("srcvia is only for L forwards with src")
+	}
+	if nil == err && nil != f.neg && (f.isUDP || f.local || f.toAgent()) {
+		err = fmt.Errorf("negcache is only for TCP targets")
+	}
+	if nil == err && "" != f.md5Key && !f.isFwd && !tcpMD5Supported {
+		err = fmt.Errorf("md5 on R forwards needs Linux")
+	}
+	if nil == err && "" != f.group && f.needsHelper() {
+		err = fmt.Errorf("group isn't for forwards using the helper")
+	}
+	if nil != err {
+		return f, fmt.Errorf("invalid options: %w", err)
+	}
+	/* The spec's logged, shown, and written all over the place */
+	if "" != f.md5Key {
+		f.spec = redactMD5(s, ms[6])
+	}
+	return f, nil
+}
+
+/* unbracket removes the square brackets from around an IPv6 address */
+func unbracket(h string) string {
+	if strings.HasPrefix(h, "[") && strings.HasSuffix(h, "]") {
+		return h[1 : len(h)-1]
+	}
+	return h
+}
+
+/* remoteBindAddr converts the address in an R forward to the one to send in
+the listen request, as OpenSSH does: an empty address means localhost and *
+means every address, which is requested with an empty address.  Anything else,
+including hostnames, is passed along for the server to interpret. */
+func remoteBindAddr(h string) string {
+	switch h {
+	case "":
+		return "localhost"
+	case "*":
+		return ""
+	default:
+		return unbracket(h)
+	}
+}
+
+/* listenAddr describes the address on which l, f's listener, is listening.
+Remote listeners only know their port, so the address is taken from f. */
+func listenAddr(l net.Listener, f fwdspec) string {
+	if f.isFwd {
+		return l.Addr().String()
+	}
+	h, _, err := net.SplitHostPort(f.laddr)
+	if nil != err {
+		return l.Addr().String()
+	}
+	if "" == h {
+		h = "*"
+	}
+	_, p, err := net.SplitHostPort(l.Addr().String())
+	if nil != err {
+		return l.Addr().String()
+	}
+	return net.JoinHostPort(h, p)
+}
+
+/* redactMD5 returns the spec s, which ends in the options opts, with md5='s
+key replaced with REDACTED. */
+func redactMD5(s, opts string) string {
+	ps := strings.Split(opts, ",")
+	for i, p := range ps {
+		if strings.HasPrefix(p, "md5=") {
+			ps[i] = "md5=" + REDACTED
+		}
+	}
+	return strings.TrimSuffix(s, opts) + strings.Join(ps, ",")
+}
+
+/* parseFwdOpts parses the comma-separated key=value options which may follow
+the addresses in a forwarding specification, and sets the appropriate fields in
+f.  An empty string of options is not an error. */
+func parseFwdOpts(f *fwdspec, opts string) error {
+	var onMax string
+	for _, o := range strings.Split(opts, ",") {
+		if "" == o {
+			continue
+		}
+		kv := strings.SplitN(o, "=", 2)
+		k, v := kv[0], kv[1]
+		switch k {
+		case "host":
+			f.httpHost = v
+		case "xff":
+			if XFFADD != v && XFFSTRIP != v {
+				return fmt.Errorf(
+					"xff must be %q or %q",
+					XFFADD,
+					XFFSTRIP,
+				)
+			}
+			f.httpXFF = v
+		case "allow":
+			n, err := parseAllow(v)
+			if nil != err {
+				return err
+			}
+			f.allow = append(f.allow, n)
+		case "prio":
+			if PRIOINTERACTIVE != v && PRIOBULK != v {
+				return fmt.Errorf(
+					"prio must be %q or %q",
+					PRIOINTERACTIVE,
+					PRIOBULK,
+				)
+			}
+			f.prio = v
+		case "maxbytes":
+			if "" == v {
+				return fmt.Errorf("maxbytes needs a count")
+			}
+			n, err := parseByteCount(v)
+			if nil != err {
+				return fmt.Errorf("maxbytes: %v", err)
+			}
+			f.limit = newByteLimit(n)
+		case "onmax":
+			if ONMAXCLOSE != v && ONMAXDISABLE != v {
+				return fmt.Errorf(
+					"onmax must be %q or %q",
+					ONMAXCLOSE,
+					ONMAXDISABLE,
+				)
+			}
+			onMax = v
+		case "retry":
+			d, err := time.ParseDuration(v)
+			if nil != err {
+				return fmt.Errorf("retry: %v", err)
+			}
+			f.retry = d
+		case "storm":
+			sl, err := parseStormLimit(v, f.laddr)
+			if nil != err {
+				return fmt.Errorf("storm: %v", err)
+			}
+			f.storm = sl
+		case "negcache":
+			nc, err := parseNegCache(v, f.caddr)
+			if nil != err {
+				return fmt.Errorf("negcache: %v", err)
+			}
+			f.neg = nc
+		case "tls":
+			if nil == net.ParseIP(v) && !CERTNAMERE.MatchString(v) {
+				return fmt.Errorf("tls needs a hostname")
+			}
+			f.tlsName = v
+		case "mdns":
+			if !MDNSTYPERE.MatchString(v) {
+				return fmt.Errorf(
+					"mdns needs a type, like _http._tcp",
+				)
+			}
+			f.mdnsType = v
+		case "onfail":
+			switch v {
+			case ONFAILCLOSE, ONFAILRST, ONFAILHTTP:
+			default:
+				return fmt.Errorf(
+					"onfail must be %q, %q, or %q",
+					ONFAILCLOSE,
+					ONFAILRST,
+					ONFAILHTTP,
+				)
+			}
+			f.onFail = v
+		case "md5":
+			if REDACTED == v {
+				return fmt.Errorf(
+					"md5's key isn't kept in specs, " +
+						"give it again",
+				)
+			}
+			if "" == v || MD5MAXKEYLEN < len(v) {
+				return fmt.Errorf(
+					"md5 needs a key of at most %v bytes",
+					MD5MAXKEYLEN,
+				)
+			}
+			AddSecret([]byte(v))
+			f.md5Key = v
+		case "src":
+			a, err := parseSrcAddr(v)
+			if nil != err {
+				return fmt.Errorf("src: %v", err)
+			}
+			f.src = a
+		case "srcvia":
+			if SRCVIACHANNEL != v && SRCVIAHELPER != v {
+				return fmt.Errorf(
+					"srcvia must be %q or %q",
+					SRCVIACHANNEL,
+					SRCVIAHELPER,
+				)
+			}
+			f.srcVia = v
+		case "maxconns":
+			n, err := strconv.Atoi(v)
+			if nil != err || 1 > n {
+				return fmt.Errorf("maxconns needs a count")
+			}
+			f.pool = newConnPool(n, "to "+f.laddr)
+		case "overflow":
+			if OVERFLOWQUEUE != v && OVERFLOWREJECT != v {
+				return fmt.Errorf(
+					"overflow must be %q or %q",
+					OVERFLOWQUEUE,
+					OVERFLOWREJECT,
+				)
+			}
+			f.overflow = v
+		case "label":
+			f.label = v
+		case "group":
+			if "" == v {
+				return fmt.Errorf("group needs a name")
+			}
+			f.group = v
+		default:
+			return fmt.Errorf("unknown option %q", k)
+		}
+	}
+	if "" != onMax {
+		if nil == f.limit {
+			return fmt.Errorf("onmax requires maxbytes")
+		}
+		f.limit.disable = ONMAXDISABLE == onMax
+	}
+	return nil
+}
+
+/* parseAllow parses an IP address or CIDR network into a network */
+func parseAllow(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); nil == err {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if nil == ip {
+		return nil, fmt.Errorf("invalid address or network %q", s)
+	}
+	if v4 := ip.To4(); nil != v4 {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
 /* CloseListeners closes the listeners in ls. */
 func CloseListeners(ls []net.Listener) {
 	for _, l := range ls {
+		/* Already closed for a handoff or by the kill switch */
+		if Released(l) {
+			forgetReleased(l)
+			continue
+		} else if KillSwitchTripped() {
+			continue
+		}
 		if err := l.Close(); nil != err {
 			log.Printf(
 				"Unable to close listener %v: %v",
@@ -60,77 +491,285 @@ func CloseListeners(ls []net.Listener) {
 	}
 }
 
-/* ForwardPorts parses the list of forwards proxies connections via the ssh
-connection according to the forwards.  Fatal errors encountered during
-proxying will be sent back on errChan. */
+/* ForwardPorts parses the list of forwards proxies connections via the chain
+according to the forwards.  Fatal errors encountered during proxying will be
+sent back on errChan, as will errLocalDone once every stdio and pipe target
+has had its connection.  When ctx is done, local listeners stop accepting and
+proxied connections are interrupted.  The caller is responsible for closing
+the returned listeners, except those for R forwards retried because of
+c.RetryRemote, which are closed when ctx is done. */
 func ForwardPorts(
-	c *ssh.Client,
+	ctx context.Context,
+	c *Chain,
 	forwards []fwdspec,
 	errChan chan<- error,
 ) ([]net.Listener, error) {
 	var (
-		ls  []net.Listener
-		err error
+		ls     []net.Listener
+		err    error
+		nLocal int
 	)
+	/* Stdio and pipe targets each take one connection */
+	localWG := &sync.WaitGroup{}
 	/* Try to listen on each of the forwarded ports */
 	for _, f := range forwards {
+		/* UDP's handled elsewhere */
+		if f.isUDP {
+			continue
+		}
 		var (
 			l net.Listener
 			d Dialer
 		)
+		/* If we're taking over, the old instance lets go of R
+		forwards one at a time */
+		if !f.isFwd {
+			if err = c.takeOver(f); nil != err {
+				CloseListeners(ls)
+				return nil, err
+			}
+		}
 		/* Listen */
 		if f.isFwd {
-			l, err = net.Listen("tcp", f.laddr)
+			/* Pick up where we left off if the chain was down,
+			in case the port was chosen for us */
+			laddr := f.laddr
+			if a := ResumeAddr(f.spec); "" != a {
+				laddr = a
+			}
+			l, err = net.Listen("tcp", laddr)
 			d = c
+			if f.needsHelper() {
+				d = helperDialer{
+					c:   c,
+					key: f.md5Key,
+					src: f.src,
+				}
+			} else if "" != f.src {
+				d = srcDialer{c: c, src: f.src}
+			}
+		} else if f.local {
+			l, err = c.Listen("tcp", f.laddr)
+			d = localDialer{}
+		} else if f.toAgent() {
+			l, err = c.Listen("tcp", f.laddr)
+			d = agentDialer{}
 		} else {
 			l, err = c.Listen("tcp", f.laddr)
-			d = &net.Dialer{}
+			nd := &net.Dialer{}
+			if "" != f.md5Key {
+				nd.Control = md5Control(f.md5Key)
+			}
+			if "" != f.src {
+				nd.LocalAddr = srcTCPAddr(f.src)
+			}
+			d = nd
+		}
+		/* Or don't, for -dryproxy */
+		if c.Dry {
+			d = dryDialer{}
+		}
+		/* The new last jump may not be ready for it yet */
+		if nil != err && !f.isFwd && !f.local && c.RetryRemote {
+			log.Printf(
+				"Unable to listen for %v, will retry every "+
+					"%v: %v",
+				withLabel(f.spec, f.label),
+				REMOTERETRYINTERVAL,
+				Hinted(err),
+			)
+			go retryRemote(ctx, c, d, f, errChan)
+			err = nil
+			continue
 		}
 		if nil != err {
 			/* On error, close all of the other listeners */
 			CloseListeners(ls)
 			return nil, err
 		}
+		/* Make sure we've a certificate before clients want it */
+		if "" != f.tlsName {
+			if _, err := certs.Get(f.tlsName); nil != err {
+				l.Close()
+				CloseListeners(ls)
+				return nil, fmt.Errorf(
+					"getting certificate for %v: %w",
+					f.tlsName,
+					err,
+				)
+			}
+		}
 		/* Fire off a handler */
-		go forwardPort(l, d, f, errChan)
+		f.limit.SetListener(l)
+		var relisten func() error
+		if !f.isFwd {
+			relisten = relistener(ctx, c, d, f, localWG, errChan)
+		}
+		state.AddListener(l, f, relisten)
+		if f.local {
+			localWG.Add(1)
+			nLocal++
+		}
+		go forwardPort(ctx, l, d, f, localWG, errChan)
 		dir := "forward"
 		if !f.isFwd {
 			dir = "reverse"
 		}
 		log.Printf(
 			"Listening on %v for %v connections to %v",
-			l.Addr(),
+			listenAddr(l, f),
 			dir,
-			f.caddr,
+			withLabel(f.caddr, f.label),
 		)
 		ls = append(ls, l)
 	}
+	/* Once the local targets are done, so are we */
+	if 0 != nLocal {
+		go func() {
+			localWG.Wait()
+			select {
+			case errChan <- errLocalDone:
+			case <-ctx.Done():
+			}
+		}()
+	}
 	return ls, err
 }
 
-/* forwardPort accepts clients on l and forwards to f.caddr via d.  Fatal
-errors will be sent to ec */
-func forwardPort(l net.Listener, d Dialer, f fwdspec, ec chan<- error) {
+/* forwardPort accepts clients on l and forwards to f.caddr via d until l is
+closed.  Fatal errors will be sent to ec, unless ctx is done.  Stdio and pipe
+targets only get one connection, after which localWG's Done method is called. */
+func forwardPort(
+	ctx context.Context,
+	l net.Listener,
+	d Dialer,
+	f fwdspec,
+	localWG *sync.WaitGroup,
+	ec chan<- error,
+) {
+	/* Stop accepting when ctx is done, if l can be told to.  Otherwise,
+	we stop when the caller closes l. */
+	if dl, ok := l.(deadliner); ok {
+		defer context.AfterFunc(ctx, func() {
+			dl.SetDeadline(time.Now())
+		})()
+	}
+
 	/* Accept clients and proxy */
+	used := false
 	for {
 		/* Pop off a client */
 		c, err := l.Accept()
 		if nil != err {
-			ec <- err
+			/* Closed on purpose */
+			if f.limit.Disabled() || Released(l) || Paused(l) ||
+				KillSwitchTripped() || nil != ctx.Err() {
+				return
+			}
+			select {
+			case ec <- err:
+			case <-ctx.Done():
+			}
 			return
 		}
+		/* Don't bother if we've relayed enough */
+		if f.limit.Exceeded() {
+			log.Printf(
+				"Dropping connection from %v to %v after "+
+					"reaching byte limit",
+				c.RemoteAddr(),
+				l.Addr(),
+			)
+			c.Close()
+			continue
+		}
+		/* Make sure it's someone we like */
+		if !f.allowed(c.RemoteAddr()) {
+			log.Printf(
+				"Dropping connection from disallowed "+
+					"client %v to %v",
+				c.RemoteAddr(),
+				l.Addr(),
+			)
+			c.Close()
+			continue
+		}
+		/* Don't let one peer flood the target */
+		if !f.storm.Allow(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		/* Local targets can only be used once */
+		if f.local && used {
+			log.Printf(
+				"Dropping connection from %v to %v: %v "+
+					"only takes one connection",
+				c.RemoteAddr(),
+				l.Addr(),
+				f.caddr,
+			)
+			c.Close()
+			continue
+		} else if f.local {
+			used = true
+			go func() {
+				defer localWG.Done()
+				forwardConnection(ctx, c, d, f)
+			}()
+			continue
+		}
+		/* Don't proxy too many at once */
+		done, ok := getConnSlots(ctx, f)
+		if !ok {
+			c.Close()
+			continue
+		}
 		/* Handle */
-		go forwardConnection(c, d, f)
+		proxyPool.Go(func() {
+			defer done()
+			forwardConnection(ctx, c, d, f)
+		})
 	}
 }
 
+/* deadliner is implemented by listeners and conns which can have their
+blocked calls interrupted */
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+/* interruptConn unblocks reads and writes on c, so proxying finishes.  If c
+doesn't support deadlines (e.g. SSH channels), it's closed instead. */
+func interruptConn(c net.Conn) {
+	if nil == c.SetDeadline(time.Now()) {
+		return
+	}
+	c.Close()
+}
+
 /* forwardConnection proxies the connection t to a connection made to f.caddr
-via d. */
-func forwardConnection(ic net.Conn, d Dialer, f fwdspec) {
+via d.  Both connections are closed when ctx is done. */
+func forwardConnection(ctx context.Context, ic net.Conn, d Dialer, f fwdspec) {
+	fwdGoroutines.Add(f.spec, 1)
+	defer fwdGoroutines.Add(f.spec, -1)
+	/* Clients may want TLS, which isn't passed on to the target */
+	if "" != f.tlsName {
+		ic = tls.Server(ic, certs.TLSConfig(f.tlsName))
+	}
 	RegisterConn(ic)
 	defer CloseConn(ic)
+	/* Don't bother if the target was unreachable a moment ago */
+	if err := f.neg.Cached(); nil != err {
+		failClient(ic, f.onFail, err)
+		return
+	}
 	/* Attempt to connect to the target */
-	oc, err := d.Dial("tcp", f.caddr)
+	dialStart := time.Now()
+	oc, err := dialTarget(ctx, d, f)
+	dialTook := time.Since(dialStart)
+	if nil == ctx.Err() {
+		f.neg.Note(err)
+	}
 	if nil != err {
 		var cs string
 		if f.isFwd {
@@ -138,22 +777,32 @@ func forwardConnection(ic net.Conn, d Dialer, f fwdspec) {
 		} else {
 			cs = fmt.Sprintf("%v<-%v", f.caddr, ic.RemoteAddr())
 		}
+		cs = withLabel(cs, f.label)
 		log.Printf(
-			"Unable to forward connection %v: %v",
+			"Unable to forward connection %v after %v: %v",
 			cs,
-			err,
+			dialTook,
+			Hinted(err),
 		)
+		failClient(ic, f.onFail, err)
 		return
 	}
 	RegisterConn(oc)
 	defer CloseConn(oc)
+
+	/* Don't outlive ctx */
+	defer context.AfterFunc(ctx, func() {
+		interruptConn(ic)
+		interruptConn(oc)
+	})()
 	var cs string
 	if f.isFwd {
 		cs = fmt.Sprintf("%v->%v", ic.RemoteAddr(), f.caddr)
 	} else {
 		cs = fmt.Sprintf("%v<-%v", f.caddr, ic.RemoteAddr())
 	}
-	log.Printf("Begin %v", cs)
+	cs = withLabel(cs, f.label)
+	log.Printf("Begin %v (dialed in %v)", cs, dialTook)
 
 	/* Proxy bytes */
 	var (
@@ -165,12 +814,43 @@ func forwardConnection(ic net.Conn, d Dialer, f fwdspec) {
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
+	/* Prioritize, if we're prioritizing */
+	var icw, ocw io.Writer = ic, oc
+	if "" != f.prio {
+		icw = prioWriter{w: ic, prio: f.prio}
+		ocw = prioWriter{w: oc, prio: f.prio}
+	}
+
+	/* Count bytes, if we're limiting */
+	if nil != f.limit {
+		if !f.limit.Add(ic, oc) {
+			return
+		}
+		defer f.limit.Remove(ic, oc)
+		icw = limitWriter{w: icw, b: f.limit}
+		ocw = limitWriter{w: ocw, b: f.limit}
+	}
+
+	/* Requests always flow from the accepted connection to the dialed
+	one, so that's the side which gets rewritten, if need be. */
+	icToOC := proxy
+	if f.rewritesHTTP() {
+		icToOC = func(
+			dst io.Writer,
+			src io.Reader,
+			n *int64,
+			err *error,
+			wg *sync.WaitGroup,
+		) {
+			proxyHTTP(dst, src, ic.RemoteAddr(), f, n, err, wg)
+		}
+	}
 	if f.isFwd {
-		go proxy(oc, ic, &ltrn, &ltre, wg)
-		go proxy(ic, oc, &rtln, &rtle, wg)
+		goFwd(f, func() { icToOC(ocw, ic, &ltrn, &ltre, wg) })
+		goFwd(f, func() { proxy(icw, oc, &rtln, &rtle, wg) })
 	} else {
-		go proxy(oc, ic, &rtln, &rtle, wg)
-		go proxy(ic, oc, &ltrn, &ltre, wg)
+		goFwd(f, func() { icToOC(ocw, ic, &rtln, &rtle, wg) })
+		goFwd(f, func() { proxy(icw, oc, &ltrn, &ltre, wg) })
 	}
 
 	wg.Wait()
@@ -185,6 +865,79 @@ func forwardConnection(ic net.Conn, d Dialer, f fwdspec) {
 
 }
 
+/* goFwd runs fn on a pooled goroutine, counted as one of f's */
+func goFwd(f fwdspec, fn func()) {
+	fwdGoroutines.Add(f.spec, 1)
+	proxyPool.Go(func() {
+		defer fwdGoroutines.Add(f.spec, -1)
+		fn()
+	})
+}
+
+/* failClient tells the client c its target couldn't be reached, according to
+how, one of the ONFAIL* constants.  The caller should close c. */
+func failClient(c net.Conn, how string, err error) {
+	switch how {
+	case ONFAILRST:
+		/* Only TCP can be reset, possibly under TLS and the like */
+		if tc, ok := tcpConn(c); ok {
+			tc.SetLinger(0)
+		}
+	case ONFAILHTTP:
+		msg := fmt.Sprintf("sshjump: unable to reach target: %v\n", err)
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		fmt.Fprintf(
+			c,
+			"HTTP/1.1 502 Bad Gateway\r\n"+
+				"Content-Type: text/plain\r\n"+
+				"Content-Length: %v\r\n"+
+				"Connection: close\r\n"+
+				"\r\n"+
+				"%v",
+			len(msg),
+			msg,
+		)
+	}
+}
+
+/* netConner is implemented by conns which wrap another conn, such as
+*tls.Conn */
+type netConner interface {
+	NetConn() net.Conn
+}
+
+/* tcpConn returns the *net.TCPConn under c's wrappers, if there is one */
+func tcpConn(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, true
+		case netConner:
+			c = v.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+/* dialTarget connects to f.caddr via d.  If f.retry is set, failed dials are
+retried until it elapses, so clients of R forwards aren't dropped while the
+target restarts.  Dialing stops when ctx is done. */
+func dialTarget(ctx context.Context, d Dialer, f fwdspec) (net.Conn, error) {
+	end := time.Now().Add(f.retry)
+	for {
+		c, err := d.DialContext(ctx, "tcp", f.caddr)
+		if nil == err || time.Now().Add(retryInterval).After(end) {
+			return c, err
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 /* proxy copies bytes from src to dst.  On completion, wg's Done method is
 called, and the number of bytes copied and any error encountered are put in n
 and err. */
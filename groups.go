@@ -0,0 +1,103 @@
+package main
+
+/*
+ * groups.go
+ * Give groups of forwards their own chains
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* MakeGroupChains makes a chain for each of the groups, as MakeSSHConns does
+with cc, each from jumps not used by the chain in used or any other group's
+chain.  The chains are returned by group.  If one can't be made, the others
+are closed.  errInterrupt is returned as-is. */
+func MakeGroupChains(
+	ctx context.Context,
+	jumps []jump,
+	used []*ssh.Client,
+	groups []string,
+	cc chainConfig,
+	cancel context.CancelFunc,
+) (map[string][]*ssh.Client, error) {
+	gcs := make(map[string][]*ssh.Client)
+	used = append([]*ssh.Client{}, used...)
+	for _, g := range groups {
+		log.Printf("Making SSH jumps for forward group %v", g)
+		cs, err := MakeSSHConns(
+			ctx,
+			unusedJumps(jumps, used),
+			cc,
+			cancel,
+		)
+		if nil != err {
+			for _, cs := range gcs {
+				CloseJumps(cs)
+			}
+			if errInterrupt == err {
+				return nil, err
+			}
+			return nil, fmt.Errorf("forward group %v: %w", g, err)
+		}
+		used = append(used, cs...)
+		gcs[g] = cs
+	}
+	return gcs, nil
+}
+
+/* fwdGroups returns the names of the groups of the forwards in fs, in the
+order in which they first appear.  Forwards without a group are served by the
+main chain and aren't in a group. */
+func fwdGroups(fs []fwdspec) []string {
+	var (
+		gs   []string
+		seen = make(map[string]bool)
+	)
+	for _, f := range fs {
+		if "" == f.group || seen[f.group] {
+			continue
+		}
+		seen[f.group] = true
+		gs = append(gs, f.group)
+	}
+	return gs
+}
+
+/* inGroup returns the forwards in fs in the group g, or without a group if g
+is empty. */
+func inGroup(fs []fwdspec, g string) []fwdspec {
+	var gfs []fwdspec
+	for _, f := range fs {
+		if g == f.group {
+			gfs = append(gfs, f)
+		}
+	}
+	return gfs
+}
+
+/* unusedJumps returns the jumps in js whose addresses aren't those of any of
+the jumps to which the clients in used are connected, so chains made from them
+don't share any jumps. */
+func unusedJumps(js []jump, used []*ssh.Client) []jump {
+	taken := make(map[string]bool)
+	for _, c := range used {
+		if j, ok := state.JumpOf(c); ok {
+			taken[credHost(j)] = true
+		}
+	}
+	var ujs []jump
+	for _, j := range js {
+		if !taken[credHost(j)] {
+			ujs = append(ujs, j)
+		}
+	}
+	return ujs
+}
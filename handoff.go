@@ -0,0 +1,247 @@
+package main
+
+/*
+ * handoff.go
+ * Hand remote forwards from one instance to another
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/* released holds the listeners closed for a handoff, until they're closed
+for good.  Those not yet reclaimed have the function to listen again. */
+var (
+	released  = make(map[net.Listener]func() error)
+	releasedL sync.Mutex
+)
+
+func init() {
+	RegisterControlCommand(
+		"release",
+		"Stop remote forwards, for another instance to take over "+
+			"(release [fwdspec...])",
+		func(w io.Writer, args []string) error {
+			ReleaseReverse(w, args)
+			return nil
+		},
+	)
+	RegisterControlCommand(
+		"reclaim",
+		"Listen again for released remote forwards, after a failed "+
+			"handoff",
+		func(w io.Writer, args []string) error {
+			ReclaimReverse(w)
+			return nil
+		},
+	)
+}
+
+/* ReleaseReverse closes the listeners for the remote forwards with the given
+specs, or all of them if there are none, so their ports on the exit jump are
+free for another instance.  The forwards' connections are left alone.  What's
+released is logged and written to w. */
+func ReleaseReverse(w io.Writer, specs []string) {
+	want := make(map[string]bool)
+	for _, s := range specs {
+		want[s] = true
+	}
+	for _, fl := range state.Listeners() {
+		if fl.f.isFwd || (0 != len(specs) && !want[fl.f.spec]) {
+			continue
+		}
+		releasedL.Lock()
+		released[fl.l] = fl.relisten
+		releasedL.Unlock()
+		state.RemoveListener(fl.l)
+		if err := fl.l.Close(); nil != err {
+			log.Printf("Unable to release %v: %v", fl.f.spec, err)
+			fmt.Fprintf(
+				w,
+				"Error releasing %v: %v\n",
+				fl.f.spec,
+				err,
+			)
+			continue
+		}
+		log.Printf("Released %v", fl.f.spec)
+		fmt.Fprintf(w, "Released %v\n", fl.f.spec)
+	}
+}
+
+/* ReclaimReverse listens again for the remote forwards released by
+ReleaseReverse.  What's reclaimed is logged and written to w. */
+func ReclaimReverse(w io.Writer) {
+	/* The old listeners stay released, so they're left alone when
+	they'd otherwise be closed for good */
+	rs := make(map[net.Listener]func() error)
+	releasedL.Lock()
+	for l, relisten := range released {
+		if nil != relisten {
+			rs[l] = relisten
+			released[l] = nil
+		}
+	}
+	releasedL.Unlock()
+	for l, relisten := range rs {
+		if err := relisten(); nil != err {
+			log.Printf("Unable to reclaim %v: %v", l.Addr(), err)
+			fmt.Fprintf(w, "Error reclaiming %v: %v\n", l.Addr(), err)
+			continue
+		}
+		log.Printf("Reclaimed %v", l.Addr())
+		fmt.Fprintf(w, "Reclaimed %v\n", l.Addr())
+	}
+}
+
+/* Released returns true if l was closed by ReleaseReverse */
+func Released(l net.Listener) bool {
+	releasedL.Lock()
+	defer releasedL.Unlock()
+	_, ok := released[l]
+	return ok
+}
+
+/* forgetReleased forgets that l was released, once it's no longer needed */
+func forgetReleased(l net.Listener) {
+	releasedL.Lock()
+	defer releasedL.Unlock()
+	delete(released, l)
+}
+
+/* relistener returns a function which listens for the remote forward f via c
+again and hands its connections to d, for ReclaimReverse.  The new listener
+is closed when ctx is done. */
+func relistener(
+	ctx context.Context,
+	c *Chain,
+	d Dialer,
+	f fwdspec,
+	localWG *sync.WaitGroup,
+	ec chan<- error,
+) func() error {
+	return func() error {
+		l, err := c.Listen("tcp", f.laddr)
+		if nil != err {
+			return err
+		}
+		context.AfterFunc(ctx, func() { l.Close() })
+		f.limit.SetListener(l)
+		state.AddListener(l, f, relistener(ctx, c, d, f, localWG, ec))
+		go forwardPort(ctx, l, d, f, localWG, ec)
+		return nil
+	}
+}
+
+/* handoffToken is the token for the old instance's control socket, if it
+needs one */
+var handoffToken []byte
+
+/* controlCall sends a command to the control socket at path, using
+handoffToken, and returns the response, or an error if the command failed. */
+func controlCall(path string, args ...string) ([]byte, error) {
+	var b bytes.Buffer
+	err := SendControl(path, handoffToken, &b, args)
+	if nil != err {
+		return nil, err
+	}
+	if bytes.HasPrefix(b.Bytes(), []byte("Error: ")) {
+		return nil, errors.New(strings.TrimSpace(
+			strings.TrimPrefix(b.String(), "Error: "),
+		))
+	}
+	return b.Bytes(), nil
+}
+
+/* SamePath returns true if a and b name the same file, as far as can be told
+without looking at the filesystem. */
+func SamePath(a, b string) bool {
+	aa, aerr := filepath.Abs(a)
+	ba, berr := filepath.Abs(b)
+	if nil != aerr || nil != berr {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return aa == ba
+}
+
+/* HandoffConfig gets the configuration from the instance with the control
+socket at path and applies it, without overriding flags already set.  The
+instance's forwarding specifications are returned along with args. */
+func HandoffConfig(path string, args []string) ([]string, error) {
+	b, err := controlCall(path, "config")
+	if nil != err {
+		return nil, err
+	}
+	return applyConfig(b, args)
+}
+
+/* HandoffRelease asks the instance with the control socket at path to
+release its remote forward f, just before we listen in its place. */
+func HandoffRelease(path string, f fwdspec) error {
+	b, err := controlCall(path, "release", f.spec)
+	if nil != err {
+		return err
+	}
+	logOld(b)
+	return nil
+}
+
+/* takeOver has the instance from which c's taking over, if any, release the
+R forward f, so we can listen in its place. */
+func (c *Chain) takeOver(f fwdspec) error {
+	if "" == c.Handoff {
+		return nil
+	}
+	if err := HandoffRelease(c.Handoff, f); nil != err {
+		return fmt.Errorf(
+			"taking over %v from old instance: %w",
+			withLabel(f.spec, f.label),
+			err,
+		)
+	}
+	return nil
+}
+
+/* HandoffReclaim asks the instance with the control socket at path to listen
+again for the remote forwards it released, as we've failed to take over. */
+func HandoffReclaim(path string) {
+	b, err := controlCall(path, "reclaim")
+	if nil != err {
+		log.Printf("Unable to have old instance reclaim forwards: %v", err)
+		return
+	}
+	logOld(b)
+}
+
+/* logOld logs the lines in b, the output of a command sent to the old
+instance */
+func logOld(b []byte) {
+	for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if "" != l {
+			log.Printf("Old instance: %v", l)
+		}
+	}
+}
+
+/* HandoffShutdown asks the instance with the control socket at path to shut
+down, now that we've taken over. */
+func HandoffShutdown(path string) {
+	b, err := controlCall(path, "shutdown", "confirm")
+	if nil != err {
+		log.Printf("Unable to shut down old instance: %v", err)
+		return
+	}
+	logOld(b)
+}
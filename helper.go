@@ -0,0 +1,155 @@
+package main
+
+/*
+ * helper.go
+ * Helper which runs on the exit jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+/* maxHelperMsg is the largest framed message either side will accept */
+const maxHelperMsg = 1024 * 1024
+
+/* helperMsg is a request to or response from the helper.  Responses have the
+same ID as the request. */
+type helperMsg struct {
+	ID      uint32
+	Op      string        `json:",omitempty"`
+	Addr    string        `json:",omitempty"`
+	Src     string        `json:",omitempty"`
+	Data    []byte        `json:",omitempty"`
+	Timeout time.Duration `json:",omitempty"`
+	RTT     time.Duration `json:",omitempty"`
+	Err     string        `json:",omitempty"`
+}
+
+/* writeHelperMsg sends a length-prefixed m to w */
+func writeHelperMsg(w io.Writer, m helperMsg) error {
+	b, err := json.Marshal(m)
+	if nil != err {
+		return err
+	}
+	b = append(make([]byte, 4, 4+len(b)), b...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err = w.Write(b)
+	return err
+}
+
+/* readHelperMsg reads a length-prefixed message from r */
+func readHelperMsg(r io.Reader) (helperMsg, error) {
+	var m helperMsg
+	lb := make([]byte, 4)
+	if _, err := io.ReadFull(r, lb); nil != err {
+		return m, err
+	}
+	l := binary.BigEndian.Uint32(lb)
+	if maxHelperMsg < l {
+		return m, fmt.Errorf("message too large (%v bytes)", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); nil != err {
+		return m, err
+	}
+	err := json.Unmarshal(b, &m)
+	return m, err
+}
+
+/* HelperMain is the entry point for the helper subcommand, which is run on
+the exit jump and services requests from stdin, sending responses to
+stdout. */
+func HelperMain(args []string) {
+	fs := flag.NewFlagSet("helper", flag.ExitOnError)
+	rm := fs.Bool("rm", false, "Remove the helper's binary on start")
+	fs.Parse(args)
+	SetLogOutput(os.Stderr)
+
+	/* Don't leave ourselves lying around */
+	if *rm {
+		if p, err := os.Executable(); nil == err {
+			os.Remove(p)
+		}
+	}
+
+	var wL sync.Mutex
+	for {
+		req, err := readHelperMsg(os.Stdin)
+		if io.EOF == err {
+			return
+		} else if nil != err {
+			log.Fatalf("Reading request: %v", err)
+		}
+		go func() {
+			res := handleHelperMsg(req)
+			res.ID = req.ID
+			wL.Lock()
+			defer wL.Unlock()
+			if err := writeHelperMsg(os.Stdout, res); nil != err {
+				log.Fatalf("Sending response: %v", err)
+			}
+		}()
+	}
+}
+
+/* handleHelperMsg services a single request */
+func handleHelperMsg(req helperMsg) helperMsg {
+	var (
+		res helperMsg
+		err error
+	)
+	switch req.Op {
+	case "hello":
+		res.Data = []byte(runtime.GOOS + "/" + runtime.GOARCH)
+	case "udp":
+		res.Data, err = helperUDP(req.Addr, req.Data, req.Timeout)
+	case "ping":
+		res.RTT, err = helperPing(req.Addr, req.Timeout)
+	case "tcpmd5", "tcp":
+		res.Addr, err = helperDialTCP(
+			req.Addr,
+			req.Data,
+			req.Src,
+			req.Timeout,
+		)
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if nil != err {
+		res.Err = err.Error()
+	}
+	return res
+}
+
+/* helperUDP sends b to addr over UDP and returns the first reply received
+before to elapses. */
+func helperUDP(addr string, b []byte, to time.Duration) ([]byte, error) {
+	c, err := net.DialTimeout("udp", addr, to)
+	if nil != err {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(to))
+	if _, err := c.Write(b); nil != err {
+		return nil, err
+	}
+	rb := make([]byte, 65536)
+	n, err := c.Read(rb)
+	if nil != err {
+		return nil, err
+	}
+	return rb[:n], nil
+}
@@ -0,0 +1,255 @@
+package main
+
+/*
+ * helperclient.go
+ * Deploy and talk to the helper on the exit jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* HELPERTIMEOUT is how long to wait for the helper to say hello */
+const HELPERTIMEOUT = 30 * time.Second
+
+/* helperClient talks to a helper running on the exit jump */
+type helperClient struct {
+	sess *ssh.Session
+	w    io.Writer
+	wL   sync.Mutex
+
+	pending map[uint32]chan helperMsg
+	nextID  uint32
+	err     error /* Set when the helper's gone */
+	pL      sync.Mutex
+}
+
+/* StartHelper starts a helper on the exit jump c.  If local isn't empty, it
+names a helper binary (i.e. sshjump compiled for the exit jump's platform)
+which will be uploaded to remote, or a random name in /tmp if remote is empty.
+An uploaded helper removes itself once it's started.  If local is empty, remote
+names an already-present helper. */
+func StartHelper(c *ssh.Client, local, remote string) (*helperClient, error) {
+	/* Upload the helper if we have one */
+	var rmFlag string
+	if "" != local {
+		if "" == remote {
+			b := make([]byte, 8)
+			if _, err := rand.Read(b); nil != err {
+				return nil, err
+			}
+			remote = "/tmp/." + hex.EncodeToString(b)
+		}
+		if err := uploadHelper(c, local, remote); nil != err {
+			return nil, fmt.Errorf("uploading helper: %v", err)
+		}
+		log.Printf("Uploaded helper %v to %v", local, remote)
+		rmFlag = " -rm"
+	}
+	if "" == remote {
+		return nil, errors.New("no helper to run")
+	}
+
+	/* Fire it up */
+	s, err := c.NewSession()
+	if nil != err {
+		return nil, err
+	}
+	h := &helperClient{sess: s, pending: make(map[uint32]chan helperMsg)}
+	if h.w, err = s.StdinPipe(); nil != err {
+		s.Close()
+		return nil, err
+	}
+	r, err := s.StdoutPipe()
+	if nil != err {
+		s.Close()
+		return nil, err
+	}
+	s.Stderr = os.Stderr
+	if err := s.Start(shellQuote(remote) + " helper" + rmFlag); nil != err {
+		s.Close()
+		return nil, err
+	}
+	go h.readResponses(r)
+
+	/* Make sure it's alive */
+	res, err := h.call(helperMsg{Op: "hello"}, HELPERTIMEOUT)
+	if nil != err {
+		h.Close()
+		return nil, err
+	}
+	log.Printf("Helper running on %s", res.Data)
+
+	return h, nil
+}
+
+/* uploadHelper copies the file named local to remote via c */
+func uploadHelper(c *ssh.Client, local, remote string) error {
+	f, err := os.Open(local)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	s, err := c.NewSession()
+	if nil != err {
+		return err
+	}
+	defer s.Close()
+	s.Stdin = f
+	q := shellQuote(remote)
+	o, err := s.CombinedOutput(
+		"umask 077 && cat >" + q + " && chmod 700 " + q,
+	)
+	if nil != err && 0 != len(o) {
+		err = fmt.Errorf("%v (%q)", err, o)
+	}
+	return err
+}
+
+/* readResponses reads responses from r and sends them to whoever is waiting
+for them. */
+func (h *helperClient) readResponses(r io.Reader) {
+	for {
+		m, err := readHelperMsg(r)
+		h.pL.Lock()
+		if nil != err {
+			/* Helper's dead, tell everybody */
+			h.err = fmt.Errorf("helper gone: %v", err)
+			for id, ch := range h.pending {
+				close(ch)
+				delete(h.pending, id)
+			}
+			h.pL.Unlock()
+			return
+		}
+		ch, ok := h.pending[m.ID]
+		delete(h.pending, m.ID)
+		h.pL.Unlock()
+		if ok {
+			ch <- m
+		}
+	}
+}
+
+/* call sends req to the helper and waits up to to for the response */
+func (h *helperClient) call(req helperMsg, to time.Duration) (
+	helperMsg,
+	error,
+) {
+	/* Register to get the response */
+	ch := make(chan helperMsg, 1)
+	h.pL.Lock()
+	if nil != h.err {
+		h.pL.Unlock()
+		return helperMsg{}, h.err
+	}
+	h.nextID++
+	req.ID = h.nextID
+	h.pending[req.ID] = ch
+	h.pL.Unlock()
+	defer func() {
+		h.pL.Lock()
+		delete(h.pending, req.ID)
+		h.pL.Unlock()
+	}()
+
+	/* Send the request */
+	h.wL.Lock()
+	err := writeHelperMsg(h.w, req)
+	h.wL.Unlock()
+	if nil != err {
+		return helperMsg{}, err
+	}
+
+	/* Wait for the response */
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			h.pL.Lock()
+			defer h.pL.Unlock()
+			return helperMsg{}, h.err
+		}
+		if "" != res.Err {
+			return res, errors.New(res.Err)
+		}
+		return res, nil
+	case <-time.After(to):
+		return helperMsg{}, fmt.Errorf("timeout")
+	}
+}
+
+/* UDP sends b to addr from the exit jump and returns the first reply
+received within to. */
+func (h *helperClient) UDP(addr string, b []byte, to time.Duration) (
+	[]byte,
+	error,
+) {
+	res, err := h.call(
+		helperMsg{Op: "udp", Addr: addr, Data: b, Timeout: to},
+		to+HELPERTIMEOUT,
+	)
+	return res.Data, err
+}
+
+/* Ping pings addr from the exit jump and returns the round trip time */
+func (h *helperClient) Ping(addr string, to time.Duration) (
+	time.Duration,
+	error,
+) {
+	res, err := h.call(
+		helperMsg{Op: "ping", Addr: addr, Timeout: to},
+		to+HELPERTIMEOUT,
+	)
+	return res.RTT, err
+}
+
+/* DialTCP has the helper connect to addr, with TCP MD5 signatures using key if
+it's not empty and from src if it's not empty, giving up after to.  The
+returned path names a Unix socket on the exit jump through which the
+connection may be used. */
+func (h *helperClient) DialTCP(addr, key, src string, to time.Duration) (
+	string,
+	error,
+) {
+	/* Helpers which predate source addresses only know tcpmd5, and would
+	ignore src */
+	op := "tcpmd5"
+	if "" != src {
+		op = "tcp"
+	}
+	res, err := h.call(
+		helperMsg{
+			Op:      op,
+			Addr:    addr,
+			Src:     src,
+			Data:    []byte(key),
+			Timeout: to,
+		},
+		to+HELPERTIMEOUT,
+	)
+	return res.Addr, err
+}
+
+/* Close stops the helper */
+func (h *helperClient) Close() error {
+	return h.sess.Close()
+}
+
+/* shellQuote quotes s for use as a single word in a POSIX shell */
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,145 @@
+package main
+
+/*
+ * hints.go
+ * Suggest fixes for common errors
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* errHint maps a (lowercase) substring of an error message to a suggestion
+for fixing it. */
+type errHint struct {
+	pattern string
+	hint    string
+}
+
+/* errHints are checked in order, so more specific patterns come first. */
+var errHints = []errHint{{
+	"administratively prohibited",
+	"server likely has AllowTcpForwarding no, or PermitOpen doesn't " +
+		"allow the target",
+}, {
+	"tcpip-forward request denied",
+	"server likely has AllowTcpForwarding no or local, or the port's " +
+		"already in use on the jump",
+}, {
+	"-strongcrypto allows none",
+	"jump only has older algorithms; upgrade it, don't use it, or " +
+		"drop -strongcrypto",
+}, {
+	"-strongcrypto refuses",
+	"the jump's algorithm options or -kex, -ciphers, -macs, or " +
+		"-hostkeyalgs chose algorithms -strongcrypto doesn't allow",
+}, {
+	"no common algorithm for key exchange",
+	"server only has key exchanges we won't use; check -denyalgs and " +
+		"kex=, or offer old ones with kex=+...",
+}, {
+	"no common algorithm for host key",
+	"server only has host key types we won't use; check -denyalgs " +
+		"and hostkeyalgs=, or offer old ones with hostkeyalgs=+...",
+}, {
+	"no common algorithm",
+	"server only has ciphers or MACs we won't use; check -denyalgs, " +
+		"ciphers=, and macs=, or offer old ones with ciphers=+...",
+}, {
+	"host key changed",
+	"jump's host key isn't the one pinned; it may have been " +
+		"reinstalled, or someone's in the middle.  Remove its line " +
+		"from the pin file if the change is expected",
+}, {
+	"host key not pinned",
+	"-hostkey strict only uses jumps in the pin file or with fp=; " +
+		"pin it with -hostkey accept-new or give its fp=",
+}, {
+	"host key not listed with fp=",
+	"jump's host key isn't one of its fp= fingerprints; check them " +
+		"against ssh-keygen -lf on the jump, or someone's in the " +
+		"middle",
+}, {
+	"tls: failed to verify certificate",
+	"exit's TLS may be intercepted, or the certificate isn't trusted " +
+		"here; -exitcert checks a certificate's hash instead",
+}, {
+	"no tor socks port found",
+	"a .onion first jump needs Tor running; start it or give its " +
+		"SOCKS port with -tor",
+}, {
+	"unable to authenticate",
+	"wrong password or key, or the server doesn't allow that sort of " +
+		"auth; -fixcreds can ask for new credentials",
+}, {
+	"refusing server version",
+	"jump's version matched -denyversions",
+}, {
+	"refusing negotiated algorithm",
+	"jump negotiated something in -denyalgs",
+}, {
+	"handshake failed: eof",
+	"server hung up before authentication; it may be rate-limiting " +
+		"(MaxStartups) or blocking our address",
+}, {
+	"connection reset by peer",
+	"something in the way, maybe a firewall, reset the connection",
+}, {
+	"connection refused",
+	"nothing's listening on the target port",
+}, {
+	"no route to host",
+	"target's network is unreachable from where it's being dialed",
+}, {
+	"network is unreachable",
+	"target's network is unreachable from where it's being dialed",
+}, {
+	"no such host",
+	"hostname didn't resolve; check for typos, or use an IP address",
+}, {
+	"address already in use",
+	"something's already listening there; pick another port, or -handoff " +
+		"from the old instance",
+}, {
+	"bind: permission denied",
+	"ports below 1024 usually need root",
+}, {
+	"i/o timeout",
+	"target didn't answer in time; it may be firewalled",
+}, {
+	"context deadline exceeded",
+	"exit jump didn't connect to the target in time (see -dialto)",
+}, {
+	"timeout",
+	"jump didn't answer in time; it may be down, firewalled, or slow " +
+		"(see -connto and -hsto)",
+}}
+
+/* Hint returns a suggestion for fixing err, or the empty string if we don't
+have one. */
+func Hint(err error) string {
+	if nil == err {
+		return ""
+	}
+	m := strings.ToLower(err.Error())
+	for _, h := range errHints {
+		if strings.Contains(m, h.pattern) {
+			return h.hint
+		}
+	}
+	return ""
+}
+
+/* Hinted returns err's message, with a hint from Hint appended if there is
+one.  It's meant for logging. */
+func Hinted(err error) string {
+	h := Hint(err)
+	if "" == h {
+		return err.Error()
+	}
+	return fmt.Sprintf("%v (hint: %v)", err, h)
+}
@@ -0,0 +1,109 @@
+package main
+
+/*
+ * hostkeylog.go
+ * Record the host keys jumps present
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* hostKeyEvent is a host key presented by a jump */
+type hostKeyEvent struct {
+	Time        time.Time
+	Depth       int /* Jump's place in the chain, from 1 */
+	User        string
+	Host        string
+	Label       string `json:",omitempty"`
+	Type        string
+	Fingerprint string /* SHA256, as with fp= */
+	MD5         string
+	Key         string /* As in authorized_keys */
+	Accepted    bool
+	Detail      string `json:",omitempty"` /* Why it wasn't accepted */
+}
+
+/* hostKeyLog writes host key events, if we're recording them */
+var hostKeyLog struct {
+	l   sync.Mutex
+	enc *json.Encoder
+}
+
+/* OpenHostKeyLog starts recording the host keys jumps present to the file
+named fname, which is appended to, one JSON object per line.  The returned
+function stops recording. */
+func OpenHostKeyLog(fname string) (func(), error) {
+	f, err := os.OpenFile(
+		fname,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if nil != err {
+		return nil, err
+	}
+	hostKeyLog.l.Lock()
+	defer hostKeyLog.l.Unlock()
+	hostKeyLog.enc = json.NewEncoder(f)
+	return func() {
+		hostKeyLog.l.Lock()
+		defer hostKeyLog.l.Unlock()
+		hostKeyLog.enc = nil
+		f.Close()
+	}, nil
+}
+
+/* RecordHostKey records key, presented by j at the given depth in the chain,
+if we're recording host keys.  err is the host key check's verdict. */
+func RecordHostKey(j jump, depth int, key ssh.PublicKey, err error) {
+	hostKeyLog.l.Lock()
+	defer hostKeyLog.l.Unlock()
+	if nil == hostKeyLog.enc {
+		return
+	}
+	ev := hostKeyEvent{
+		Time:        time.Now(),
+		Depth:       depth,
+		User:        j.username,
+		Host:        j.host,
+		Label:       j.label,
+		Type:        key.Type(),
+		Fingerprint: ssh.FingerprintSHA256(key),
+		MD5:         ssh.FingerprintLegacyMD5(key),
+		Key: strings.TrimSpace(
+			string(ssh.MarshalAuthorizedKey(key)),
+		),
+		Accepted: nil == err,
+	}
+	if nil != err {
+		ev.Detail = err.Error()
+	}
+	if err := hostKeyLog.enc.Encode(ev); nil != err {
+		log.Printf("Unable to record host key: %v", err)
+	}
+}
+
+/* RecordingHostKeys wraps cb, which checks j's host key, so the key and
+whether it was accepted are recorded with RecordHostKey. */
+func RecordingHostKeys(
+	j jump,
+	depth int,
+	cb ssh.HostKeyCallback,
+) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := cb(hostname, remote, key)
+		RecordHostKey(j, depth, key, err)
+		return err
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+/*
+ * httprewrite.go
+ * Lightweight rewriting of proxied HTTP requests
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	/* XFFADD adds the client's address to X-Forwarded-For */
+	XFFADD = "add"
+	/* XFFSTRIP removes X-Forwarded-For entirely */
+	XFFSTRIP = "strip"
+)
+
+/* countingWriter counts the bytes written to the underlying writer */
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+/* Write writes b to the underlying writer and updates the count */
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+/* proxyHTTP is like proxy, but parses the bytes from src as HTTP requests and
+rewrites their headers according to f before sending them to dst.  The address
+of the client, ca, is used for X-Forwarded-For.  Once a request which changes
+protocols (i.e. CONNECT or an Upgrade) is seen, the remaining bytes are copied
+unaltered. */
+func proxyHTTP(
+	dst io.Writer,
+	src io.Reader,
+	ca net.Addr,
+	f fwdspec,
+	n *int64,
+	err *error,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+	cw := &countingWriter{w: dst}
+	defer func() { *n = cw.n }()
+	br := bufio.NewReader(src)
+
+	for {
+		/* Wait for the next request */
+		if _, *err = br.Peek(1); nil != *err {
+			if io.EOF == *err {
+				*err = nil
+			}
+			return
+		}
+		req, rerr := http.ReadRequest(br)
+		if nil != rerr {
+			*err = fmt.Errorf("parsing HTTP request: %v", rerr)
+			return
+		}
+		rewriteRequest(req, ca, f)
+		if *err = writeRequest(cw, req); nil != *err {
+			return
+		}
+		/* After a protocol switch, it's just bytes */
+		if "CONNECT" == req.Method || "" != req.Header.Get("Upgrade") {
+			var m int64
+			m, *err = io.Copy(dst, br)
+			cw.n += m
+			return
+		}
+	}
+}
+
+/* rewriteRequest modifies req's headers according to f.  The client's address
+is given in ca. */
+func rewriteRequest(req *http.Request, ca net.Addr, f fwdspec) {
+	if "" != f.httpHost {
+		req.Host = f.httpHost
+	}
+	switch f.httpXFF {
+	case XFFSTRIP:
+		req.Header.Del("X-Forwarded-For")
+	case XFFADD:
+		h, _, err := net.SplitHostPort(ca.String())
+		if nil != err {
+			h = ca.String()
+		}
+		if p := req.Header.Get("X-Forwarded-For"); "" != p {
+			h = p + ", " + h
+		}
+		req.Header.Set("X-Forwarded-For", h)
+	}
+}
+
+/* writeRequest writes req to w in wire format.  Unlike req.Write, it leaves
+the headers alone other than Host and the framing headers.  The headers are
+sent before the body is read, so a server can answer an Expect: 100-continue
+itself. */
+func writeRequest(w io.Writer, req *http.Request) error {
+	chunked := 0 != len(req.TransferEncoding) &&
+		"chunked" == strings.ToLower(req.TransferEncoding[0])
+	/* Framing headers are rebuilt from what was parsed.  An explicit
+	Content-Length: 0 is kept, as some servers want one on a POST. */
+	_, hadCL := req.Header["Content-Length"]
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	if chunked {
+		req.Header.Set("Transfer-Encoding", "chunked")
+		/* ReadRequest moves the Trailer header to req.Trailer */
+		if 0 != len(req.Trailer) {
+			ts := make([]string, 0, len(req.Trailer))
+			for k := range req.Trailer {
+				ts = append(ts, k)
+			}
+			sort.Strings(ts)
+			req.Header.Set("Trailer", strings.Join(ts, ", "))
+		}
+	} else if 0 < req.ContentLength || hadCL {
+		req.Header.Set(
+			"Content-Length",
+			fmt.Sprintf("%v", req.ContentLength),
+		)
+	}
+
+	/* Request line and headers */
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(
+		bw,
+		"%v %v %v\r\nHost: %v\r\n",
+		req.Method,
+		req.RequestURI,
+		req.Proto,
+		req.Host,
+	)
+	if err := req.Header.Write(bw); nil != err {
+		return err
+	}
+	if _, err := bw.WriteString("\r\n"); nil != err {
+		return err
+	}
+	if err := bw.Flush(); nil != err {
+		return err
+	}
+
+	/* Body, if we have one */
+	var err error
+	switch {
+	case chunked:
+		cw := httputil.NewChunkedWriter(bw)
+		if _, err = io.Copy(cw, req.Body); nil != err {
+			break
+		}
+		if err = cw.Close(); nil != err {
+			break
+		}
+		/* Trailers are only known once the body's been read */
+		if err = req.Trailer.Write(bw); nil != err {
+			break
+		}
+		_, err = bw.WriteString("\r\n")
+	case 0 < req.ContentLength:
+		_, err = io.Copy(bw, req.Body)
+	}
+	if nil != err {
+		return err
+	}
+	return bw.Flush()
+}
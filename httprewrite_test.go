@@ -0,0 +1,182 @@
+package main
+
+/*
+ * httprewrite_test.go
+ * Tests for httprewrite.go
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteRequest(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		have string
+		want string
+	}{{
+		name: "no body",
+		have: "GET /x?y=z HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"User-Agent: kittens\r\n" +
+			"\r\n",
+		want: "GET /x?y=z HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"User-Agent: kittens\r\n" +
+			"\r\n",
+	}, {
+		name: "repeated headers",
+		have: "GET / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"X-A: 1\r\n" +
+			"X-A: 2\r\n" +
+			"\r\n",
+		want: "GET / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"X-A: 1\r\n" +
+			"X-A: 2\r\n" +
+			"\r\n",
+	}, {
+		name: "Content-Length: 0",
+		have: "POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Content-Length: 0\r\n" +
+			"\r\n",
+		want: "POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Content-Length: 0\r\n" +
+			"\r\n",
+	}, {
+		name: "body",
+		have: "POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Content-Length: 5\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			"hello",
+		want: "POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Content-Length: 5\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			"hello",
+	}, {
+		name: "chunked",
+		have: "POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n\r\n",
+		want: "POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n\r\n",
+	}, {
+		name: "chunked with trailers",
+		have: "POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Trailer: X-Sum, X-Count\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n" +
+			"X-Count: 1\r\n" +
+			"X-Sum: abc\r\n" +
+			"\r\n",
+		want: "POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Trailer: X-Count, X-Sum\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n" +
+			"X-Count: 1\r\n" +
+			"X-Sum: abc\r\n" +
+			"\r\n",
+	}} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(
+				strings.NewReader(c.have),
+			))
+			if nil != err {
+				t.Fatalf("Reading request: %v", err)
+			}
+			var b bytes.Buffer
+			if err := writeRequest(&b, req); nil != err {
+				t.Fatalf("Writing request: %v", err)
+			}
+			if got := b.String(); got != c.want {
+				t.Errorf(
+					"Incorrect request\n got: %q\nwant: %q",
+					got,
+					c.want,
+				)
+			}
+		})
+	}
+}
+
+func TestWriteRequestHeadersFirst(t *testing.T) {
+	/* Request with a body we control */
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+		"POST / HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Content-Length: 5\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n",
+	)))
+	if nil != err {
+		t.Fatalf("Reading request: %v", err)
+	}
+	br, bw := io.Pipe()
+	req.Body = br
+
+	/* The headers should come through before the body's sent */
+	or, ow := io.Pipe()
+	ech := make(chan error, 1)
+	go func() {
+		err := writeRequest(ow, req)
+		ow.CloseWithError(err)
+		ech <- err
+	}()
+	want := "POST / HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Content-Length: 5\r\n" +
+		"Expect: 100-continue\r\n" +
+		"\r\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(or, got); nil != err {
+		t.Fatalf("Reading headers: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("Incorrect headers\n got: %q\nwant: %q", got, want)
+	}
+
+	/* Now the body */
+	go func() {
+		bw.Write([]byte("hello"))
+		bw.Close()
+	}()
+	body, err := io.ReadAll(or)
+	if nil != err {
+		t.Fatalf("Reading body: %v", err)
+	}
+	if "hello" != string(body) {
+		t.Errorf("Incorrect body %q", body)
+	}
+	if err := <-ech; nil != err {
+		t.Errorf("Writing request: %v", err)
+	}
+}
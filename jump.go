@@ -5,17 +5,19 @@ package main
  * Reads the jumps from the jumpfile
  * By J. Stuart McMurray
  * Created 20170401
- * Last Modified 20170401
+ * Last Modified 20261017
  */
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
+	"unicode"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -23,66 +25,137 @@ import (
 /* KEYPREFIX is the password prefix to indicate a keyfile */
 const KEYPREFIX = "key:"
 
-/* JUMPRE parses lines of the jumpfile */
-var JUMPRE = regexp.MustCompile(`^([^@]+)@(\S+)\s+(.*)\s(SSH-\S+)$`)
+/* PKCS11PREFIX is the password prefix to indicate a PKCS#11 URI */
+const PKCS11PREFIX = "pkcs11:"
+
+/* LABELCOMMENT starts a jumpfile comment which labels the next jump */
+const LABELCOMMENT = "@label"
+
+/* Kinds of authentication which may be allowed with auth= */
+const (
+	AUTHKEY      = "key"      /* Publickey authentication */
+	AUTHPASSWORD = "password" /* Password and keyboard-interactive */
+)
+
+/* DEFVERSION is the version string used for jumps which don't have one */
+const DEFVERSION = "SSH-2.0-OpenSSH_8.9p1"
 
 /* jump represents an entry in the jumpfile */
 type jump struct {
 	username string
 	host     string
-	password string
+	password string /* Credential, unless it's a plain password */
+	secret   []byte /* Plain password from the jumpfile */
+	pw       []byte /* Password got at connect time, wiped once used */
+	cred     int    /* Place on its jumpfile line, 0 for the password */
 	version  string
 	key      ssh.Signer
+	vrf      string   /* VRF from which to connect, if first */
+	label    string   /* Operator's note, for humans */
+	line     int      /* Line number in the jumpfile */
+	alias    string   /* Alias from which host came, if it did */
+	defVer   bool     /* No version in the jumpfile */
+	alts     []jump   /* More credentials to try in order, from cred= */
+	auth     []string /* Allowed kinds of authentication, from auth= */
+	fps      []string /* Allowed host key fingerprints, from fp= */
+
+	algs map[string]string /* Algorithm lists by kind, from kex= etc. */
 }
 
-/* ReadJumps reads the jumpfile and returns the jumps */
-func ReadJumps(fname string, keydir string) ([]jump, error) {
+/* ReadJumps reads the jumpfile and returns the jumps as well as the proxy
+through which to egress after the last jump, if the last line of the jumpfile
+is a proxy URL. */
+func ReadJumps(fname string, keydir string) ([]jump, *exitProxy, error) {
 	/* Slurp the jumpfile */
 	jf, err := ioutil.ReadFile(fname)
 	if nil != err {
-		return nil, err
+		return nil, nil, err
 	}
 
-	/* Split into lines */
+	/* Split into lines.  Plain passwords end up in the jumps' secrets,
+	which can be wiped; the strings parsed along the way can't be, but
+	aren't kept. */
+	defer wipe(jf)
 	ls := strings.Split(string(jf), "\n")
 
 	/* Parse into jumps */
-	var js []jump
-	for _, l := range ls {
+	var (
+		js    []jump
+		xp    *exitProxy
+		pn    int    /* Proxy's line number */
+		label string /* From a label comment */
+	)
+	for n, l := range ls {
 		l = strings.TrimSpace(l)
-		/* Ignore blanks and comments */
-		if "" == l || strings.HasPrefix(l, "#") {
+		/* Ignore blanks and comments, but not labels */
+		if strings.HasPrefix(l, "#") {
+			c := strings.Fields(l[1:])
+			if 0 != len(c) && LABELCOMMENT == c[0] {
+				label = strings.Join(c[1:], " ")
+			}
 			continue
 		}
-		/* Grow the list of jumps */
-		ms := JUMPRE.FindStringSubmatch(l)
-		if nil == ms {
-			log.Printf("Invalid line in jump file: %q", l)
-		}
-		j := jump{
-			username: ms[1],
-			host:     ms[2],
-			password: ms[3],
-			version:  ms[4],
-		}
-		/* Handle a possible key */
-		if strings.HasPrefix(j.password, KEYPREFIX) {
-			kf := strings.TrimPrefix(
-				j.password,
-				KEYPREFIX,
+		if "" == l {
+			continue
+		}
+		/* A proxy may only be the last thing in the file */
+		if nil != xp {
+			log.Printf(
+				"Ignoring proxy on line %v of jump file, as "+
+					"it's not the last line",
+				pn,
 			)
-			key, err := getKey(keydir, kf)
+			xp = nil
+		}
+		if isProxyLine(l) {
+			p, err := parseExitProxy(l)
 			if nil != err {
 				log.Printf(
-					"Unable to retreive key for "+
-						"%v@%v from %v: %v",
+					"Invalid proxy on line %v in jump "+
+						"file: %v",
+					n+1,
+					err,
+				)
+				continue
+			}
+			xp, pn = p, n+1
+			label = ""
+			continue
+		}
+		/* Grow the list of jumps */
+		j, err := parseJumpLine(l)
+		if nil != err {
+			log.Printf("Invalid line %v in jump file: %v", n+1, err)
+			continue
+		}
+		j.line = n + 1
+		takeSecret(&j)
+		for i := range j.alts {
+			takeSecret(&j.alts[i])
+		}
+		AddJumpSecrets(j)
+		if "" == j.label {
+			j.label = label
+		}
+		label = ""
+		/* Handle possible keys */
+		if err := setJumpKey(&j, keydir); nil != err {
+			log.Printf(
+				"Unable to retreive key for %v@%v: %v",
+				j.username,
+				j.host,
+				err,
+			)
+		}
+		for i := range j.alts {
+			if err := setJumpKey(&j.alts[i], keydir); nil != err {
+				log.Printf(
+					"Unable to retreive cred= key for "+
+						"%v@%v: %v",
 					j.username,
 					j.host,
-					kf,
 					err,
 				)
-			} else {
-				j.key = key
 			}
 		}
 		/* Add it to the list */
@@ -90,10 +163,312 @@ func ReadJumps(fname string, keydir string) ([]jump, error) {
 		continue
 	}
 	if 0 == len(js) {
-		return nil, fmt.Errorf("no jumps in %v", fname)
+		return nil, nil, fmt.Errorf("no jumps in %v", fname)
+	}
+
+	return js, xp, nil
+}
+
+/* takeSecret moves j's password to j.secret if it's a plain password, and
+not a key file, some other sort of credential, or a reference to one.  Unlike
+the password, the secret can be wiped. */
+func takeSecret(j *jump) {
+	if PROMPTPASSWORD == j.password || AGENTCRED == j.password {
+		return
+	}
+	if p, _ := splitCred(j.password); "" != p {
+		return
 	}
+	j.secret = append([]byte{}, j.password...)
+	j.password = ""
+}
 
-	return js, nil
+/* credText returns c's password or cred= credential as it'd appear in the
+jumpfile. */
+func credText(c jump) string {
+	if nil != c.secret {
+		return string(c.secret)
+	}
+	return c.password
+}
+
+/* parseJumpLine parses a line of the jumpfile, of the form
+user@host password [version] [key=value...].  The password may be quoted with
+double quotes, in which case a backslash escapes the next character, or with
+single quotes, in which case nothing is special.  Unquoted passwords are taken
+as-is, spaces and all, for compatibility with older jumpfiles, up to the last
+word starting with SSH-, which starts the version.  Unquoted passwords with
+such a word need quoting.  Options may only follow an unquoted password if
+there's a version.  The version may have comments, as in
+SSH-2.0-OpenSSH_8.9p1 Ubuntu-3.  If the version is omitted, DEFVERSION is
+used.  If there's no password at all, it's set to PROMPTPASSWORD, to ask the
+operator. */
+func parseJumpLine(l string) (jump, error) {
+	var j jump
+
+	/* Who and where */
+	uh := l
+	rest := ""
+	if i := strings.IndexFunc(l, unicode.IsSpace); -1 != i {
+		uh, rest = l[:i], strings.TrimSpace(l[i:])
+	}
+	i := strings.Index(uh, "@")
+	if 0 >= i || len(uh)-1 == i {
+		return j, fmt.Errorf("no user@host in %q", uh)
+	}
+	j.username, j.host = uh[:i], uh[i+1:]
+
+	/* No password at all means ask */
+	if "" == rest {
+		j.password = PROMPTPASSWORD
+		j.version = DEFVERSION
+		j.defVer = true
+		return j, nil
+	}
+
+	/* Password, version, and options */
+	if strings.HasPrefix(rest, `"`) || strings.HasPrefix(rest, "'") {
+		var err error
+		if j.password, rest, err = unquotePassword(rest); nil != err {
+			return j, err
+		}
+		fs := strings.Fields(rest)
+		if 0 != len(fs) && strings.HasPrefix(fs[0], "SSH-") {
+			j.version, fs = splitVersion(fs)
+		}
+		for _, f := range fs {
+			if err := setJumpOpt(&j, f); nil != err {
+				return j, err
+			}
+		}
+	} else {
+		/* Unquoted passwords may have spaces and equals signs, so
+		the version's the last word which looks like one and
+		options only count after it. */
+		j.password = rest
+		for r := rest; ; {
+			i := strings.LastIndexFunc(r, unicode.IsSpace)
+			if -1 == i {
+				break
+			}
+			if !strings.HasPrefix(r[i+1:], "SSH-") {
+				r = strings.TrimRightFunc(
+					r[:i],
+					unicode.IsSpace,
+				)
+				continue
+			}
+			j.password = strings.TrimSpace(r[:i])
+			var opts []string
+			j.version, opts = splitVersion(
+				strings.Fields(rest[i+1:]),
+			)
+			for _, o := range opts {
+				if err := setJumpOpt(&j, o); nil != err {
+					return j, err
+				}
+			}
+			break
+		}
+	}
+	if "" == j.version {
+		j.version = DEFVERSION
+		j.defVer = true
+	}
+
+	return j, nil
+}
+
+/* splitVersion splits fs, the fields of a jumpfile line from the version on,
+into the version, with its comments, and the options after it.  Every
+key=value word after the version is taken as an option, known or not, so a
+mistyped option is an error and not part of the version. */
+func splitVersion(fs []string) (string, []string) {
+	n := 1
+	for n < len(fs) && !strings.Contains(fs[n], "=") {
+		n++
+	}
+	return strings.Join(fs[:n], " "), fs[n:]
+}
+
+/* setJumpKey loads the key named by j's password, if it starts with
+KEYPREFIX or PKCS11PREFIX.  If the key can't be loaded, j.key is nil and the
+password is assumed to really be a password. */
+func setJumpKey(j *jump, keydir string) error {
+	j.key = nil
+	if strings.HasPrefix(j.password, PKCS11PREFIX) {
+		key, err := getPKCS11Key(j.password)
+		if nil != err {
+			return fmt.Errorf("from PKCS#11: %v", err)
+		}
+		j.key = key
+		return nil
+	}
+	if !strings.HasPrefix(j.password, KEYPREFIX) {
+		return nil
+	}
+	kf := strings.TrimPrefix(j.password, KEYPREFIX)
+	key, err := getKey(keydir, kf)
+	if nil != err {
+		return fmt.Errorf("from %v: %v", kf, err)
+	}
+	j.key = key
+	return nil
+}
+
+/* formatJumpLine turns j back into a jumpfile line, with the password
+double-quoted.  Credentials reordered by -lrucreds are put back in the
+jumpfile's order.  A version which wasn't in the jumpfile is left out, so
+-randversions still picks one for j. */
+func formatJumpLine(j jump) string {
+	cs := append([]jump{j}, j.alts...)
+	sort.SliceStable(cs, func(a, b int) bool {
+		return cs[a].cred < cs[b].cred
+	})
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	l := fmt.Sprintf(
+		"%v@%v \"%v\"",
+		j.username,
+		j.host,
+		r.Replace(credText(cs[0])),
+	)
+	j.alts = cs[1:]
+	if !j.defVer {
+		l += " " + j.version
+	}
+	if "" != j.vrf {
+		l += " vrf=" + j.vrf
+	}
+	for _, a := range j.alts {
+		l += " cred=" + credText(a)
+	}
+	if 0 != len(j.auth) {
+		l += " auth=" + strings.Join(j.auth, ",")
+	}
+	for _, fp := range j.fps {
+		l += " fp=" + fp
+	}
+	l += formatAlgOpts(j)
+	/* Labels with spaces come from comments, which stay put */
+	if "" != j.label && -1 == strings.IndexFunc(j.label, unicode.IsSpace) {
+		l += " label=" + j.label
+	}
+	return l
+}
+
+/* isJumpOpt returns true if s looks like a jumpfile option */
+func isJumpOpt(s string) bool {
+	switch strings.SplitN(s, "=", 2)[0] {
+	case "vrf", "label", "cred", "auth", "fp":
+		return strings.Contains(s, "=")
+	default:
+		return isAlgKind(strings.SplitN(s, "=", 2)[0]) &&
+			strings.Contains(s, "=")
+	}
+}
+
+/* setJumpOpt sets the jumpfile option o, of the form key=value, in j */
+func setJumpOpt(j *jump, o string) error {
+	if !isJumpOpt(o) {
+		if strings.Contains(o, "=") {
+			return fmt.Errorf(
+				"unknown option %q",
+				strings.SplitN(o, "=", 2)[0],
+			)
+		}
+		return fmt.Errorf("unexpected %q after password", o)
+	}
+	kv := strings.SplitN(o, "=", 2)
+	switch kv[0] {
+	case "vrf":
+		j.vrf = kv[1]
+	case "label":
+		j.label = kv[1]
+	case "cred":
+		if "" == kv[1] {
+			return fmt.Errorf("empty cred")
+		}
+		j.alts = append(j.alts, jump{
+			password: kv[1],
+			cred:     len(j.alts) + 1,
+		})
+	case "auth":
+		j.auth = nil
+		for _, a := range strings.Split(kv[1], ",") {
+			switch a {
+			case AUTHKEY, AUTHPASSWORD:
+				j.auth = append(j.auth, a)
+			default:
+				return fmt.Errorf("unknown auth %q", a)
+			}
+		}
+	case "fp":
+		if !strings.HasPrefix(kv[1], FPPREFIX) {
+			return fmt.Errorf(
+				"fingerprint %q doesn't start with %v",
+				kv[1],
+				FPPREFIX,
+			)
+		}
+		j.fps = append(j.fps, kv[1])
+	default: /* Algorithms */
+		if _, err := ParseAlgs(kv[0], kv[1]); nil != err {
+			return err
+		}
+		if nil == j.algs {
+			j.algs = make(map[string]string)
+		}
+		j.algs[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+/* Allows returns true if j may try authentication of the kind auth, which
+should be AUTHKEY or AUTHPASSWORD.  Without auth=, everything's allowed. */
+func (j jump) Allows(auth string) bool {
+	if 0 == len(j.auth) {
+		return true
+	}
+	for _, a := range j.auth {
+		if auth == a {
+			return true
+		}
+	}
+	return false
+}
+
+/* unquotePassword removes the quoted password from the start of s and returns
+it, unquoted, as well as the rest of s. */
+func unquotePassword(s string) (pw, rest string, err error) {
+	q := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case q == c:
+			rest = s[i+1:]
+			if "" != rest && !unicode.IsSpace(rune(rest[0])) {
+				return "", "", fmt.Errorf(
+					"unexpected %q after quoted password",
+					rest[0],
+				)
+			}
+			return b.String(), rest, nil
+		case '\\' == c && '"' == q && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated %c-quoted password", q)
+}
+
+/* withLabel appends label to s in square brackets, if there's a label */
+func withLabel(s, label string) string {
+	if "" == label {
+		return s
+	}
+	return s + " [" + label + "]"
 }
 
 /* shuffleJumps shuffles a slice of jumps */
@@ -105,8 +480,14 @@ func ShuffleJumps(s []jump) {
 }
 
 /* getKey tries to get the key named keyname.  If it is a relative path, it
-will be searched for in keydir. */
+will be searched for in keydir.  Encrypted keys are decrypted with a passphrase
+from passphrases.  Security keys are used via ssh-agent.  A keyfile of
+KEYSTDIN means the key's read from stdin. */
 func getKey(keydir, keyfile string) (ssh.Signer, error) {
+	/* Piped-in keys don't have a file */
+	if KEYSTDIN == keyfile {
+		return StdinKey()
+	}
 	/* Work out where the file should be */
 	if !filepath.IsAbs(keyfile) {
 		keyfile = filepath.Join(keydir, keyfile)
@@ -116,7 +497,43 @@ func getKey(keydir, keyfile string) (ssh.Signer, error) {
 	if nil != err {
 		return nil, err
 	}
+	defer wipe(b)
+	return parseKey(keyfile, b)
+}
+
+/* parseKey turns the key in b into a signer.  The key came from keyfile, or
+something described by keyfile, which is used when asking for a passphrase and
+remembering it. */
+func parseKey(keyfile string, b []byte) (ssh.Signer, error) {
+	/* Security keys need the agent */
+	if pub, err := skPublicKey(b); nil == err {
+		return newAgentSigner(pub, keyfile)
+	}
+	/* PuTTY keys are special */
+	if isPPK(b) {
+		enc, err := ppkEncrypted(b)
+		if nil != err {
+			return nil, err
+		} else if !enc {
+			return parsePPK(b, nil)
+		}
+		return passphrases.Parse(keyfile, func(pp []byte) (
+			ssh.Signer,
+			error,
+		) {
+			return parsePPK(b, pp)
+		})
+	}
 	/* Turn it into a signer */
 	s, err := ssh.ParsePrivateKey(b)
+	var pme *ssh.PassphraseMissingError
+	if errors.As(err, &pme) {
+		return passphrases.Parse(keyfile, func(pp []byte) (
+			ssh.Signer,
+			error,
+		) {
+			return ssh.ParsePrivateKeyWithPassphrase(b, pp)
+		})
+	}
 	return s, err
 }
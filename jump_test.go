@@ -0,0 +1,246 @@
+package main
+
+/*
+ * jump_test.go
+ * Tests for jump.go
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJumpLine(t *testing.T) {
+	for _, c := range []struct {
+		line    string
+		want    jump
+		wantErr bool
+	}{{
+		line: "u@h",
+		want: jump{
+			username: "u",
+			host:     "h",
+			password: PROMPTPASSWORD,
+			version:  DEFVERSION,
+			defVer:   true,
+		},
+	}, {
+		line: "u@h pass",
+		want: jump{
+			username: "u",
+			host:     "h",
+			password: "pass",
+			version:  DEFVERSION,
+			defVer:   true,
+		},
+	}, {
+		/* Unquoted passwords keep their spaces */
+		line: "u@h  pass  word   SSH-2.0-x",
+		want: jump{
+			username: "u",
+			host:     "h",
+			password: "pass  word",
+			version:  "SSH-2.0-x",
+		},
+	}, {
+		/* Unquoted options only count after a version */
+		line: "u@h a=b vrf=red",
+		want: jump{
+			username: "u",
+			host:     "h",
+			password: "a=b vrf=red",
+			version:  DEFVERSION,
+			defVer:   true,
+		},
+	}, {
+		line: "u@h pw SSH-2.0-OpenSSH_8.9p1 Ubuntu-3 vrf=red label=x",
+		want: jump{
+			username: "u",
+			host:     "h",
+			password: "pw",
+			version:  "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3",
+			vrf:      "red",
+			label:    "x",
+		},
+	}, {
+		/* The last SSH- word starts the version */
+		line: "u@h SSH-pw SSH-2.0-x",
+		want: jump{
+			username: "u",
+			host:     "h",
+			password: "SSH-pw",
+			version:  "SSH-2.0-x",
+		},
+	}, {
+		line: `u@h "a \"b\" SSH-c" SSH-2.0-x`,
+		want: jump{
+			username: "u",
+			host:     "h",
+			password: `a "b" SSH-c`,
+			version:  "SSH-2.0-x",
+		},
+	}, {
+		line: `u@h 'a\b' vrf=red`,
+		want: jump{
+			username: "u",
+			host:     "h",
+			password: `a\b`,
+			version:  DEFVERSION,
+			vrf:      "red",
+			defVer:   true,
+		},
+	}, {
+		line: `u@h "" label=x`,
+		want: jump{
+			username: "u",
+			host:     "h",
+			version:  DEFVERSION,
+			label:    "x",
+			defVer:   true,
+		},
+	}, {
+		line:    "h",
+		wantErr: true,
+	}, {
+		line:    "@h pw",
+		wantErr: true,
+	}, {
+		line:    "u@ pw",
+		wantErr: true,
+	}, {
+		line:    `u@h "pw`,
+		wantErr: true,
+	}, {
+		line:    `u@h "pw"x`,
+		wantErr: true,
+	}, {
+		line:    `u@h "pw" junk`,
+		wantErr: true,
+	}, {
+		line:    "u@h pw SSH-2.0-x bogus=1",
+		wantErr: true,
+	}, {
+		line:    "u@h pw SSH-2.0-x cred=",
+		wantErr: true,
+	}} {
+		c := c
+		t.Run(c.line, func(t *testing.T) {
+			got, err := parseJumpLine(c.line)
+			if c.wantErr {
+				if nil == err {
+					t.Fatalf("No error, got %#v", got)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf(
+					"Incorrect jump\n got: %#v\nwant: %#v",
+					got,
+					c.want,
+				)
+			}
+		})
+	}
+}
+
+func TestSplitVersion(t *testing.T) {
+	for _, c := range []struct {
+		fs       []string
+		wantVer  string
+		wantOpts []string
+	}{{
+		fs:       []string{"SSH-2.0-x"},
+		wantVer:  "SSH-2.0-x",
+		wantOpts: []string{},
+	}, {
+		fs:       []string{"SSH-2.0-x", "Ubuntu-3", "FreeBSD"},
+		wantVer:  "SSH-2.0-x Ubuntu-3 FreeBSD",
+		wantOpts: []string{},
+	}, {
+		fs:       []string{"SSH-2.0-x", "vrf=red", "label=x"},
+		wantVer:  "SSH-2.0-x",
+		wantOpts: []string{"vrf=red", "label=x"},
+	}, {
+		/* Unknown options are still options */
+		fs:       []string{"SSH-2.0-x", "Ubuntu-3", "bogus=1", "y"},
+		wantVer:  "SSH-2.0-x Ubuntu-3",
+		wantOpts: []string{"bogus=1", "y"},
+	}} {
+		ver, opts := splitVersion(c.fs)
+		if ver != c.wantVer {
+			t.Errorf(
+				"splitVersion(%q): version %q, want %q",
+				c.fs,
+				ver,
+				c.wantVer,
+			)
+		}
+		if !reflect.DeepEqual(opts, c.wantOpts) {
+			t.Errorf(
+				"splitVersion(%q): options %q, want %q",
+				c.fs,
+				opts,
+				c.wantOpts,
+			)
+		}
+	}
+}
+
+func TestUnquotePassword(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		wantPW   string
+		wantRest string
+		wantErr  bool
+	}{
+		{s: `"pw"`, wantPW: "pw"},
+		{s: `"pw" SSH-2.0-x`, wantPW: "pw", wantRest: " SSH-2.0-x"},
+		{s: `"a b"`, wantPW: "a b"},
+		{s: `"a\"b"`, wantPW: `a"b`},
+		{s: `"a\\b"`, wantPW: `a\b`},
+		{s: `"a'b"`, wantPW: "a'b"},
+		{s: `'a\b'`, wantPW: `a\b`},
+		{s: `'a"b' x`, wantPW: `a"b`, wantRest: " x"},
+		{s: `""`, wantPW: ""},
+		{s: `"pw`, wantErr: true},
+		{s: `"pw\"`, wantErr: true},
+		{s: `'pw`, wantErr: true},
+		{s: `"pw"x`, wantErr: true},
+		{s: `'pw''`, wantErr: true},
+	} {
+		pw, rest, err := unquotePassword(c.s)
+		if c.wantErr {
+			if nil == err {
+				t.Errorf(
+					"unquotePassword(%s): no error, "+
+						"got %q and %q",
+					c.s,
+					pw,
+					rest,
+				)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("unquotePassword(%s): error: %v", c.s, err)
+			continue
+		}
+		if pw != c.wantPW || rest != c.wantRest {
+			t.Errorf(
+				"unquotePassword(%s): got %q and %q, "+
+					"want %q and %q",
+				c.s,
+				pw,
+				rest,
+				c.wantPW,
+				c.wantRest,
+			)
+		}
+	}
+}
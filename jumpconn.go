@@ -5,11 +5,12 @@ package main
  * Make connections between the jumps
  * By J. Stuart McMurray
  * Created 20170401
- * Last Modified 20170401
+ * Last Modified 20261017
  */
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -22,48 +23,213 @@ import (
 /* DEFPORT is the default SSH port */
 const DEFPORT = "22"
 
+/* Errors for when we give up */
+var (
+	errTimeout   = errors.New("timeout")
+	errInterrupt = errors.New("interrupt")
+)
+
+/* Exit test policies */
+const (
+	EXITREQUIRED = "required" /* Last jump must pass the exit test */
+	EXITADVISORY = "advisory" /* Exit test failures are only logged */
+	EXITSKIP     = "skip"     /* No exit test is made */
+)
+
+/* chainConfig holds the settings used when making the chain of jumps */
+type chainConfig struct {
+	njump      uint             /* Number of jumps, 0 for all */
+	connto     time.Duration    /* TCP connection timeout */
+	hsto       time.Duration    /* SSH handshake timeout */
+	kaint      time.Duration    /* Keepalive interval */
+	katimeout  time.Duration    /* Keepalive reply wait, 0 for forever */
+	exitTest   string           /* Exit test target */
+	exitPolicy string           /* Exit test policy */
+	exitWant   exitContent      /* What the exit test should find */
+	versions   *versionRotation /* Client versions overriding the jumps' */
+	breaker    *circuitBreaker  /* Skips hosts which keep timing out */
+	creds      *credUsage       /* Orders accounts on the same host */
+	aliases    *hostAliases     /* Hosts with several addresses */
+	firstHop   Dialer           /* Dials the first jump, or nil */
+	quality    *qualityPolicy   /* Refuses weak jumps */
+	fixer      *credFixer       /* Asks for new credentials, or nil */
+	exitCache  *exitCache       /* Remembers exit test results */
+	adjacency  adjacency        /* Which jumps can reach which */
+	keydir     string           /* Where to find keys named by secrets */
+	pins       *hostPins        /* Pinned host keys, or nil */
+	wireLog    string           /* Jump whose SSH messages to log */
+	helper     string           /* Helper binary for ICMP exit tests */
+	helperPath string           /* Remote helper path, as for -helperpath */
+}
+
+/* firstHopDialer returns the dialer to use for the first jump. */
+func (cc chainConfig) firstHopDialer() Dialer {
+	if nil == cc.firstHop {
+		return &net.Dialer{}
+	}
+	return cc.firstHop
+}
+
+/* firstHopVRF returns the dialer to use for a first jump in the VRF vrf. */
+func (cc chainConfig) firstHopVRF(vrf string) Dialer {
+	f, ok := cc.firstHop.(*firstHopDialer)
+	if !ok {
+		f = NewFirstHopDialer(false, "", "", "", nil)
+	}
+	return f.ForVRF(vrf)
+}
+
 /* makeSSHConns returs a list of ssh clients, of which each subsequent client
 connected to its server through the previous one (except the first one, of
-course).  It attempts to use the jumps in jumps in order, and will make njump
-connections, or use all the jumps if njump is zero.  If there's fewer working
-jumps than njump, all the connections are disconnected and an error is
-returned.  The context is checked before every connection attempt for an
-indication to stop.  Once the final jump has been established, a connection to
-exitTest is made to test for connectivity. */
+course).  It attempts to use the jumps in jumps in order, and will make
+cc.njump connections, or use all the jumps if cc.njump is zero.  If there's
+fewer working jumps than cc.njump, all the connections are disconnected and an
+error is returned.  The context is checked before every connection attempt for
+an indication to stop.  Once the final jump has been established, a connection
+to cc.exitTest is made to test for connectivity, subject to cc.exitPolicy. */
 func MakeSSHConns(
 	ctx context.Context,
 	jumps []jump,
-	njump uint,
-	connto time.Duration,
-	hsto time.Duration,
-	kaint time.Duration,
-	exitTest string,
+	cc chainConfig,
 	cancel context.CancelFunc,
 ) ([]*ssh.Client, error) {
 	var (
-		d  Dialer = &net.Dialer{}
-		cs []*ssh.Client
+		d    Dialer = cc.firstHopDialer()
+		cs   []*ssh.Client
+		hops []jump /* Jump for each of cs */
+		aj   jump   /* Jump being tried, with its credentials */
+		/* Account tried on each host, with -lrucreds */
+		picked = make(map[string]string)
+		/* Wrong passwords given for each of jumps, by index */
+		wrongPrompts = make(map[int]int)
 	)
-	for _, j := range jumps {
+	/* Passwords got for this build don't outlive it */
+	defer func() { WipePasswords(aj) }()
+	defer ForgetPasswords()
+	cc.creds.Order(jumps)
+	depths := cc.adjacency.Depths(jumps)
+	for i := 0; i < len(jumps); i++ {
+		j := jumps[i]
 		/* Make sure we're not meant to quit yet */
 		if nil != ctx.Err() {
 			CloseJumps(cs)
-			return nil, fmt.Errorf("interrupt")
+			return nil, errInterrupt
+		}
+		/* Rotated and random versions take precedence */
+		if v := cc.versions.For(j); "" != v {
+			j.version = v
+		}
+		/* Aliases get a different address each time */
+		if a := cc.aliases.Expand(j.host, func(addr string) bool {
+			return cc.breaker.Allow(addr)
+		}); a != j.host {
+			log.Printf("Trying %v for %v", a, j.host)
+			j.alias, j.host = j.host, a
 		}
-		cstr := fmt.Sprintf( /* Connection string */
+		cstr := withLabel(fmt.Sprintf( /* Connection string */
 			"%v@%v %v (%v)",
 			j.username,
 			j.host,
-			j.password,
+			RedactCred(j),
 			j.version,
-		)
+		), j.label)
 		/* Make sure the address has a port */
 		_, p, err := net.SplitHostPort(j.host)
 		if "" == p || nil != err {
 			j.host = net.JoinHostPort(j.host, DEFPORT)
 		}
-		/* Dial with the previous conn as the dialer */
-		c, err := dialWithTimeout(ctx, d, j.host, connto)
+		/* Don't bother if the last jump can't reach it, or it can't
+		reach enough jumps to finish the chain */
+		var prev *jump
+		if 0 != len(cs) {
+			prev = &hops[len(cs)-1]
+		}
+		if !cc.adjacency.Reaches(prev, j) {
+			log.Printf(
+				"Skipping %v, unreachable from jump %v",
+				j.host,
+				len(cs),
+			)
+			Trace(TRACESKIP, j, len(cs), "unreachable")
+			continue
+		}
+		if need := int(cc.njump) - len(cs); 0 != cc.njump &&
+			depths[i] < need {
+			log.Printf(
+				"Skipping %v, which can't reach %v more jumps",
+				j.host,
+				need-1,
+			)
+			Trace(TRACESKIP, j, len(cs), "dead end")
+			continue
+		}
+		/* Don't bother if it's been timing out.  The breaker's
+		already said so. */
+		if !cc.breaker.Allow(j.host) {
+			Trace(TRACESKIP, j, len(cs), "repeated timeouts")
+			continue
+		}
+		/* With -lrucreds, each host only sees one account */
+		if k, ok := picked[credHost(j)]; ok && k != credKey(j) {
+			log.Printf(
+				"Skipping %v, already tried %v",
+				credKey(j),
+				k,
+			)
+			Trace(TRACESKIP, j, len(cs), "another account tried")
+			continue
+		}
+		/* Ask for the password if it's not in the jumpfile */
+		WipePasswords(aj)
+		aj = j
+		if NeedsPrompt(j) {
+			p, err := PromptPassword(j)
+			if nil != err {
+				log.Printf("Skipping %v: %v", j.host, err)
+				Trace(TRACESKIP, j, len(cs), err.Error())
+				continue
+			}
+			aj.pw = p
+		}
+		/* Or fetch it from wherever it lives */
+		if IsExternalCred(j) {
+			aj, err = ExternalCred(ctx, j, cc.keydir)
+			if nil != err {
+				log.Printf("Skipping %v: %v", j.host, err)
+				Trace(TRACESKIP, j, len(cs), err.Error())
+				continue
+			}
+		}
+		/* As may its other credentials */
+		if 0 != len(j.alts) {
+			aj.alts = ExternalAlts(ctx, aj, cc.keydir)
+		}
+		/* Don't bother if auth= leaves nothing to try */
+		if 0 != len(j.auth) && 0 == len(authMethods(aj, nil)) {
+			log.Printf(
+				"Skipping %v: no credentials for auth=%v",
+				j.host,
+				strings.Join(j.auth, ","),
+			)
+			Trace(TRACESKIP, j, len(cs), "no allowed credentials")
+			continue
+		}
+		if nil != cc.creds {
+			picked[credHost(j)] = credKey(j)
+		}
+		Trace(TRACEATTEMPT, j, len(cs), "")
+		/* Dial with the previous conn as the dialer, or from the
+		jump's VRF if it's first */
+		jd := d
+		if 0 == len(cs) && "" != j.vrf {
+			jd = cc.firstHopVRF(j.vrf)
+		}
+		dialStart := time.Now()
+		c, err := dialWithTimeout(ctx, jd, j.host, cc.connto)
+		dialTook := time.Since(dialStart)
+		if errTimeout == err {
+			cc.breaker.Timeout(j.host)
+		}
 		if nil != err {
 			/* Handle case in which the jump doesn't forward
 			connections */
@@ -73,17 +239,34 @@ func MakeSSHConns(
 						"forwarding, closing",
 					len(cs),
 				)
-				d, cs = removeLastJump(cs)
+				Trace(TRACENOFORWARD, j, len(cs), err.Error())
+				d, cs = removeLastJump(cs, cc.firstHopDialer())
 				continue
 			}
+			cc.aliases.Result(j.alias, j.host, false)
 			log.Printf(
-				"Unable to connect to %v: %v",
+				"Unable to connect to %v after %v: %v",
 				j.host,
-				err,
+				dialTook,
+				Hinted(err),
+			)
+			TraceTimed(
+				TRACEDIALFAIL,
+				j,
+				len(cs),
+				err.Error(),
+				dialTook,
 			)
 			continue
 		}
 
+		if wireLogMatches(cc.wireLog, j, len(cs)+1) {
+			c = NewWireLogConn(c, fmt.Sprintf("jump %v", len(cs)+1))
+		}
+		/* Note what it says about itself, even if auth fails */
+		var si *serverInfo
+		c, si = SniffServerInfo(c)
+
 		worky := make(chan struct{}) /* Will be closed on handshake */
 		var aberr error
 		/* Kill the connection if the handshake takes too long */
@@ -91,78 +274,134 @@ func MakeSSHConns(
 			select {
 			case <-ctx.Done():
 				c.Close()
-				aberr = fmt.Errorf("interrupt")
-			case <-time.After(hsto):
+				aberr = errInterrupt
+			case <-time.After(cc.hsto):
 				c.Close()
-				aberr = fmt.Errorf("timeout")
+				aberr = errTimeout
 			case <-worky:
 			}
 		}()
-		/* Keyboard-interactive auth function */
-		ki := func(
-			user string,
-			instruction string,
-			questions []string,
-			echos []bool,
-		) (answers []string, err error) {
-			return []string{j.password}, nil
-		}
-		/* Auth Methods */
-		var am []ssh.AuthMethod
-		if nil == j.key {
-			am = []ssh.AuthMethod{
-				ssh.Password(j.password),
-				ssh.KeyboardInteractive(ki),
-			}
-		} else {
-			am = []ssh.AuthMethod{ssh.PublicKeys(j.key)}
-		}
-
 		/* Upgrade to an SSH connection */
-		scon, chans, reqs, err := ssh.NewClientConn(
-			c,
-			j.host,
-			&ssh.ClientConfig{
-				User:          j.username,
-				Auth:          am,
-				ClientVersion: j.version,
-			},
+		hkcb := RecordingHostKeys(
+			j,
+			len(cs)+1,
+			cc.pins.HostKeyCallback(j),
 		)
+		cred := -1 /* Credential which worked */
+		conf := &ssh.ClientConfig{
+			User: j.username,
+			Auth: authMethods(aj, func(c int) {
+				cred = c
+			}),
+			ClientVersion:   j.version,
+			HostKeyCallback: hkcb,
+			BannerCallback:  si.BannerCallback(j, len(cs)+1),
+		}
+		ApplyAlgs(conf, j)
+		cc.quality.Apply(conf)
+		hsStart := time.Now()
+		scon, chans, reqs, err := ssh.NewClientConn(c, j.host, conf)
+		hsTook := time.Since(hsStart)
 		/* Signal we're done before error-checking */
 		close(worky)
+		/* Passwords are fetched or asked for again next time */
+		WipePasswords(aj)
+		if NeedsPrompt(j) {
+			ForgetPassword(j)
+		}
 		if nil != err {
 			/* Change the error if it was a timeout */
 			if nil != aberr {
 				err = aberr
 			}
+			if errTimeout == err {
+				cc.breaker.Timeout(j.host)
+			}
+			err = cc.quality.Explain(err)
+			cc.aliases.Result(j.alias, j.host, false)
 			log.Printf(
-				"Unable to handshake as %v: %v",
+				"Unable to handshake as %v with server %v "+
+					"after %v: %v",
 				cstr,
-				err,
+				si,
+				hsTook,
+				Hinted(err),
+			)
+			TraceTimed(
+				TRACEHSFAIL,
+				j,
+				len(cs),
+				fmt.Sprintf("server %v: %v", si, err),
+				hsTook,
 			)
 			c.Close()
+			if isAuthErr(err) {
+				cc.creds.Failed(j)
+			}
+			/* Maybe the operator knows better */
+			switch {
+			case isAuthErr(err) && NeedsPrompt(j):
+				wrongPrompts[i]++
+				if MAXPROMPTS > wrongPrompts[i] {
+					i--
+					break
+				}
+				log.Printf(
+					"Skipping %v after %v wrong passwords",
+					j.host,
+					wrongPrompts[i],
+				)
+				Trace(
+					TRACESKIP,
+					j,
+					len(cs),
+					"too many wrong passwords",
+				)
+			case isAuthErr(err) && cc.fixer.Fix(&jumps[i]):
+				i--
+			}
 			continue
 		}
 
+		cc.breaker.Success(j.host)
+		cc.aliases.Result(j.alias, j.host, true)
+		cc.creds.Used(j, cred)
+
 		/* Upgrade to an SSH client */
 		scli := ssh.NewClient(scon, chans, reqs)
 
 		/* Add it to the list of connections */
 		cs = append(cs, scli)
+		state.NoteJump(scli, j)
+		hops = append(hops[:len(cs)-1], j)
 		log.Printf(
-			"Jump %v: %v",
+			"Jump %v: %v with server %v (connected in %v, "+
+				"handshake in %v)",
 			len(cs),
 			cstr,
+			si,
+			dialTook,
+			hsTook,
 		)
+		TraceTimed(TRACEJUMP, j, len(cs), "server "+string(
+			scon.ServerVersion(),
+		), hsTook)
 
 		/* If we have enough, we're done */
-		if uint(0) != njump && uint(len(cs)) >= njump {
+		if uint(0) != cc.njump && uint(len(cs)) >= cc.njump {
 			/* Make sure we can proxy through the last jump */
-			if testExit(cs[len(cs)-1], exitTest) {
-				go sendKeepalives(cs[len(cs)-1], kaint, cancel)
+			if traceExit(
+				j,
+				len(cs),
+				cc,
+				checkExit(cs[len(cs)-1], hops[len(cs)-1], cc),
+			) {
+				Trace(TRACECHAIN, jump{}, len(cs), "")
+				watchChain(ctx, cs, cc, cancel)
 				return cs, nil
 			}
-			d, cs = removeLastJump(cs)
+			Trace(TRACEDROP, j, len(cs), "failed exit test")
+			d, cs = removeLastJump(cs, cc.firstHopDialer())
 			continue
 		}
 
@@ -170,35 +409,58 @@ func MakeSSHConns(
 		d = scli
 	}
 	if nil != ctx.Err() {
-		return nil, fmt.Errorf("interrupt")
+		Trace(TRACECHAINFAIL, jump{}, len(cs), errInterrupt.Error())
+		return nil, errInterrupt
 	}
 	/* If we ran out of jumps, tear down what we have */
-	if uint(0) != njump && uint(len(cs)) < njump {
+	if uint(0) != cc.njump && uint(len(cs)) < cc.njump {
+		Trace(TRACECHAINFAIL, jump{}, len(cs), "out of jumps")
 		CloseJumps(cs)
 		return nil, fmt.Errorf(
 			"insufficient SSH jumps (only made %v/%v)",
 			len(cs),
-			njump,
+			cc.njump,
 		)
 	}
-	if uint(0) != njump {
-		log.Printf("Out of jumps, made %v / %v", len(cs), njump) /* DEBUG */
-		log.Printf("This is a bug, please tell the dev")         /* DEBUG */
+	if uint(0) != cc.njump {
+		log.Printf("Out of jumps, made %v / %v", len(cs), cc.njump) /* DEBUG */
+		log.Printf("This is a bug, please tell the dev")            /* DEBUG */
 	}
 	/* Make sure we can get out */
-	if testExit(cs[len(cs)-1], exitTest) {
+	if traceExit(
+		jump{},
+		len(cs),
+		cc,
+		checkExit(cs[len(cs)-1], hops[len(cs)-1], cc),
+	) {
+		Trace(TRACECHAIN, jump{}, len(cs), "")
+		watchChain(ctx, cs, cc, cancel)
 		return cs, nil
 	}
 	/* If we're here, we failed to exittest */
 	if 1 == len(cs) {
+		Trace(TRACECHAINFAIL, jump{}, len(cs), "no working jumps")
 		return nil, fmt.Errorf("no working jumps found")
 	}
 	log.Printf("Closing last jump")
-	_, cs = removeLastJump(cs)
-	go sendKeepalives(cs[len(cs)-1], kaint, cancel)
+	Trace(TRACEDROP, jump{}, len(cs), "failed exit test")
+	_, cs = removeLastJump(cs, cc.firstHopDialer())
+	Trace(TRACECHAIN, jump{}, len(cs), "")
+	watchChain(ctx, cs, cc, cancel)
 	return cs, nil
 }
 
+/* traceExit traces the result ok of the exit test made through the last jump,
+j, and returns ok. */
+func traceExit(j jump, depth int, cc chainConfig, ok bool) bool {
+	ev := TRACEEXITPASS
+	if !ok {
+		ev = TRACEEXITFAIL
+	}
+	Trace(ev, j, depth, cc.exitPolicy+" "+cc.exitTest)
+	return ok
+}
+
 /* CloseJumps closes the slice of SSH connections, starting with the highest
 index (i.e. len(cs)-1). */
 func CloseJumps(cs []*ssh.Client) {
@@ -216,59 +478,105 @@ func CloseJumps(cs []*ssh.Client) {
 }
 
 /* dialWithTimeout dials a via d, but gives up after to or if ctx signals to
-finish. */
+finish.  Abandoned dials are canceled via the context passed to d. */
 func dialWithTimeout(
 	ctx context.Context,
 	d Dialer,
 	a string,
 	to time.Duration,
 ) (net.Conn, error) {
-	ech := make(chan error)
-	worky := make(chan net.Conn)
-	/* Dial the address */
-	go func() {
-		c, err := d.Dial("tcp", a)
-		/* When it's done, send the result back */
-		ech <- err
-		worky <- c
-	}()
-	/* Wait for something to happen */
-	select {
-	case <-time.After(to):
-		go killConnFromChannel(worky)
-		return nil, fmt.Errorf("timeout")
-	case <-ctx.Done():
-		go killConnFromChannel(worky)
-		return nil, fmt.Errorf("interrupt")
-	case err := <-ech:
-		/* If there was no error, return it */
-		if nil == err {
-			return <-worky, nil
-		}
-		go killConnFromChannel(worky)
+	dctx, cancel := context.WithTimeout(ctx, to)
+	defer cancel()
+	c, err := d.DialContext(dctx, "tcp", a)
+	if nil == err {
+		return c, nil
+	}
+	/* Work out why it failed */
+	switch {
+	case nil != ctx.Err():
+		return nil, errInterrupt
+	case context.DeadlineExceeded == dctx.Err():
+		return nil, errTimeout
+	default:
 		return nil, err
 	}
 }
 
-/* killConnFromChannel reads a conn from ch and calls its Close method */
-func killConnFromChannel(ch <-chan net.Conn) {
-	c := <-ch
-	if nil != c {
-		c.Close()
+/* checkExit applies cc's exit test policy to the last jump sc, made to hop,
+and returns true if sc is suitable for use as the last jump.  If the exit test
+target starts with ICMPPREFIX, the rest of it is pinged, with cc's helper if
+it has one.  Recent results for hop are taken from cc.exitCache. */
+func checkExit(sc *ssh.Client, hop jump, cc chainConfig) bool {
+	uh := hop.username + "@" + hop.host
+	target := cc.exitTest
+	test := testExit
+	if strings.HasPrefix(target, ICMPPREFIX) {
+		target = strings.TrimPrefix(target, ICMPPREFIX)
+		test = func(sc *ssh.Client, t string, _ exitContent) bool {
+			return testExitICMP(sc, t, cc.helper, cc.helperPath)
+		}
+	}
+	/* The exit test's a connection through the chain, too */
+	if err := exitScope(cc.exitTest); nil != err {
+		test = func(*ssh.Client, string, exitContent) bool {
+			log.Printf("Not making exit test: %v", err)
+			return false
+		}
+	}
+	cached := func() bool {
+		return cc.exitCache.Test(uh, cc.exitTest, func() bool {
+			return test(sc, target, cc.exitWant)
+		})
+	}
+	switch cc.exitPolicy {
+	case EXITSKIP:
+		log.Printf("Skipping exit test")
+		return true
+	case EXITADVISORY:
+		if !cached() {
+			log.Printf("Using last jump despite failed exit test")
+		}
+		return true
+	default:
+		return cached()
+	}
+}
+
+/* exitScope returns an error if the -scope doesn't allow the exit test to
+target.  ICMP targets are checked as port 0, so need a rule without ports. */
+func exitScope(target string) error {
+	if strings.HasPrefix(target, ICMPPREFIX) {
+		return scope.Check(net.JoinHostPort(
+			strings.TrimPrefix(target, ICMPPREFIX),
+			"0",
+		))
 	}
+	return scope.Check(ExitDialAddr(target))
 }
 
 /* testExit returns true if a connection was able to be made to the target via
-the client. */
-func testExit(sc *ssh.Client, target string) bool {
+the client and it had what want wants. */
+func testExit(sc *ssh.Client, target string, want exitContent) bool {
 	log.Printf("Making a test connection to %v", target)
-	c, err := sc.Dial("tcp", target)
+	start := time.Now()
+	c, err := sc.Dial("tcp", ExitDialAddr(target))
 	if nil != err {
-		log.Printf("Connection to %v failed: %v", target, err)
+		log.Printf("Connection to %v failed: %v", target, Hinted(err))
 		return false
 	}
-	log.Printf("Connection to %v successful", target)
-	c.Close()
+	if err := want.Check(c, target); nil != err {
+		log.Printf(
+			"Connected to %v, but %v",
+			target,
+			Hinted(err),
+		)
+		return false
+	}
+	log.Printf(
+		"Connection to %v successful in %v",
+		target,
+		time.Since(start),
+	)
 	return true
 }
 
@@ -290,31 +598,102 @@ func isSSHForwardErr(err error) bool {
 	return false
 }
 
+/* watchChain sends keepalives to the last jump in cs, per cc, and watches
+every jump in cs for its connection dropping.  If either happens before ctx
+is done, the chain's been lost, and the kill switch is tripped before cancel
+is called. */
+func watchChain(
+	ctx context.Context,
+	cs []*ssh.Client,
+	cc chainConfig,
+	cancel context.CancelFunc,
+) {
+	for i, c := range cs {
+		go watchJump(ctx, c, i+1, cancel)
+	}
+	go sendKeepalives(ctx, cs[len(cs)-1], cc.kaint, cc.katimeout, cancel)
+}
+
+/* watchJump waits for the connection to c, the n'th jump, to drop.  If it
+drops before ctx is done, the kill switch is tripped before cancel is
+called. */
+func watchJump(
+	ctx context.Context,
+	c *ssh.Client,
+	n int,
+	cancel context.CancelFunc,
+) {
+	err := c.Wait()
+	if nil != ctx.Err() {
+		return
+	}
+	log.Printf("Lost jump %v: %v", n, err)
+	if nil == err {
+		err = errors.New("connection closed")
+	}
+	Trace(TRACELOST, jump{}, n, err.Error())
+	TripKillSwitch(fmt.Sprintf("jump %v lost", n))
+	cancel()
+}
+
 /* sendKeepalives sends keepalives on the ssh connection at the given
-interval*/
+interval.  If one fails or isn't answered within timeout before ctx is done,
+the chain's been lost, and the kill switch is tripped before cancel is
+called. */
 func sendKeepalives(
+	ctx context.Context,
 	c *ssh.Client,
 	interval time.Duration,
+	timeout time.Duration,
 	cancel context.CancelFunc,
 ) {
 	log.Printf("Sending keepalives every %v to last jump", interval)
 	for {
-		if _, _, err := c.SendRequest(
-			"keepalive@openssh.com",
-			true,
-			nil,
-		); err != nil {
+		if err := keepalive(c, timeout); err != nil {
 			log.Printf("No longer seending keepalives: %v", err)
+			Trace(TRACELOST, jump{}, 0, err.Error())
 			break
 		}
-		time.Sleep(interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+	if nil == ctx.Err() {
+		TripKillSwitch("chain lost")
 	}
 	cancel()
 }
 
+/* keepalive sends a keepalive on c and waits up to timeout, or forever if
+it's 0, for the reply.  SendRequest can't be interrupted, so on timeout it's
+left to finish when c's closed. */
+func keepalive(c *ssh.Client, timeout time.Duration) error {
+	ech := make(chan error, 1)
+	go func() {
+		_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+		ech <- err
+	}()
+	if 0 == timeout {
+		return <-ech
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-ech:
+		return err
+	case <-t.C:
+		return fmt.Errorf("no keepalive reply in %v", timeout)
+	}
+}
+
 /* removeLastJump closes and removes the last jump from cs and returns the
-dialer to find the next jump. */
-func removeLastJump(cs []*ssh.Client) (Dialer, []*ssh.Client) {
+dialer to find the next jump, which is first if there are no jumps left. */
+func removeLastJump(
+	cs []*ssh.Client,
+	first Dialer,
+) (Dialer, []*ssh.Client) {
 	/* Close the bad last jump */
 	err := cs[len(cs)-1].Close()
 	if nil != err {
@@ -324,7 +703,133 @@ func removeLastJump(cs []*ssh.Client) (Dialer, []*ssh.Client) {
 	cs = cs[:len(cs)-1]
 	/* Work out the next dialer */
 	if 0 == len(cs) {
-		return &net.Dialer{}, cs
+		return first, cs
 	}
 	return cs[len(cs)-1], cs
 }
+
+/* authMethods returns the ways to authenticate as j, using j's credentials
+followed by its cred= credentials.  Keys are tried with publickey
+authentication and passwords with password and keyboard-interactive
+authentication, each in order, and the kind of authentication with the first
+credential is tried first.  A credential which is a loaded key is only ever
+tried as a key; a key: "password" which couldn't be loaded is tried as a
+password instead.  PKCS#11 URIs and references to secret backends are never
+tried as passwords.  AGENTCRED means every key in ssh-agent.  A password got
+at connect time, in pw, is used in place of the jumpfile's.  Kinds of
+authentication j's auth= doesn't allow are left out.  If used isn't nil, it's
+called with the cred of each credential as it's offered to the server, so the
+last call is for the credential which worked. */
+func authMethods(j jump, used func(cred int)) []ssh.AuthMethod {
+	var (
+		keys     []func() ([]ssh.Signer, error)
+		pws      [][]byte
+		kcs, pcs []int    /* Creds of keys and pws */
+		kAt, pAt = -1, -1 /* Credentials with the first key, password */
+	)
+	if nil == used {
+		used = func(int) {}
+	}
+	for i, c := range append([]jump{j}, j.alts...) {
+		switch {
+		case !j.Allows(AUTHKEY):
+		case AGENTCRED == c.password:
+			keys = append(keys, agentSigners)
+			kcs = append(kcs, c.cred)
+		case nil != c.key:
+			k := c.key
+			keys = append(keys, func() ([]ssh.Signer, error) {
+				return []ssh.Signer{k}, nil
+			})
+			kcs = append(kcs, c.cred)
+		}
+		switch {
+		case !j.Allows(AUTHPASSWORD):
+		case nil != c.pw:
+			pws = append(pws, c.pw)
+			pcs = append(pcs, c.cred)
+		case nil != c.key: /* Loaded keys aren't passwords */
+		case nil != c.secret:
+			pws = append(pws, c.secret)
+			pcs = append(pcs, c.cred)
+		case AGENTCRED != c.password &&
+			!strings.HasPrefix(c.password, PKCS11PREFIX) &&
+			!IsExternalCred(c):
+			pws = append(pws, []byte(c.password))
+			pcs = append(pcs, c.cred)
+		}
+		if -1 == kAt && 0 != len(keys) {
+			kAt = i
+		}
+		if -1 == pAt && 0 != len(pws) {
+			pAt = i
+		}
+	}
+
+	/* Every key, from every source */
+	var km ssh.AuthMethod
+	if 0 != len(keys) {
+		km = ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var ss []ssh.Signer
+			for n, f := range keys {
+				s, err := f()
+				if nil != err {
+					log.Printf(
+						"Unable to get keys for %v: %v",
+						j.host,
+						err,
+					)
+					continue
+				}
+				cred := kcs[n]
+				for _, k := range s {
+					ss = append(ss, noteSigns(k, func() {
+						used(cred)
+					}))
+				}
+			}
+			return ss, nil
+		})
+	}
+	if 0 == len(pws) {
+		if nil == km {
+			return nil
+		}
+		return []ssh.AuthMethod{km}
+	}
+
+	/* Every password, each time the server asks */
+	var npw, nki int
+	pm := ssh.RetryableAuthMethod(
+		ssh.PasswordCallback(func() (string, error) {
+			p := pws[npw%len(pws)]
+			used(pcs[npw%len(pws)])
+			npw++
+			return string(p), nil
+		}),
+		len(pws),
+	)
+	ki := ssh.RetryableAuthMethod(ssh.KeyboardInteractive(func(
+		user string,
+		instruction string,
+		questions []string,
+		echos []bool,
+	) (answers []string, err error) {
+		/* Only answer the question we know */
+		if 1 != len(questions) {
+			return make([]string, len(questions)), nil
+		}
+		p := pws[nki%len(pws)]
+		used(pcs[nki%len(pws)])
+		nki++
+		return []string{string(p)}, nil
+	}), len(pws))
+	am := []ssh.AuthMethod{pm, ki}
+	if nil == km {
+		return am
+	}
+	if kAt <= pAt {
+		return append([]ssh.AuthMethod{km}, am...)
+	}
+	return append(am, km)
+}
@@ -0,0 +1,100 @@
+package main
+
+/*
+ * killswitch.go
+ * Close everything the moment the chain's lost
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+/* killSwitch notes whether the chain's been lost.  Once it's tripped, the
+forwards' listeners and proxied connections are closed, as are any added
+before it's reset, so nothing's accepted between the chain dropping and the
+rest of the teardown.  A disarmed kill switch can't be tripped. */
+var killSwitch struct {
+	sync.Mutex
+	tripped  bool
+	disarmed bool        /* The chain's being closed on purpose */
+	closers  []io.Closer /* Other things to close, e.g. -socksunix */
+}
+
+/* TripKillSwitch closes the forwards' listeners and the proxied connections
+because of why, and keeps closing new ones until ResetKillSwitch is called. */
+func TripKillSwitch(why string) {
+	killSwitch.Lock()
+	if killSwitch.tripped || killSwitch.disarmed {
+		killSwitch.Unlock()
+		return
+	}
+	killSwitch.tripped = true
+	cs := killSwitch.closers
+	killSwitch.closers = nil
+	killSwitch.Unlock()
+
+	/* Listeners and conns added from here on check the switch
+	themselves */
+	fls := state.Listeners()
+	log.Printf(
+		"Kill switch tripped (%v), closing %v listeners and %v "+
+			"connections",
+		why,
+		len(fls)+len(cs),
+		ConnCount(),
+	)
+	for _, fl := range fls {
+		if Released(fl.l) || Paused(fl.l) {
+			continue
+		}
+		fl.l.Close()
+	}
+	for _, c := range cs {
+		c.Close()
+	}
+	CloseConns()
+}
+
+/* KillOnTrip arranges for c to be closed when the kill switch trips.  If
+it's already been tripped, c's closed straight away.  This is for things
+which aren't forward listeners or proxied connections, such as the
+-socksunix listener and UDP forwards. */
+func KillOnTrip(c io.Closer) {
+	killSwitch.Lock()
+	defer killSwitch.Unlock()
+	if killSwitch.tripped {
+		c.Close()
+		return
+	}
+	killSwitch.closers = append(killSwitch.closers, c)
+}
+
+/* KillSwitchTripped returns true if the chain's been lost and the kill
+switch hasn't been reset. */
+func KillSwitchTripped() bool {
+	killSwitch.Lock()
+	defer killSwitch.Unlock()
+	return killSwitch.tripped
+}
+
+/* DisarmKillSwitch keeps the kill switch from tripping when the chain's
+closed on purpose, until ResetKillSwitch is called. */
+func DisarmKillSwitch() {
+	killSwitch.Lock()
+	defer killSwitch.Unlock()
+	killSwitch.disarmed = true
+}
+
+/* ResetKillSwitch readies the kill switch for a new chain */
+func ResetKillSwitch() {
+	killSwitch.Lock()
+	defer killSwitch.Unlock()
+	killSwitch.tripped = false
+	killSwitch.disarmed = false
+	killSwitch.closers = nil
+}
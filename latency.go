@@ -0,0 +1,83 @@
+package main
+
+/*
+ * latency.go
+ * Work out which jump is slowing things down
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* ProbeLatency measures the round trip time to each jump in cs by sending it
+a keepalive.  As the keepalive to each jump passes through all of the jumps
+before it, the difference between successive round trip times is roughly the
+latency added by that jump. */
+func ProbeLatency(cs []*ssh.Client) ([]time.Duration, error) {
+	rtts := make([]time.Duration, len(cs))
+	for i, c := range cs {
+		start := time.Now()
+		if _, _, err := c.SendRequest(
+			"keepalive@openssh.com",
+			true,
+			nil,
+		); nil != err {
+			return nil, fmt.Errorf("jump %v: %v", i+1, err)
+		}
+		rtts[i] = time.Since(start)
+	}
+	return rtts, nil
+}
+
+/* LogLatency probes the chain cs every interval and logs how much latency
+each jump adds, until ctx is done or a probe fails. */
+func LogLatency(ctx context.Context, cs []*ssh.Client, interval time.Duration) {
+	log.Printf("Probing per-jump latency every %v", interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		rtts, err := ProbeLatency(cs)
+		if nil != err {
+			log.Printf("Latency probe failed: %v", err)
+			return
+		}
+		log.Printf("Latency: %v", formatLatency(rtts))
+	}
+}
+
+/* formatLatency turns the cumulative round trip times into a breakdown of
+how much each jump adds. */
+func formatLatency(rtts []time.Duration) string {
+	parts := make([]string, len(rtts))
+	var prev time.Duration
+	for i, rtt := range rtts {
+		/* Jitter can make a later jump look faster */
+		d := rtt - prev
+		if 0 > d {
+			d = 0
+		}
+		parts[i] = fmt.Sprintf(
+			"jump %v +%v",
+			i+1,
+			d.Round(time.Millisecond),
+		)
+		prev = rtt
+	}
+	return fmt.Sprintf(
+		"total %v (%v)",
+		rtts[len(rtts)-1].Round(time.Millisecond),
+		strings.Join(parts, ", "),
+	)
+}
@@ -0,0 +1,64 @@
+package main
+
+/*
+ * leak.go
+ * Goroutine leak detection, for debugging
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+const (
+	/* LEAKWAIT is how long CheckLeaks waits for goroutines to finish */
+	LEAKWAIT = 5 * time.Second
+	/* DEBUGINTERVAL is how often WatchGoroutines logs */
+	DEBUGINTERVAL = time.Minute
+)
+
+/* WatchGoroutines logs the number of goroutines and proxied sockets every
+DEBUGINTERVAL until ctx is done, to make slow leaks obvious. */
+func WatchGoroutines(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(DEBUGINTERVAL):
+		}
+		log.Printf(
+			"Debug: %v goroutines, %v proxied sockets",
+			runtime.NumGoroutine(),
+			ConnCount(),
+		)
+	}
+}
+
+/* CheckLeaks waits up to LEAKWAIT for the number of goroutines to drop to
+baseline, and if it doesn't, logs the stacks of the goroutines which are still
+running.  It should be called once everything's been torn down. */
+func CheckLeaks(baseline int) {
+	end := time.Now().Add(LEAKWAIT)
+	for baseline < runtime.NumGoroutine() && time.Now().Before(end) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	n := runtime.NumGoroutine()
+	if baseline >= n {
+		log.Printf("Debug: no leaked goroutines")
+		return
+	}
+	log.Printf(
+		"Debug: %v goroutines still running after shutdown, "+
+			"expected %v:",
+		n,
+		baseline,
+	)
+	pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
+}
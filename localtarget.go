@@ -0,0 +1,163 @@
+package main
+
+/*
+ * localtarget.go
+ * R forwards to stdio and named pipes
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+/* Prefixes for R forward targets which aren't network addresses */
+const (
+	TARGETSTDIO = "stdio:" /* Our own stdin and stdout */
+	TARGETPIPE  = "pipe:"  /* A named pipe, which is written */
+)
+
+/* errLocalDone is sent on the error channel when a stdio or pipe target's one
+connection is finished. */
+var errLocalDone = errors.New("local target finished")
+
+/* isLocalTarget returns true if t is a stdio or pipe target */
+func isLocalTarget(t string) bool {
+	return TARGETSTDIO == t ||
+		(strings.HasPrefix(t, TARGETPIPE) && TARGETPIPE != t)
+}
+
+/* UsesStdio returns true if any of the forwarding specifications in specs
+forward to stdio, in which case logs shouldn't go to stdout. */
+func UsesStdio(specs []string) bool {
+	for _, s := range specs {
+		ms := FWDRE.FindStringSubmatch(s)
+		if nil != ms && TARGETSTDIO == ms[4] && "" == ms[5] {
+			return true
+		}
+	}
+	return false
+}
+
+/* localDialer opens stdio and pipe targets */
+type localDialer struct{}
+
+/* Dial opens the local target addr */
+func (d localDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext opens the local target addr.  Opening a named pipe blocks until
+something opens it for reading, which ctx can't interrupt. */
+func (d localDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	switch {
+	case TARGETSTDIO == addr:
+		/* Reads from stdin can't be interrupted, so read in the
+		background and give up on the read when we're closed. */
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := io.Copy(pw, os.Stdin)
+			pw.CloseWithError(err)
+		}()
+		return &localConn{r: pr, w: os.Stdout, name: addr}, nil
+	case strings.HasPrefix(addr, TARGETPIPE):
+		f, err := os.OpenFile(
+			strings.TrimPrefix(addr, TARGETPIPE),
+			os.O_WRONLY,
+			0,
+		)
+		if nil != err {
+			return nil, err
+		}
+		return &localConn{w: f, name: addr}, nil
+	default:
+		return nil, fmt.Errorf("unknown local target %q", addr)
+	}
+}
+
+/* localConn is a net.Conn made from a reader and a writer.  If r is nil,
+reads return io.EOF. */
+type localConn struct {
+	r    io.ReadCloser
+	w    io.WriteCloser
+	name string
+}
+
+/* Read reads from c.r */
+func (c *localConn) Read(b []byte) (int, error) {
+	if nil == c.r {
+		return 0, io.EOF
+	}
+	return c.r.Read(b)
+}
+
+/* Write writes to c.w */
+func (c *localConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+/* Close closes c.r and c.w.  Closing stdout lets whatever's reading it know
+we're done. */
+func (c *localConn) Close() error {
+	var err error
+	if nil != c.r {
+		err = c.r.Close()
+	}
+	if werr := c.w.Close(); nil == err {
+		err = werr
+	}
+	return err
+}
+
+/* LocalAddr returns c's target */
+func (c *localConn) LocalAddr() net.Addr {
+	return localAddr(c.name)
+}
+
+/* RemoteAddr returns c's target */
+func (c *localConn) RemoteAddr() net.Addr {
+	return localAddr(c.name)
+}
+
+/* SetDeadline returns os.ErrNoDeadline; localConns are closed instead. */
+func (c *localConn) SetDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+/* SetReadDeadline returns os.ErrNoDeadline */
+func (c *localConn) SetReadDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+/* SetWriteDeadline returns os.ErrNoDeadline */
+func (c *localConn) SetWriteDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+/* localAddr is the address of a stdio or pipe target */
+type localAddr string
+
+/* Network returns "local" */
+func (a localAddr) Network() string {
+	return "local"
+}
+
+/* String returns a as a string */
+func (a localAddr) String() string {
+	return string(a)
+}
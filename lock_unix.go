@@ -0,0 +1,50 @@
+//go:build !windows
+
+package main
+
+/*
+ * lock_unix.go
+ * Lock files with flock(2)
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+/* lockFile takes an exclusive lock on the file named fname, creating it if
+necessary, and writes our PID to it.  The lock is released by the returned
+function or when the process exits. */
+func lockFile(fname string) (func(), error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0600)
+	if nil != err {
+		return nil, err
+	}
+	if err := syscall.Flock(
+		int(f.Fd()),
+		syscall.LOCK_EX|syscall.LOCK_NB,
+	); nil != err {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			b, _ := ioutil.ReadFile(fname)
+			return nil, fmt.Errorf(
+				"in use by PID %v",
+				strings.TrimSpace(string(b)),
+			)
+		}
+		return nil, err
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%v\n", os.Getpid())
+	return func() {
+		f.Truncate(0)
+		f.Close()
+	}, nil
+}
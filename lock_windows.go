@@ -0,0 +1,36 @@
+package main
+
+/*
+ * lock_windows.go
+ * Lock files by creating them exclusively
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/* lockFile creates the file named fname, which mustn't already exist, and
+writes our PID to it.  The returned function removes the file.  If sshjump dies
+without removing it, it'll need to be removed by hand. */
+func lockFile(fname string) (func(), error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		b, _ := ioutil.ReadFile(fname)
+		return nil, fmt.Errorf(
+			"in use by PID %v (remove %v if not)",
+			strings.TrimSpace(string(b)),
+			fname,
+		)
+	} else if nil != err {
+		return nil, err
+	}
+	fmt.Fprintf(f, "%v\n", os.Getpid())
+	f.Close()
+	return func() { os.Remove(fname) }, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+/*
+ * logtime.go
+ * Timestamp log lines precisely
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+/* LOGTIMEFORMAT is the format of log lines' timestamps, precise enough to
+work out latencies from the logs */
+const LOGTIMEFORMAT = time.RFC3339Nano
+
+func init() {
+	SetLogOutput(os.Stderr)
+}
+
+/* stampWriter prefixes what's written to it with the time */
+type stampWriter struct {
+	w io.Writer
+}
+
+/* Write writes b, which should be a whole log line, to the underlying writer
+with the current time in front.  The length of b is returned on success. */
+func (s stampWriter) Write(b []byte) (int, error) {
+	l := make([]byte, 0, len(LOGTIMEFORMAT)+1+len(b))
+	l = time.Now().AppendFormat(l, LOGTIMEFORMAT)
+	l = append(l, ' ')
+	l = append(l, b...)
+	if _, err := s.w.Write(l); nil != err {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+/* SetLogOutput sends log output to w, with each line timestamped with
+LOGTIMEFORMAT and secrets masked. */
+func SetLogOutput(w io.Writer) {
+	log.SetFlags(0)
+	log.SetOutput(stampWriter{w: Redacted(w)})
+}
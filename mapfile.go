@@ -0,0 +1,140 @@
+package main
+
+/*
+ * mapfile.go
+ * Machine-readable map of where the forwards are listening
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* mapEntry describes one forward's listener */
+type mapEntry struct {
+	Spec   string `json:"spec"`            /* As given */
+	Type   string `json:"type"`            /* L, R, or U */
+	Listen string `json:"listen"`          /* Actual listen address */
+	Target string `json:"target"`          /* Where connections go */
+	Jump   string `json:"jump,omitempty"`  /* Remote listener's host */
+	Label  string `json:"label,omitempty"` /* Operator's note */
+}
+
+/* listenerMap keeps the map file up to date */
+type listenerMap struct {
+	sync.Mutex
+	fname   string
+	entries []mapEntry
+}
+
+/* fwdMap is the map written to the file from -mapfile */
+var fwdMap = &listenerMap{}
+
+/* SetFile sets the file to which the map is written, and writes it. */
+func (m *listenerMap) SetFile(fname string) {
+	m.Lock()
+	defer m.Unlock()
+	m.fname = fname
+	m.write()
+}
+
+/* Add notes that f is listening on addr, which for remote forwards is on
+jump, and updates the file. */
+func (m *listenerMap) Add(f fwdspec, addr, jump string) {
+	m.Lock()
+	defer m.Unlock()
+	e := mapEntry{
+		Spec:   f.spec,
+		Listen: addr,
+		Target: f.caddr,
+		Label:  f.label,
+	}
+	switch {
+	case f.isUDP:
+		e.Type = "U"
+	case f.isFwd:
+		e.Type = "L"
+	default:
+		e.Type = "R"
+		e.Jump = jump
+	}
+	m.entries = append(m.entries, e)
+	m.write()
+}
+
+/* Remove removes the forward with the given spec, which is no longer
+listening, and updates the file. */
+func (m *listenerMap) Remove(spec string) {
+	m.Lock()
+	defer m.Unlock()
+	es := m.entries[:0:0]
+	for _, e := range m.entries {
+		if e.Spec != spec {
+			es = append(es, e)
+		}
+	}
+	m.entries = es
+	m.write()
+}
+
+/* Reset empties the map, when the listeners are closed, and updates the
+file. */
+func (m *listenerMap) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.entries = nil
+	m.write()
+}
+
+/* write replaces the file with the current map.  The file is written under a
+temporary name and renamed, so readers never see half of it.  The caller must
+hold the lock. */
+func (m *listenerMap) write() {
+	if "" == m.fname {
+		return
+	}
+	es := m.entries
+	if nil == es {
+		es = []mapEntry{}
+	}
+	j, err := json.MarshalIndent(struct {
+		PID       int        `json:"pid"`
+		Build     buildInfo  `json:"build"`
+		Updated   time.Time  `json:"updated"`
+		Listeners []mapEntry `json:"listeners"`
+	}{os.Getpid(), BuildInfo(), time.Now(), es}, "", "\t")
+	if nil != err {
+		log.Printf("Unable to encode listener map: %v", err)
+		return
+	}
+	tf, err := ioutil.TempFile(
+		filepath.Dir(m.fname),
+		"."+filepath.Base(m.fname)+".",
+	)
+	if nil != err {
+		log.Printf("Unable to write listener map: %v", err)
+		return
+	}
+	_, err = tf.Write(append(j, '\n'))
+	if cerr := tf.Close(); nil == err {
+		err = cerr
+	}
+	if nil == err {
+		err = os.Chmod(tf.Name(), 0644)
+	}
+	if nil == err {
+		err = os.Rename(tf.Name(), m.fname)
+	}
+	if nil != err {
+		os.Remove(tf.Name())
+		log.Printf("Unable to write listener map %v: %v", m.fname, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+/*
+ * maxbytes.go
+ * Limit the bytes relayed by a forward
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* What to do when a forward's relayed enough */
+const (
+	ONMAXCLOSE   = "close"   /* Close connections, refuse new ones */
+	ONMAXDISABLE = "disable" /* Also close the listener */
+)
+
+/* errMaxBytes is returned when writing to a forward which has relayed too
+much */
+var errMaxBytes = errors.New("forward byte limit reached")
+
+/* byteLimit counts the bytes relayed by a forward's connections, and closes
+them once too many have been relayed. */
+type byteLimit struct {
+	max     int64
+	disable bool /* Close ln as well */
+
+	l     sync.Mutex
+	n     int64
+	hit   bool
+	conns map[net.Conn]struct{}
+	ln    net.Listener
+}
+
+/* newByteLimit returns a byteLimit which trips after max bytes */
+func newByteLimit(max int64) *byteLimit {
+	return &byteLimit{max: max, conns: make(map[net.Conn]struct{})}
+}
+
+/* SetListener sets the listener to close if the limit is hit and the forward
+is to be disabled. */
+func (b *byteLimit) SetListener(l net.Listener) {
+	if nil == b {
+		return
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.ln = l
+}
+
+/* Add notes connections to close when the limit is reached.  It returns false
+if the limit's already been reached. */
+func (b *byteLimit) Add(cs ...net.Conn) bool {
+	if nil == b {
+		return true
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.hit {
+		return false
+	}
+	for _, c := range cs {
+		b.conns[c] = struct{}{}
+	}
+	return true
+}
+
+/* Remove stops tracking connections */
+func (b *byteLimit) Remove(cs ...net.Conn) {
+	if nil == b {
+		return
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	for _, c := range cs {
+		delete(b.conns, c)
+	}
+}
+
+/* Exceeded returns true if the limit has been reached */
+func (b *byteLimit) Exceeded() bool {
+	if nil == b {
+		return false
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.hit
+}
+
+/* Disabled returns true if the limit has been reached and the forward's
+listener closed. */
+func (b *byteLimit) Disabled() bool {
+	if nil == b {
+		return false
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.hit && b.disable
+}
+
+/* count adds n bytes to the count, and closes everything once the limit is
+reached. */
+func (b *byteLimit) count(n int) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.n += int64(n)
+	if b.hit || b.n < b.max {
+		return
+	}
+	b.hit = true
+	log.Printf(
+		"Forward relayed %v/%v bytes, closing %v connections",
+		b.n,
+		b.max,
+		len(b.conns),
+	)
+	for c := range b.conns {
+		c.Close()
+		delete(b.conns, c)
+	}
+	if b.disable && nil != b.ln {
+		log.Printf("Disabling forward on %v", b.ln.Addr())
+		b.ln.Close()
+	}
+}
+
+/* limitWriter counts bytes written to w against a byteLimit */
+type limitWriter struct {
+	w io.Writer
+	b *byteLimit
+}
+
+/* Write writes b to the underlying writer unless the limit's been reached. */
+func (l limitWriter) Write(b []byte) (int, error) {
+	if l.b.Exceeded() {
+		return 0, errMaxBytes
+	}
+	n, err := l.w.Write(b)
+	l.b.count(n)
+	return n, err
+}
+
+/* parseByteCount parses a number of bytes, optionally suffixed with k, m, or
+g, for kibibytes, mebibytes, or gibibytes. */
+func parseByteCount(s string) (int64, error) {
+	m := int64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		m = 1 << 10
+	case "m":
+		m = 1 << 20
+	case "g":
+		m = 1 << 30
+	}
+	if 1 != m {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if nil != err {
+		return 0, err
+	}
+	if 0 >= n {
+		return 0, fmt.Errorf("byte count must be positive")
+	}
+	return n * m, nil
+}
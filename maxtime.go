@@ -0,0 +1,61 @@
+package main
+
+/*
+ * maxtime.go
+ * Tear everything down after a while
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+/* StartMaxTime tears everything down by calling cancel once d has passed,
+after logging a warning warn beforehand, unless warn is 0.  The returned
+function stops the timers. */
+func StartMaxTime(
+	d time.Duration,
+	warn time.Duration,
+	cancel context.CancelFunc,
+) (func(), error) {
+	if 0 >= d {
+		return nil, fmt.Errorf("duration must be positive")
+	}
+	if 0 > warn || d <= warn {
+		return nil, fmt.Errorf(
+			"warning must be shorter than the duration",
+		)
+	}
+	end := time.Now().Add(d)
+	state.SetDeadline(end)
+	log.Printf(
+		"Tearing down after %v, at %v",
+		d,
+		end.Format(time.RFC3339),
+	)
+	var wt *time.Timer
+	if 0 != warn {
+		wt = time.AfterFunc(d-warn, func() {
+			log.Printf(
+				"Tearing down in %v, at %v",
+				warn,
+				end.Format(time.RFC3339),
+			)
+		})
+	}
+	t := time.AfterFunc(d, func() {
+		log.Printf("Maximum time of %v reached, tearing down", d)
+		cancel()
+	})
+	return func() {
+		t.Stop()
+		if nil != wt {
+			wt.Stop()
+		}
+	}, nil
+}
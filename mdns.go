@@ -0,0 +1,355 @@
+package main
+
+/*
+ * mdns.go
+ * Advertise local forwards with mDNS/DNS-SD
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	/* MDNSADDR is the IPv4 mDNS group and port */
+	MDNSADDR = "224.0.0.251:5353"
+	/* MDNSTTL is the TTL, in seconds, of our records */
+	MDNSTTL = 120
+	/* MDNSSERVICES is the name for DNS-SD service type enumeration */
+	MDNSSERVICES = "_services._dns-sd._udp.local."
+)
+
+/* MDNSTYPERE matches a DNS-SD service type, like _http._tcp */
+var MDNSTYPERE = regexp.MustCompile(`^_[A-Za-z0-9-]{1,15}\._(tcp|udp)$`)
+
+/* mdnsCacheFlush is set in the class of records which only we answer */
+const mdnsCacheFlush = 0x8000
+
+/* mdnsRecord is a record we'll answer for */
+type mdnsRecord struct {
+	name   string
+	typ    dnsmessage.Type
+	value  string /* For deduplication, and PTR records' targets */
+	unique bool   /* Set the cache-flush bit */
+	add    func(*dnsmessage.Builder, dnsmessage.ResourceHeader) error
+}
+
+/* mdnsResponder answers mDNS queries for the forwards' services */
+type mdnsResponder struct {
+	pc      *net.UDPConn
+	group   *net.UDPAddr
+	records []mdnsRecord
+}
+
+/* StartMDNS advertises the local forwards in ls which have a service type
+set, and answers queries for them until Close is called.  Forwards listening
+only on loopback addresses aren't advertised.  If there's nothing to
+advertise, nil is returned. */
+func StartMDNS(ls []fwdListener) (*mdnsResponder, error) {
+	hn, err := os.Hostname()
+	if nil != err {
+		return nil, err
+	}
+	hn = strings.SplitN(hn, ".", 2)[0]
+	host := hn + ".local."
+
+	/* Work out what to advertise */
+	var (
+		m     = &mdnsResponder{}
+		hosts = make(map[string]bool) /* Addresses with A records */
+		types = make(map[string]bool) /* Service types */
+	)
+	for _, fl := range ls {
+		if "" == fl.f.mdnsType {
+			continue
+		}
+		ta, ok := fl.l.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		ips, err := mdnsAddrs(ta.IP)
+		if nil != err {
+			return nil, err
+		}
+		if 0 == len(ips) {
+			log.Printf(
+				"Not advertising %v with mDNS, as it's "+
+					"not reachable from the network",
+				ta,
+			)
+			continue
+		}
+		for _, ip := range ips {
+			if hosts[ip.String()] {
+				continue
+			}
+			hosts[ip.String()] = true
+			a := [4]byte{}
+			copy(a[:], ip.To4())
+			m.records = append(m.records, mdnsRecord{
+				name:   host,
+				typ:    dnsmessage.TypeA,
+				value:  ip.String(),
+				unique: true,
+				add: func(
+					b *dnsmessage.Builder,
+					h dnsmessage.ResourceHeader,
+				) error {
+					return b.AResource(
+						h,
+						dnsmessage.AResource{A: a},
+					)
+				},
+			})
+		}
+		st := fl.f.mdnsType + ".local."
+		if !types[st] {
+			types[st] = true
+			m.records = append(m.records, mdnsPTR(MDNSSERVICES, st))
+		}
+		inst := fmt.Sprintf("%v-%v.%v", hn, ta.Port, st)
+		m.records = append(
+			m.records,
+			mdnsPTR(st, inst),
+			mdnsSRV(inst, host, ta.Port),
+			mdnsTXT(inst, "target="+fl.f.caddr),
+		)
+		log.Printf(
+			"Advertising %v as %v with mDNS",
+			ta,
+			strings.TrimSuffix(inst, "."),
+		)
+	}
+	if 0 == len(types) {
+		return nil, nil
+	}
+
+	/* Listen for questions */
+	if m.group, err = net.ResolveUDPAddr("udp4", MDNSADDR); nil != err {
+		return nil, err
+	}
+	m.pc, err = net.ListenMulticastUDP("udp4", nil, m.group)
+	if nil != err {
+		return nil, err
+	}
+	/* Go turns off loopback, but tools on this host might want to know */
+	if err := ipv4.NewPacketConn(m.pc).SetMulticastLoopback(
+		true,
+	); nil != err {
+		log.Printf("Unable to enable mDNS loopback: %v", err)
+	}
+	go m.serve()
+
+	/* Tell everybody we're here */
+	m.announce(MDNSTTL)
+	time.AfterFunc(time.Second, func() { m.announce(MDNSTTL) })
+
+	return m, nil
+}
+
+/* mdnsAddrs returns the IPv4 addresses to advertise for a listener on ip.  An
+unspecified address means all of the non-loopback addresses. */
+func mdnsAddrs(ip net.IP) ([]net.IP, error) {
+	if ip.IsLoopback() {
+		return nil, nil
+	}
+	if !ip.IsUnspecified() {
+		if nil == ip.To4() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+	as, err := net.InterfaceAddrs()
+	if nil != err {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range as {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLoopback() || nil == n.IP.To4() {
+			continue
+		}
+		ips = append(ips, n.IP)
+	}
+	return ips, nil
+}
+
+/* mdnsPTR returns a PTR record from name to ptr */
+func mdnsPTR(name, ptr string) mdnsRecord {
+	return mdnsRecord{
+		name:  name,
+		typ:   dnsmessage.TypePTR,
+		value: ptr,
+		add: func(
+			b *dnsmessage.Builder,
+			h dnsmessage.ResourceHeader,
+		) error {
+			return b.PTRResource(h, dnsmessage.PTRResource{
+				PTR: dnsmessage.MustNewName(ptr),
+			})
+		},
+	}
+}
+
+/* mdnsSRV returns an SRV record for the service instance inst */
+func mdnsSRV(inst, host string, port int) mdnsRecord {
+	return mdnsRecord{
+		name:   inst,
+		typ:    dnsmessage.TypeSRV,
+		value:  net.JoinHostPort(host, strconv.Itoa(port)),
+		unique: true,
+		add: func(
+			b *dnsmessage.Builder,
+			h dnsmessage.ResourceHeader,
+		) error {
+			return b.SRVResource(h, dnsmessage.SRVResource{
+				Target: dnsmessage.MustNewName(host),
+				Port:   uint16(port),
+			})
+		},
+	}
+}
+
+/* mdnsTXT returns a TXT record for the service instance inst */
+func mdnsTXT(inst string, txt ...string) mdnsRecord {
+	return mdnsRecord{
+		name:   inst,
+		typ:    dnsmessage.TypeTXT,
+		value:  strings.Join(txt, "\x00"),
+		unique: true,
+		add: func(
+			b *dnsmessage.Builder,
+			h dnsmessage.ResourceHeader,
+		) error {
+			return b.TXTResource(
+				h,
+				dnsmessage.TXTResource{TXT: txt},
+			)
+		},
+	}
+}
+
+/* serve answers queries until m.pc is closed */
+func (m *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := m.pc.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if nil != err {
+			log.Printf("Error reading mDNS queries: %v", err)
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if nil != err || h.Response {
+			continue
+		}
+		qs, err := p.AllQuestions()
+		if nil != err {
+			continue
+		}
+		var rs []mdnsRecord
+		for _, q := range qs {
+			rs = append(rs, m.answers(q)...)
+		}
+		if 0 != len(rs) {
+			m.send(rs, MDNSTTL)
+		}
+	}
+}
+
+/* answers returns the records which answer q */
+func (m *mdnsResponder) answers(q dnsmessage.Question) []mdnsRecord {
+	var rs []mdnsRecord
+	for _, r := range m.records {
+		if !strings.EqualFold(q.Name.String(), r.name) {
+			continue
+		}
+		if dnsmessage.TypeALL != q.Type && r.typ != q.Type {
+			continue
+		}
+		rs = append(rs, r)
+		/* Save the asker a round trip */
+		if dnsmessage.TypePTR == r.typ && MDNSSERVICES != r.name {
+			rs = append(rs, m.answers(dnsmessage.Question{
+				Name: dnsmessage.MustNewName(r.value),
+				Type: dnsmessage.TypeALL,
+			})...)
+		}
+		if dnsmessage.TypeSRV == r.typ {
+			for _, a := range m.records {
+				if dnsmessage.TypeA == a.typ {
+					rs = append(rs, a)
+				}
+			}
+		}
+	}
+	return rs
+}
+
+/* send multicasts the records in rs with the given TTL */
+func (m *mdnsResponder) send(rs []mdnsRecord, ttl uint32) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		Response:      true,
+		Authoritative: true,
+	})
+	b.EnableCompression()
+	b.StartAnswers()
+	seen := make(map[string]bool)
+	for _, r := range rs {
+		/* Don't repeat ourselves */
+		k := r.name + "/" + r.typ.String() + "/" + r.value
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		class := dnsmessage.ClassINET
+		if r.unique {
+			class |= mdnsCacheFlush
+		}
+		if err := r.add(&b, dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(r.name),
+			Class: class,
+			TTL:   ttl,
+		}); nil != err {
+			log.Printf("Unable to build mDNS response: %v", err)
+			return
+		}
+	}
+	msg, err := b.Finish()
+	if nil != err {
+		log.Printf("Unable to build mDNS response: %v", err)
+		return
+	}
+	if _, err := m.pc.WriteToUDP(msg, m.group); nil != err {
+		log.Printf("Unable to send mDNS response: %v", err)
+	}
+}
+
+/* announce sends all of our records with the given TTL */
+func (m *mdnsResponder) announce(ttl uint32) {
+	m.send(m.records, ttl)
+}
+
+/* Close says goodbye and stops answering queries.  A nil m is a no-op. */
+func (m *mdnsResponder) Close() error {
+	if nil == m {
+		return nil
+	}
+	m.announce(0)
+	return m.pc.Close()
+}
@@ -0,0 +1,93 @@
+package main
+
+/*
+ * negcache.go
+ * Fail fast when a forward's target was just unreachable
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/* negCache remembers that a forward's target couldn't be reached, so clients
+which reconnect in a tight loop are failed locally for a while rather than each
+costing a dial (and, for L forwards, a channel open on the exit jump).  Clients
+failed without a dial are counted, and the count logged when the dial's next
+tried, to keep the logs readable.  A nil negCache always dials. */
+type negCache struct {
+	ttl time.Duration
+	dst string /* For logging */
+
+	l      sync.Mutex
+	err    error     /* Last dial's error, nil if it worked */
+	until  time.Time /* When to dial again */
+	failed int       /* Clients failed without a dial */
+}
+
+/* parseNegCache parses how long to remember a failed dial to dst */
+func parseNegCache(s, dst string) (*negCache, error) {
+	d, err := time.ParseDuration(s)
+	if nil != err {
+		return nil, err
+	}
+	if 0 >= d {
+		return nil, fmt.Errorf("duration must be positive")
+	}
+	return &negCache{ttl: d, dst: dst}, nil
+}
+
+/* Cached returns the error from the last dial if it failed recently enough
+that we shouldn't dial again, or nil if we should. */
+func (n *negCache) Cached() error {
+	if nil == n {
+		return nil
+	}
+	n.l.Lock()
+	defer n.l.Unlock()
+	if nil == n.err {
+		return nil
+	}
+	if time.Now().Before(n.until) {
+		n.failed++
+		return n.err
+	}
+	/* Time to try again */
+	if 0 != n.failed {
+		log.Printf(
+			"Failed %v connections to %v without dialing",
+			n.failed,
+			n.dst,
+		)
+	}
+	n.err = nil
+	n.failed = 0
+	return nil
+}
+
+/* Note records the result of a dial, err being nil if it worked */
+func (n *negCache) Note(err error) {
+	if nil == n {
+		return
+	}
+	n.l.Lock()
+	defer n.l.Unlock()
+	if nil == err {
+		n.err = nil
+		return
+	}
+	if nil == n.err {
+		log.Printf(
+			"Failing connections to %v without dialing for %v",
+			n.dst,
+			n.ttl,
+		)
+	}
+	n.err = err
+	n.until = time.Now().Add(n.ttl)
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package main
+
+/*
+ * netns_linux.go
+ * Network namespaces and VRFs on Linux
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+/* NETNSDIR is where ip(8) keeps named network namespaces */
+const NETNSDIR = "/var/run/netns"
+
+/* netnsSupported indicates network namespaces and VRFs work here */
+const netnsSupported = true
+
+/* inNetNS calls fn in the network namespace ns, which is either a path or a
+name in NETNSDIR.  Sockets fn creates stay in ns.  Namespaces are per-thread,
+so fn's called in a goroutine of its own, locked to its thread.  If the
+thread can't be put back in our namespace, the goroutine exits with the
+thread still locked, and the runtime throws the thread away rather than
+reusing it. */
+func inNetNS(ns string, fn func() error) error {
+	if !strings.Contains(ns, "/") {
+		ns = filepath.Join(NETNSDIR, ns)
+	}
+	target, err := os.Open(ns)
+	if nil != err {
+		return err
+	}
+	defer target.Close()
+
+	ech := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		ech <- inNetNSLocked(ns, target, fn)
+	}()
+	return <-ech
+}
+
+/* inNetNSLocked calls fn in the namespace target, named ns, on the current
+thread, which must be locked.  The thread's unlocked only if it's back in its
+original namespace. */
+func inNetNSLocked(ns string, target *os.File, fn func() error) error {
+	orig, err := os.Open(fmt.Sprintf(
+		"/proc/self/task/%v/ns/net",
+		unix.Gettid(),
+	))
+	if nil != err {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer orig.Close()
+	if err := unix.Setns(
+		int(target.Fd()),
+		unix.CLONE_NEWNET,
+	); nil != err {
+		/* Setns doesn't change anything if it fails */
+		runtime.UnlockOSThread()
+		return fmt.Errorf("entering %v: %v", ns, err)
+	}
+	ferr := fn()
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); nil != err {
+		return fmt.Errorf("leaving %v: %v", ns, err)
+	}
+	runtime.UnlockOSThread()
+	return ferr
+}
+
+/* bindToDevice binds the socket c to the device (e.g. a VRF) dev */
+func bindToDevice(c syscall.RawConn, dev string) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptString(
+			int(fd),
+			unix.SOL_SOCKET,
+			unix.SO_BINDTODEVICE,
+			dev,
+		)
+	}); nil != err {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package main
+
+/*
+ * netns_other.go
+ * Network namespace and VRF stubs for platforms which don't have them
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"syscall"
+)
+
+/* netnsSupported indicates network namespaces and VRFs work here */
+const netnsSupported = false
+
+/* errNoNetNS is returned on platforms without namespaces and VRFs */
+var errNoNetNS = errors.New("network namespaces and VRFs need Linux")
+
+/* inNetNS returns an error, as network namespaces are Linux-only. */
+func inNetNS(ns string, fn func() error) error {
+	return errNoNetNS
+}
+
+/* bindToDevice returns an error, as VRFs are Linux-only. */
+func bindToDevice(c syscall.RawConn, dev string) error {
+	return errNoNetNS
+}
@@ -0,0 +1,137 @@
+package main
+
+/*
+ * passphrase.go
+ * Decrypt passphrase-protected keys
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* PASSPHRASEENV is the environment variable which may hold a passphrase for
+encrypted keys */
+const PASSPHRASEENV = "SSHJUMP_KEY_PASSPHRASE"
+
+/* PASSPHRASETRIES is how many times the operator's asked for a key's
+passphrase */
+const PASSPHRASETRIES = 3
+
+/* keyPassphrases finds passphrases for encrypted keys, and remembers the ones
+which worked. */
+type keyPassphrases struct {
+	sync.Mutex
+	passfile []byte            /* From -passfile */
+	cache    map[string][]byte /* Key file -> working passphrase */
+	order    []string          /* Key files, in the order cached */
+}
+
+/* passphrases is where getKey gets passphrases */
+var passphrases = &keyPassphrases{cache: make(map[string][]byte)}
+
+/* SetPassFile reads a passphrase for encrypted keys from the first line of
+the file named fname. */
+func SetPassFile(fname string) error {
+	b, err := ioutil.ReadFile(fname)
+	if nil != err {
+		return err
+	}
+	if i := bytes.IndexAny(b, "\r\n"); -1 != i {
+		b = b[:i]
+	}
+	if 0 == len(b) {
+		return errors.New("empty passphrase")
+	}
+	passphrases.Lock()
+	defer passphrases.Unlock()
+	passphrases.passfile = b
+	return nil
+}
+
+/* Parse decrypts the encrypted key read from keyfile with parse, which should
+return x509.IncorrectPasswordError if the passphrase it's given is wrong.  The
+passphrase which last worked for keyfile is tried first, then those which
+worked for other keys, then the one from -passfile, then the one in the
+environment, and finally, if there's a terminal or askpass program, the
+operator is asked. */
+func (p *keyPassphrases) Parse(
+	keyfile string,
+	parse func(passphrase []byte) (ssh.Signer, error),
+) (ssh.Signer, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	/* Try what we already have */
+	cands := make([][]byte, 0, len(p.order)+3)
+	if pp, ok := p.cache[keyfile]; ok {
+		cands = append(cands, pp)
+	}
+	for _, k := range p.order {
+		if k != keyfile {
+			cands = append(cands, p.cache[k])
+		}
+	}
+	if nil != p.passfile {
+		cands = append(cands, p.passfile)
+	}
+	if e := os.Getenv(PASSPHRASEENV); "" != e {
+		cands = append(cands, []byte(e))
+	}
+	for _, pp := range cands {
+		s, err := parse(pp)
+		if nil == err {
+			p.remember(keyfile, pp)
+			return s, nil
+		} else if !errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, err
+		}
+	}
+
+	/* Ask the operator */
+	if !CanReadSecret() {
+		return nil, fmt.Errorf(
+			"key is encrypted, and no passphrase worked "+
+				"(try -passfile or %v)",
+			PASSPHRASEENV,
+		)
+	}
+	for i := 0; i < PASSPHRASETRIES; i++ {
+		pp, err := ReadSecret(
+			fmt.Sprintf("Passphrase for %v: ", keyfile),
+		)
+		if nil != err {
+			return nil, err
+		}
+		s, err := parse(pp)
+		if nil == err {
+			p.remember(keyfile, pp)
+			return s, nil
+		}
+		wipe(pp)
+		if !errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Incorrect passphrase\n")
+	}
+	return nil, errors.New("incorrect passphrase")
+}
+
+/* remember caches pp as keyfile's passphrase.  The caller must hold the
+lock. */
+func (p *keyPassphrases) remember(keyfile string, pp []byte) {
+	if _, ok := p.cache[keyfile]; !ok {
+		p.order = append(p.order, keyfile)
+	}
+	p.cache[keyfile] = pp
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package main
+
+/*
+ * peercred_linux.go
+ * Find out who's on the other end of a Unix socket
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+/* peerCredSupported indicates peerUID works here */
+const peerCredSupported = true
+
+/* peerUID returns the UID of the process on the other end of c. */
+func peerUID(c *net.UnixConn) (uint32, error) {
+	rc, err := c.SyscallConn()
+	if nil != err {
+		return 0, err
+	}
+	var (
+		cred *unix.Ucred
+		cerr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		cred, cerr = unix.GetsockoptUcred(
+			int(fd),
+			unix.SOL_SOCKET,
+			unix.SO_PEERCRED,
+		)
+	}); nil != err {
+		return 0, err
+	}
+	if nil != cerr {
+		return 0, cerr
+	}
+	return cred.Uid, nil
+}
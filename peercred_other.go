@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+/*
+ * peercred_other.go
+ * Peer credential stub for platforms where we don't get them
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"net"
+)
+
+/* peerCredSupported indicates peerUID works here */
+const peerCredSupported = false
+
+/* peerUID returns an error, as peer credentials are only checked on Linux. */
+func peerUID(c *net.UnixConn) (uint32, error) {
+	return 0, errNoPeerCred
+}
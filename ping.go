@@ -0,0 +1,263 @@
+package main
+
+/*
+ * ping.go
+ * ICMP reachability checks from the exit jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* ICMPPREFIX marks an exit test target as a host to ping */
+const ICMPPREFIX = "icmp:"
+
+/* PINGTIMEOUT is how long to wait for a ping reply */
+const PINGTIMEOUT = 5 * time.Second
+
+/* pingPayload is sent in our echo requests */
+var pingPayload = []byte("sshjump")
+
+/* PingMain is the entry point for the ping subcommand, which makes a chain and
+checks whether hosts respond to ICMP echo requests from the exit jump. */
+func PingMain(args []string) {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	var (
+		count = fs.Uint(
+			"c",
+			1,
+			"Ping each host `N` times",
+		)
+		interval = fs.Duration(
+			"i",
+			time.Second,
+			"Wait `interval` between pings",
+		)
+		helper = fs.String(
+			"helper",
+			"",
+			"Optional helper `binary` to upload and ping with, "+
+				"instead of the exit jump's ping",
+		)
+		helperPath = fs.String(
+			"helperpath",
+			"",
+			"Remote `path` for the uploaded helper, or an "+
+				"existing helper if -helper isn't given",
+		)
+	)
+	cf := addChainFlags(fs, "jumps")
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v ping [options] host [host...]
+
+Makes a chain and pings the hosts from the exit jump, either with a helper or
+the exit jump's own ping.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 0 == fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	/* Get to the exit */
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs, err := cf.makeChain(ctx, cancel)
+	if nil != err {
+		log.Fatalf("Unable to make SSH connections: %v", err)
+	}
+	defer CloseJumps(cs)
+	exit := cs[len(cs)-1]
+
+	/* Work out how to ping */
+	ping := func(h string) (time.Duration, error) {
+		return systemPing(exit, h, PINGTIMEOUT)
+	}
+	if "" != *helper || "" != *helperPath {
+		hc, err := StartHelper(exit, *helper, *helperPath)
+		if nil != err {
+			log.Fatalf("Unable to start helper: %v", err)
+		}
+		defer hc.Close()
+		ping = func(h string) (time.Duration, error) {
+			return hc.Ping(h, PINGTIMEOUT)
+		}
+	}
+
+	/* Ping ALL the hosts */
+	for i := uint(0); i < *count; i++ {
+		if 0 != i {
+			time.Sleep(*interval)
+		}
+		for _, h := range fs.Args() {
+			if nil != ctx.Err() {
+				return
+			}
+			rtt, err := ping(h)
+			if nil != err {
+				log.Printf("%v: %v", h, err)
+				continue
+			}
+			if 0 == rtt {
+				log.Printf("%v: alive", h)
+				continue
+			}
+			log.Printf("%v: alive, rtt %v", h, rtt)
+		}
+	}
+}
+
+/* testExitICMP returns true if the exit jump sc can ping target.  If local or
+remote isn't empty, a helper is started as by StartHelper to send the ping.
+Otherwise, the exit jump's own ping is used. */
+func testExitICMP(sc *ssh.Client, target, local, remote string) bool {
+	ping := func() error {
+		_, err := systemPing(sc, target, PINGTIMEOUT)
+		return err
+	}
+	if "" != local || "" != remote {
+		log.Printf("Pinging %v from the exit jump's helper", target)
+		ping = func() error {
+			hc, err := StartHelper(sc, local, remote)
+			if nil != err {
+				return fmt.Errorf("starting helper: %w", err)
+			}
+			defer hc.Close()
+			_, err = hc.Ping(target, PINGTIMEOUT)
+			return err
+		}
+	} else {
+		log.Printf("Pinging %v from the exit jump", target)
+	}
+	if err := ping(); nil != err {
+		log.Printf("Ping to %v failed: %v", target, err)
+		return false
+	}
+	log.Printf("Ping to %v successful", target)
+	return true
+}
+
+/* systemPing uses the ping command on sc to ping host once.  The round trip
+time isn't parsed out of ping's output, so 0 is returned on success. */
+func systemPing(
+	sc *ssh.Client,
+	host string,
+	to time.Duration,
+) (time.Duration, error) {
+	s, err := sc.NewSession()
+	if nil != err {
+		return 0, err
+	}
+	defer s.Close()
+	/* Don't wait forever for ping to give up */
+	t := time.AfterFunc(to, func() { s.Close() })
+	defer t.Stop()
+	o, err := s.CombinedOutput("ping -c 1 " + shellQuote(host))
+	if nil != err {
+		if l := lastLine(o); "" != l {
+			return 0, fmt.Errorf("%v (%v)", err, l)
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+/* lastLine returns the last non-blank line in b */
+func lastLine(b []byte) string {
+	ls := strings.Split(string(bytes.TrimSpace(b)), "\n")
+	return strings.TrimSpace(ls[len(ls)-1])
+}
+
+/* helperPing pings addr and returns the round trip time.  An unprivileged
+ICMP socket is tried first, falling back to a raw socket. */
+func helperPing(addr string, to time.Duration) (time.Duration, error) {
+	/* Work out what sort of ping we need */
+	ip, err := net.ResolveIPAddr("ip", addr)
+	if nil != err {
+		return 0, err
+	}
+	var (
+		dgram, raw, laddr string
+		proto             int
+		typ, reply        icmp.Type
+	)
+	if nil != ip.IP.To4() {
+		dgram, raw, laddr = "udp4", "ip4:icmp", "0.0.0.0"
+		proto = 1
+		typ, reply = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	} else {
+		dgram, raw, laddr = "udp6", "ip6:ipv6-icmp", "::"
+		proto = 58
+		typ, reply = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	/* Get a socket, and an address to which to send */
+	var dst net.Addr = &net.UDPAddr{IP: ip.IP, Zone: ip.Zone}
+	c, err := icmp.ListenPacket(dgram, laddr)
+	if nil != err {
+		if c, err = icmp.ListenPacket(raw, laddr); nil != err {
+			return 0, err
+		}
+		dst = ip
+	}
+	defer c.Close()
+
+	/* Send the ping */
+	seq := int(time.Now().UnixNano() & 0xFFFF)
+	b, err := (&icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{
+			ID:   os.Getpid() & 0xFFFF,
+			Seq:  seq,
+			Data: pingPayload,
+		},
+	}).Marshal(nil)
+	if nil != err {
+		return 0, err
+	}
+	start := time.Now()
+	c.SetDeadline(start.Add(to))
+	if _, err := c.WriteTo(b, dst); nil != err {
+		return 0, err
+	}
+
+	/* Wait for the reply */
+	rb := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(rb)
+		if nil != err {
+			return 0, err
+		}
+		m, err := icmp.ParseMessage(proto, rb[:n])
+		if nil != err || reply != m.Type {
+			continue
+		}
+		if e, ok := m.Body.(*icmp.Echo); ok && seq == e.Seq {
+			return time.Since(start), nil
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+/*
+ * pins.go
+ * Trust jumps' host keys on first use
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* What to do when a jump's host key doesn't match its pin */
+const (
+	PINREFUSE = "refuse" /* Don't use the jump */
+	PINWARN   = "warn"   /* Log the change and use the jump anyway */
+)
+
+/* How strictly jumps' host keys are checked, as OpenSSH's
+StrictHostKeyChecking */
+const (
+	HOSTKEYSTRICT    = "strict"     /* Only pinned or fp= keys */
+	HOSTKEYACCEPTNEW = "accept-new" /* Pin new keys, refuse changed ones */
+	HOSTKEYOFF       = "off"        /* Accept every key */
+)
+
+/* FPPREFIX starts host key fingerprints given with fp= */
+const FPPREFIX = "SHA256:"
+
+var (
+	/* errHostKeyChanged is returned when a jump's host key isn't the
+	pinned one */
+	errHostKeyChanged = errors.New("host key changed")
+
+	/* errHostKeyUnknown is returned by strict checking when a jump's host
+	key isn't pinned */
+	errHostKeyUnknown = errors.New("host key not pinned")
+
+	/* errHostKeyNotListed is returned when a jump's host key isn't one of
+	the ones given with fp= */
+	errHostKeyNotListed = errors.New("host key not listed with fp=")
+)
+
+/* hostPins holds the fingerprints of jumps' host keys, pinned the first time
+each jump's seen with each type of key, as with known_hosts.  A nil hostPins
+accepts every key not checked with fp=. */
+type hostPins struct {
+	sync.Mutex
+	fname    string
+	mode     string /* HOSTKEYSTRICT, HOSTKEYACCEPTNEW, or HOSTKEYOFF */
+	onChange string
+	pins     map[pinKey]string /* Fingerprints */
+}
+
+/* pinKey is what a pin's for: a jump's address and the type of its key.  The
+type's empty for pins from old files without types, which are for every
+type. */
+type pinKey struct {
+	host    string
+	keyType string
+}
+
+/* LoadHostPins loads the pins in the file named fname, which needn't exist,
+or keeps them only in memory if fname is empty.  New pins are appended to the
+file as they're made.  mode says how strictly keys are checked and onChange
+what to do when a host key doesn't match its pin, PINREFUSE or PINWARN, unless
+mode is HOSTKEYSTRICT.  Each line of the file is a jump's address, its host
+key's type, and the key's SHA256 fingerprint.  Lines without a type, from older
+files, pin the fingerprint for every type. */
+func LoadHostPins(fname, mode, onChange string) (*hostPins, error) {
+	switch mode {
+	case HOSTKEYSTRICT, HOSTKEYACCEPTNEW, HOSTKEYOFF:
+	default:
+		return nil, fmt.Errorf("unknown host key checking %q", mode)
+	}
+	switch onChange {
+	case PINREFUSE, PINWARN:
+	default:
+		return nil, fmt.Errorf("unknown pin change action %q", onChange)
+	}
+	p := &hostPins{
+		fname:    fname,
+		mode:     mode,
+		onChange: onChange,
+		pins:     make(map[pinKey]string),
+	}
+	if "" == fname {
+		return p, nil
+	}
+	b, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if nil != err {
+		return nil, err
+	}
+	for n, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fs := strings.Fields(l)
+		switch len(fs) {
+		case 2: /* Old, typeless */
+			p.pins[pinKey{host: fs[0]}] = fs[1]
+		case 3:
+			p.pins[pinKey{host: fs[0], keyType: fs[1]}] = fs[2]
+		default:
+			return nil, fmt.Errorf(
+				"line %v: need an address, key type, and "+
+					"fingerprint",
+				n+1,
+			)
+		}
+	}
+	return p, nil
+}
+
+/* Len returns the number of pinned host keys. */
+func (p *hostPins) Len() int {
+	if nil == p {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	return len(p.pins)
+}
+
+/* Check checks key, from the jump at hostname, against its pin for key's
+type, or pins it if it's not been seen before with that type.  It's an
+ssh.HostKeyCallback. */
+func (p *hostPins) Check(
+	hostname string,
+	remote net.Addr,
+	key ssh.PublicKey,
+) error {
+	if nil == p || HOSTKEYOFF == p.mode {
+		return nil
+	}
+	fp := ssh.FingerprintSHA256(key)
+	p.Lock()
+	defer p.Unlock()
+
+	/* First time, pin it, if we're allowed.  A typeless pin will do in
+	place of one for key's type. */
+	pk := pinKey{host: hostname, keyType: key.Type()}
+	pin, ok := p.pins[pk]
+	if !ok {
+		pin, ok = p.pins[pinKey{host: hostname}]
+	}
+	if !ok && HOSTKEYSTRICT == p.mode {
+		return fmt.Errorf(
+			"%w for %v: got %v %v",
+			errHostKeyUnknown,
+			hostname,
+			key.Type(),
+			fp,
+		)
+	}
+	if !ok {
+		if err := p.add(pk, fp); nil != err {
+			return fmt.Errorf("pinning host key: %w", err)
+		}
+		log.Printf(
+			"Pinned %v host key %v for %v",
+			key.Type(),
+			fp,
+			hostname,
+		)
+		return nil
+	}
+
+	/* Same as last time */
+	if pin == fp {
+		return nil
+	}
+	err := fmt.Errorf(
+		"%w for %v: pinned %v, got %v %v",
+		errHostKeyChanged,
+		hostname,
+		pin,
+		key.Type(),
+		fp,
+	)
+	if PINWARN == p.onChange && HOSTKEYSTRICT != p.mode {
+		log.Printf("Using jump anyway: %v", err)
+		return nil
+	}
+	return err
+}
+
+/* add appends a pin to the file, if there is one, and notes it.  p must be
+locked. */
+func (p *hostPins) add(pk pinKey, fp string) error {
+	if "" == p.fname {
+		p.pins[pk] = fp
+		return nil
+	}
+	f, err := os.OpenFile(
+		p.fname,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if nil != err {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%v %v %v\n", pk.host, pk.keyType, fp)
+	if cerr := f.Close(); nil == err {
+		err = cerr
+	}
+	if nil != err {
+		return err
+	}
+	p.pins[pk] = fp
+	return nil
+}
+
+/* HostKeyCallback returns the callback which checks j's host key.  If j has
+fingerprints from fp=, the key must match one of them and isn't pinned.
+Otherwise, the key's checked against its pin.  With HOSTKEYOFF, nothing's
+checked. */
+func (p *hostPins) HostKeyCallback(j jump) ssh.HostKeyCallback {
+	if 0 == len(j.fps) || (nil != p && HOSTKEYOFF == p.mode) {
+		return p.Check
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fp := ssh.FingerprintSHA256(key)
+		for _, f := range j.fps {
+			if f == fp {
+				return nil
+			}
+		}
+		return fmt.Errorf(
+			"%w for %v: got %v %v",
+			errHostKeyNotListed,
+			hostname,
+			key.Type(),
+			fp,
+		)
+	}
+}
@@ -0,0 +1,549 @@
+//go:build pkcs11 && cgo
+
+package main
+
+/*
+ * pkcs11.go
+ * Keys held on smartcards and HSMs, via PKCS#11
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ssh"
+)
+
+/* PKCS11PINENV is the environment variable which may hold a PKCS#11 token's
+PIN */
+const PKCS11PINENV = "SSHJUMP_PKCS11_PIN"
+
+/* pkcs11Supported indicates getPKCS11Key works in this build */
+const pkcs11Supported = true
+
+/* p11URI is the parts of an RFC 7512 PKCS#11 URI we understand */
+type p11URI struct {
+	module string /* module-path */
+	token  string /* token, the token label */
+	serial string /* serial */
+	slot   string /* slot-id */
+	object string /* object, the key's label */
+	id     []byte /* id */
+	pin    string /* pin-value, or read from pin-source */
+}
+
+/* p11 caches loaded modules and keys, as each module may only be initialized
+once and there's no point in logging in again every rebuild. */
+var p11 = struct {
+	sync.Mutex
+	mods map[string]*pkcs11.Ctx
+	keys map[string]ssh.Signer
+}{
+	mods: make(map[string]*pkcs11.Ctx),
+	keys: make(map[string]ssh.Signer),
+}
+
+/* PKCS#11 OIDs for the curves we know */
+var (
+	oidP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+/* digestInfos are the DER prefixes for PKCS#1 v1.5 signatures, as PKCS#11's
+CKM_RSA_PKCS only pads. */
+var digestInfos = map[crypto.Hash][]byte{
+	crypto.SHA1: {
+		0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02,
+		0x1a, 0x05, 0x00, 0x04, 0x14,
+	},
+	crypto.SHA256: {
+		0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+		0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20,
+	},
+	crypto.SHA512: {
+		0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+		0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40,
+	},
+}
+
+/* getPKCS11Key gets a signer for the key described by uri, an RFC 7512
+PKCS#11 URI.  Keys are cached, so each is only logged into once. */
+func getPKCS11Key(uri string) (ssh.Signer, error) {
+	p11.Lock()
+	defer p11.Unlock()
+	if s, ok := p11.keys[uri]; ok {
+		return s, nil
+	}
+
+	/* Work out what we're after */
+	u, err := parsePKCS11URI(uri)
+	if nil != err {
+		return nil, err
+	}
+	ctx, err := loadPKCS11Module(u.module)
+	if nil != err {
+		return nil, err
+	}
+	slot, err := findPKCS11Slot(ctx, u)
+	if nil != err {
+		return nil, err
+	}
+
+	/* Log in to the token */
+	sh, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if nil != err {
+		return nil, fmt.Errorf("opening session: %w", err)
+	}
+	if err := loginPKCS11(ctx, sh, slot, u); nil != err {
+		ctx.CloseSession(sh)
+		return nil, err
+	}
+
+	/* Find the key and make a signer from it */
+	k, err := findPKCS11Key(ctx, sh, u)
+	if nil != err {
+		ctx.CloseSession(sh)
+		return nil, err
+	}
+	s, err := ssh.NewSignerFromSigner(k)
+	if nil != err {
+		ctx.CloseSession(sh)
+		return nil, err
+	}
+	p11.keys[uri] = s
+	return s, nil
+}
+
+/* parsePKCS11URI parses the bits of an RFC 7512 URI we understand.  Unknown
+attributes are an error, so a typo doesn't pick the wrong key. */
+func parsePKCS11URI(uri string) (p11URI, error) {
+	var u p11URI
+	if !strings.HasPrefix(uri, PKCS11PREFIX) {
+		return u, fmt.Errorf("missing %q", PKCS11PREFIX)
+	}
+	path, query := strings.TrimPrefix(uri, PKCS11PREFIX), ""
+	if i := strings.IndexByte(path, '?'); -1 != i {
+		path, query = path[:i], path[i+1:]
+	}
+	var pinSource string
+	for _, kvs := range []struct {
+		s   string
+		sep string
+	}{{path, ";"}, {query, "&"}} {
+		for _, a := range strings.Split(kvs.s, kvs.sep) {
+			if "" == a {
+				continue
+			}
+			kv := strings.SplitN(a, "=", 2)
+			if 2 != len(kv) {
+				return u, fmt.Errorf("invalid attribute %q", a)
+			}
+			v, err := url.PathUnescape(kv[1])
+			if nil != err {
+				return u, fmt.Errorf("%v: %w", kv[0], err)
+			}
+			switch kv[0] {
+			case "module-path":
+				u.module = v
+			case "token":
+				u.token = v
+			case "serial":
+				u.serial = v
+			case "slot-id":
+				u.slot = v
+			case "object":
+				u.object = v
+			case "id":
+				u.id = []byte(v)
+			case "pin-value":
+				u.pin = v
+			case "pin-source":
+				pinSource = v
+			case "type":
+				if "private" != v {
+					return u, errors.New(
+						"type must be private",
+					)
+				}
+			default:
+				return u, fmt.Errorf(
+					"unsupported attribute %q",
+					kv[0],
+				)
+			}
+		}
+	}
+	if "" == u.module {
+		return u, errors.New("need a module-path")
+	}
+	if "" != pinSource {
+		b, err := ioutil.ReadFile(strings.TrimPrefix(
+			pinSource,
+			"file:",
+		))
+		if nil != err {
+			return u, fmt.Errorf("reading PIN: %w", err)
+		}
+		if i := bytes.IndexAny(b, "\r\n"); -1 != i {
+			b = b[:i]
+		}
+		u.pin = string(b)
+	}
+	return u, nil
+}
+
+/* loadPKCS11Module loads and initializes the module at path, or returns the
+one already loaded.  The caller must hold p11's lock. */
+func loadPKCS11Module(path string) (*pkcs11.Ctx, error) {
+	if ctx, ok := p11.mods[path]; ok {
+		return ctx, nil
+	}
+	ctx := pkcs11.New(path)
+	if nil == ctx {
+		return nil, fmt.Errorf("unable to load module %v", path)
+	}
+	if err := ctx.Initialize(); nil != err && !errors.Is(
+		err,
+		pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED),
+	) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("initializing %v: %w", path, err)
+	}
+	p11.mods[path] = ctx
+	return ctx, nil
+}
+
+/* findPKCS11Slot finds the one slot with a token matching u */
+func findPKCS11Slot(ctx *pkcs11.Ctx, u p11URI) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if nil != err {
+		return 0, fmt.Errorf("listing slots: %w", err)
+	}
+	var found []uint
+	for _, s := range slots {
+		if "" != u.slot && strconv.FormatUint(uint64(s), 10) != u.slot {
+			continue
+		}
+		ti, err := ctx.GetTokenInfo(s)
+		if nil != err {
+			return 0, fmt.Errorf(
+				"getting token in slot %v: %w",
+				s,
+				err,
+			)
+		}
+		if "" != u.token && strings.TrimRight(ti.Label, "\x00") !=
+			u.token {
+			continue
+		}
+		if "" != u.serial && strings.TrimRight(
+			ti.SerialNumber,
+			"\x00",
+		) != u.serial {
+			continue
+		}
+		found = append(found, s)
+	}
+	switch len(found) {
+	case 0:
+		return 0, errors.New("no matching token")
+	case 1:
+		return found[0], nil
+	default:
+		return 0, fmt.Errorf(
+			"%v matching tokens, need token, serial, or slot-id",
+			len(found),
+		)
+	}
+}
+
+/* loginPKCS11 logs in to the token in slot.  The PIN comes from u, then the
+environment, then ReadSecret.  Tokens with their own PIN pad get no PIN. */
+func loginPKCS11(
+	ctx *pkcs11.Ctx,
+	sh pkcs11.SessionHandle,
+	slot uint,
+	u p11URI,
+) error {
+	ti, err := ctx.GetTokenInfo(slot)
+	if nil != err {
+		return fmt.Errorf("getting token info: %w", err)
+	}
+	if 0 == ti.Flags&pkcs11.CKF_LOGIN_REQUIRED {
+		return nil
+	}
+	pin := u.pin
+	if "" == pin && 0 == ti.Flags&pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH {
+		pin = os.Getenv(PKCS11PINENV)
+		if "" == pin && CanReadSecret() {
+			b, err := ReadSecret(
+				fmt.Sprintf("PIN for %v: ", ti.Label),
+			)
+			if nil != err {
+				return err
+			}
+			pin = string(b)
+			wipe(b)
+		}
+		if "" == pin {
+			return fmt.Errorf(
+				"token needs a PIN (try pin-source or %v)",
+				PKCS11PINENV,
+			)
+		}
+	}
+	err = ctx.Login(sh, pkcs11.CKU_USER, pin)
+	if nil != err && !errors.Is(
+		err,
+		pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN),
+	) {
+		return fmt.Errorf("logging in: %w", err)
+	}
+	return nil
+}
+
+/* findPKCS11Key finds the one private key matching u, and its public key. */
+func findPKCS11Key(
+	ctx *pkcs11.Ctx,
+	sh pkcs11.SessionHandle,
+	u p11URI,
+) (*p11Key, error) {
+	/* Find the private key */
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if "" != u.object {
+		tmpl = append(tmpl, pkcs11.NewAttribute(
+			pkcs11.CKA_LABEL,
+			u.object,
+		))
+	}
+	if nil != u.id {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, u.id))
+	}
+	objs, err := findPKCS11Objects(ctx, sh, tmpl)
+	if nil != err {
+		return nil, err
+	}
+	switch len(objs) {
+	case 0:
+		return nil, errors.New("no matching private key")
+	case 1:
+	default:
+		return nil, fmt.Errorf(
+			"%v matching private keys, need object or id",
+			len(objs),
+		)
+	}
+	k := &p11Key{ctx: ctx, sh: sh, o: objs[0]}
+
+	/* Work out its public key */
+	as, err := ctx.GetAttributeValue(sh, k.o, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if nil != err {
+		return nil, fmt.Errorf("getting key type: %w", err)
+	}
+	kt, id := p11Uint(as[0].Value), as[1].Value
+	switch kt {
+	case pkcs11.CKK_RSA:
+		as, err := ctx.GetAttributeValue(sh, k.o, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if nil != err {
+			return nil, fmt.Errorf(
+				"getting RSA public key: %w",
+				err,
+			)
+		}
+		k.pub = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(as[0].Value),
+			E: int(new(big.Int).SetBytes(as[1].Value).Int64()),
+		}
+	case pkcs11.CKK_EC:
+		/* The point's only on the public key object */
+		pos, err := findPKCS11Objects(ctx, sh, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(
+				pkcs11.CKA_CLASS,
+				pkcs11.CKO_PUBLIC_KEY,
+			),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		})
+		if nil != err {
+			return nil, err
+		}
+		if 1 != len(pos) {
+			return nil, fmt.Errorf(
+				"found %v public keys for private key",
+				len(pos),
+			)
+		}
+		if k.pub, err = pkcs11ECPublicKey(ctx, sh, pos[0]); nil != err {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %v", kt)
+	}
+	return k, nil
+}
+
+/* findPKCS11Objects finds the objects matching tmpl */
+func findPKCS11Objects(
+	ctx *pkcs11.Ctx,
+	sh pkcs11.SessionHandle,
+	tmpl []*pkcs11.Attribute,
+) ([]pkcs11.ObjectHandle, error) {
+	if err := ctx.FindObjectsInit(sh, tmpl); nil != err {
+		return nil, fmt.Errorf("searching for keys: %w", err)
+	}
+	defer ctx.FindObjectsFinal(sh)
+	var objs []pkcs11.ObjectHandle
+	for {
+		o, _, err := ctx.FindObjects(sh, 16)
+		if nil != err {
+			return nil, fmt.Errorf("searching for keys: %w", err)
+		}
+		if 0 == len(o) {
+			return objs, nil
+		}
+		objs = append(objs, o...)
+	}
+}
+
+/* pkcs11ECPublicKey gets the ECDSA public key o */
+func pkcs11ECPublicKey(
+	ctx *pkcs11.Ctx,
+	sh pkcs11.SessionHandle,
+	o pkcs11.ObjectHandle,
+) (*ecdsa.PublicKey, error) {
+	as, err := ctx.GetAttributeValue(sh, o, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if nil != err {
+		return nil, fmt.Errorf("getting ECDSA public key: %w", err)
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(as[0].Value, &oid); nil != err {
+		return nil, fmt.Errorf("parsing curve: %w", err)
+	}
+	var c elliptic.Curve
+	switch {
+	case oid.Equal(oidP256):
+		c = elliptic.P256()
+	case oid.Equal(oidP384):
+		c = elliptic.P384()
+	case oid.Equal(oidP521):
+		c = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %v", oid)
+	}
+	/* The point should be wrapped in an OCTET STRING, but not every
+	module does. */
+	pt := as[1].Value
+	var inner []byte
+	if _, err := asn1.Unmarshal(pt, &inner); nil == err {
+		pt = inner
+	}
+	x, y := elliptic.Unmarshal(c, pt)
+	if nil == x {
+		return nil, errors.New("invalid ECDSA public key")
+	}
+	return &ecdsa.PublicKey{Curve: c, X: x, Y: y}, nil
+}
+
+/* p11Uint decodes the native-endian CK_ULONG in b */
+func p11Uint(b []byte) uint {
+	switch len(b) {
+	case 4:
+		return uint(binary.NativeEndian.Uint32(b))
+	case 8:
+		return uint(binary.NativeEndian.Uint64(b))
+	default:
+		return 0
+	}
+}
+
+/* p11Key is a crypto.Signer backed by a private key on a token */
+type p11Key struct {
+	l   sync.Mutex /* Sessions aren't safe for concurrent use */
+	ctx *pkcs11.Ctx
+	sh  pkcs11.SessionHandle
+	o   pkcs11.ObjectHandle
+	pub crypto.PublicKey
+}
+
+/* Public returns k's public key */
+func (k *p11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+/* Sign has the token sign digest */
+func (k *p11Key) Sign(
+	rand io.Reader,
+	digest []byte,
+	opts crypto.SignerOpts,
+) ([]byte, error) {
+	k.l.Lock()
+	defer k.l.Unlock()
+	switch k.pub.(type) {
+	case *rsa.PublicKey:
+		di, ok := digestInfos[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf(
+				"unsupported hash %v",
+				opts.HashFunc(),
+			)
+		}
+		return k.sign(
+			pkcs11.CKM_RSA_PKCS,
+			append(append([]byte{}, di...), digest...),
+		)
+	case *ecdsa.PublicKey:
+		/* PKCS#11 gives us r||s, but crypto.Signer wants DER */
+		rs, err := k.sign(pkcs11.CKM_ECDSA, digest)
+		if nil != err {
+			return nil, err
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(rs[:len(rs)/2]),
+			new(big.Int).SetBytes(rs[len(rs)/2:]),
+		})
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
+
+/* sign signs data with mechanism m.  The caller must hold k's lock. */
+func (k *p11Key) sign(m uint, data []byte) ([]byte, error) {
+	if err := k.ctx.SignInit(
+		k.sh,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(m, nil)},
+		k.o,
+	); nil != err {
+		return nil, err
+	}
+	return k.ctx.Sign(k.sh, data)
+}
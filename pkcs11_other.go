@@ -0,0 +1,28 @@
+//go:build !pkcs11 || !cgo
+
+package main
+
+/*
+ * pkcs11_other.go
+ * PKCS#11 stub for builds without it
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* pkcs11Supported indicates getPKCS11Key works in this build */
+const pkcs11Supported = false
+
+/* getPKCS11Key returns an error, as PKCS#11 needs cgo and the pkcs11 build
+tag. */
+func getPKCS11Key(uri string) (ssh.Signer, error) {
+	return nil, errors.New(
+		"PKCS#11 support needs building with cgo and -tags pkcs11",
+	)
+}
@@ -0,0 +1,152 @@
+package main
+
+/*
+ * policy.go
+ * Starlark scripts deciding where connections go
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"golang.org/x/crypto/ssh"
+)
+
+/* POLICYFUNC is the function in the policy script called for every
+connection */
+const POLICYFUNC = "route"
+
+/* POLICYMAXSTEPS limits how much work the policy script may do for one
+connection, so a buggy script can't hang connections forever */
+const POLICYMAXSTEPS = 1000000
+
+/* errPolicyDenied is returned by Route when the policy script doesn't allow a
+connection */
+var errPolicyDenied = errors.New("denied by policy")
+
+/* routePolicy calls a Starlark script's POLICYFUNC to decide whether each
+connection's allowed and, if so, from which jump it's made. */
+type routePolicy struct {
+	fname string
+	route starlark.Callable
+}
+
+/* LoadRoutePolicy loads the policy script in the file named fname, which must
+define POLICYFUNC. */
+func LoadRoutePolicy(fname string) (*routePolicy, error) {
+	th := &starlark.Thread{Name: fname, Print: policyPrint}
+	gs, err := starlark.ExecFile(th, fname, nil, nil)
+	if nil != err {
+		return nil, err
+	}
+	gs.Freeze()
+	r, ok := gs[POLICYFUNC].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("no %v function", POLICYFUNC)
+	}
+	return &routePolicy{fname: fname, route: r}, nil
+}
+
+/* policyPrint logs the policy script's print()s */
+func policyPrint(th *starlark.Thread, msg string) {
+	log.Printf("[%v] %v", th.Name, msg)
+}
+
+/* Route asks the policy script about a connection to addr via the chain cs,
+and returns the number of the jump, from 1, from which to connect.  If the
+connection's not allowed, an error wrapping errPolicyDenied is returned.
+
+The script's POLICYFUNC is passed a struct with the connection's network, addr,
+host, and port, and jumps, a list of the chain's jumps' labels or, for jumps
+without labels, user@host.  It returns True to connect from the exit jump as
+usual, False or None to deny the connection, a jump number (negative to count
+from the exit, so -1 is the exit), or a jump's label, host, or user@host. */
+func (p *routePolicy) Route(
+	cs []*ssh.Client,
+	network string,
+	addr string,
+) (int, error) {
+	/* What the script gets */
+	h, ps, err := net.SplitHostPort(addr)
+	if nil != err {
+		h, ps = addr, "0"
+	}
+	port, _ := strconv.Atoi(ps)
+	js := make([]jump, len(cs))
+	jl := make([]starlark.Value, len(cs))
+	for i, c := range cs {
+		js[i], _ = state.JumpOf(c)
+		n := js[i].label
+		if "" == n {
+			n = js[i].username + "@" + js[i].host
+		}
+		jl[i] = starlark.String(n)
+	}
+	conn := starlarkstruct.FromStringDict(
+		starlark.String("conn"),
+		starlark.StringDict{
+			"network": starlark.String(network),
+			"addr":    starlark.String(addr),
+			"host":    starlark.String(h),
+			"port":    starlark.MakeInt(port),
+			"jumps":   starlark.NewList(jl),
+		},
+	)
+
+	/* Ask it */
+	th := &starlark.Thread{Name: p.fname, Print: policyPrint}
+	th.SetMaxExecutionSteps(POLICYMAXSTEPS)
+	v, err := starlark.Call(th, p.route, starlark.Tuple{conn}, nil)
+	if nil != err {
+		return 0, fmt.Errorf("%w: %v", errPolicyDenied, err)
+	}
+
+	/* Work out what it said */
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return 0, errPolicyDenied
+	case starlark.Bool:
+		if !v {
+			return 0, errPolicyDenied
+		}
+		return len(cs), nil
+	case starlark.Int:
+		n, ok := v.Int64()
+		if ok && 0 > n {
+			n += int64(len(cs)) + 1
+		}
+		if !ok || 1 > n || int64(len(cs)) < n {
+			return 0, fmt.Errorf(
+				"%w: no jump %v in a chain of %v",
+				errPolicyDenied,
+				v,
+				len(cs),
+			)
+		}
+		return int(n), nil
+	case starlark.String:
+		for i, j := range js {
+			for _, n := range jumpNames(j) {
+				if string(v) == n {
+					return i + 1, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("%w: no jump %v", errPolicyDenied, v)
+	default:
+		return 0, fmt.Errorf(
+			"%w: unexpected %v from %v",
+			errPolicyDenied,
+			v.Type(),
+			POLICYFUNC,
+		)
+	}
+}
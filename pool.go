@@ -0,0 +1,71 @@
+package main
+
+/*
+ * pool.go
+ * Reusable goroutines for proxying
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"expvar"
+	"time"
+)
+
+/* POOLIDLE is how long a pooled goroutine waits for more work before
+exiting.  It's shorter than LEAKWAIT, so -debug doesn't take idle goroutines
+for leaks. */
+const POOLIDLE = 3 * time.Second
+
+/* proxyPool runs the goroutines which handle forwarded connections */
+var proxyPool = &goPool{
+	idle: POOLIDLE,
+	work: make(chan func()),
+}
+
+/* Pool counters, served as JSON from /debug/vars with -pprof */
+var (
+	/* poolGoroutines is the number of goroutines in proxyPool */
+	poolGoroutines = expvar.NewInt("pool_goroutines")
+	/* poolIdle is the number of proxyPool's goroutines waiting for
+	work */
+	poolIdle = expvar.NewInt("pool_idle")
+)
+
+/* goPool runs functions on goroutines which stick around for a while after
+they finish, so relays with lots of short-lived connections don't start (and
+grow the stacks of) several new goroutines for each. */
+type goPool struct {
+	idle time.Duration
+	work chan func() /* Unbuffered, so sends only go to idle goroutines */
+}
+
+/* Go runs f on an idle goroutine, or a new one if none are idle */
+func (p *goPool) Go(f func()) {
+	select {
+	case p.work <- f:
+	default:
+		poolGoroutines.Add(1)
+		go p.run(f)
+	}
+}
+
+/* run runs f and then whatever else it's given, until it's been idle for
+p.idle. */
+func (p *goPool) run(f func()) {
+	defer poolGoroutines.Add(-1)
+	for {
+		f()
+		poolIdle.Add(1)
+		t := time.NewTimer(p.idle)
+		select {
+		case f = <-p.work:
+			t.Stop()
+			poolIdle.Add(-1)
+		case <-t.C:
+			poolIdle.Add(-1)
+			return
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+/*
+ * ppk.go
+ * Parse PuTTY's private key files
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+/* PPKPREFIX starts PuTTY private key files */
+const PPKPREFIX = "PuTTY-User-Key-File-"
+
+/* ppkFile holds the parsed contents of a PPK file */
+type ppkFile struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+	headers    map[string]string /* Everything else, e.g. Argon2 bits */
+}
+
+/* errMismatchedPPK is returned when a PPK file's private key isn't for its
+public key */
+var errMismatchedPPK = errors.New("private key doesn't match public key")
+
+/* isPPK returns true if b looks like a PPK file */
+func isPPK(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(PPKPREFIX))
+}
+
+/* ppkEncrypted returns true if the PPK file in b needs a passphrase */
+func ppkEncrypted(b []byte) (bool, error) {
+	f, err := readPPK(b)
+	if nil != err {
+		return false, err
+	}
+	return "none" != f.encryption, nil
+}
+
+/* parsePPK parses the PPK file in b, which is decrypted with passphrase if
+it's encrypted.  An incorrect passphrase returns
+x509.IncorrectPasswordError. */
+func parsePPK(b, passphrase []byte) (ssh.Signer, error) {
+	f, err := readPPK(b)
+	if nil != err {
+		return nil, err
+	}
+
+	/* Work out the keys */
+	var ck, iv, mk []byte
+	var mh func() hash.Hash
+	switch f.version {
+	case 2:
+		mh = sha1.New
+		mkh := sha1.New()
+		mkh.Write([]byte("putty-private-key-file-mac-key"))
+		if "none" != f.encryption {
+			mkh.Write(passphrase)
+			ck = make([]byte, 0, 40)
+			for _, seq := range []byte{0, 1} {
+				h := sha1.New()
+				h.Write([]byte{0, 0, 0, seq})
+				h.Write(passphrase)
+				ck = h.Sum(ck)
+			}
+			ck = ck[:32]
+			iv = make([]byte, aes.BlockSize)
+		}
+		mk = mkh.Sum(nil)
+	case 3:
+		mh = sha256.New
+		if "none" != f.encryption {
+			k, err := f.argon2(passphrase)
+			if nil != err {
+				return nil, err
+			}
+			ck, iv, mk = k[:32], k[32:48], k[48:]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PPK version %v", f.version)
+	}
+
+	/* Decrypt if we need to */
+	priv := f.private
+	switch f.encryption {
+	case "none":
+	case "aes256-cbc":
+		if 0 != len(priv)%aes.BlockSize {
+			return nil, errors.New(
+				"private key isn't a whole number of blocks",
+			)
+		}
+		bc, err := aes.NewCipher(ck)
+		if nil != err {
+			return nil, err
+		}
+		priv = make([]byte, len(f.private))
+		cipher.NewCBCDecrypter(bc, iv).CryptBlocks(priv, f.private)
+	default:
+		return nil, fmt.Errorf(
+			"unsupported encryption %q",
+			f.encryption,
+		)
+	}
+
+	/* Only the signer needs the key, after this */
+	defer wipe(priv, f.private, ck, mk)
+
+	/* Make sure we got it right */
+	m := hmac.New(mh, mk)
+	for _, v := range [][]byte{
+		[]byte(f.algorithm),
+		[]byte(f.encryption),
+		[]byte(f.comment),
+		f.public,
+		priv,
+	} {
+		m.Write(ssh.Marshal(struct{ B []byte }{v}))
+	}
+	if !hmac.Equal(m.Sum(nil), f.mac) {
+		if "none" != f.encryption {
+			return nil, x509.IncorrectPasswordError
+		}
+		return nil, errors.New("MAC mismatch, file may be corrupt")
+	}
+
+	return ppkSigner(f.algorithm, f.public, priv)
+}
+
+/* readPPK splits the PPK file in b into its parts */
+func readPPK(b []byte) (*ppkFile, error) {
+	f := &ppkFile{headers: make(map[string]string)}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	/* readLines reads n lines of base64 */
+	readLines := func(ns string) ([]byte, error) {
+		n, err := strconv.Atoi(ns)
+		if nil != err {
+			return nil, fmt.Errorf("invalid line count %q", ns)
+		}
+		var sb strings.Builder
+		for i := 0; i < n; i++ {
+			if !s.Scan() {
+				return nil, errors.New("file ended early")
+			}
+			sb.WriteString(strings.TrimSpace(s.Text()))
+		}
+		return base64.StdEncoding.DecodeString(sb.String())
+	}
+	var err error
+	for s.Scan() {
+		l := strings.TrimRight(s.Text(), "\r")
+		if "" == l {
+			continue
+		}
+		parts := strings.SplitN(l, ": ", 2)
+		if 2 != len(parts) {
+			return nil, fmt.Errorf("invalid line %q", l)
+		}
+		k, v := parts[0], parts[1]
+		switch {
+		case strings.HasPrefix(k, PPKPREFIX):
+			f.version, err = strconv.Atoi(strings.TrimPrefix(
+				k,
+				PPKPREFIX,
+			))
+			f.algorithm = v
+		case "Encryption" == k:
+			f.encryption = v
+		case "Comment" == k:
+			f.comment = v
+		case "Public-Lines" == k:
+			f.public, err = readLines(v)
+		case "Private-Lines" == k:
+			f.private, err = readLines(v)
+		case "Private-MAC" == k:
+			f.mac, err = hex.DecodeString(v)
+		default:
+			f.headers[k] = v
+		}
+		if nil != err {
+			return nil, fmt.Errorf("%v: %v", k, err)
+		}
+	}
+	if err := s.Err(); nil != err {
+		return nil, err
+	}
+	if "" == f.algorithm || "" == f.encryption || nil == f.public ||
+		nil == f.private || nil == f.mac {
+		return nil, errors.New("incomplete PPK file")
+	}
+	return f, nil
+}
+
+/* argon2 derives the cipher key, IV, and MAC key for a v3 PPK file from
+passphrase. */
+func (f *ppkFile) argon2(passphrase []byte) ([]byte, error) {
+	var ps [3]uint64
+	for i, k := range []string{
+		"Argon2-Memory",
+		"Argon2-Passes",
+		"Argon2-Parallelism",
+	} {
+		n, err := strconv.ParseUint(f.headers[k], 10, 32)
+		if nil != err {
+			return nil, fmt.Errorf("invalid %v %q", k, f.headers[k])
+		}
+		ps[i] = n
+	}
+	if 0xFF < ps[2] || 0 == ps[2] {
+		return nil, fmt.Errorf("invalid Argon2-Parallelism %v", ps[2])
+	}
+	salt, err := hex.DecodeString(f.headers["Argon2-Salt"])
+	if nil != err {
+		return nil, fmt.Errorf("invalid Argon2-Salt: %v", err)
+	}
+	kf := argon2.IDKey
+	switch f.headers["Key-Derivation"] {
+	case "Argon2id":
+	case "Argon2i":
+		kf = argon2.Key
+	default:
+		return nil, fmt.Errorf(
+			"unsupported key derivation %q",
+			f.headers["Key-Derivation"],
+		)
+	}
+	return kf(
+		passphrase,
+		salt,
+		uint32(ps[1]),
+		uint32(ps[0]),
+		uint8(ps[2]),
+		32+aes.BlockSize+32,
+	), nil
+}
+
+/* ppkSigner makes a signer from a PPK file's public and decrypted private
+blobs. */
+func ppkSigner(algorithm string, pub, priv []byte) (ssh.Signer, error) {
+	var k interface{}
+	switch algorithm {
+	case ssh.KeyAlgoRSA:
+		var pu struct {
+			Type string
+			E    *big.Int
+			N    *big.Int
+		}
+		var pr struct {
+			D    *big.Int
+			P    *big.Int
+			Q    *big.Int
+			IQMP *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := unmarshalPPK(pub, &pu, priv, &pr); nil != err {
+			return nil, err
+		}
+		rk := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: pu.N, E: int(pu.E.Int64())},
+			D:         pr.D,
+			Primes:    []*big.Int{pr.P, pr.Q},
+		}
+		if err := rk.Validate(); nil != err {
+			return nil, err
+		}
+		rk.Precompute()
+		k = rk
+	case ssh.KeyAlgoDSA:
+		var pu struct {
+			Type       string
+			P, Q, G, Y *big.Int
+		}
+		var pr struct {
+			X    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := unmarshalPPK(pub, &pu, priv, &pr); nil != err {
+			return nil, err
+		}
+		k = &dsa.PrivateKey{
+			PublicKey: dsa.PublicKey{
+				Parameters: dsa.Parameters{
+					P: pu.P,
+					Q: pu.Q,
+					G: pu.G,
+				},
+				Y: pu.Y,
+			},
+			X: pr.X,
+		}
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var pu struct {
+			Type  string
+			Curve string
+			Q     []byte
+		}
+		var pr struct {
+			D    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := unmarshalPPK(pub, &pu, priv, &pr); nil != err {
+			return nil, err
+		}
+		var c elliptic.Curve
+		switch algorithm {
+		case ssh.KeyAlgoECDSA256:
+			c = elliptic.P256()
+		case ssh.KeyAlgoECDSA384:
+			c = elliptic.P384()
+		default:
+			c = elliptic.P521()
+		}
+		ek := &ecdsa.PrivateKey{D: pr.D}
+		ek.Curve = c
+		ek.X, ek.Y = c.ScalarBaseMult(pr.D.Bytes())
+		/* Make sure the private key matches the public one */
+		x, y := elliptic.Unmarshal(c, pu.Q)
+		if nil == x || 0 != x.Cmp(ek.X) || 0 != y.Cmp(ek.Y) {
+			return nil, errMismatchedPPK
+		}
+		k = ek
+	case ssh.KeyAlgoED25519:
+		var pu struct {
+			Type string
+			Key  []byte
+		}
+		var pr struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := unmarshalPPK(pub, &pu, priv, &pr); nil != err {
+			return nil, err
+		}
+		/* PuTTY stores the seed as a little-endian integer, so it
+		may have lost trailing zeros. */
+		if ed25519.SeedSize < len(pr.Key) {
+			return nil, errors.New("invalid ed25519 private key")
+		}
+		seed := make([]byte, ed25519.SeedSize)
+		copy(seed, pr.Key)
+		ek := ed25519.NewKeyFromSeed(seed)
+		wipe(seed)
+		if !bytes.Equal(ek.Public().(ed25519.PublicKey), pu.Key) {
+			return nil, errMismatchedPPK
+		}
+		k = ek
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", algorithm)
+	}
+	return ssh.NewSignerFromKey(k)
+}
+
+/* unmarshalPPK unmarshals a PPK file's public and private blobs into pu and
+pr, which must have a Rest field to take the private blob's padding. */
+func unmarshalPPK(
+	pub []byte,
+	pu interface{},
+	priv []byte,
+	pr interface{},
+) error {
+	if err := ssh.Unmarshal(pub, pu); nil != err {
+		return fmt.Errorf("parsing public key: %w", err)
+	}
+	if err := ssh.Unmarshal(priv, pr); nil != err {
+		return fmt.Errorf("parsing private key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+/*
+ * pprof.go
+ * Serve profiles and internal counters
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+/* Internal counters, served as JSON from /debug/vars with -pprof */
+var (
+	/* fwdGoroutines is the number of goroutines handling each forward's
+	connections, keyed by fwdspec */
+	fwdGoroutines = expvar.NewMap("forward_goroutines")
+	/* chanOpens is the number of channels being opened on the exit
+	jump */
+	chanOpens = expvar.NewInt("channel_opens_in_flight")
+)
+
+func init() {
+	expvar.Publish("proxied_sockets", expvar.Func(func() any {
+		return ConnCount()
+	}))
+	expvar.Publish("build", expvar.Func(func() any {
+		return BuildInfo()
+	}))
+}
+
+/* isPprofSocket returns true if addr, from -pprof, is a Unix socket's path
+and not a TCP address. */
+func isPprofSocket(addr string) bool {
+	return strings.Contains(addr, "/")
+}
+
+/* StartPprof serves net/http/pprof's profiles and the internal counters on
+addr, which is either a TCP address or, if it contains a slash, the path to a
+Unix socket.  As with the control socket, any stale socket is removed and the
+socket's permissions are set to perm.  If token isn't nil, clients must send
+it as a bearer token.  A TCP address requires a token, as the counters list
+the chain.  The server runs until the returned listener is closed. */
+func StartPprof(
+	addr string,
+	perm os.FileMode,
+	token []byte,
+) (net.Listener, error) {
+	/* Work out where to listen */
+	var (
+		l   net.Listener
+		err error
+	)
+	if isPprofSocket(addr) {
+		if l, err = listenUnix(addr, perm); nil != err {
+			return nil, err
+		}
+	} else {
+		if nil == token {
+			return nil, errors.New(
+				"a TCP address needs -controltoken",
+			)
+		}
+		if l, err = net.Listen("tcp", addr); nil != err {
+			return nil, err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	log.Printf("Serving profiles and counters on %v", l.Addr())
+	go func() {
+		err := http.Serve(l, pprofAuth(mux, token))
+		log.Printf("Profile server on %v stopped: %v", l.Addr(), err)
+	}()
+	return l, nil
+}
+
+/* pprofAuth wraps h so that requests without token as their bearer token are
+refused.  If token is nil, h is returned as-is. */
+func pprofAuth(h http.Handler, token []byte) http.Handler {
+	if nil == token {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := strings.CutPrefix(
+			r.Header.Get("Authorization"),
+			"Bearer ",
+		)
+		if !ok || 1 != subtle.ConstantTimeCompare([]byte(t), token) {
+			log.Printf(
+				"Rejected unauthenticated profile client %v",
+				r.RemoteAddr,
+			)
+			http.Error(
+				w,
+				"authentication failed",
+				http.StatusUnauthorized,
+			)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+/*
+ * priority.go
+ * Give interactive forwards preference over bulk forwards
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+/* Forward priority classes */
+const (
+	PRIOINTERACTIVE = "interactive"
+	PRIOBULK        = "bulk"
+)
+
+const (
+	/* prioIdle is how long after interactive traffic bulk traffic waits */
+	prioIdle = 50 * time.Millisecond
+	/* prioMaxWait is the most bulk traffic will wait for each write, so
+	it's never completely starved */
+	prioMaxWait = 250 * time.Millisecond
+	/* prioBackoff is how long bulk traffic sleeps between checks */
+	prioBackoff = 5 * time.Millisecond
+)
+
+/* lastInteractive is the time, in Unix nanoseconds, of the last interactive
+write */
+var lastInteractive int64
+
+/* prioWriter wraps a writer and either notes interactive traffic or holds off
+bulk traffic while there's interactive traffic flowing. */
+type prioWriter struct {
+	w    io.Writer
+	prio string
+}
+
+/* Write writes b to the underlying writer, after waiting for interactive
+traffic to quiet down for bulk writers. */
+func (p prioWriter) Write(b []byte) (int, error) {
+	switch p.prio {
+	case PRIOINTERACTIVE:
+		atomic.StoreInt64(&lastInteractive, time.Now().UnixNano())
+	case PRIOBULK:
+		waitForInteractive()
+	}
+	return p.w.Write(b)
+}
+
+/* waitForInteractive waits until there's been no interactive traffic for a
+little bit, or prioMaxWait, whichever comes first. */
+func waitForInteractive() {
+	for start := time.Now(); time.Since(start) < prioMaxWait; {
+		li := time.Unix(0, atomic.LoadInt64(&lastInteractive))
+		if time.Since(li) >= prioIdle {
+			return
+		}
+		time.Sleep(prioBackoff)
+	}
+}
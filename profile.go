@@ -0,0 +1,101 @@
+package main
+
+/*
+ * profile.go
+ * Sets of option defaults for unusual links
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* PROFILEHIGHLATENCY is the profile for links with multi-second RTTs, e.g.
+satellite first hops */
+const PROFILEHIGHLATENCY = "highlatency"
+
+/* profile is a set of defaults which work well together */
+type profile struct {
+	/* flags maps flag names to values, applied unless the flag's been set
+	some other way */
+	flags map[string]string
+	/* retryInterval is how often R forwards' targets are redialed, with
+	retry= */
+	retryInterval time.Duration
+}
+
+/* profiles are the profiles -profile knows about.  x/crypto/ssh doesn't let
+us change its window sizes, so those stay put. */
+var profiles = map[string]profile{
+	PROFILEHIGHLATENCY: {
+		flags: map[string]string{
+			"connto":     "60s",
+			"hsto":       "2m",
+			"dialto":     "2m",
+			"kaint":      "15s",
+			"katimeout":  "1m",
+			"breakfails": "5",
+			"breakcool":  "2m",
+		},
+		retryInterval: 3 * time.Second,
+	},
+}
+
+/* ProfileNames returns the names of the known profiles, sorted. */
+func ProfileNames() []string {
+	ns := make([]string, 0, len(profiles))
+	for n := range profiles {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+/* ApplyProfile sets the flags in the profile named name which haven't already
+been set on the command line or in the config file. */
+func ApplyProfile(name string) error {
+	p, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf(
+			"unknown profile %q, known profiles: %v",
+			name,
+			strings.Join(ProfileNames(), ", "),
+		)
+	}
+	/* Don't override the operator */
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	ns := make([]string, 0, len(p.flags))
+	for n := range p.flags {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	for _, n := range ns {
+		if set[n] {
+			log.Printf(
+				"Profile %v: keeping -%v %v",
+				name,
+				n,
+				flag.Lookup(n).Value,
+			)
+			continue
+		}
+		if err := flag.Set(n, p.flags[n]); nil != err {
+			return fmt.Errorf("setting -%v: %v", n, err)
+		}
+		log.Printf("Profile %v: -%v %v", name, n, p.flags[n])
+	}
+	if 0 != p.retryInterval {
+		retryInterval = p.retryInterval
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+/*
+ * prompt.go
+ * Ask the operator for passwords which aren't in the jumpfile
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/* PROMPTPASSWORD is the password which means to ask the operator for the real
+one at connect time. */
+const PROMPTPASSWORD = "prompt:"
+
+/* MAXPROMPTS is how many times a jump's password is asked for in a single
+build before giving up on it, as OpenSSH's NumberOfPasswordPrompts, lest an
+SSH_ASKPASS program which keeps giving the same wrong password lock the
+account. */
+const MAXPROMPTS = 3
+
+/* errPromptSkipped is returned by PromptPassword if the operator didn't give
+a password. */
+var errPromptSkipped = errors.New("no password given")
+
+/* prompted holds the passwords the operator's given, by user@host, until
+they've been used.  They're then wiped, so chain rebuilds ask again.  The lock
+is held while asking, so only one prompt is on the terminal at once. */
+var prompted = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: make(map[string][]byte)}
+
+/* NeedsPrompt returns true if j's password is to be asked for, which it isn't
+if j's auth= doesn't allow passwords */
+func NeedsPrompt(j jump) bool {
+	return PROMPTPASSWORD == j.password && j.Allows(AUTHPASSWORD)
+}
+
+/* PromptPassword returns a copy of the password for j, asking for it with
+ReadSecret if it's not been asked for since it was last forgotten.  The copy
+should be wiped once it's been used. */
+func PromptPassword(j jump) ([]byte, error) {
+	prompted.Lock()
+	defer prompted.Unlock()
+	uh := j.username + "@" + j.host
+	if p, ok := prompted.m[uh]; ok {
+		return append([]byte(nil), p...), nil
+	}
+	b, err := ReadSecret(fmt.Sprintf(
+		"Password for %v (blank to skip): ",
+		uh,
+	))
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(b) {
+		return nil, errPromptSkipped
+	}
+	prompted.m[uh] = b
+	return append([]byte(nil), b...), nil
+}
+
+/* ForgetPassword wipes and forgets the password given for j, which has been
+tried, so it's asked for again next time. */
+func ForgetPassword(j jump) {
+	prompted.Lock()
+	defer prompted.Unlock()
+	uh := j.username + "@" + j.host
+	wipe(prompted.m[uh])
+	delete(prompted.m, uh)
+}
+
+/* ForgetPasswords wipes and forgets every password given. */
+func ForgetPasswords() {
+	prompted.Lock()
+	defer prompted.Unlock()
+	for uh, p := range prompted.m {
+		wipe(p)
+		delete(prompted.m, uh)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+/*
+ * proxy.go
+ * Egress through a proxy after the last jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+/* Schemes for a final-hop proxy in the jumpfile */
+const (
+	PROXYSOCKS5 = "socks5"
+	PROXYHTTP   = "http"
+)
+
+/* exitProxy is a SOCKS5 or HTTP proxy, reached through the last jump, through
+which forwarded connections egress. */
+type exitProxy struct {
+	u *url.URL
+}
+
+/* isProxyLine returns true if the jumpfile line l looks like a proxy URL */
+func isProxyLine(l string) bool {
+	return strings.HasPrefix(l, PROXYSOCKS5+"://") ||
+		strings.HasPrefix(l, PROXYHTTP+"://")
+}
+
+/* parseExitProxy parses a proxy URL of the form
+scheme://[user[:password]@]host:port from the jumpfile. */
+func parseExitProxy(l string) (*exitProxy, error) {
+	u, err := url.Parse(l)
+	if nil != err {
+		return nil, err
+	}
+	if PROXYSOCKS5 != u.Scheme && PROXYHTTP != u.Scheme {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if "" == u.Hostname() || "" == u.Port() {
+		return nil, fmt.Errorf("proxy address needs a host and port")
+	}
+	if "" != strings.Trim(u.Path, "/") || "" != u.RawQuery {
+		return nil, fmt.Errorf("unexpected path or query in proxy URL")
+	}
+	return &exitProxy{u: u}, nil
+}
+
+/* String returns the proxy's URL, without its password */
+func (p *exitProxy) String() string {
+	return p.u.Redacted()
+}
+
+/* DialContext connects to addr via the proxy, which is itself connected to
+via d.  Only TCP is supported. */
+func (p *exitProxy) DialContext(
+	ctx context.Context,
+	d Dialer,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	if "tcp" != network {
+		return nil, fmt.Errorf("proxy can't dial %v", network)
+	}
+	switch p.u.Scheme {
+	case PROXYSOCKS5:
+		var auth *xproxy.Auth
+		if nil != p.u.User {
+			pw, _ := p.u.User.Password()
+			auth = &xproxy.Auth{
+				User:     p.u.User.Username(),
+				Password: pw,
+			}
+		}
+		sd, err := xproxy.SOCKS5("tcp", p.u.Host, auth, d)
+		if nil != err {
+			return nil, err
+		}
+		return sd.(xproxy.ContextDialer).DialContext(ctx, network, addr)
+	case PROXYHTTP:
+		c, err := d.DialContext(ctx, "tcp", p.u.Host)
+		if nil != err {
+			return nil, err
+		}
+		bc, err := p.connect(ctx, c, addr)
+		if nil != err {
+			c.Close()
+			return nil, err
+		}
+		return bc, nil
+	default:
+		return nil, fmt.Errorf(
+			"unsupported proxy scheme %q",
+			p.u.Scheme,
+		)
+	}
+}
+
+/* connect asks the HTTP proxy on the other end of c to CONNECT to addr. */
+func (p *exitProxy) connect(
+	ctx context.Context,
+	c net.Conn,
+	addr string,
+) (net.Conn, error) {
+	/* Don't wait forever for a slow proxy */
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if nil != p.u.User {
+		pw, _ := p.u.User.Password()
+		req.SetBasicAuth(p.u.User.Username(), pw)
+		req.Header.Set(
+			"Proxy-Authorization",
+			req.Header.Get("Authorization"),
+		)
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(c); nil != err {
+		return nil, p.ctxErr(ctx, err)
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if nil != err {
+		return nil, p.ctxErr(ctx, err)
+	}
+	res.Body.Close()
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf("proxy said %v", res.Status)
+	}
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	/* Anything the target's already sent is in br */
+	return &bufferedConn{Conn: c, r: br}, nil
+}
+
+/* ctxErr returns ctx's error if it's done, which is the real reason err
+happened, or err otherwise. */
+func (p *exitProxy) ctxErr(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); nil != cerr {
+		return cerr
+	}
+	return err
+}
+
+/* bufferedConn is a net.Conn which reads from a bufio.Reader wrapping the
+conn. */
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+/* Read reads from c's bufio.Reader */
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+/* NetConn returns the underlying conn */
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+/* checkProxyExit applies the exit test policy to the proxy at the end of c,
+and returns true if it's suitable for use.  ICMP exit tests aren't made
+through the proxy. */
+func checkProxyExit(
+	c *Chain,
+	target string,
+	policy string,
+	want exitContent,
+) bool {
+	if EXITSKIP == policy || strings.HasPrefix(target, ICMPPREFIX) {
+		return true
+	}
+	log.Printf("Making a test connection to %v via %v", target, c.Proxy)
+	t, err := c.Dial("tcp", ExitDialAddr(target))
+	if nil == err {
+		err = want.Check(t, target)
+	}
+	if nil != err {
+		log.Printf(
+			"Connection to %v via %v failed: %v",
+			target,
+			c.Proxy,
+			Hinted(err),
+		)
+		return EXITADVISORY == policy
+	}
+	log.Printf("Connection to %v successful", target)
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+/*
+ * publiclisten.go
+ * Make sure listening on every interface is on purpose
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/term"
+)
+
+/* isPublicListen returns true if f listens on every interface, either
+locally or, for R forwards, on the exit jump */
+func isPublicListen(f fwdspec) bool {
+	return isPublicAddr(f.laddr)
+}
+
+/* isPublicAddr returns true if the host:port addr is on every interface */
+func isPublicAddr(addr string) bool {
+	h, _, err := net.SplitHostPort(addr)
+	if nil != err {
+		return false
+	}
+	/* An R forward's * is requested as an empty address */
+	if "" == h || "*" == h {
+		return true
+	}
+	ip := net.ParseIP(h)
+	return nil != ip && ip.IsUnspecified()
+}
+
+/* describePublicListen describes where f listens, for asking about it */
+func describePublicListen(f fwdspec) string {
+	if f.isFwd {
+		return "every local interface"
+	}
+	return "every interface on the exit jump"
+}
+
+/* CheckPublicListens makes sure forwards in fs which listen on every
+interface are meant to.  Unless allow is true, the operator is asked on the
+terminal about each, and an error is returned if the answer's no or there's no
+terminal. */
+func CheckPublicListens(fs []fwdspec, allow bool) error {
+	if allow {
+		return nil
+	}
+	for _, f := range fs {
+		if !isPublicListen(f) {
+			continue
+		}
+		if err := confirmPublicListen(
+			f.spec,
+			describePublicListen(f),
+		); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* confirmPublicListen asks the operator on the terminal whether what should
+really listen on where.  An error is returned if the answer's no or there's no
+terminal. */
+func confirmPublicListen(what, where string) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf(
+			"%v listens on %v, which needs -allow-public-listen",
+			what,
+			where,
+		)
+	}
+	if !confirm(fmt.Sprintf("%v listens on %v.  Really?", what, where)) {
+		return fmt.Errorf("not listening on %v", what)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+/*
+ * quality.go
+ * Refuse jumps with weak versions or algorithms
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* ALGSINSECURE in -denyalgs stands for all of the algorithms x/crypto/ssh
+considers insecure */
+const ALGSINSECURE = "insecure"
+
+/* strongAlgs are the only algorithms allowed with -strongcrypto: AEAD or
+encrypt-then-MAC, SHA-2, and elliptic curve or post-quantum key exchange.
+They're modern, not FIPS-validated. */
+var strongAlgs = map[string]bool{
+	ssh.KeyExchangeMLKEM768X25519:  true,
+	ssh.KeyExchangeCurve25519:      true,
+	"curve25519-sha256@libssh.org": true,
+	ssh.KeyExchangeECDHP256:        true,
+	ssh.KeyExchangeECDHP384:        true,
+	ssh.KeyExchangeECDHP521:        true,
+	ssh.CipherChaCha20Poly1305:     true,
+	ssh.CipherAES256GCM:            true,
+	ssh.CipherAES128GCM:            true,
+	ssh.HMACSHA256ETM:              true,
+	ssh.HMACSHA512ETM:              true,
+	ssh.KeyAlgoED25519:             true,
+	ssh.KeyAlgoSKED25519:           true,
+	ssh.KeyAlgoECDSA256:            true,
+	ssh.KeyAlgoSKECDSA256:          true,
+	ssh.KeyAlgoECDSA384:            true,
+	ssh.KeyAlgoECDSA521:            true,
+	ssh.KeyAlgoRSASHA256:           true,
+	ssh.KeyAlgoRSASHA512:           true,
+	ssh.CertAlgoED25519v01:         true,
+	ssh.CertAlgoSKED25519v01:       true,
+	ssh.CertAlgoECDSA256v01:        true,
+	ssh.CertAlgoSKECDSA256v01:      true,
+	ssh.CertAlgoECDSA384v01:        true,
+	ssh.CertAlgoECDSA521v01:        true,
+	ssh.CertAlgoRSASHA256v01:       true,
+	ssh.CertAlgoRSASHA512v01:       true,
+}
+
+/* qualityPolicy refuses jumps whose server version or negotiated algorithms
+aren't good enough.  A nil qualityPolicy allows everything. */
+type qualityPolicy struct {
+	versions *regexp.Regexp  /* Refused server versions */
+	algs     map[string]bool /* Refused algorithms */
+	strong   bool            /* Only strongAlgs allowed */
+}
+
+/* NewQualityPolicy returns a qualityPolicy which refuses servers whose version
+matches the regex denyVersions and connections which negotiate any of the
+comma-separated algorithms in denyAlgs, which may include ALGSINSECURE.  If
+strong is true, only the algorithms in strongAlgs are allowed.  If nothing's
+refused, nil is returned. */
+func NewQualityPolicy(
+	denyVersions string,
+	denyAlgs string,
+	strong bool,
+) (*qualityPolicy, error) {
+	if "" == denyVersions && "" == denyAlgs && !strong {
+		return nil, nil
+	}
+	p := &qualityPolicy{algs: make(map[string]bool), strong: strong}
+	if "" != denyVersions {
+		var err error
+		if p.versions, err = regexp.Compile(denyVersions); nil != err {
+			return nil, err
+		}
+	}
+	for _, a := range strings.Split(denyAlgs, ",") {
+		a = strings.TrimSpace(a)
+		switch a {
+		case "":
+			continue
+		case ALGSINSECURE:
+			ia := ssh.InsecureAlgorithms()
+			for _, l := range [][]string{
+				ia.KeyExchanges,
+				ia.Ciphers,
+				ia.MACs,
+				ia.HostKeys,
+			} {
+				for _, a := range l {
+					p.algs[a] = true
+				}
+			}
+		default:
+			p.algs[a] = true
+		}
+	}
+	return p, nil
+}
+
+/* Check returns an error if the server version v or the negotiated
+algorithms na aren't allowed. */
+func (p *qualityPolicy) Check(v string, na ssh.NegotiatedAlgorithms) error {
+	if nil == p {
+		return nil
+	}
+	if nil != p.versions && p.versions.MatchString(v) {
+		return fmt.Errorf("refusing server version %q", v)
+	}
+	for _, a := range []string{
+		na.KeyExchange,
+		na.HostKey,
+		na.Read.Cipher,
+		na.Write.Cipher,
+		na.Read.MAC,
+		na.Write.MAC,
+	} {
+		if p.algs[a] {
+			return fmt.Errorf("refusing negotiated algorithm %v", a)
+		}
+		/* AEAD ciphers don't negotiate a MAC */
+		if p.strong && "" != a && !strongAlgs[a] {
+			return fmt.Errorf(
+				"-strongcrypto refuses negotiated algorithm %v",
+				a,
+			)
+		}
+	}
+	return nil
+}
+
+/* Explain adds to err, from a handshake, why a jump couldn't agree on an
+algorithm we allow with -strongcrypto: either it has none, or it has some but
+the jump's algorithm options don't include them. */
+func (p *qualityPolicy) Explain(err error) error {
+	var ane *ssh.AlgorithmNegotiationError
+	if nil == p || !p.strong || !errors.As(err, &ane) {
+		return err
+	}
+	var strong []string
+	for _, a := range ane.RequestedAlgorithms {
+		if strongAlgs[a] && !p.algs[a] {
+			strong = append(strong, a)
+		}
+	}
+	if 0 != len(strong) {
+		return fmt.Errorf(
+			"-strongcrypto refuses the jump's chosen %v "+
+				"algorithms, but it has %v: %w",
+			ane.What,
+			strings.Join(strong, ","),
+			err,
+		)
+	}
+	return fmt.Errorf(
+		"-strongcrypto allows none of the jump's %v "+
+			"algorithms (%v): %w",
+		ane.What,
+		strings.Join(ane.RequestedAlgorithms, ","),
+		err,
+	)
+}
+
+/* Apply removes the refused algorithms from those offered in c and has c
+check each jump before sending credentials.  For each sort of algorithm of
+which some are refused, the algorithms already in c which aren't refused are
+offered or, if c has none, x/crypto/ssh's secure algorithms which aren't
+refused, which is a bit stricter than its default.  If that leaves nothing,
+nothing's offered, and the handshake fails. */
+func (p *qualityPolicy) Apply(c *ssh.ClientConfig) {
+	if nil == p {
+		return
+	}
+	sa, ia := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	for _, l := range []struct {
+		dst      *[]string
+		secure   []string
+		insecure []string
+	}{
+		{&c.KeyExchanges, sa.KeyExchanges, ia.KeyExchanges},
+		{&c.Ciphers, sa.Ciphers, ia.Ciphers},
+		{&c.MACs, sa.MACs, ia.MACs},
+		{&c.HostKeyAlgorithms, sa.HostKeys, ia.HostKeys},
+	} {
+		if !p.strong &&
+			!p.refusesAny(l.secure) &&
+			!p.refusesAny(l.insecure) {
+			continue
+		}
+		base := *l.dst
+		if nil == base {
+			base = l.secure
+		}
+		/* Not nil, which would get x/crypto/ssh's defaults */
+		*l.dst = []string{}
+		for _, a := range base {
+			if !p.algs[a] && (!p.strong || strongAlgs[a]) {
+				*l.dst = append(*l.dst, a)
+			}
+		}
+	}
+	c.AuthCallback = func(
+		ac *ssh.ClientAuthContext,
+	) (ssh.AuthMethod, error) {
+		return nil, p.Check(
+			string(ac.Metadata.ServerVersion()),
+			ac.Algorithms,
+		)
+	}
+}
+
+/* refusesAny returns true if p refuses any of the algorithms in as */
+func (p *qualityPolicy) refusesAny(as []string) bool {
+	for _, a := range as {
+		if p.algs[a] {
+			return true
+		}
+	}
+	return false
+}
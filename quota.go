@@ -0,0 +1,63 @@
+package main
+
+/*
+ * quota.go
+ * Shut down once enough has been proxied
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+/* quota is the -maxbytes limit on the bytes proxied via the chain by all of
+the forwards, together, for the life of the process */
+var quota struct {
+	sync.Mutex
+	max    int64 /* 0 for no limit */
+	n      int64
+	hit    bool
+	cancel context.CancelFunc
+}
+
+/* SetQuota shuts everything down with cancel once max bytes have been
+proxied via the chain, in either direction. */
+func SetQuota(max int64, cancel context.CancelFunc) {
+	quota.Lock()
+	defer quota.Unlock()
+	quota.max = max
+	quota.cancel = cancel
+}
+
+/* QuotaUsed returns the number of bytes counted against the quota and the
+quota, which is 0 if there isn't one. */
+func QuotaUsed() (n, max int64) {
+	quota.Lock()
+	defer quota.Unlock()
+	return quota.n, quota.max
+}
+
+/* countQuota counts n bytes against the quota, and shuts everything down if
+that's enough. */
+func countQuota(n int) {
+	quota.Lock()
+	defer quota.Unlock()
+	if 0 == quota.max {
+		return
+	}
+	quota.n += int64(n)
+	if quota.hit || quota.n < quota.max {
+		return
+	}
+	quota.hit = true
+	log.Printf(
+		"Proxied %v/%v bytes, shutting down",
+		quota.n,
+		quota.max,
+	)
+	quota.cancel()
+}
@@ -0,0 +1,187 @@
+package main
+
+/*
+ * redact.go
+ * Keep passwords and key paths out of the logs
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"hash/maphash"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* REDACTED is logged in place of secrets */
+const REDACTED = "<redacted>"
+
+/* REDACTMINLEN is the length of the shortest secret masked wherever it
+appears in the logs.  Shorter ones would mask too much which isn't a secret,
+and are only masked where credentials are logged on purpose. */
+const REDACTMINLEN = 4
+
+/* secrets holds what's needed to mask secrets in log output.  The secrets
+themselves aren't kept, only their hashes, with a seed which changes every
+run, and their lengths. */
+var secrets = struct {
+	sync.Mutex
+	seed maphash.Seed
+	sums map[uint64]struct{}
+	lens []int /* Longest first */
+	show bool
+}{seed: maphash.MakeSeed(), sums: make(map[uint64]struct{})}
+
+/* ShowSecrets turns masking secrets on or off */
+func ShowSecrets(show bool) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.show = show
+}
+
+/* AddSecret notes that b is a secret, to be masked in log output.  Only its
+hash is kept, so b may be wiped afterwards.  Secrets shorter than
+REDACTMINLEN are ignored. */
+func AddSecret(b []byte) {
+	if REDACTMINLEN > len(b) {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.sums[maphash.Bytes(secrets.seed, b)] = struct{}{}
+	for _, l := range secrets.lens {
+		if l == len(b) {
+			return
+		}
+	}
+	/* Longest first, so one secret inside another is masked whole */
+	secrets.lens = append(secrets.lens, len(b))
+	sort.Sort(sort.Reverse(sort.IntSlice(secrets.lens)))
+}
+
+/* AddCredSecret notes the secret part of a jump's password or cred=
+credential, which is all of a plain password, in its secret, and whatever
+follows the prefix for keys, PKCS#11 URIs, and references to secret
+backends. */
+func AddCredSecret(c jump) {
+	if nil != c.secret {
+		AddSecret(c.secret)
+		return
+	}
+	if PROMPTPASSWORD == c.password || AGENTCRED == c.password {
+		return
+	}
+	_, rest := splitCred(c.password)
+	AddSecret([]byte(rest))
+}
+
+/* AddJumpSecrets notes the secrets in j's password and cred= credentials */
+func AddJumpSecrets(j jump) {
+	AddCredSecret(j)
+	for _, a := range j.alts {
+		AddCredSecret(a)
+	}
+}
+
+/* Redact returns s with secrets masked, unless ShowSecrets(true) has been
+called.  Every substring as long as a secret is hashed and checked against
+the secrets' hashes. */
+func Redact(s string) string {
+	secrets.Lock()
+	defer secrets.Unlock()
+	if secrets.show || 0 == len(secrets.lens) {
+		return s
+	}
+	var (
+		sb    strings.Builder
+		start int /* Start of the text not yet added to sb */
+	)
+	for i := 0; i < len(s); {
+		n := 0
+		for _, l := range secrets.lens {
+			if len(s)-i < l {
+				continue
+			}
+			if _, ok := secrets.sums[maphash.String(
+				secrets.seed,
+				s[i:i+l],
+			)]; ok {
+				n = l
+				break
+			}
+		}
+		if 0 == n {
+			i++
+			continue
+		}
+		sb.WriteString(s[start:i])
+		sb.WriteString(REDACTED)
+		i += n
+		start = i
+	}
+	if 0 == start {
+		return s
+	}
+	sb.WriteString(s[start:])
+	return sb.String()
+}
+
+/* RedactCred returns c's password or cred= credential, masked for logging as
+AddCredSecret would, regardless of its length. */
+func RedactCred(c jump) string {
+	secrets.Lock()
+	show := secrets.show
+	secrets.Unlock()
+	if nil != c.secret {
+		if show {
+			return string(c.secret)
+		}
+		return REDACTED
+	}
+	pw := c.password
+	if show || PROMPTPASSWORD == pw || AGENTCRED == pw {
+		return pw
+	}
+	p, rest := splitCred(pw)
+	if "" == rest {
+		return pw
+	}
+	return p + REDACTED
+}
+
+/* splitCred splits pw into its prefix, if it has one which says what sort of
+credential it is, and the rest. */
+func splitCred(pw string) (prefix, rest string) {
+	for _, p := range []string{KEYPREFIX, PKCS11PREFIX} {
+		if strings.HasPrefix(pw, p) {
+			return p, strings.TrimPrefix(pw, p)
+		}
+	}
+	if _, p := secretBackendFor(jump{password: pw}); "" != p {
+		return p, strings.TrimPrefix(pw, p)
+	}
+	return "", pw
+}
+
+/* redactWriter masks secrets in what's written to it */
+type redactWriter struct {
+	w io.Writer
+}
+
+/* Redacted wraps w so secrets written to it are masked.  Each write should
+be a whole log line. */
+func Redacted(w io.Writer) io.Writer {
+	return redactWriter{w: w}
+}
+
+/* Write writes b, with secrets masked, to the underlying writer.  The length
+of b is returned on success, even if masking changed the length. */
+func (r redactWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(b))); nil != err {
+		return 0, err
+	}
+	return len(b), nil
+}
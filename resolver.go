@@ -0,0 +1,206 @@
+package main
+
+/*
+ * resolver.go
+ * Resolve the first jump's name without the system resolver
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* RESOLVERTIMEOUT is how long a DoH or DoT lookup may take */
+const RESOLVERTIMEOUT = 10 * time.Second
+
+/* DOTPORT is DNS over TLS's port, if the -resolver URL doesn't have one */
+const DOTPORT = "853"
+
+/* DOHMAXRESPONSE is the largest DoH response we'll read */
+const DOHMAXRESPONSE = 64 * 1024
+
+/* hostResolver looks up hosts' addresses.  It's implemented by
+*net.Resolver. */
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+/* NewResolver returns a hostResolver which uses the resolver at u, which is
+either an https:// URL for DNS over HTTPS or a tls://host[:port] URL for DNS
+over TLS.  If u is empty, the system resolver is returned. */
+func NewResolver(u string) (hostResolver, error) {
+	if "" == u {
+		return net.DefaultResolver, nil
+	}
+	pu, err := url.Parse(u)
+	if nil != err {
+		return nil, err
+	}
+	switch pu.Scheme {
+	case "https":
+		return dohResolver{
+			u: u,
+			c: &http.Client{Timeout: RESOLVERTIMEOUT},
+		}, nil
+	case "tls":
+		return newDoTResolver(pu)
+	default:
+		return nil, fmt.Errorf(
+			"need an https:// or tls:// URL, not %q",
+			u,
+		)
+	}
+}
+
+/* newDoTResolver returns a net.Resolver which sends every query over TLS to
+the server at u's host and port. */
+func newDoTResolver(u *url.URL) (*net.Resolver, error) {
+	h, p := u.Hostname(), u.Port()
+	if "" == h {
+		return nil, fmt.Errorf("no server in %q", u)
+	}
+	if "" == p {
+		p = DOTPORT
+	}
+	a := net.JoinHostPort(h, p)
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: RESOLVERTIMEOUT},
+		Config:    &tls.Config{ServerName: h},
+	}
+	/* The Go resolver uses TCP's framing with conns which aren't
+	PacketConns, which is the same as DoT's. */
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(
+			ctx context.Context,
+			network string,
+			address string,
+		) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", a)
+		},
+	}, nil
+}
+
+/* dohResolver looks up names with DNS over HTTPS, per RFC 8484 */
+type dohResolver struct {
+	u string
+	c *http.Client
+}
+
+/* LookupHost looks up host's IPv4 and IPv6 addresses. */
+func (d dohResolver) LookupHost(
+	ctx context.Context,
+	host string,
+) ([]string, error) {
+	var (
+		addrs []string
+		errs  []string
+	)
+	for _, t := range []dnsmessage.Type{
+		dnsmessage.TypeA,
+		dnsmessage.TypeAAAA,
+	} {
+		as, err := d.lookup(ctx, host, t)
+		if nil != err {
+			errs = append(errs, err.Error())
+			continue
+		}
+		addrs = append(addrs, as...)
+	}
+	if 0 != len(addrs) {
+		return addrs, nil
+	}
+	if 0 != len(errs) {
+		return nil, fmt.Errorf(
+			"looking up %v via %v: %v",
+			host,
+			d.u,
+			strings.Join(errs, "; "),
+		)
+	}
+	return nil, fmt.Errorf("no addresses for %v", host)
+}
+
+/* lookup asks the DoH server for host's records of type t. */
+func (d dohResolver) lookup(
+	ctx context.Context,
+	host string,
+	t dnsmessage.Type,
+) ([]string, error) {
+	/* Roll a query */
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	n, err := dnsmessage.NewName(host)
+	if nil != err {
+		return nil, err
+	}
+	q, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  n,
+			Type:  t,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	if nil != err {
+		return nil, err
+	}
+
+	/* Ask the server */
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		d.u,
+		bytes.NewReader(q),
+	)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := d.c.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf("HTTP status %v", res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, DOHMAXRESPONSE))
+	if nil != err {
+		return nil, err
+	}
+
+	/* Pick out the addresses */
+	var m dnsmessage.Message
+	if err := m.Unpack(b); nil != err {
+		return nil, err
+	}
+	if dnsmessage.RCodeSuccess != m.RCode {
+		return nil, fmt.Errorf("%v", m.RCode)
+	}
+	var as []string
+	for _, a := range m.Answers {
+		switch r := a.Body.(type) {
+		case *dnsmessage.AResource:
+			as = append(as, net.IP(r.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			as = append(as, net.IP(r.AAAA[:]).String())
+		}
+	}
+	return as, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+/*
+ * rpending.go
+ * Keep re-requesting R forwards after the chain's rebuilt
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+/* REMOTERETRYINTERVAL is how often a pending R forward's listen is
+re-requested */
+const REMOTERETRYINTERVAL = 10 * time.Second
+
+/* retryRemote re-requests f's listen on c's last jump every
+REMOTERETRYINTERVAL until it works or ctx is done, and then forwards
+connections as forwardPort does, via d.  Fatal errors are sent to ec.  The
+listener's closed when ctx is done. */
+func retryRemote(
+	ctx context.Context,
+	c *Chain,
+	d Dialer,
+	f fwdspec,
+	ec chan<- error,
+) {
+	state.AddPending(f)
+	defer state.DonePending(f)
+	t := time.NewTicker(REMOTERETRYINTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		l, err := c.Listen("tcp", f.laddr)
+		if nil != err {
+			continue
+		}
+		if nil != ctx.Err() {
+			l.Close()
+			return
+		}
+		defer context.AfterFunc(ctx, func() { l.Close() })()
+		f.limit.SetListener(l)
+		state.AddListener(l, f, relistener(ctx, c, d, f, nil, ec))
+		log.Printf(
+			"Listening on %v for pending reverse connections to %v",
+			listenAddr(l, f),
+			withLabel(f.caddr, f.label),
+		)
+		forwardPort(ctx, l, d, f, nil, ec)
+		return
+	}
+}
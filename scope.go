@@ -0,0 +1,230 @@
+package main
+
+/*
+ * scope.go
+ * Keep connections to targets within the engagement's scope
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/* Scope rule actions */
+const (
+	SCOPEALLOW = "allow"
+	SCOPEDENY  = "deny"
+)
+
+/* SCOPEANY in a scope rule matches every target */
+const SCOPEANY = "*"
+
+/* errOutOfScope is returned when a target's not in scope */
+var errOutOfScope = errors.New("out of scope")
+
+/* scope is the scope from -scope, checked for every connection to a target.
+A nil scope allows everything. */
+var scope *targetScope
+
+/* scopeRule is one line of a scope file */
+type scopeRule struct {
+	line   int
+	allow  bool
+	any    bool       /* Matches every host */
+	net    *net.IPNet /* Matches addresses in net */
+	domain string     /* Matches domain and names under it */
+	ports  [][2]int   /* Port ranges, or every port if empty */
+}
+
+/* targetScope is a list of rules saying which targets may be connected to. */
+type targetScope struct {
+	rules  []scopeRule
+	nAllow int
+	nNet   int /* Rules with addresses, which names can't be checked against */
+}
+
+/* ReadScope reads the scope rules in the file named fname.  Each line is
+allow or deny, a CIDR range, address, domain, or *, and optionally a
+comma-separated list of ports and port ranges, e.g.
+
+allow 10.0.0.0/8
+allow .corp.example.com 22,80,443,8000-8999
+deny 10.0.5.0/24
+deny * 25
+
+A target may be connected to if no deny rule matches it and, if there are
+allow rules, one of them does.  Names aren't resolved, so they only match
+domain and * rules, and if there are any CIDR or address rules, names are
+refused, as they may resolve to addresses the rules deny. */
+func ReadScope(fname string) (*targetScope, error) {
+	b, err := ioutil.ReadFile(fname)
+	if nil != err {
+		return nil, err
+	}
+	s := &targetScope{}
+	for n, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		r, err := parseScopeRule(l)
+		if nil != err {
+			return nil, fmt.Errorf("line %v: %w", n+1, err)
+		}
+		r.line = n + 1
+		if r.allow {
+			s.nAllow++
+		}
+		if nil != r.net {
+			s.nNet++
+		}
+		s.rules = append(s.rules, r)
+	}
+	if 0 == len(s.rules) {
+		return nil, errors.New("no rules")
+	}
+	return s, nil
+}
+
+/* parseScopeRule parses a single line of a scope file. */
+func parseScopeRule(l string) (scopeRule, error) {
+	var r scopeRule
+	fs := strings.Fields(l)
+	if 2 != len(fs) && 3 != len(fs) {
+		return r, fmt.Errorf("need 2 or 3 fields, got %v", len(fs))
+	}
+
+	/* Allow or deny */
+	switch strings.ToLower(fs[0]) {
+	case SCOPEALLOW:
+		r.allow = true
+	case SCOPEDENY:
+	default:
+		return r, fmt.Errorf("unknown action %q", fs[0])
+	}
+
+	/* Which hosts */
+	h := strings.ToLower(fs[1])
+	if SCOPEANY == h {
+		r.any = true
+	} else if _, n, err := net.ParseCIDR(h); nil == err {
+		r.net = n
+	} else if ip := net.ParseIP(h); nil != ip {
+		bits := 8 * net.IPv6len
+		if nil != ip.To4() {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		r.net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if d := scopeName(h); "" != d {
+		r.domain = d
+	} else {
+		return r, fmt.Errorf("invalid host %q", fs[1])
+	}
+
+	/* Which ports */
+	if 2 == len(fs) {
+		return r, nil
+	}
+	for _, p := range strings.Split(fs[2], ",") {
+		lo, hi := p, p
+		if i := strings.Index(p, "-"); -1 != i {
+			lo, hi = p[:i], p[i+1:]
+		}
+		lp, lerr := strconv.ParseUint(lo, 10, 16)
+		hp, herr := strconv.ParseUint(hi, 10, 16)
+		if nil != lerr || nil != herr || lp > hp {
+			return r, fmt.Errorf("invalid port %q", p)
+		}
+		r.ports = append(r.ports, [2]int{int(lp), int(hp)})
+	}
+	return r, nil
+}
+
+/* scopeName returns h, a hostname, without leading or trailing dots, for
+comparison. */
+func scopeName(h string) string {
+	return strings.Trim(strings.ToLower(h), ".")
+}
+
+/* Check returns an error wrapping errOutOfScope if s doesn't allow
+connections to addr, a host and port. */
+func (s *targetScope) Check(addr string) error {
+	if nil == s {
+		return nil
+	}
+	h, ps, err := net.SplitHostPort(addr)
+	if nil != err {
+		return fmt.Errorf("%w: %v: %v", errOutOfScope, addr, err)
+	}
+	port, err := strconv.Atoi(ps)
+	if nil != err {
+		return fmt.Errorf("%w: %v: invalid port", errOutOfScope, addr)
+	}
+	if i := strings.Index(h, "%"); -1 != i { /* IPv6 zone */
+		h = h[:i]
+	}
+	ip := net.ParseIP(h)
+	h = scopeName(h)
+
+	allowed := 0 == s.nAllow
+	for _, r := range s.rules {
+		if !r.matches(h, ip, port) {
+			continue
+		}
+		if !r.allow {
+			return fmt.Errorf(
+				"%w: %v denied by line %v",
+				errOutOfScope,
+				addr,
+				r.line,
+			)
+		}
+		allowed = true
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %v not allowed", errOutOfScope, addr)
+	}
+	/* The name's allowed, but it might point at a denied address */
+	if nil == ip && 0 != s.nNet {
+		return fmt.Errorf(
+			"%w: %v is a name, which can't be checked against "+
+				"address rules",
+			errOutOfScope,
+			addr,
+		)
+	}
+	return nil
+}
+
+/* matches returns true if r matches the host h, which is ip if it's an
+address, and port. */
+func (r scopeRule) matches(h string, ip net.IP, port int) bool {
+	switch {
+	case r.any:
+	case nil != r.net:
+		if nil == ip || !r.net.Contains(ip) {
+			return false
+		}
+	case nil != ip:
+		return false
+	case h != r.domain && !strings.HasSuffix(h, "."+r.domain):
+		return false
+	}
+	if 0 == len(r.ports) {
+		return true
+	}
+	for _, p := range r.ports {
+		if p[0] <= port && port <= p[1] {
+			return true
+		}
+	}
+	return false
+}
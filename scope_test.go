@@ -0,0 +1,239 @@
+package main
+
+/*
+ * scope_test.go
+ * Tests for scope.go
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseScopeRule(t *testing.T) {
+	for _, c := range []struct {
+		line    string
+		want    scopeRule
+		wantErr bool
+	}{{
+		line: "allow *",
+		want: scopeRule{allow: true, any: true},
+	}, {
+		line: "DENY * 25",
+		want: scopeRule{any: true, ports: [][2]int{{25, 25}}},
+	}, {
+		line: "allow 10.0.0.0/8",
+		want: scopeRule{allow: true, net: &net.IPNet{
+			IP:   net.IP{10, 0, 0, 0},
+			Mask: net.CIDRMask(8, 32),
+		}},
+	}, {
+		/* Host bits are dropped */
+		line: "deny 10.0.5.7/24 22,80",
+		want: scopeRule{
+			net: &net.IPNet{
+				IP:   net.IP{10, 0, 5, 0},
+				Mask: net.CIDRMask(24, 32),
+			},
+			ports: [][2]int{{22, 22}, {80, 80}},
+		},
+	}, {
+		line: "allow 192.168.1.1",
+		want: scopeRule{allow: true, net: &net.IPNet{
+			IP:   net.IP{192, 168, 1, 1},
+			Mask: net.CIDRMask(32, 32),
+		}},
+	}, {
+		line: "allow 2001:db8::1 443",
+		want: scopeRule{
+			allow: true,
+			net: &net.IPNet{
+				IP:   net.ParseIP("2001:db8::1"),
+				Mask: net.CIDRMask(128, 128),
+			},
+			ports: [][2]int{{443, 443}},
+		},
+	}, {
+		line: "allow .Corp.Example.com. 22,8000-8999",
+		want: scopeRule{
+			allow:  true,
+			domain: "corp.example.com",
+			ports:  [][2]int{{22, 22}, {8000, 8999}},
+		},
+	}, {
+		line: "allow * 0-65535",
+		want: scopeRule{
+			allow: true,
+			any:   true,
+			ports: [][2]int{{0, 65535}},
+		},
+	}, {
+		line:    "allow",
+		wantErr: true,
+	}, {
+		line:    "allow * 22 80",
+		wantErr: true,
+	}, {
+		line:    "permit *",
+		wantErr: true,
+	}, {
+		line:    "allow ...",
+		wantErr: true,
+	}, {
+		line:    "allow * http",
+		wantErr: true,
+	}, {
+		line:    "allow * 65536",
+		wantErr: true,
+	}, {
+		line:    "allow * 90-80",
+		wantErr: true,
+	}, {
+		line:    "allow * 22,",
+		wantErr: true,
+	}, {
+		line:    "allow * -22",
+		wantErr: true,
+	}} {
+		got, err := parseScopeRule(c.line)
+		if c.wantErr {
+			if nil == err {
+				t.Errorf("%q: no error, got %+v", c.line, got)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("%q: error: %v", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf(
+				"%q: incorrect rule\n got: %+v\nwant: %+v",
+				c.line,
+				got,
+				c.want,
+			)
+		}
+	}
+}
+
+func TestTargetScopeCheck(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		rules string
+		ok    []string /* In scope */
+		notOK []string /* Out of scope */
+	}{{
+		name:  "allow and deny",
+		rules: "allow 10.0.0.0/8\ndeny 10.0.5.0/24\n",
+		ok:    []string{"10.1.2.3:22", "10.0.4.255:80"},
+		notOK: []string{
+			"10.0.5.1:22",
+			"192.168.1.1:22",
+			"[2001:db8::1]:22",
+			/* Names might resolve to denied addresses */
+			"example.com:22",
+		},
+	}, {
+		name:  "only deny",
+		rules: "# Not the mail servers\ndeny * 25\n",
+		ok:    []string{"10.0.0.1:22", "example.com:80"},
+		notOK: []string{"10.0.0.1:25", "example.com:25"},
+	}, {
+		name: "domains",
+		rules: "allow .corp.example.com 22,80,8000-8999\n" +
+			"deny prod.corp.example.com\n",
+		ok: []string{
+			"corp.example.com:22",
+			"a.corp.example.com:8000",
+			"A.Corp.Example.COM.:8999",
+		},
+		notOK: []string{
+			"a.corp.example.com:443",
+			"prod.corp.example.com:22",
+			"db.prod.corp.example.com:22",
+			"evilcorp.example.com:22",
+			"example.com:22",
+			/* Addresses don't match names */
+			"10.0.0.1:22",
+		},
+	}, {
+		name:  "IPv6",
+		rules: "allow 2001:db8::/32\n",
+		ok:    []string{"[2001:db8::1]:22", "[2001:db8::1%eth0]:22"},
+		notOK: []string{"[2001:db9::1]:22", "10.0.0.1:22"},
+	}, {
+		name:  "bad addresses",
+		rules: "allow *\n",
+		ok:    []string{"example.com:22"},
+		notOK: []string{"example.com", "example.com:ssh", ""},
+	}} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "scope")
+			if err := os.WriteFile(
+				fn,
+				[]byte(c.rules),
+				0600,
+			); nil != err {
+				t.Fatalf("Writing scope file: %v", err)
+			}
+			s, err := ReadScope(fn)
+			if nil != err {
+				t.Fatalf("Reading scope: %v", err)
+			}
+			for _, a := range c.ok {
+				if err := s.Check(a); nil != err {
+					t.Errorf("%q: error: %v", a, err)
+				}
+			}
+			for _, a := range c.notOK {
+				err := s.Check(a)
+				if !errors.Is(err, errOutOfScope) {
+					t.Errorf(
+						"%q: got %v, want %v",
+						a,
+						err,
+						errOutOfScope,
+					)
+				}
+			}
+		})
+	}
+
+	/* No scope allows everything */
+	var s *targetScope
+	if err := s.Check("10.0.0.1:22"); nil != err {
+		t.Errorf("Nil scope: error: %v", err)
+	}
+}
+
+func TestReadScopeErrors(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		rules string
+	}{
+		{name: "empty", rules: ""},
+		{name: "only comments", rules: "# allow *\n\n"},
+		{name: "bad rule", rules: "allow *\nallow kittens 22 80\n"},
+	} {
+		fn := filepath.Join(t.TempDir(), "scope")
+		if err := os.WriteFile(
+			fn,
+			[]byte(c.rules),
+			0600,
+		); nil != err {
+			t.Fatalf("Writing scope file: %v", err)
+		}
+		if s, err := ReadScope(fn); nil == err {
+			t.Errorf("%v: no error, got %+v", c.name, s)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+/*
+ * secrets.go
+ * Fetch jump credentials from elsewhere at connect time
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+/* secretBackend fetches the secret named by ref, which is the jump's password
+less the backend's prefix. */
+type secretBackend func(ctx context.Context, ref string) ([]byte, error)
+
+var (
+	secretBackends  = make(map[string]secretBackend)
+	secretBackendsL sync.Mutex
+)
+
+/* RegisterSecretBackend makes a backend available for passwords starting
+with prefix */
+func RegisterSecretBackend(prefix string, b secretBackend) {
+	secretBackendsL.Lock()
+	defer secretBackendsL.Unlock()
+	secretBackends[prefix] = b
+}
+
+/* secretBackendFor returns the backend which fetches j's credentials, and its
+prefix, or nil if j's credentials are in the jumpfile. */
+func secretBackendFor(j jump) (secretBackend, string) {
+	secretBackendsL.Lock()
+	defer secretBackendsL.Unlock()
+	for p, b := range secretBackends {
+		if strings.HasPrefix(j.password, p) {
+			return b, p
+		}
+	}
+	return nil, ""
+}
+
+/* IsExternalCred returns true if j's credentials come from a secret
+backend */
+func IsExternalCred(j jump) bool {
+	b, _ := secretBackendFor(j)
+	return nil != b
+}
+
+/* ExternalCred fetches j's credentials from its secret backend and returns
+a copy of j with the secret as its key, if it looks like a key or names a key
+file with KEYPREFIX (relative to keydir), or as its pw, less a trailing
+newline.  The pw should be wiped, with WipePasswords, once it's been used. */
+func ExternalCred(ctx context.Context, j jump, keydir string) (jump, error) {
+	b, p := secretBackendFor(j)
+	if nil == b {
+		return j, nil
+	}
+	ref := strings.TrimSpace(strings.TrimPrefix(j.password, p))
+	if "" == ref {
+		return j, fmt.Errorf("nothing after %v", p)
+	}
+	s, err := b(ctx, ref)
+	if nil != err {
+		return j, err
+	}
+	defer wipe(s)
+
+	/* Lose the trailing newline, if there is one */
+	s = bytes.TrimSuffix(bytes.TrimSuffix(s, []byte("\n")), []byte("\r"))
+
+	/* Key files are keys */
+	if bytes.HasPrefix(s, []byte(KEYPREFIX)) {
+		kj := jump{password: string(s)}
+		if err := setJumpKey(&kj, keydir); nil != err {
+			return j, fmt.Errorf("key from %v%v: %w", p, ref, err)
+		}
+		j.key = kj.key
+		return j, nil
+	}
+
+	/* As are keys themselves */
+	if blk, _ := pem.Decode(s); nil != blk || isPPK(s) {
+		key, err := parseKey(p+ref, s)
+		if nil != err {
+			return j, fmt.Errorf("key from %v%v: %w", p, ref, err)
+		}
+		j.key = key
+		return j, nil
+	}
+
+	/* Anything else is a password */
+	j.pw = append([]byte(nil), s...)
+	return j, nil
+}
+
+/* ExternalAlts returns a copy of j's cred= credentials, with those which come
+from secret backends fetched as by ExternalCred.  Credentials which can't be
+fetched are logged and left out. */
+func ExternalAlts(ctx context.Context, j jump, keydir string) []jump {
+	as := make([]jump, 0, len(j.alts))
+	for _, a := range j.alts {
+		if IsExternalCred(a) {
+			var err error
+			if a, err = ExternalCred(ctx, a, keydir); nil != err {
+				log.Printf(
+					"Unable to get cred= credential for "+
+						"%v: %v",
+					j.host,
+					err,
+				)
+				continue
+			}
+		}
+		as = append(as, a)
+	}
+	return as
+}
@@ -0,0 +1,360 @@
+package main
+
+/*
+ * selftest.go
+ * Make sure the binary works, without needing any real jumps
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* SelfTest starts an in-process SSH server and an echo server, makes a
+one-jump chain through the SSH server, and checks that L and R forwards to the
+echo server work.  It returns true if everything worked. */
+func SelfTest() bool {
+	log.Printf("Starting self-test")
+	ok := true
+	check := func(what string, err error) {
+		if nil != err {
+			log.Printf("FAIL: %v: %v", what, err)
+			ok = false
+			return
+		}
+		log.Printf("PASS: %v", what)
+	}
+
+	/* Something to which to forward */
+	echo, err := startEchoServer()
+	check("echo server", err)
+	if nil != err {
+		return false
+	}
+	defer echo.Close()
+
+	/* Something through which to jump */
+	pb := make([]byte, 16)
+	if _, err := rand.Read(pb); nil != err {
+		check("password generation", err)
+		return false
+	}
+	pass := hex.EncodeToString(pb)
+	sshl, err := startTestSSHServer(pass)
+	check("SSH server", err)
+	if nil != err {
+		return false
+	}
+	defer sshl.Close()
+
+	/* Jump through it */
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs, err := MakeSSHConns(
+		ctx,
+		[]jump{{
+			username: "selftest",
+			host:     sshl.Addr().String(),
+			secret:   []byte(pass),
+			version:  "SSH-2.0-sshjump_selftest",
+		}},
+		chainConfig{
+			njump:      1,
+			connto:     10 * time.Second,
+			hsto:       10 * time.Second,
+			kaint:      time.Minute,
+			katimeout:  10 * time.Second,
+			exitTest:   echo.Addr().String(),
+			exitPolicy: EXITREQUIRED,
+		},
+		cancel,
+	)
+	check("chain", err)
+	if nil != err {
+		return false
+	}
+	defer CloseJumps(cs)
+
+	/* Forward through it */
+	ec := make(chan error, 2)
+	ea := echo.Addr().String()
+	ls, err := ForwardPorts(
+		ctx,
+		NewChain(cs, 10*time.Second),
+		[]fwdspec{
+			{isFwd: true, laddr: "127.0.0.1:0", caddr: ea},
+			{isFwd: false, laddr: "127.0.0.1:0", caddr: ea},
+		},
+		ec,
+	)
+	check("listeners", err)
+	if nil != err {
+		return false
+	}
+	defer CloseConns()
+	defer CloseListeners(ls)
+	check("L forward", testEcho(ls[0].Addr().String()))
+	check("R forward", testEcho(ls[1].Addr().String()))
+
+	if ok {
+		log.Printf("Self-test passed")
+	} else {
+		log.Printf("Self-test failed")
+	}
+	return ok
+}
+
+/* testEcho connects to addr, sends some random bytes, and makes sure the same
+bytes come back. */
+func testEcho(addr string) error {
+	c, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if nil != err {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	b := make([]byte, 4096)
+	if _, err := rand.Read(b); nil != err {
+		return err
+	}
+	if _, err := c.Write(b); nil != err {
+		return err
+	}
+	rb := make([]byte, len(b))
+	if _, err := io.ReadFull(c, rb); nil != err {
+		return err
+	}
+	if !bytes.Equal(b, rb) {
+		return fmt.Errorf("echoed bytes differ")
+	}
+	return nil
+}
+
+/* startEchoServer starts a TCP echo server on a random loopback port */
+func startEchoServer() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l, nil
+}
+
+/* startTestSSHServer starts a minimal SSH server on a random loopback port
+which accepts the password pass, direct-tcpip channels, and tcpip-forward
+requests. */
+func startTestSSHServer(pass string) (net.Listener, error) {
+	/* Server config */
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		return nil, err
+	}
+	hk, err := ssh.NewSignerFromKey(priv)
+	if nil != err {
+		return nil, err
+	}
+	conf := &ssh.ServerConfig{
+		PasswordCallback: func(
+			cm ssh.ConnMetadata,
+			p []byte,
+		) (*ssh.Permissions, error) {
+			if pass != string(p) {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	conf.AddHostKey(hk)
+
+	/* Listen and serve */
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go serveTestSSH(c, conf)
+		}
+	}()
+	return l, nil
+}
+
+/* serveTestSSH handles a client of the test SSH server */
+func serveTestSSH(c net.Conn, conf *ssh.ServerConfig) {
+	defer c.Close()
+	sc, chans, reqs, err := ssh.NewServerConn(c, conf)
+	if nil != err {
+		return
+	}
+	defer sc.Close()
+
+	/* Remote listeners, by port, closed when the client goes away */
+	var (
+		ls  = make(map[uint32]net.Listener)
+		lsL sync.Mutex
+	)
+	defer func() {
+		lsL.Lock()
+		defer lsL.Unlock()
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
+
+	/* Listen requests */
+	go func() {
+		for req := range reqs {
+			var fr struct {
+				Addr string
+				Port uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &fr); nil != err {
+				req.Reply(false, nil)
+				continue
+			}
+			switch req.Type {
+			case "tcpip-forward":
+				l, err := net.Listen("tcp", net.JoinHostPort(
+					fr.Addr,
+					strconv.Itoa(int(fr.Port)),
+				))
+				if nil != err {
+					req.Reply(false, nil)
+					continue
+				}
+				port := uint32(l.Addr().(*net.TCPAddr).Port)
+				lsL.Lock()
+				ls[port] = l
+				lsL.Unlock()
+				req.Reply(true, ssh.Marshal(struct {
+					Port uint32
+				}{port}))
+				go serveTestForward(sc, l, fr.Addr, port)
+			case "cancel-tcpip-forward":
+				lsL.Lock()
+				l, ok := ls[fr.Port]
+				delete(ls, fr.Port)
+				lsL.Unlock()
+				if ok {
+					l.Close()
+				}
+				req.Reply(ok, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	/* Dial requests */
+	for nc := range chans {
+		if "direct-tcpip" != nc.ChannelType() {
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var dr struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(nc.ExtraData(), &dr); nil != err {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		go func() {
+			t, err := net.Dial("tcp", net.JoinHostPort(
+				dr.Host,
+				strconv.Itoa(int(dr.Port)),
+			))
+			if nil != err {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				return
+			}
+			ch, creqs, err := nc.Accept()
+			if nil != err {
+				t.Close()
+				return
+			}
+			go ssh.DiscardRequests(creqs)
+			spliceTest(ch, t)
+		}()
+	}
+}
+
+/* serveTestForward accepts connections on l and sends them back to the
+client as forwarded-tcpip channels. */
+func serveTestForward(sc *ssh.ServerConn, l net.Listener, a string, p uint32) {
+	for {
+		c, err := l.Accept()
+		if nil != err {
+			return
+		}
+		go func() {
+			ra := c.RemoteAddr().(*net.TCPAddr)
+			ch, reqs, err := sc.OpenChannel(
+				"forwarded-tcpip",
+				ssh.Marshal(struct {
+					Addr     string
+					Port     uint32
+					OrigAddr string
+					OrigPort uint32
+				}{a, p, ra.IP.String(), uint32(ra.Port)}),
+			)
+			if nil != err {
+				c.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			spliceTest(ch, c)
+		}()
+	}
+}
+
+/* spliceTest copies bytes between ch and c until both directions finish */
+func spliceTest(ch ssh.Channel, c net.Conn) {
+	defer ch.Close()
+	defer c.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, ch)
+		c.(*net.TCPConn).CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
@@ -0,0 +1,114 @@
+package main
+
+/*
+ * serverinfo.go
+ * Note what jumps say about themselves before authentication
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+/* SERVERVERSIONMAX is the most read from a jump while looking for its version
+string, which RFC 4253 limits to 255 bytes, after any other lines */
+const SERVERVERSIONMAX = 8 * 1024
+
+/* serverInfo is what a jump says about itself before authentication, which
+is its version string.  Banners are logged as they arrive. */
+type serverInfo struct {
+	l       sync.Mutex
+	buf     []byte /* Read before the version string */
+	done    bool   /* Found the version, or gave up */
+	version string
+}
+
+/* serverInfoConn notes the server's version string read from a jump */
+type serverInfoConn struct {
+	net.Conn
+	si *serverInfo
+}
+
+/* SniffServerInfo wraps c, a connection to a jump, to note the jump's version
+string, which is available from the returned serverInfo even if the handshake
+fails. */
+func SniffServerInfo(c net.Conn) (net.Conn, *serverInfo) {
+	si := &serverInfo{}
+	return serverInfoConn{Conn: c, si: si}, si
+}
+
+/* Read reads from the underlying conn, looking for the version string */
+func (c serverInfoConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.si.add(b[:n])
+	return n, err
+}
+
+/* add looks for the version string in b, the next bytes from the jump */
+func (si *serverInfo) add(b []byte) {
+	si.l.Lock()
+	defer si.l.Unlock()
+	if si.done || 0 == len(b) {
+		return
+	}
+	si.buf = append(si.buf, b...)
+	for {
+		i := bytes.IndexByte(si.buf, '\n')
+		if -1 == i {
+			break
+		}
+		l := strings.TrimRight(string(si.buf[:i]), "\r")
+		si.buf = si.buf[i+1:]
+		if strings.HasPrefix(l, "SSH-") {
+			si.version = l
+			si.done = true
+			si.buf = nil
+			return
+		}
+	}
+	if SERVERVERSIONMAX < len(si.buf) {
+		si.done = true
+		si.buf = nil
+	}
+}
+
+/* Version returns the jump's version string, or the empty string if it's not
+been seen. */
+func (si *serverInfo) Version() string {
+	si.l.Lock()
+	defer si.l.Unlock()
+	return si.version
+}
+
+/* BannerCallback returns an ssh.BannerCallback which logs and traces the
+banner from j, which would be jump number depth. */
+func (si *serverInfo) BannerCallback(
+	j jump,
+	depth int,
+) func(message string) error {
+	return func(message string) error {
+		log.Printf(
+			"Banner from jump %v (%v): %q",
+			depth,
+			j.host,
+			message,
+		)
+		Trace(TRACEBANNER, j, depth-1, message)
+		return nil
+	}
+}
+
+/* String returns the jump's version, for logging, or "unknown" if it's not
+been seen. */
+func (si *serverInfo) String() string {
+	if v := si.Version(); "" != v {
+		return v
+	}
+	return "unknown"
+}
@@ -0,0 +1,141 @@
+package main
+
+/*
+ * shutdown.go
+ * Orderly teardown, from the control socket
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	/* DRAINTIMEOUT is how long a shutdown waits by default for proxied
+	connections to finish */
+	DRAINTIMEOUT = 30 * time.Second
+	/* CLEANUPTIMEOUT is how long a cleanup command may run on a jump */
+	CLEANUPTIMEOUT = 30 * time.Second
+)
+
+/* shutdownRequest asks main to tear everything down.  Progress is written to
+w, and done is closed when everything's torn down. */
+type shutdownRequest struct {
+	w     io.Writer
+	drain time.Duration
+	done  chan struct{}
+}
+
+/* shutdownChan passes shutdown requests from the control socket to main */
+var shutdownChan = make(chan shutdownRequest)
+
+func init() {
+	RegisterControlCommand(
+		"shutdown",
+		"Tear everything down in order (shutdown confirm [drain])",
+		func(w io.Writer, args []string) error {
+			if 0 == len(args) || "confirm" != args[0] {
+				return errors.New("not shutting down " +
+					"without confirmation, use " +
+					"shutdown confirm [drain]")
+			}
+			req := shutdownRequest{
+				w:     w,
+				drain: DRAINTIMEOUT,
+				done:  make(chan struct{}),
+			}
+			if 2 <= len(args) {
+				d, err := time.ParseDuration(args[1])
+				if nil != err {
+					return fmt.Errorf("drain time: %v", err)
+				}
+				req.drain = d
+			}
+			select {
+			case shutdownChan <- req:
+			case <-time.After(CONTROLTIMEOUT):
+				return errors.New("shutdown in progress")
+			}
+			<-req.done
+			return nil
+		},
+	)
+}
+
+/* CascadeShutdown tears everything down in order.  New connections are
+refused, proxied connections are given up to drain to finish before being
+closed, and the jumps are closed from the last one inward.  If cleanup isn't
+empty, it's run on each jump before the jump is closed.  Progress is logged and
+written to w. */
+func CascadeShutdown(
+	w io.Writer,
+	ls []net.Listener,
+	pcs []net.PacketConn,
+	cs []*ssh.Client,
+	cleanup string,
+	drain time.Duration,
+) {
+	say := func(f string, a ...interface{}) {
+		log.Printf(f, a...)
+		fmt.Fprintf(w, f+"\n", a...)
+	}
+	say("Shutting down")
+
+	/* Stop accepting new things */
+	CloseListeners(ls)
+	CloseUDP(pcs)
+	say("Closed %v listeners", len(ls)+len(pcs))
+
+	/* Let the existing connections finish */
+	end := time.Now().Add(drain)
+	for 0 != ConnCount() && time.Now().Before(end) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := ConnCount(); 0 != n {
+		say("Closing %v connections after %v", n, drain)
+	} else {
+		say("All connections finished")
+	}
+	CloseConns()
+
+	/* Close the chain from the far end */
+	DisarmKillSwitch()
+	for i := len(cs) - 1; 0 <= i; i-- {
+		if "" != cleanup {
+			o, err := runCleanup(cs[i], cleanup)
+			if nil != err {
+				say("Cleanup on jump %v failed: %v", i+1, err)
+			} else {
+				say("Cleanup on jump %v: %q", i+1, o)
+			}
+		}
+		if err := cs[i].Close(); nil != err {
+			say("Unable to close jump %v: %v", i+1, err)
+			continue
+		}
+		say("Closed jump %v", i+1)
+	}
+	say("Shutdown complete")
+}
+
+/* runCleanup runs the shell command cmd on c and returns its output */
+func runCleanup(c *ssh.Client, cmd string) ([]byte, error) {
+	s, err := c.NewSession()
+	if nil != err {
+		return nil, err
+	}
+	defer s.Close()
+	requestAgent(c, s)
+	t := time.AfterFunc(CLEANUPTIMEOUT, func() { s.Close() })
+	defer t.Stop()
+	return s.CombinedOutput(cmd)
+}
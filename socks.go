@@ -0,0 +1,371 @@
+package main
+
+/*
+ * socks.go
+ * SOCKS5 proxy through the chain, on a Unix socket
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* SOCKSTIMEOUT is how long a SOCKS client has to say where it's going */
+const SOCKSTIMEOUT = 10 * time.Second
+
+/* SOCKS5 protocol bits */
+const (
+	socksVersion     = 5
+	socksNoAuth      = 0x00
+	socksNoMethods   = 0xFF
+	socksCmdConnect  = 0x01
+	socksAtypIPv4    = 0x01
+	socksAtypName    = 0x03
+	socksAtypIPv6    = 0x04
+	socksSucceeded   = 0x00
+	socksFailure     = 0x01
+	socksNotAllowed  = 0x02
+	socksNetUnreach  = 0x03
+	socksHostUnreach = 0x04
+	socksConnRefused = 0x05
+	socksTTLExpired  = 0x06
+	socksCmdNotSupp  = 0x07
+	socksAtypNotSupp = 0x08
+)
+
+/* socksFailReply maps a (lowercase) substring of a dial error's message to
+the SOCKS reply which best describes it. */
+type socksFailReply struct {
+	pattern string
+	rep     byte
+}
+
+/* socksFailReplies are checked in order.  The messages are from the SSH
+server, which usually passes on the exit jump's strerror(3) or
+gai_strerror(3), or from our own dialing via an exit proxy or the helper. */
+var socksFailReplies = []socksFailReply{
+	{"administratively prohibited", socksNotAllowed},
+	{"connection refused", socksConnRefused},
+	{"no route to host", socksHostUnreach},
+	{"host is unreachable", socksHostUnreach},
+	{"host unreachable", socksHostUnreach},
+	{"network is unreachable", socksNetUnreach},
+	{"network unreachable", socksNetUnreach},
+	{"no such host", socksHostUnreach},
+	{"name or service not known", socksHostUnreach},
+	{"nodename nor servname", socksHostUnreach},
+	{"no address associated", socksHostUnreach},
+	{"name resolution", socksHostUnreach},
+	{"unknown host", socksHostUnreach},
+	{"timed out", socksTTLExpired},
+	{"i/o timeout", socksTTLExpired},
+	{"deadline exceeded", socksTTLExpired},
+}
+
+/* errNoPeerCred is returned where we can't tell who's on the other end of a
+Unix socket */
+var errNoPeerCred = errors.New("peer credentials are only checked on Linux")
+
+/* ParseUIDs parses a comma-separated list of UIDs */
+func ParseUIDs(s string) ([]uint32, error) {
+	var uids []uint32
+	for _, p := range strings.Split(s, ",") {
+		if "" == p {
+			continue
+		}
+		n, err := strconv.ParseUint(p, 10, 32)
+		if nil != err {
+			return nil, fmt.Errorf("invalid UID %q", p)
+		}
+		uids = append(uids, uint32(n))
+	}
+	return uids, nil
+}
+
+/* ServeSOCKSUnix listens on a Unix socket at path for SOCKS5 clients, and
+connects them to their targets via d.  Only clients running as our own UID
+or one of uids are served.  Any stale socket at path is removed first.  When
+ctx is done, the listener stops accepting and proxied connections are
+interrupted.  The caller is responsible for closing the returned listener. */
+func ServeSOCKSUnix(
+	ctx context.Context,
+	path string,
+	uids []uint32,
+	d Dialer,
+) (net.Listener, error) {
+	if !peerCredSupported {
+		return nil, errNoPeerCred
+	}
+	uids = append([]uint32{uint32(os.Getuid())}, uids...)
+	/* Other users need to be able to connect to be checked */
+	perm := os.FileMode(0600)
+	if 1 < len(uids) {
+		perm = 0666
+	}
+	l, err := listenUnix(path, perm)
+	if nil != err {
+		return nil, err
+	}
+	go serveSOCKS(ctx, l.(*net.UnixListener), path, uids, d)
+	log.Printf("Listening on %v for SOCKS5 clients", path)
+	return l, nil
+}
+
+/* serveSOCKS accepts SOCKS5 clients on l until l is closed or ctx is
+done. */
+func serveSOCKS(
+	ctx context.Context,
+	l *net.UnixListener,
+	path string,
+	uids []uint32,
+	d Dialer,
+) {
+	defer context.AfterFunc(ctx, func() {
+		l.SetDeadline(time.Now())
+	})()
+	for {
+		c, err := l.AcceptUnix()
+		if nil != err {
+			if nil == ctx.Err() && !errors.Is(err, net.ErrClosed) {
+				log.Printf(
+					"Unable to accept SOCKS clients on "+
+						"%v: %v",
+					path,
+					err,
+				)
+			}
+			return
+		}
+		go handleSOCKS(ctx, c, path, uids, d)
+	}
+}
+
+/* handleSOCKS checks that c's from someone allowed, works out where it wants
+to go, and connects it via d. */
+func handleSOCKS(
+	ctx context.Context,
+	c *net.UnixConn,
+	path string,
+	uids []uint32,
+	d Dialer,
+) {
+	/* Make sure it's someone we like */
+	uid, err := peerUID(c)
+	if nil != err {
+		log.Printf("Unable to check SOCKS client on %v: %v", path, err)
+		c.Close()
+		return
+	}
+	allowed := false
+	for _, u := range uids {
+		if u == uid {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		log.Printf(
+			"Dropping SOCKS client with disallowed UID %v on %v",
+			uid,
+			path,
+		)
+		c.Close()
+		return
+	}
+
+	/* Work out where it's going */
+	c.SetDeadline(time.Now().Add(SOCKSTIMEOUT))
+	target, err := socksHandshake(c)
+	if nil != err {
+		log.Printf(
+			"SOCKS handshake with UID %v on %v failed: %v",
+			uid,
+			path,
+			err,
+		)
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	/* Proxy as if it were a forward */
+	f := fwdspec{spec: "socks:" + path, isFwd: true, caddr: target}
+	done, ok := getConnSlots(ctx, f)
+	if !ok {
+		c.Close()
+		return
+	}
+	defer done()
+	forwardConnection(
+		ctx,
+		socksConn{
+			Conn: c,
+			addr: localAddr(fmt.Sprintf("uid:%v", uid)),
+		},
+		socksDialer{d: d, c: c},
+		f,
+	)
+}
+
+/* socksHandshake negotiates no authentication with the client on c and reads
+its CONNECT request, which is returned as a host:port. */
+func socksHandshake(c net.Conn) (string, error) {
+	/* Methods, of which we only do no auth */
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); nil != err {
+		return "", err
+	}
+	if socksVersion != b[0] {
+		return "", fmt.Errorf("unsupported version %v", b[0])
+	}
+	ms := make([]byte, b[1])
+	if _, err := io.ReadFull(c, ms); nil != err {
+		return "", err
+	}
+	m := byte(socksNoMethods)
+	for _, v := range ms {
+		if socksNoAuth == v {
+			m = socksNoAuth
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, m}); nil != err {
+		return "", err
+	}
+	if socksNoAuth != m {
+		return "", errors.New("client doesn't do no-auth")
+	}
+
+	/* The request itself */
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(c, b); nil != err {
+		return "", err
+	}
+	if socksCmdConnect != b[1] {
+		writeSOCKSReply(c, socksCmdNotSupp)
+		return "", fmt.Errorf("unsupported command %v", b[1])
+	}
+	var host string
+	switch b[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, 4)
+		if socksAtypIPv6 == b[3] {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(c, ip); nil != err {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypName:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); nil != err {
+			return "", err
+		}
+		n := make([]byte, l[0])
+		if _, err := io.ReadFull(c, n); nil != err {
+			return "", err
+		}
+		host = string(n)
+	default:
+		writeSOCKSReply(c, socksAtypNotSupp)
+		return "", fmt.Errorf("unsupported address type %v", b[3])
+	}
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(c, p); nil != err {
+		return "", err
+	}
+	return net.JoinHostPort(
+		host,
+		strconv.Itoa(int(binary.BigEndian.Uint16(p))),
+	), nil
+}
+
+/* writeSOCKSReply sends a reply with the code rep and an unspecified bound
+address to c. */
+func writeSOCKSReply(c net.Conn, rep byte) error {
+	_, err := c.Write([]byte{
+		socksVersion, rep, 0x00,
+		socksAtypIPv4, 0, 0, 0, 0,
+		0, 0,
+	})
+	return err
+}
+
+/* socksConn is a SOCKS client's conn, with a more useful remote address */
+type socksConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+/* RemoteAddr returns c.addr */
+func (c socksConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+/* NetConn returns the underlying conn */
+func (c socksConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+/* socksDialer dials with d, and tells the SOCKS client on c how it went */
+type socksDialer struct {
+	d Dialer
+	c net.Conn
+}
+
+/* Dial dials with sd.d and tells sd.c how it went */
+func (sd socksDialer) Dial(network, addr string) (net.Conn, error) {
+	return sd.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext dials with sd.d and tells sd.c how it went */
+func (sd socksDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	oc, err := sd.d.DialContext(ctx, network, addr)
+	if nil != err {
+		writeSOCKSReply(sd.c, socksReplyFor(err))
+		return nil, err
+	}
+	if err := writeSOCKSReply(sd.c, socksSucceeded); nil != err {
+		oc.Close()
+		return nil, err
+	}
+	return oc, nil
+}
+
+/* socksReplyFor returns the SOCKS reply which best describes why a dial
+failed with err, so scanners and the like going through the chain can tell a
+closed port from a dead host.  Targets refused by -policy, outside the -scope,
+or prohibited by the jump aren't allowed.  Anything we can't work out is a
+general failure. */
+func socksReplyFor(err error) byte {
+	var oce *ssh.OpenChannelError
+	if errors.Is(err, errPolicyDenied) ||
+		errors.Is(err, errOutOfScope) ||
+		(errors.As(err, &oce) && ssh.Prohibited == oce.Reason) {
+		return socksNotAllowed
+	}
+	m := strings.ToLower(err.Error())
+	for _, r := range socksFailReplies {
+		if strings.Contains(m, r.pattern) {
+			return r.rep
+		}
+	}
+	return socksFailure
+}
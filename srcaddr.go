@@ -0,0 +1,134 @@
+package main
+
+/*
+ * srcaddr.go
+ * Pick the address from which connections to targets come
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* How an L forward's src= address is used, with srcvia= */
+const (
+	SRCVIACHANNEL = "channel" /* Sent in the direct-tcpip request */
+	SRCVIAHELPER  = "helper"  /* Bound by the helper */
+)
+
+/* parseSrcAddr parses a source address, an IP address with an optional port,
+e.g. 10.3.4.5, 10.3.4.5:1179, or [fd00::5]:1179, into a host:port, with port 0
+if there's none. */
+func parseSrcAddr(s string) (string, error) {
+	h, p, err := net.SplitHostPort(s)
+	if nil != err {
+		h, p = unbracket(s), "0"
+	}
+	if nil == net.ParseIP(h) {
+		return "", fmt.Errorf("%q isn't an IP address", h)
+	}
+	if _, err := strconv.ParseUint(p, 10, 16); nil != err {
+		return "", fmt.Errorf("invalid port %q", p)
+	}
+	return net.JoinHostPort(h, p), nil
+}
+
+/* srcTCPAddr converts an address from parseSrcAddr to a *net.TCPAddr */
+func srcTCPAddr(src string) *net.TCPAddr {
+	h, p, _ := net.SplitHostPort(src)
+	port, _ := strconv.Atoi(p)
+	return &net.TCPAddr{IP: net.ParseIP(h), Port: port}
+}
+
+/* srcDialer connects via the chain, asking the exit jump to connect from a
+particular source address */
+type srcDialer struct {
+	c   *Chain
+	src string
+}
+
+/* Dial connects to addr via the chain, from d.src */
+func (d srcDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext connects to addr via the chain, from d.src */
+func (d srcDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	return d.c.DialContextFrom(ctx, network, addr, d.src)
+}
+
+/* dialFrom asks c to connect to addr with src as the originator address in
+the direct-tcpip request.  OpenSSH's sshd ignores the originator, but some
+servers bind to it.  Unlike with c.Dial, addr's host is sent as-is, so names
+are resolved by the server. */
+func dialFrom(c *ssh.Client, addr, src string) (net.Conn, error) {
+	rh, rps, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+	rp, err := strconv.ParseUint(rps, 10, 16)
+	if nil != err {
+		return nil, fmt.Errorf("invalid port %q", rps)
+	}
+	lh, lps, err := net.SplitHostPort(src)
+	if nil != err {
+		return nil, err
+	}
+	lp, err := strconv.ParseUint(lps, 10, 16)
+	if nil != err {
+		return nil, fmt.Errorf("invalid source port %q", lps)
+	}
+	ch, reqs, err := c.OpenChannel("direct-tcpip", ssh.Marshal(struct {
+		RAddr string
+		RPort uint32
+		LAddr string
+		LPort uint32
+	}{rh, uint32(rp), lh, uint32(lp)}))
+	if nil != err {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return channelConn{Channel: ch, laddr: srcTCPAddr(src)}, nil
+}
+
+/* channelConn is a net.Conn made from a direct-tcpip channel */
+type channelConn struct {
+	ssh.Channel
+	laddr net.Addr
+}
+
+/* LocalAddr returns the address requested as the source */
+func (c channelConn) LocalAddr() net.Addr { return c.laddr }
+
+/* RemoteAddr returns the zero address, as the target's address isn't known */
+func (c channelConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+/* SetDeadline isn't supported on SSH channels */
+func (c channelConn) SetDeadline(t time.Time) error {
+	return errors.New("deadlines not supported")
+}
+
+/* SetReadDeadline isn't supported on SSH channels */
+func (c channelConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+/* SetWriteDeadline isn't supported on SSH channels */
+func (c channelConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
@@ -0,0 +1,227 @@
+package main
+
+/*
+ * sshconfig.go
+ * Export the chain as an OpenSSH config snippet
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* SSHCONFIGHOST prefixes the Host aliases in the exported config, which are
+followed by the jump's number in the chain */
+const SSHCONFIGHOST = "sshjump-"
+
+/* SSHCONFIGEXIT is the extra Host alias for the exit jump */
+const SSHCONFIGEXIT = SSHCONFIGHOST + "exit"
+
+/* sshConfigExport writes the chain as an OpenSSH config snippet to a file
+every time the chain's made. */
+type sshConfigExport struct {
+	sync.Mutex
+	fname  string
+	keydir string
+}
+
+/* sshConfig is the export written to the file from -sshconfig */
+var sshConfig = &sshConfigExport{keydir: "."}
+
+func init() {
+	RegisterControlCommand(
+		"sshconfig",
+		"Print the chain as an OpenSSH config snippet",
+		func(w io.Writer, args []string) error {
+			cs := state.Chain()
+			if 0 == len(cs) {
+				return errors.New("no chain")
+			}
+			sshConfig.Lock()
+			defer sshConfig.Unlock()
+			return WriteSSHConfig(w, cs, sshConfig.keydir)
+		},
+	)
+}
+
+/* Set sets the file to which the snippet's written, which may be empty for
+none, and the directory in which keys with relative paths are found. */
+func (e *sshConfigExport) Set(fname, keydir string) {
+	e.Lock()
+	defer e.Unlock()
+	e.fname = fname
+	e.keydir = keydir
+}
+
+/* Update writes the snippet for the chain cs to the file, if there is one.
+The file is written under a temporary name and renamed, so readers never see
+half of it. */
+func (e *sshConfigExport) Update(cs []*ssh.Client) {
+	e.Lock()
+	defer e.Unlock()
+	if "" == e.fname {
+		return
+	}
+	var b bytes.Buffer
+	if err := WriteSSHConfig(&b, cs, e.keydir); nil != err {
+		log.Printf("Unable to make OpenSSH config: %v", err)
+		return
+	}
+	tf, err := ioutil.TempFile(
+		filepath.Dir(e.fname),
+		"."+filepath.Base(e.fname)+".",
+	)
+	if nil != err {
+		log.Printf("Unable to write OpenSSH config: %v", err)
+		return
+	}
+	_, err = tf.Write(b.Bytes())
+	if cerr := tf.Close(); nil == err {
+		err = cerr
+	}
+	if nil == err {
+		err = os.Rename(tf.Name(), e.fname)
+	}
+	if nil != err {
+		os.Remove(tf.Name())
+		log.Printf(
+			"Unable to write OpenSSH config %v: %v",
+			e.fname,
+			err,
+		)
+		return
+	}
+	log.Printf("Wrote the chain as OpenSSH config to %v", e.fname)
+}
+
+/* WriteSSHConfig writes a Host stanza to w for each jump in cs, each with a
+ProxyJump to the previous jump, so ssh -J sshjump-exit reaches targets the same
+way sshjump does.  Keys in files are given as IdentityFiles, with relative
+paths relative to keydir.  Other credentials are only noted, as are things
+OpenSSH can't do. */
+func WriteSSHConfig(w io.Writer, cs []*ssh.Client, keydir string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(
+		&b,
+		"# sshjump %v chain, exported %v\n"+
+			"# Targets may be reached with "+
+			"ssh -J %v user@target\n",
+		Version,
+		time.Now().Format(time.RFC3339),
+		SSHCONFIGEXIT,
+	)
+	for i, c := range cs {
+		j, _ := state.JumpOf(c)
+		if "" == j.host {
+			j.host = c.RemoteAddr().String()
+		}
+		if "" == j.username {
+			j.username = c.User()
+		}
+
+		/* Who and where */
+		names := []string{fmt.Sprintf("%v%v", SSHCONFIGHOST, i+1)}
+		if "" != j.label &&
+			-1 == strings.IndexFunc(j.label, unicode.IsSpace) {
+			names = append(names, j.label)
+		}
+		if len(cs)-1 == i {
+			names = append(names, SSHCONFIGEXIT)
+		}
+		fmt.Fprintf(&b, "\nHost %v\n", strings.Join(names, " "))
+		h, p, err := net.SplitHostPort(j.host)
+		if nil != err {
+			h, p = j.host, DEFPORT
+		}
+		fmt.Fprintf(&b, "\tHostName %v\n", h)
+		if DEFPORT != p {
+			fmt.Fprintf(&b, "\tPort %v\n", p)
+		}
+		fmt.Fprintf(&b, "\tUser %v\n", j.username)
+		if 0 != i {
+			fmt.Fprintf(&b, "\tProxyJump %v%v\n", SSHCONFIGHOST, i)
+		}
+
+		/* How to authenticate */
+		switch {
+		case !j.Allows(AUTHPASSWORD):
+			fmt.Fprintf(
+				&b,
+				"\tPreferredAuthentications publickey\n",
+			)
+		case !j.Allows(AUTHKEY):
+			fmt.Fprintf(
+				&b,
+				"\tPreferredAuthentications "+
+					"password,keyboard-interactive\n",
+			)
+		}
+		for _, l := range sshConfigAlgs(j) {
+			fmt.Fprintf(&b, "\t%v\n", l)
+		}
+		for _, a := range append([]jump{j}, j.alts...) {
+			fmt.Fprintf(
+				&b,
+				"\t%v\n",
+				sshConfigCred(a.password, keydir),
+			)
+		}
+
+		/* Things which don't translate */
+		for _, fp := range j.fps {
+			fmt.Fprintf(&b, "\t# Host key %v\n", fp)
+		}
+		if "" != j.vrf {
+			fmt.Fprintf(&b, "\t# Connect from VRF %v\n", j.vrf)
+		}
+		fmt.Fprintf(
+			&b,
+			"\t# Client version %s\n",
+			c.ClientVersion(),
+		)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+/* sshConfigCred returns the config line for the credential pw, which is an
+IdentityFile for keys in files and a comment for everything else. */
+func sshConfigCred(pw, keydir string) string {
+	switch p, rest := splitCred(pw); {
+	case AGENTCRED == pw:
+		return "# Keys from ssh-agent"
+	case PROMPTPASSWORD == pw:
+		return "# Password asked for"
+	case KEYPREFIX == p && KEYSTDIN == rest:
+		return "# Key from stdin"
+	case KEYPREFIX == p:
+		if !filepath.IsAbs(rest) {
+			if a, err := filepath.Abs(
+				filepath.Join(keydir, rest),
+			); nil == err {
+				rest = a
+			}
+		}
+		return fmt.Sprintf("IdentityFile %q", rest)
+	case "" != p:
+		return fmt.Sprintf("# Credentials from %v", p)
+	default:
+		return "# Password"
+	}
+}
@@ -5,7 +5,7 @@ package main
  * Jump through a few SSH hosts
  * By J. Stuart McMurray
  * Created 20170305
- * Last Modified 20170331
+ * Last Modified 20261017
  */
 
 import (
@@ -14,20 +14,57 @@ import (
 	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	mrand "math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
 	"time"
 )
 
-/* Dialer is anything which can dial */
+/* Dialer is anything which can dial, with or without a context */
 type Dialer interface {
 	Dial(network, addr string) (c net.Conn, err error)
+	DialContext(
+		ctx context.Context,
+		network string,
+		addr string,
+	) (net.Conn, error)
 }
 
 func main() {
+	/* Handle subcommands */
+	if 1 < len(os.Args) {
+		switch os.Args[1] {
+		case "banners":
+			BannersMain(os.Args[2:])
+			return
+		case "helper":
+			HelperMain(os.Args[2:])
+			return
+		case "ping":
+			PingMain(os.Args[2:])
+			return
+		case "control":
+			ControlMain(os.Args[2:])
+			return
+		case "status":
+			StatusMain(os.Args[2:])
+			return
+		case "replay":
+			ReplayMain(os.Args[2:])
+			return
+		case "tail":
+			TailMain(os.Args[2:])
+			return
+		case "exec-all":
+			ExecAllMain(os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		jumpfile = flag.String(
 			"jumps",
@@ -45,6 +82,44 @@ func main() {
 			false,
 			"Shuffle the list of jumps",
 		)
+		aliasFile = flag.String(
+			"aliases",
+			"",
+			"Optional `file` of names which may be used as jumps' "+
+				"hosts, each for several addresses",
+		)
+		acmeURL = flag.String(
+			"acme",
+			"",
+			"Optional ACME directory `URL` from which to get "+
+				"certificates for tls= forwards, instead of "+
+				"self-signing",
+		)
+		acmeDNS = flag.String(
+			"acmedns",
+			"",
+			"Shell `command` which, with add or del, a TXT "+
+				"record's name, and its value, sets DNS for "+
+				"-acme challenges",
+		)
+		acmeEmail = flag.String(
+			"acmeemail",
+			"",
+			"Optional contact `address` for the -acme account",
+		)
+		adjFile = flag.String(
+			"adjacency",
+			"",
+			"Optional `file` listing which jumps each jump can "+
+				"reach",
+		)
+		dialTO = flag.Duration(
+			"dialto",
+			30*time.Second,
+			"Forwarded connection `timeout` for the exit "+
+				"jump to connect to the target, or 0 to wait "+
+				"forever",
+		)
 		hsto = flag.Duration(
 			"hsto",
 			15*time.Second,
@@ -60,11 +135,450 @@ func main() {
 			time.Second,
 			"SSH keepalive `interval`",
 		)
+		katimeout = flag.Duration(
+			"katimeout",
+			10*time.Second,
+			"How long to wait for a keepalive reply before the "+
+				"chain's considered lost",
+		)
+		breakFails = flag.Uint(
+			"breakfails",
+			0,
+			"Skip a jump for a while after `N` consecutive "+
+				"timeouts, or 0 to never skip",
+		)
+		breakCool = flag.Duration(
+			"breakcool",
+			10*time.Minute,
+			"Time to skip a jump which keeps timing out "+
+				"(the `cooldown`)",
+		)
+		lruCreds = flag.Bool(
+			"lrucreds",
+			false,
+			"Of several accounts on the same jump, use the one "+
+				"used least recently",
+		)
+		fastOpen = flag.Bool(
+			"tfo",
+			false,
+			"Use TCP Fast Open to connect to the first jump "+
+				"(Linux only)",
+		)
+		netns = flag.String(
+			"netns",
+			"",
+			"Optional network `namespace` (name or path) from "+
+				"which to connect to the first jump (Linux "+
+				"only)",
+		)
+		torAddr = flag.String(
+			"tor",
+			"",
+			"Tor SOCKS `address` via which to connect to a "+
+				".onion first jump (default: look on ports "+
+				"9050 and 9150)",
+		)
+		upstream = flag.String(
+			"upstream",
+			"",
+			"Another sshjump's -socksunix socket, or a SOCKS5 "+
+				"proxy's `address`, via which to connect to "+
+				"the first jump",
+		)
+		resolverURL = flag.String(
+			"resolver",
+			"",
+			"Optional DNS over HTTPS (https://...) or TLS "+
+				"(tls://host[:port]) `URL` with which to "+
+				"resolve the first jump's name",
+		)
+		preResolve = flag.Bool(
+			"preresolve",
+			false,
+			"Resolve all of the jumps' names before making "+
+				"the chain",
+		)
+		latencyInt = flag.Duration(
+			"latencyint",
+			0,
+			"If nonzero, log how much latency each jump adds "+
+				"every `interval`",
+		)
+		fwdAgent = flag.String(
+			"forwardagent",
+			"",
+			"Forward ssh-agent to the exit jump ("+AGENTFWDEXIT+
+				") or every jump ("+AGENTFWDALL+")",
+		)
 		exitTest = flag.String(
 			"exittest",
 			"check.torproject.org:443",
 			"Host and port on `target` to test last "+
-				"jump forwarding ability",
+				"jump forwarding ability, an http(s) URL to "+
+				"fetch, or "+ICMPPREFIX+"host to ping host",
+		)
+		exitPolicy = flag.String(
+			"exitpolicy",
+			EXITREQUIRED,
+			"Exit test `policy`, one of "+EXITREQUIRED+", "+
+				EXITADVISORY+", or "+EXITSKIP,
+		)
+		exitCert = flag.String(
+			"exitcert",
+			"",
+			"SHA256 `hash` of the exit test target's TLS "+
+				"certificate, to catch interception",
+		)
+		exitBody = flag.String(
+			"exitbody",
+			"",
+			"SHA256 `hash` of the body of the exit test URL, to "+
+				"catch mangling",
+		)
+		noExitTest = flag.Bool(
+			"noexittest",
+			false,
+			"Don't make an exit test (same as -exitpolicy "+
+				EXITSKIP+")",
+		)
+		exitCacheTTL = flag.Duration(
+			"exitcache",
+			5*time.Minute,
+			"Reuse passed exit tests through the same exit jump "+
+				"for `duration`, or 0 to always test",
+		)
+		policyFile = flag.String(
+			"policy",
+			"",
+			"Optional Starlark `script` deciding whether and from "+
+				"which jump each connection's made",
+		)
+		scopeFile = flag.String(
+			"scope",
+			"",
+			"Optional `file` with rules saying which targets may "+
+				"be connected to",
+		)
+		pinFile = flag.String(
+			"pinfile",
+			"",
+			"Optional `file` in which to pin jumps' host keys "+
+				"the first time they're seen (default "+PINFILE+
+				" in -statedir, if given)",
+		)
+		hostKeyMode = flag.String(
+			"hostkey",
+			"",
+			"How strictly to check jumps' host keys, "+
+				HOSTKEYSTRICT+", "+HOSTKEYACCEPTNEW+", or "+
+				HOSTKEYOFF+" (default "+HOSTKEYACCEPTNEW+
+				" with a pin file, otherwise only fp=)",
+		)
+		pinChange = flag.String(
+			"pinchange",
+			PINREFUSE,
+			"What to do when a jump's host key doesn't match its "+
+				"pin, "+PINREFUSE+" or "+PINWARN+" (always "+
+				PINREFUSE+" with -hostkey "+HOSTKEYSTRICT+")",
+		)
+		forceExitTest = flag.Bool(
+			"forceexittest",
+			false,
+			"Always make the exit test (same as -exitcache 0)",
+		)
+		versionFile = flag.String(
+			"versions",
+			"",
+			"Optional `file` with client version strings to "+
+				"rotate through, overriding the jumpfile's",
+		)
+		versionInt = flag.Duration(
+			"versionint",
+			24*time.Hour,
+			"Client version rotation `interval`",
+		)
+		randVersions = flag.Bool(
+			"randversions",
+			false,
+			"Present a common client version, or one from "+
+				"-versions, picked per jump, to each jump "+
+				"without its own",
+		)
+		tunDev = flag.String(
+			"tun",
+			"",
+			"Experimental: forward IP packets between the local "+
+				"tun `device` and the exit jump (Linux only)",
+		)
+		tunUnit = flag.Uint(
+			"tununit",
+			TUNANY,
+			"Remote tun device `number` for -tun, or the default "+
+				"for any",
+		)
+		helper = flag.String(
+			"helper",
+			"",
+			"Optional helper `binary` (sshjump built for the exit "+
+				"jump) to upload and run on the exit jump",
+		)
+		helperPath = flag.String(
+			"helperpath",
+			"",
+			"Remote `path` for the uploaded helper, or an "+
+				"existing helper if -helper isn't given",
+		)
+		printVersion = flag.Bool(
+			"version",
+			false,
+			"Print version and build information and exit",
+		)
+		selfTest = flag.Bool(
+			"selftest",
+			false,
+			"Make a chain through an in-process SSH server, "+
+				"test forwarding, and exit",
+		)
+		configFile = flag.String(
+			"config",
+			"",
+			"Optional configuration `file`, e.g. from the "+
+				"control socket's config command",
+		)
+		controlPath = flag.String(
+			"control",
+			"",
+			"Optional control socket `path` (default "+
+				CONTROLSOCK+" in -statedir, if given)",
+		)
+		controlTokenFile = flag.String(
+			"controltoken",
+			"",
+			"Optional `file` containing a token control "+
+				"clients must send",
+		)
+		handoff = flag.String(
+			"handoff",
+			"",
+			"Take over from the instance with the control "+
+				"socket at `path`",
+		)
+		handoffTokenFile = flag.String(
+			"handofftoken",
+			"",
+			"Optional `file` containing the token for the "+
+				"-handoff control socket",
+		)
+		stateDirName = flag.String(
+			"statedir",
+			"",
+			"Optional `directory` for state which outlives a "+
+				"run, which only one instance may use at once",
+		)
+		cleanup = flag.String(
+			"cleanup",
+			"",
+			"Optional shell `command` to run on each jump, "+
+				"from the last inward, during a control "+
+				"socket shutdown",
+		)
+		traceFile = flag.String(
+			"trace",
+			"",
+			"Optional `file` to which to append chain "+
+				"construction events, for sshjump replay",
+		)
+		wireLog = flag.String(
+			"wirelog",
+			"",
+			"Log the SSH message types exchanged with the `jump` "+
+				"with this number in the chain, label, or "+
+				"address, until the connection's encrypted",
+		)
+		hostKeyLogFile = flag.String(
+			"hostkeylog",
+			"",
+			"Optional `file` to which to append the host keys "+
+				"jumps present, as JSON",
+		)
+		denyVersions = flag.String(
+			"denyversions",
+			"",
+			"Optional `regex` matching server versions of jumps "+
+				"which shouldn't be used (e.g. ^SSH-1\\.)",
+		)
+		denyAlgs = flag.String(
+			"denyalgs",
+			"",
+			"Comma-separated `list` of key exchange, host key, "+
+				"cipher, and MAC algorithms which jumps may "+
+				"not use, which may include \""+ALGSINSECURE+
+				"\"",
+		)
+		strongCrypto = flag.Bool(
+			"strongcrypto",
+			false,
+			"Only use modern key exchanges, ciphers, MACs, "+
+				"and host key algorithms, and refuse jumps "+
+				"without them",
+		)
+		kexAlgs = flag.String(
+			ALGKEX,
+			"",
+			"Comma-separated `list` of key exchange algorithms to "+
+				"offer jumps without kex=, or +list to add to "+
+				"the defaults",
+		)
+		cipherAlgs = flag.String(
+			ALGCIPHERS,
+			"",
+			"Comma-separated `list` of ciphers to offer jumps "+
+				"without ciphers=, or +list to add to the "+
+				"defaults",
+		)
+		macAlgs = flag.String(
+			ALGMACS,
+			"",
+			"Comma-separated `list` of MACs to offer jumps "+
+				"without macs=, or +list to add to the "+
+				"defaults",
+		)
+		hostKeyAlgs = flag.String(
+			ALGHOSTKEYS,
+			"",
+			"Comma-separated `list` of host key algorithms to "+
+				"offer jumps without hostkeyalgs=, or +list "+
+				"to add to the defaults",
+		)
+		fixCreds = flag.Bool(
+			"fixcreds",
+			false,
+			"Ask on the terminal for a new password or key when "+
+				"a jump's authentication fails",
+		)
+		showSecrets = flag.Bool(
+			"showsecrets",
+			false,
+			"Log passwords and key paths instead of masking them",
+		)
+		activeWindowSpec = flag.String(
+			"active",
+			"",
+			"Optional daily `window` (e.g. 22:00-06:00) outside "+
+				"of which the chain and listeners are torn "+
+				"down",
+		)
+		maxTime = flag.Duration(
+			"maxtime",
+			0,
+			"Optional `duration` after which to tear everything "+
+				"down and exit",
+		)
+		maxBytes = flag.String(
+			"maxbytes",
+			"",
+			"Optional `count` of bytes (k, m, or g suffix "+
+				"allowed) proxied by all forwards together "+
+				"after which to shut down",
+		)
+		maxTimeWarn = flag.Duration(
+			"maxtimewarn",
+			0,
+			"Optionally log a warning this long (the `period`) "+
+				"before -maxtime",
+		)
+		activeTZ = flag.String(
+			"tz",
+			"",
+			"Timezone `name` (e.g. Europe/Berlin) for -active, "+
+				"if not the local timezone",
+		)
+		debug = flag.Bool(
+			"debug",
+			false,
+			"Periodically log goroutine counts and check for "+
+				"leaked goroutines on exit",
+		)
+		pprofAddr = flag.String(
+			"pprof",
+			"",
+			"Serve profiles and internal counters over HTTP on "+
+				"a Unix socket or TCP `address` (e.g. "+
+				"./pprof.sock, or 127.0.0.1:6060 with "+
+				"-controltoken)",
+		)
+		profileName = flag.String(
+			"profile",
+			"",
+			"Use defaults for timeouts and such suited to a "+
+				"particular sort of link (e.g. "+
+				PROFILEHIGHLATENCY+")",
+		)
+		passFile = flag.String(
+			"passfile",
+			"",
+			"Name of `file` containing the passphrase for "+
+				"encrypted keys (or set "+PASSPHRASEENV+")",
+		)
+		socksUnix = flag.String(
+			"socksunix",
+			"",
+			"Serve SOCKS5 through the chain on a Unix socket at "+
+				"`path`, for local tools",
+		)
+		socksUIDsList = flag.String(
+			"socksuids",
+			"",
+			"Comma-separated `list` of UIDs, besides our own, "+
+				"allowed to use -socksunix",
+		)
+		mapFile = flag.String(
+			"mapfile",
+			"",
+			"Optional `file` to which to write a JSON map of "+
+				"forwards to listen addresses (default "+
+				MAPFILE+" in -statedir, if given)",
+		)
+		sshConfigFile = flag.String(
+			"sshconfig",
+			"",
+			"Optional `file` to which to write the chain as an "+
+				"OpenSSH config snippet, each time it's made",
+		)
+		allowPublic = flag.Bool(
+			"allow-public-listen",
+			false,
+			"Allow forwards to listen on every interface "+
+				"without asking",
+		)
+		maxConns = flag.Uint(
+			"maxconns",
+			0,
+			"Maximum `number` of connections proxied at once, "+
+				"or 0 for no limit",
+		)
+		overflow = flag.String(
+			"overflow",
+			OVERFLOWQUEUE,
+			"What to do with clients when there are too many "+
+				"connections, "+OVERFLOWQUEUE+" or "+
+				OVERFLOWREJECT+" (fwdspecs may override "+
+				"with overflow=)",
+		)
+		dryProxy = flag.Bool(
+			"dryproxy",
+			false,
+			"Accept and log connections to forwards, but "+
+				"throw away what's sent instead of "+
+				"connecting to targets",
+		)
+		addFile = flag.String(
+			"addfile",
+			"",
+			"Optional `file` from which to add forwarding "+
+				"specifications on SIGUSR2 (default "+
+				ADDFWDFILE+" in -statedir, if given)",
 		)
 		keyDir = flag.String(
 			"keydir",
@@ -72,64 +586,402 @@ func main() {
 			"Top-level directory for keys with a "+
 				"non-absolute path",
 		)
+		controlPerm = permFlag(0600)
+	)
+	flag.Var(
+		&controlPerm,
+		"controlperm",
+		"Control socket `permissions`, in octal, e.g. 0660 to allow "+
+			"the group",
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(
 			os.Stderr,
 			`Usage: %v [options] fwdspec [fwdspec...]
+       %v banners [options]
+       %v ping [options] host [host...]
+       %v control [options] command [args...]
+       %v status [options]
+       %v replay tracefile
+       %v tail [options] hopN:file
+       %v exec-all [options] command
 
 The jumpfile must contain lines of the form
-user@host password versionstring
+user@host password [versionstring]
+
+Passwords with spaces or leading quotes may be double-quoted, with backslash
+escapes, or single-quoted.  Unquoted passwords end at the last word starting
+with SSH-, the versionstring.  If the versionstring is omitted,
+%v is used, or a common one per jump with -randversions.
 
 If the password is of the form %vfilename, it is taken to be used as the name
 of a PEM-encoded SSH key (e.g. generated by ssh-keygen).  If the file cannot
-be found, it is assumed that it was actually a password starting with %v.
+be loaded, it is assumed that it was actually a password starting with %v.
+A filename of %v reads the key from stdin.
+
+More passwords or keys to try may follow the versionstring, each as
+cred=<password or %vfilename>, or %v for every key in ssh-agent.
+Only keys or only passwords are tried with auth=key or auth=password.
+With fp=SHA256:..., the jump's host key must have that fingerprint.
+The algorithms offered may be set with kex=, ciphers=, macs=, and hostkeyalgs=,
+each a comma-separated list, or +list to add to the defaults.
 
 Each fwdspec should be of one of the following forms
 
 L<laddr>,<lport>,<targetaddr>,<targetport>
 R<raddr>,<rport>,<targetaddr>,<targetport>
+R<raddr>,<rport>,stdio:                     (one connection to stdin/stdout)
+R<raddr>,<rport>,pipe:<path>                (one connection to a named pipe)
+R<raddr>,<rport>,agent:                     (the local ssh-agent)
+U<laddr>,<lport>,<targetaddr>,<targetport>  (UDP, requires a helper)
 
-The fwdspecs are similar to OpenSSH's -L and -R options, but always consist of
-two address/port pairs.
+The fwdspecs are similar to OpenSSH's -L and -R options, but otherwise always
+consist of two address/port pairs.  As with OpenSSH, an R forward's <raddr> may
+be empty for localhost or * for all addresses, subject to the server's
+configuration.  IPv6 addresses may be in square brackets.  Fwdspecs may be
+followed by comma-separated key=value options:
+
+host=<host>            Set the Host header of HTTP requests to <host>
+xff=add|strip          Add the client's address to or strip X-Forwarded-For
+allow=<cidr>           Only allow clients from <cidr>, may be repeated
+prio=interactive|bulk  Prefer interactive forwards' traffic to bulk
+maxbytes=<n>[k|m|g]    Close the forward's connections after <n> bytes
+onmax=close|disable    After maxbytes, refuse new clients or stop listening
+retry=<duration>       Retry an R forward's target for up to <duration>
+mdns=<service type>    Advertise an L forward with mDNS, e.g. mdns=_http._tcp
+tls=<hostname>         Serve TLS to an L forward's clients, with a self-signed
+                       or ACME (-acme) certificate for <hostname>
+storm=<n>/<interval>   Drop R forward connections from a peer after <n> in
+                       <interval>, logging a count of those dropped
+negcache=<duration>    After failing to reach the target, fail clients
+                       without trying again for <duration>
+onfail=close|rst|http  On failure to reach the target, close the client's
+                       connection, reset it, or send an HTTP 502
+md5=<key>              Use TCP MD5 signatures with the target (L forwards
+                       require a helper)
+src=<addr>[:port]      Connect to the target from this address
+srcvia=channel|helper  How L forwards use src=; helper binds it for real
+maxconns=<n>           Proxy at most <n> connections at once
+overflow=queue|reject  Past maxconns or -maxconns, hold or close new clients
+label=<note>           Note shown with the forward in logs and status
+group=<name>           Serve the forward with the group's own chain, through
+                       jumps no other chain uses
 
 Options:
 `,
 			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			DEFVERSION,
+			KEYPREFIX,
 			KEYPREFIX,
+			KEYSTDIN,
 			KEYPREFIX,
+			AGENTCRED,
 		)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+	args := flag.Args()
 
-	log.SetOutput(os.Stdout)
+	/* Load the config file, if we have one */
+	if "" != *configFile {
+		var err error
+		if args, err = ApplyConfig(*configFile, args); nil != err {
+			fmt.Fprintf(
+				os.Stderr,
+				"Unable to load config from %v: %v\n",
+				*configFile,
+				err,
+			)
+			os.Exit(1)
+		}
+	}
+
+	/* Take the config from another instance, if we're taking over */
+	if "" != *handoff {
+		var err error
+		if "" != *handoffTokenFile {
+			if handoffToken, err = ReadControlToken(
+				*handoffTokenFile,
+			); nil != err {
+				fmt.Fprintf(
+					os.Stderr,
+					"Unable to read handoff token: %v\n",
+					err,
+				)
+				os.Exit(1)
+			}
+		}
+		if args, err = HandoffConfig(*handoff, args); nil != err {
+			fmt.Fprintf(
+				os.Stderr,
+				"Unable to get handoff config from %v: %v\n",
+				*handoff,
+				err,
+			)
+			os.Exit(1)
+		}
+	}
+
+	if *printVersion {
+		PrintVersion(os.Stdout)
+		return
+	}
+
+	/* Stdout may be for forwarded data */
+	ShowSecrets(*showSecrets)
+	if UsesStdio(args) {
+		SetLogOutput(os.Stderr)
+	} else {
+		SetLogOutput(os.Stdout)
+	}
+	log.Printf("sshjump %v (%v) starting", Version, BuildInfo().Commit)
+
+	/* Adjust for odd links */
+	if "" != *profileName {
+		if err := ApplyProfile(*profileName); nil != err {
+			log.Fatalf("Unable to apply profile: %v", err)
+		}
+	}
+
+	/* Make sure things work, if we're asked */
+	if *selfTest {
+		if !SelfTest() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	/* Keep track of what happens */
+	if "" != *traceFile {
+		stop, err := OpenTrace(*traceFile)
+		if nil != err {
+			log.Fatalf("Unable to open trace file: %v", err)
+		}
+		defer stop()
+	}
+	if "" != *hostKeyLogFile {
+		stop, err := OpenHostKeyLog(*hostKeyLogFile)
+		if nil != err {
+			log.Fatalf("Unable to open host key log: %v", err)
+		}
+		defer stop()
+	}
+
+	/* Claim our state directory */
+	if "" != *stateDirName {
+		unlock, err := OpenStateDir(*stateDirName)
+		if nil != err {
+			log.Fatalf("Unable to use state directory: %v", err)
+		}
+		defer unlock()
+		log.Printf("Using state directory %v", *stateDirName)
+		if "" == *controlPath {
+			*controlPath = StatePath(CONTROLSOCK)
+		}
+		if "" == *mapFile {
+			*mapFile = StatePath(MAPFILE)
+		}
+		if "" == *addFile {
+			*addFile = StatePath(ADDFWDFILE)
+		}
+	}
+	if "" != *handoff && "" != *controlPath &&
+		SamePath(*controlPath, *handoff) {
+		log.Fatalf(
+			"Refusing to use the -handoff instance's control "+
+				"socket %v as our own",
+			*handoff,
+		)
+	}
+	if "" != *mapFile {
+		fwdMap.SetFile(*mapFile)
+		log.Printf("Writing listener map to %v", *mapFile)
+	}
+	if err := certs.Configure(
+		StatePath(CERTDIR),
+		*acmeURL,
+		*acmeDNS,
+		*acmeEmail,
+	); nil != err {
+		log.Fatalf("Unable to set up certificates: %v", err)
+	}
+	sshConfig.Set(*sshConfigFile, *keyDir)
+
+	/* Work out how to test the exit */
+	if *noExitTest {
+		*exitPolicy = EXITSKIP
+	}
+	switch *exitPolicy {
+	case EXITREQUIRED, EXITADVISORY, EXITSKIP:
+	default:
+		log.Fatalf("Unknown exit test policy %q", *exitPolicy)
+	}
+	exitWant, err := NewExitContent(*exitTest, *exitCert, *exitBody)
+	if nil != err {
+		log.Fatalf("Invalid exit test: %v", err)
+	}
+
+	/* Make sure we've an agent to forward */
+	var agentSock string
+	switch *fwdAgent {
+	case "":
+	case AGENTFWDEXIT, AGENTFWDALL:
+		if agentSock = os.Getenv(AGENTSOCKENV); "" == agentSock {
+			log.Fatalf(
+				"No ssh-agent to forward (%v not set)",
+				AGENTSOCKENV,
+			)
+		}
+	default:
+		log.Fatalf("Unknown -forwardagent %q", *fwdAgent)
+	}
 
 	/* Try to seed the random number generator */
 	if err := seedRandom(); nil != err {
 		log.Fatalf("Unable to seed PRNG with CSPRNG: %v", err)
 	}
 
+	/* Work out how many connections we'll proxy */
+	switch *overflow {
+	case OVERFLOWQUEUE, OVERFLOWREJECT:
+		defaultOverflow = *overflow
+	default:
+		log.Fatalf("Unknown -overflow %q", *overflow)
+	}
+	globalConns = newConnPool(int(*maxConns), "in all")
+
+	/* Make sure we know what to do with changed host keys */
+	switch *pinChange {
+	case PINREFUSE, PINWARN:
+	default:
+		log.Fatalf("Unknown -pinchange %q", *pinChange)
+	}
+	switch *hostKeyMode {
+	case "", HOSTKEYSTRICT, HOSTKEYACCEPTNEW, HOSTKEYOFF:
+	default:
+		log.Fatalf("Unknown -hostkey %q", *hostKeyMode)
+	}
+
+	/* Work out what's in scope */
+	if "" != *scopeFile {
+		var err error
+		if scope, err = ReadScope(*scopeFile); nil != err {
+			log.Fatalf("Unable to read scope file: %v", err)
+		}
+		log.Printf(
+			"Read %v scope rules from %v",
+			len(scope.rules),
+			*scopeFile,
+		)
+		if "" != *tunDev {
+			log.Fatalf("A tun device can't be kept in scope")
+		}
+		if EXITSKIP != *exitPolicy {
+			if err := exitScope(*exitTest); nil != err {
+				log.Fatalf("Exit test %q: %v", *exitTest, err)
+			}
+		}
+	}
+
 	/* Parse the forwarding specs */
-	forwards := ParseForwards(flag.Args())
-	if 0 == len(forwards) {
+	forwards := ParseForwards(args)
+	if 0 == len(forwards) && "" == *tunDev {
 		fmt.Fprintf(os.Stderr, "No forwarding specifications given\n")
 		os.Exit(1)
 	}
 	log.Printf("Parsed %v forwarding specifications", len(forwards))
+	needHelper := false
 	for i, f := range forwards {
-		if f.isFwd {
-			log.Printf("%v: %v -> %v", i, f.laddr, f.caddr)
+		if f.needsHelper() {
+			needHelper = true
+		}
+		if err := f.checkScope(); nil != err {
+			log.Fatalf("Forward %q: %v", f.spec, err)
+		}
+		var d string
+		if f.isUDP {
+			d = fmt.Sprintf("%v -> %v (UDP)", f.laddr, f.caddr)
+		} else if f.isFwd {
+			d = fmt.Sprintf("%v -> %v", f.laddr, f.caddr)
 		} else {
-			log.Printf("%v: %v <- %v", i, f.caddr, f.laddr)
+			d = fmt.Sprintf("%v <- %v", f.caddr, f.laddr)
 		}
+		log.Printf("%v: %v", i, withLabel(d, f.label))
+	}
+
+	/* Dry runs only pretend to connect to targets, which UDP and
+	tunnels don't do */
+	if *dryProxy {
+		if "" != *tunDev {
+			log.Fatalf("A tun device can't be used in a dry run")
+		}
+		for _, f := range forwards {
+			if f.isUDP {
+				log.Printf(
+					"Dry run: not forwarding %v (UDP)",
+					f.laddr,
+				)
+			}
+		}
+		log.Printf("Dry run: targets won't be connected to")
+		needHelper = false
+	}
+
+	if needHelper && "" == *helper && "" == *helperPath {
+		log.Fatalf(
+			"UDP forwards and L forwards with md5 or "+
+				"srcvia=%v require -helper or -helperpath",
+			SRCVIAHELPER,
+		)
+	}
+
+	/* Don't accidentally share the chain with the LAN */
+	if err := CheckPublicListens(forwards, *allowPublic); nil != err {
+		log.Fatalf("Refusing to listen: %v", err)
+	}
+
+	/* Open the tun device early, it probably needs privileges */
+	var tun io.ReadWriteCloser
+	if "" != *tunDev {
+		var err error
+		if tun, err = OpenTun(*tunDev); nil != err {
+			log.Fatalf(
+				"Unable to open tun device %v: %v",
+				*tunDev,
+				err,
+			)
+		}
+		defer tun.Close()
+		log.Printf("Opened tun device %v", *tunDev)
+	}
+
+	/* Work out who may share the chain */
+	socksUIDs, err := ParseUIDs(*socksUIDsList)
+	if nil != err {
+		log.Fatalf("Invalid -socksuids: %v", err)
 	}
 
 	/* Slurp the jumpfile */
 	if "" == *jumpfile {
 		log.Fatalf("No jumpfile given with -jumps")
 	}
-	jumps, err := ReadJumps(*jumpfile, *keyDir)
+	if "" != *passFile {
+		if err := SetPassFile(*passFile); nil != err {
+			log.Fatalf(
+				"Unable to read passphrase from %v: %v",
+				*passFile,
+				err,
+			)
+		}
+	}
+	jumps, xp, err := ReadJumps(*jumpfile, *keyDir)
 	if nil != err {
 		log.Fatalf("Unable to read jumpfile: %v", err)
 	}
@@ -137,6 +989,147 @@ Options:
 		log.Fatalf("No useable jumps in jumpfile (%q)", *jumpfile)
 	}
 	log.Printf("Read %v jumps from %v", len(jumps), *jumpfile)
+	defer WipeSecrets(jumps)
+	if StdinKeyRead() {
+		for _, f := range forwards {
+			if f.local && TARGETSTDIO == f.caddr {
+				log.Fatalf(
+					"Stdin can't be used for both a key "+
+						"and %v",
+					TARGETSTDIO,
+				)
+			}
+		}
+	}
+	if nil != xp {
+		log.Printf("Will egress via proxy %v", xp)
+	}
+	var policy *routePolicy
+	if "" != *policyFile {
+		if policy, err = LoadRoutePolicy(*policyFile); nil != err {
+			log.Fatalf("Unable to load policy script: %v", err)
+		}
+		log.Printf("Loaded routing policy from %v", *policyFile)
+	}
+	var adj adjacency
+	if "" != *adjFile {
+		if adj, err = ReadAdjacency(*adjFile); nil != err {
+			log.Fatalf("Unable to read adjacency file: %v", err)
+		}
+		log.Printf("Read which jumps reach which from %v", *adjFile)
+	}
+	var aliases *hostAliases
+	if "" != *aliasFile {
+		if aliases, err = ReadAliases(*aliasFile); nil != err {
+			log.Fatalf("Unable to read aliases: %v", err)
+		}
+		log.Printf("Read host aliases from %v", *aliasFile)
+	}
+	state.SetJumps(jumps)
+	state.SetForwards(forwards)
+	state.SetAliases(aliases)
+
+	/* Work out if we're rotating or randomizing client versions */
+	var versions *versionRotation
+	if *randVersions {
+		if versions, err = RandomVersions(*versionFile); nil != err {
+			log.Fatalf("Unable to read client versions: %v", err)
+		}
+		log.Printf(
+			"Picking from %v client versions for jumps without "+
+				"their own",
+			len(versions.versions),
+		)
+	} else if "" != *versionFile {
+		if versions, err = ReadVersions(
+			*versionFile,
+			*versionInt,
+		); nil != err {
+			log.Fatalf("Unable to read client versions: %v", err)
+		}
+		log.Printf(
+			"Rotating through %v client versions every %v",
+			len(versions.versions),
+			versions.interval,
+		)
+	}
+
+	/* Work out how to get to the first jump */
+	if "" != *netns && !netnsSupported {
+		log.Fatalf("Network namespaces are only supported on Linux")
+	}
+	if *fastOpen {
+		if err := CheckFastOpen(); nil != err {
+			log.Fatalf("Unable to use TCP Fast Open: %v", err)
+		}
+	}
+	res, err := NewResolver(*resolverURL)
+	if nil != err {
+		log.Fatalf("Invalid -resolver: %v", err)
+	}
+	if "" != *resolverURL {
+		log.Printf("Resolving jumps' names via %v", *resolverURL)
+	}
+	firstHop := NewFirstHopDialer(
+		*fastOpen,
+		*netns,
+		*torAddr,
+		*upstream,
+		res,
+	)
+	if *preResolve {
+		var hosts []string
+		for _, j := range jumps {
+			hosts = append(hosts, aliases.Addrs(j.host)...)
+		}
+		firstHop.Resolve(context.Background(), hosts)
+		log.Printf("Resolved jumps' names")
+	}
+
+	/* Work out which jumps are good enough */
+	quality, err := NewQualityPolicy(
+		*denyVersions,
+		*denyAlgs,
+		*strongCrypto,
+	)
+	if nil != err {
+		log.Fatalf("Invalid jump quality policy: %v", err)
+	}
+	for k, v := range map[string]string{
+		ALGKEX:      *kexAlgs,
+		ALGCIPHERS:  *cipherAlgs,
+		ALGMACS:     *macAlgs,
+		ALGHOSTKEYS: *hostKeyAlgs,
+	} {
+		if "" == v {
+			continue
+		}
+		if _, err := ParseAlgs(k, v); nil != err {
+			log.Fatalf("Invalid -%v: %v", k, err)
+		}
+		defaultAlgs[k] = v
+	}
+
+	/* Work out how to fix broken credentials */
+	var fixer *credFixer
+	if *fixCreds {
+		if fixer, err = NewCredFixer(*jumpfile, *keyDir); nil != err {
+			log.Fatalf("Unable to ask for credentials: %v", err)
+		}
+	}
+
+	/* Work out when we're meant to be running */
+	var window *activeWindow
+	if "" != *activeWindowSpec {
+		if window, err = ParseActiveWindow(
+			*activeWindowSpec,
+			*activeTZ,
+		); nil != err {
+			log.Fatalf("Invalid active window: %v", err)
+		}
+	} else if "" != *activeTZ {
+		log.Fatalf("-tz requires -active")
+	}
 
 	/* Shuffle it if need be */
 	if *shuffle {
@@ -146,10 +1139,11 @@ Options:
 
 	/* Pass errors up and cancels down */
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	errChan := make(chan error)
 
 	/* Watch for incoming sigints */
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	go func() {
 		s := <-sigChan
 		log.Printf("Caught %v, gracefully giving up", s)
@@ -161,43 +1155,535 @@ Options:
 
 	signal.Notify(sigChan, os.Interrupt)
 
-	/* Make connection to last node */
-	log.Printf("Making SSH jumps")
-	sshConns, err := MakeSSHConns(
-		ctx,
-		jumps,
-		*njump,
-		*connto,
-		*hsto,
-		*kaint,
-		*exitTest,
-		cancel,
-	)
-	if nil != err {
-		log.Fatalf("Unable to make SSH connections: %v", err)
+	/* Don't outlive our welcome */
+	if 0 != *maxTime {
+		stop, err := StartMaxTime(*maxTime, *maxTimeWarn, cancel)
+		if nil != err {
+			log.Fatalf("Invalid -maxtime: %v", err)
+		}
+		defer stop()
+	} else if 0 != *maxTimeWarn {
+		log.Fatalf("-maxtimewarn requires -maxtime")
+	}
+	if "" != *maxBytes {
+		n, err := parseByteCount(*maxBytes)
+		if nil != err {
+			log.Fatalf("Invalid -maxbytes: %v", err)
+		}
+		SetQuota(n, cancel)
+		log.Printf("Shutting down after proxying %v bytes", n)
 	}
-	defer CloseJumps(sshConns)
 
-	/* Attempt forwards on command line */
-	listeners, err := ForwardPorts(
-		sshConns[len(sshConns)-1],
-		forwards,
-		errChan,
-	)
-	if nil != err {
-		log.Fatalf("Unable to forward ports: %v", err)
+	/* Add forwards on SIGUSR2, if asked */
+	var addChan chan os.Signal
+	if "" != *addFile {
+		addChan = make(chan os.Signal, 1)
+		if NotifyAddForwards(addChan) {
+			log.Printf(
+				"Will add forwards from %v on SIGUSR2",
+				*addFile,
+			)
+		} else {
+			log.Printf("No SIGUSR2 here, ignoring -addfile")
+		}
 	}
-	defer CloseConns()
-	defer CloseListeners(listeners)
 
-	/* Wait for something bad to happen */
-	select {
-	case <-ctx.Done():
-		/* TODO: Print something useful */
-	case err := <-errChan:
-		log.Printf("Error: %v", err)
-		cancel()
-		/* TODO: Print something useful */
+	/* Keep an eye out for leaks, if we're debugging.  Anything started
+	from here on should be gone by the time we return. */
+	if *debug {
+		baseline := runtime.NumGoroutine()
+		defer func() {
+			cancel()
+			CheckLeaks(baseline)
+		}()
+		go WatchGoroutines(ctx)
+	}
+
+	/* Remember which jumps are being skipped between runs */
+	breaker := NewCircuitBreaker(*breakFails, *breakCool)
+	if bf := StatePath(BREAKERFILE); "" != bf {
+		if err := breaker.Load(bf); nil != err {
+			log.Printf("Unable to load skipped jumps: %v", err)
+		}
+		defer func() {
+			if err := breaker.Save(bf); nil != err {
+				log.Printf(
+					"Unable to save skipped jumps: %v",
+					err,
+				)
+			}
+		}()
+	}
+
+	/* Spread logins across accounts, remembering which were used between
+	runs */
+	var creds *credUsage
+	if *lruCreds {
+		creds = NewCredUsage()
+	}
+	if cf := StatePath(CREDUSEFILE); "" != cf && nil != creds {
+		if err := creds.Load(cf); nil != err {
+			log.Printf("Unable to load account usage: %v", err)
+		}
+		defer func() {
+			if err := creds.Save(cf); nil != err {
+				log.Printf(
+					"Unable to save account usage: %v",
+					err,
+				)
+			}
+		}()
+	}
+
+	/* Work out how to check host keys.  With a pin file, they're trusted
+	on first use unless we're told otherwise. */
+	if "" == *pinFile {
+		*pinFile = StatePath(PINFILE)
+	}
+	if "" == *hostKeyMode && "" != *pinFile {
+		*hostKeyMode = HOSTKEYACCEPTNEW
+	}
+	if HOSTKEYOFF == *hostKeyMode {
+		*pinFile = ""
+	}
+	var pins *hostPins
+	if "" != *hostKeyMode {
+		if pins, err = LoadHostPins(
+			*pinFile,
+			*hostKeyMode,
+			*pinChange,
+		); nil != err {
+			log.Fatalf("Unable to load pinned host keys: %v", err)
+		}
+	}
+	switch {
+	case HOSTKEYOFF == *hostKeyMode:
+		log.Printf("Not checking jumps' host keys")
+	case "" != *pinFile:
+		log.Printf(
+			"Loaded %v pinned host keys from %v",
+			pins.Len(),
+			*pinFile,
+		)
+	case HOSTKEYSTRICT == *hostKeyMode:
+		log.Printf("Only jumps with fp= may be used without a pin file")
+	case "" != *hostKeyMode:
+		log.Printf("Pinning host keys for this run only")
+	}
+
+	/* Don't keep testing the same exit */
+	if *forceExitTest {
+		*exitCacheTTL = 0
+	}
+	exitCache := NewExitCache(*exitCacheTTL)
+
+	/* Listen for control commands */
+	var controlToken []byte
+	if "" != *controlTokenFile {
+		if controlToken, err = ReadControlToken(
+			*controlTokenFile,
+		); nil != err {
+			log.Fatalf("Unable to read control token: %v", err)
+		}
+	}
+	if "" != *controlPath {
+		cl, err := ListenControl(
+			*controlPath,
+			os.FileMode(controlPerm),
+			controlToken,
+		)
+		if nil != err {
+			log.Fatalf(
+				"Unable to listen on control socket: %v",
+				err,
+			)
+		}
+		defer os.Remove(*controlPath)
+		defer cl.Close()
+	}
+
+	/* Serve up profiles, if asked, held to the control socket's rules */
+	if "" != *pprofAddr {
+		if !*allowPublic && !isPprofSocket(*pprofAddr) &&
+			isPublicAddr(*pprofAddr) {
+			if err := confirmPublicListen(
+				"-pprof "+*pprofAddr,
+				"every local interface",
+			); nil != err {
+				log.Fatalf("Refusing to listen: %v", err)
+			}
+		}
+		pl, err := StartPprof(
+			*pprofAddr,
+			os.FileMode(controlPerm),
+			controlToken,
+		)
+		if nil != err {
+			log.Fatalf(
+				"Unable to serve profiles on %v: %v",
+				*pprofAddr,
+				err,
+			)
+		}
+		if isPprofSocket(*pprofAddr) {
+			defer os.Remove(*pprofAddr)
+		}
+		defer pl.Close()
+	}
+
+	/* runChain makes the chain and forwards, and waits for something to
+	happen.  Everything it sets up is torn down before it returns.  If
+	the chain's taken down by a down request, the request is returned. */
+	handedOff := "" == *handoff
+	built := false /* Forwarded once, so R forwards may be retried */
+	runChain := func(
+		ctx context.Context,
+		cancel context.CancelFunc,
+	) *downRequest {
+		/* Make connection to last node */
+		ResetKillSwitch()
+		log.Printf("Making SSH jumps")
+		cc := chainConfig{
+			njump:      *njump,
+			connto:     *connto,
+			hsto:       *hsto,
+			kaint:      *kaint,
+			katimeout:  *katimeout,
+			exitTest:   *exitTest,
+			exitWant:   exitWant,
+			exitPolicy: *exitPolicy,
+			versions:   versions,
+			breaker:    breaker,
+			creds:      creds,
+			aliases:    aliases,
+			firstHop:   firstHop,
+			quality:    quality,
+			fixer:      fixer,
+			exitCache:  exitCache,
+			adjacency:  adj,
+			keydir:     *keyDir,
+			pins:       pins,
+			wireLog:    *wireLog,
+			helper:     *helper,
+			helperPath: *helperPath,
+		}
+		sshConns, err := MakeSSHConns(ctx, jumps, cc, cancel)
+		if errInterrupt == err && nil != window {
+			/* Window closed, or ^C */
+			return nil
+		} else if nil != err {
+			log.Fatalf(
+				"Unable to make SSH connections: %v",
+				Hinted(err),
+			)
+		}
+		defer func() { CloseJumps(sshConns) }()
+		/* Remember which accounts worked, even if we don't get to
+		exit cleanly */
+		if cf := StatePath(CREDUSEFILE); "" != cf {
+			if err := creds.Save(cf); nil != err {
+				log.Printf(
+					"Unable to save account usage: %v",
+					err,
+				)
+			}
+		}
+		state.SetChain(sshConns)
+		defer state.SetChain(nil)
+		sshConfig.Update(sshConns)
+
+		/* Share our keys, if asked */
+		if "" != agentSock {
+			go ForwardAgent(ctx, sshConns, *fwdAgent, agentSock)
+		}
+
+		/* Keep an eye on latency, if asked */
+		if 0 != *latencyInt {
+			go LogLatency(ctx, sshConns, *latencyInt)
+		}
+
+		/* Make sure the proxy, if we have one, works */
+		chain := NewChain(sshConns, *dialTO)
+		chain.Policy = policy
+		if nil != xp {
+			chain.Proxy = xp
+			state.SetProxy(xp)
+			if !checkProxyExit(
+				chain,
+				*exitTest,
+				*exitPolicy,
+				exitWant,
+			) {
+				log.Fatalf(
+					"Unable to connect via proxy %v",
+					xp,
+				)
+			}
+		}
+		/* Only targets are pretended, not the exit test */
+		chain.Dry = *dryProxy
+
+		/* Start the helper, if we have one */
+		var h *helperClient
+		if "" != *helper || "" != *helperPath {
+			h, err = StartHelper(
+				sshConns[len(sshConns)-1],
+				*helper,
+				*helperPath,
+			)
+			if nil != err {
+				log.Fatalf("Unable to start helper: %v", err)
+			}
+			defer h.Close()
+			chain.Helper = h
+		}
+
+		/* Give each group of forwards its own chain, through jumps no
+		other chain uses */
+		gcs, err := MakeGroupChains(
+			ctx,
+			jumps,
+			sshConns,
+			fwdGroups(forwards),
+			cc,
+			cancel,
+		)
+		if errInterrupt == err && nil != window {
+			return nil
+		} else if nil != err {
+			log.Fatalf(
+				"Unable to make SSH connections: %v",
+				Hinted(err),
+			)
+		}
+		defer func() {
+			for _, gc := range gcs {
+				CloseJumps(gc)
+			}
+		}()
+		state.SetGroupChains(gcs)
+		defer state.SetGroupChains(nil)
+		groupChains := make(map[string]*Chain)
+		for g, gc := range gcs {
+			c := NewChain(gc, *dialTO)
+			c.Policy = policy
+			c.Dry = *dryProxy
+			c.RetryRemote = built
+			if !handedOff {
+				c.Handoff = *handoff
+			}
+			groupChains[g] = c
+		}
+
+		/* Attempt forwards on command line.  If we're taking over,
+		the old instance releases each R forward just before we
+		listen for it, and gets back any it released if we fail. */
+		chain.RetryRemote = built
+		if !handedOff {
+			chain.Handoff = *handoff
+		}
+		listeners, err := ForwardPorts(
+			ctx,
+			chain,
+			inGroup(forwards, ""),
+			errChan,
+		)
+		if nil != err {
+			if !handedOff {
+				HandoffReclaim(*handoff)
+			}
+			log.Fatalf("Unable to forward ports: %v", Hinted(err))
+		}
+		defer state.ResetListeners()
+		defer CloseConns()
+		defer func() { CloseListeners(listeners) }()
+		for _, g := range fwdGroups(forwards) {
+			ls, err := ForwardPorts(
+				ctx,
+				groupChains[g],
+				inGroup(forwards, g),
+				errChan,
+			)
+			if nil != err {
+				if !handedOff {
+					CloseListeners(listeners)
+					HandoffReclaim(*handoff)
+				}
+				log.Fatalf(
+					"Unable to forward ports for group "+
+						"%v: %v",
+					g,
+					Hinted(err),
+				)
+			}
+			listeners = append(listeners, ls...)
+		}
+		built = true
+		if !handedOff {
+			go HandoffShutdown(*handoff)
+			handedOff = true
+		}
+
+		/* Let local tools use the chain, if asked */
+		if "" != *socksUnix {
+			sl, err := ServeSOCKSUnix(
+				ctx,
+				*socksUnix,
+				socksUIDs,
+				chain,
+			)
+			if nil != err {
+				log.Fatalf(
+					"Unable to serve SOCKS5 on %v: %v",
+					*socksUnix,
+					err,
+				)
+			}
+			defer sl.Close()
+			KillOnTrip(sl)
+		}
+
+		/* Tell the LAN about the forwards, if asked */
+		md, err := StartMDNS(state.Listeners())
+		if nil != err {
+			log.Printf("Unable to advertise with mDNS: %v", err)
+		}
+		defer md.Close()
+
+		/* Forward UDP via the helper */
+		var pcs []net.PacketConn
+		if nil != h && !*dryProxy {
+			pcs, err = ForwardUDP(ctx, h, forwards, errChan)
+			if nil != err {
+				log.Fatalf("Unable to forward UDP: %v", err)
+			}
+			defer func() { CloseUDP(pcs) }()
+			for _, pc := range pcs {
+				KillOnTrip(pc)
+			}
+		}
+
+		/* Start tunneling packets */
+		if nil != tun {
+			if err := ForwardTun(
+				ctx,
+				sshConns[len(sshConns)-1],
+				tun,
+				uint32(*tunUnit),
+				errChan,
+			); nil != err {
+				log.Fatalf("Unable to open tunnel: %v", err)
+			}
+		}
+
+		/* Wait for something bad to happen, adding forwards as asked */
+		for {
+			select {
+			case <-ctx.Done():
+			case err := <-errChan:
+				if errLocalDone == err {
+					log.Printf(
+						"Finished with local targets",
+					)
+				} else {
+					log.Printf("Error: %v", Hinted(err))
+				}
+				cancel()
+			case req := <-shutdownChan:
+				CascadeShutdown(
+					req.w,
+					listeners,
+					pcs,
+					sshConns,
+					*cleanup,
+					req.drain,
+				)
+				/* Already closed */
+				listeners, pcs, sshConns = nil, nil, nil
+				close(req.done)
+			case <-addChan:
+				nfs := ReadAddedForwards(
+					*addFile,
+					forwards,
+					*allowPublic,
+				)
+				if 0 == len(nfs) {
+					continue
+				}
+				ls, ps, added := AddForwards(
+					ctx,
+					chain,
+					groupChains,
+					h,
+					nfs,
+					errChan,
+				)
+				listeners = append(listeners, ls...)
+				pcs = append(pcs, ps...)
+				forwards = append(forwards, added...)
+				state.SetForwards(forwards)
+				log.Printf("Added %v forwards", len(added))
+				continue
+			case req := <-downChan:
+				log.Printf("Taking the chain down")
+				listeners = PauseListeners(state.Listeners())
+				cancel()
+				return &req
+			}
+			log.Printf(
+				"Closing %v listeners, %v UDP forwards, and "+
+					"%v SSH connections",
+				len(listeners),
+				len(pcs),
+				len(sshConns),
+			)
+			return nil
+		}
+	}
+
+	/* Without a window, we only need the one chain, unless it's taken
+	down and brought back up */
+	if nil == window {
+		for nil == ctx.Err() {
+			cctx, ccancel := context.WithCancel(ctx)
+			req := runChain(cctx, ccancel)
+			ccancel()
+			if nil == req || !WaitChainUp(ctx, *req) {
+				break
+			}
+		}
+		return
+	}
+
+	/* Bring everything up when the window opens and down when it closes */
+	for nil == ctx.Err() {
+		end := window.Wait(ctx)
+		if nil != ctx.Err() {
+			break
+		}
+		log.Printf(
+			"In active window until %v",
+			end.Format(time.RFC3339),
+		)
+		wctx, wcancel := context.WithCancel(ctx)
+		t := time.AfterFunc(time.Until(end), func() {
+			log.Printf("Active window closed, tearing down")
+			wcancel()
+		})
+		req := runChain(wctx, wcancel)
+		/* Only the window's closing or a down request doesn't stop
+		us */
+		closed := !t.Stop()
+		wcancel()
+		if nil != req {
+			if !WaitChainUp(ctx, *req) {
+				break
+			}
+			continue
+		}
+		if !closed {
+			break
+		}
 	}
 }
 
@@ -216,5 +1702,3 @@ func seedRandom() error {
 
 	return nil
 }
-
-/* TODO: Key auth */
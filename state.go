@@ -0,0 +1,270 @@
+package main
+
+/*
+ * state.go
+ * Runtime state, for the control socket
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* runState holds what's going on, for reporting via the control socket */
+type runState struct {
+	l        sync.Mutex
+	start    time.Time
+	jumps    []jump
+	forwards []fwdspec
+	chain    []*ssh.Client
+	groups   map[string][]*ssh.Client /* Forward groups' chains */
+	hops     map[*ssh.Client]jump     /* Where each of chain came from */
+	proxy    *exitProxy
+	aliases  *hostAliases
+	ls       []fwdListener
+	pending  map[string]int /* R forwards' specs -> retriers */
+	deadline time.Time      /* When -maxtime tears everything down */
+}
+
+/* fwdListener is a forward's listener */
+type fwdListener struct {
+	l net.Listener
+	f fwdspec
+
+	/* relisten, if not nil, listens again for f after l's been released
+	for a handoff which didn't happen */
+	relisten func() error
+}
+
+/* state is the program's runtime state */
+var state = &runState{start: time.Now()}
+
+/* SetDeadline records when everything will be torn down */
+func (s *runState) SetDeadline(t time.Time) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.deadline = t
+}
+
+/* Deadline returns when everything will be torn down, or the zero time if
+there's no limit */
+func (s *runState) Deadline() time.Time {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.deadline
+}
+
+/* SetJumps records the jumps read from the jumpfile */
+func (s *runState) SetJumps(js []jump) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.jumps = js
+}
+
+/* SetForwards records the forwarding specifications */
+func (s *runState) SetForwards(fs []fwdspec) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.forwards = fs
+}
+
+/* SetChain records the current chain */
+func (s *runState) SetChain(cs []*ssh.Client) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.chain = cs
+	/* Forget about jumps no longer in the chain */
+	hops := make(map[*ssh.Client]jump)
+	for _, c := range cs {
+		if j, ok := s.hops[c]; ok {
+			hops[c] = j
+		}
+	}
+	s.hops = hops
+}
+
+/* SetGroupChains records the forward groups' chains */
+func (s *runState) SetGroupChains(gcs map[string][]*ssh.Client) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.groups = gcs
+}
+
+/* GroupChains returns the forward groups' chains */
+func (s *runState) GroupChains() map[string][]*ssh.Client {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.groups
+}
+
+/* NoteJump records that c is a connection to j, for describeJump */
+func (s *runState) NoteJump(c *ssh.Client, j jump) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if nil == s.hops {
+		s.hops = make(map[*ssh.Client]jump)
+	}
+	s.hops[c] = j
+}
+
+/* SetProxy records the proxy used after the last jump */
+func (s *runState) SetProxy(p *exitProxy) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.proxy = p
+}
+
+/* SetAliases records the jumps' host aliases */
+func (s *runState) SetAliases(as *hostAliases) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.aliases = as
+}
+
+/* AddListener records the listener for a forward.  If the chain's already
+been lost, the listener's closed.  For R forwards, relisten is used to listen
+again if a handoff fails; it may be nil. */
+func (s *runState) AddListener(
+	l net.Listener,
+	f fwdspec,
+	relisten func() error,
+) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.ls = append(s.ls, fwdListener{l: l, f: f, relisten: relisten})
+	if KillSwitchTripped() {
+		l.Close()
+	}
+	var jump string
+	cs := s.chain
+	if "" != f.group {
+		cs = s.groups[f.group]
+	}
+	if 0 != len(cs) {
+		jump = cs[len(cs)-1].RemoteAddr().String()
+	}
+	fwdMap.Add(f, listenAddr(l, f), jump)
+}
+
+/* AddPending notes that f's remote listen is being retried */
+func (s *runState) AddPending(f fwdspec) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if nil == s.pending {
+		s.pending = make(map[string]int)
+	}
+	s.pending[f.spec]++
+}
+
+/* DonePending notes that f's remote listen is no longer being retried */
+func (s *runState) DonePending(f fwdspec) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.pending[f.spec]--; 0 >= s.pending[f.spec] {
+		delete(s.pending, f.spec)
+	}
+}
+
+/* ForwardState returns "live" if f has a listener, "pending" if its remote
+listen is being retried, or the empty string otherwise. */
+func (s *runState) ForwardState(f fwdspec) string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for _, fl := range s.ls {
+		if fl.f.spec == f.spec {
+			return "live"
+		}
+	}
+	if 0 != s.pending[f.spec] {
+		return "pending"
+	}
+	return ""
+}
+
+/* RemoveListener forgets l, which has been closed but isn't being
+replaced */
+func (s *runState) RemoveListener(l net.Listener) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	ls := s.ls[:0:0]
+	for _, fl := range s.ls {
+		if fl.l == l {
+			fwdMap.Remove(fl.f.spec)
+			continue
+		}
+		ls = append(ls, fl)
+	}
+	s.ls = ls
+}
+
+/* ResetListeners forgets the forwards' listeners, once they're closed */
+func (s *runState) ResetListeners() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.ls = nil
+	fwdMap.Reset()
+}
+
+/* Listeners returns the forwards' listeners */
+func (s *runState) Listeners() []fwdListener {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.ls
+}
+
+/* Jumps returns the jumps read from the jumpfile */
+func (s *runState) Jumps() []jump {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.jumps
+}
+
+/* Forwards returns the forwarding specifications */
+func (s *runState) Forwards() []fwdspec {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.forwards
+}
+
+/* Chain returns the current chain */
+func (s *runState) Chain() []*ssh.Client {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.chain
+}
+
+/* Proxy returns the proxy used after the last jump, or nil */
+func (s *runState) Proxy() *exitProxy {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.proxy
+}
+
+/* Aliases returns the jumps' host aliases, or nil */
+func (s *runState) Aliases() *hostAliases {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.aliases
+}
+
+/* JumpOf returns the jump to which c is connected, if it's known */
+func (s *runState) JumpOf(c *ssh.Client) (jump, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	j, ok := s.hops[c]
+	return j, ok
+}
+
+/* describeJump returns a secret-free description of c, with its jump's
+label */
+func describeJump(c *ssh.Client) string {
+	j, _ := state.JumpOf(c)
+	return withLabel(c.User()+"@"+c.RemoteAddr().String()+
+		" ("+string(c.ClientVersion())+")", j.label)
+}
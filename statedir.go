@@ -0,0 +1,59 @@
+package main
+
+/*
+ * statedir.go
+ * Directory for state which outlives a run
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	/* STATELOCK is the name of the lock file in the state directory */
+	STATELOCK = "lock"
+	/* BREAKERFILE is the name of the circuit breaker's state file */
+	BREAKERFILE = "breaker.json"
+	/* MAPFILE is the name of the listener map file */
+	MAPFILE = "listeners.json"
+	/* ADDFWDFILE is the name of the file from which forwards are added on
+	SIGUSR2 */
+	ADDFWDFILE = "add.fwds"
+	/* PINFILE is the name of the file holding jumps' pinned host keys */
+	PINFILE = "pins"
+	/* CREDUSEFILE is the name of the file recording when each account on
+	each jump was last used */
+	CREDUSEFILE = "creds.json"
+)
+
+/* stateDir is the directory in which state is kept, or "" for none */
+var stateDir string
+
+/* OpenStateDir makes dir, if it doesn't exist, and locks it so no other
+instance can use it at the same time.  The returned function releases the
+lock. */
+func OpenStateDir(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return nil, err
+	}
+	unlock, err := lockFile(filepath.Join(dir, STATELOCK))
+	if nil != err {
+		return nil, fmt.Errorf("locking %v: %v", dir, err)
+	}
+	stateDir = dir
+	return unlock, nil
+}
+
+/* StatePath returns the path to name in the state directory, or the empty
+string if there's no state directory. */
+func StatePath(name string) string {
+	if "" == stateDir {
+		return ""
+	}
+	return filepath.Join(stateDir, name)
+}
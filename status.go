@@ -0,0 +1,146 @@
+package main
+
+/*
+ * status.go
+ * Report on a running instance
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+func init() {
+	RegisterControlCommand(
+		"status",
+		"Summarize the chain, forwards, and connections",
+		func(w io.Writer, args []string) error {
+			WriteStatus(w)
+			return nil
+		},
+	)
+}
+
+/* WriteStatus writes a human-readable summary of what's going on to w */
+func WriteStatus(w io.Writer) {
+	bi := BuildInfo()
+	fmt.Fprintf(
+		w,
+		"Version:  %v (%v), %v\n",
+		bi.Version,
+		bi.Commit,
+		bi.Platform,
+	)
+	fmt.Fprintf(
+		w,
+		"Uptime:   %v\n",
+		time.Since(state.start).Round(time.Second),
+	)
+	if dl := state.Deadline(); !dl.IsZero() {
+		fmt.Fprintf(
+			w,
+			"Ends:     in %v, at %v\n",
+			time.Until(dl).Round(time.Second),
+			dl.Format(time.RFC3339),
+		)
+	}
+	cs := state.Chain()
+	if ChainDown() {
+		fmt.Fprintf(w, "Chain:    down, use up to resume\n")
+	} else {
+		fmt.Fprintf(w, "Chain:    %v jumps\n", len(cs))
+	}
+	for i, c := range cs {
+		fmt.Fprintf(
+			w,
+			"  %v: %v, server %v\n",
+			i+1,
+			describeJump(c),
+			string(c.ServerVersion()),
+		)
+	}
+	if p := state.Proxy(); nil != p {
+		fmt.Fprintf(w, "  Proxy: %v\n", p)
+	}
+	gcs := state.GroupChains()
+	gs := make([]string, 0, len(gcs))
+	for g := range gcs {
+		gs = append(gs, g)
+	}
+	sort.Strings(gs)
+	for _, g := range gs {
+		fmt.Fprintf(w, "Group %v: %v jumps\n", g, len(gcs[g]))
+		for i, c := range gcs[g] {
+			fmt.Fprintf(
+				w,
+				"  %v: %v, server %v\n",
+				i+1,
+				describeJump(c),
+				string(c.ServerVersion()),
+			)
+		}
+	}
+	state.Aliases().WriteStatus(w)
+	fs := state.Forwards()
+	fmt.Fprintf(w, "Forwards: %v\n", len(fs))
+	for _, f := range fs {
+		var st string
+		if s := state.ForwardState(f); !f.isFwd && "" != s {
+			st = " (" + s + ")"
+		}
+		fmt.Fprintf(w, "  %v%v\n", withLabel(f.spec, f.label), st)
+	}
+	fmt.Fprintf(w, "Sockets:  %v proxied sockets open\n", ConnCount())
+	if n, max := QuotaUsed(); 0 != max {
+		fmt.Fprintf(w, "Quota:    %v/%v bytes proxied\n", n, max)
+	}
+	fmt.Fprintf(w, "Usage:\n")
+	WriteUsage(w)
+}
+
+/* StatusMain is the entry point for the status subcommand, which prints a
+summary of a running instance's state, via its control socket. */
+func StatusMain(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	sock := addControlFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v status [options]
+
+Prints a summary of a running instance's chain, forwards, and connections, via
+its control socket.  Exits non-zero if the instance can't be reached.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	path, token := sock()
+	var b bytes.Buffer
+	if err := SendControl(
+		path,
+		token,
+		&b,
+		[]string{"status"},
+	); nil != err {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	/* Errors from the instance should fail, too */
+	if bytes.HasPrefix(b.Bytes(), []byte("Error: ")) {
+		os.Stderr.Write(b.Bytes())
+		os.Exit(1)
+	}
+	os.Stdout.Write(b.Bytes())
+}
@@ -0,0 +1,72 @@
+package main
+
+/*
+ * stdinkey.go
+ * Read a key from stdin, so it needn't touch disk
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* KEYSTDIN is the key file name which means to read the key from stdin, as
+in key:- */
+const KEYSTDIN = "-"
+
+/* STDINKEYMAX is the most we'll read from stdin looking for a key */
+const STDINKEYMAX = 1024 * 1024
+
+/* stdinKey holds the key read from stdin.  Stdin can only be read once, so
+it's kept for every jump which uses it and every time the jumpfile's read.
+Once the key's parsed, the bytes read are wiped and only the signer's kept. */
+var stdinKey struct {
+	sync.Mutex
+	b      []byte
+	err    error
+	read   bool
+	signer ssh.Signer
+}
+
+/* StdinKey reads a key from stdin, until EOF, the first time it's called and
+returns it every time. */
+func StdinKey() (ssh.Signer, error) {
+	stdinKey.Lock()
+	defer stdinKey.Unlock()
+	if !stdinKey.read {
+		stdinKey.b, stdinKey.err = ioutil.ReadAll(io.LimitReader(
+			os.Stdin,
+			STDINKEYMAX,
+		))
+		stdinKey.read = true
+	}
+	if nil != stdinKey.err {
+		return nil, fmt.Errorf("reading stdin: %w", stdinKey.err)
+	}
+	if nil != stdinKey.signer {
+		return stdinKey.signer, nil
+	}
+	s, err := parseKey("stdin", stdinKey.b)
+	if nil != err {
+		return nil, err
+	}
+	wipe(stdinKey.b)
+	stdinKey.b = nil
+	stdinKey.signer = s
+	return s, nil
+}
+
+/* StdinKeyRead returns true if stdin's been read by StdinKey */
+func StdinKeyRead() bool {
+	stdinKey.Lock()
+	defer stdinKey.Unlock()
+	return stdinKey.read
+}
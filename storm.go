@@ -0,0 +1,126 @@
+package main
+
+/*
+ * storm.go
+ * Limit reconnect storms to R forwards
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* stormLimit limits how many connections a single peer may make to a forward
+in an interval.  Connections over the limit are dropped and counted, and the
+count logged when the interval's over, to keep the logs readable during a
+reconnect storm.  A nil stormLimit allows everything. */
+type stormLimit struct {
+	max      int
+	interval time.Duration
+	dst      string /* For logging */
+
+	l     sync.Mutex
+	peers map[string]*stormPeer
+}
+
+/* stormPeer is a peer's connections in the current interval */
+type stormPeer struct {
+	start   time.Time
+	n       int /* Connections */
+	dropped int /* Connections over the limit */
+}
+
+/* parseStormLimit parses a limit of the form count/interval, e.g. 5/10s */
+func parseStormLimit(s, dst string) (*stormLimit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if 2 != len(parts) {
+		return nil, fmt.Errorf("not of the form count/interval")
+	}
+	n, err := strconv.Atoi(parts[0])
+	if nil != err || 1 > n {
+		return nil, fmt.Errorf("invalid count %q", parts[0])
+	}
+	d, err := time.ParseDuration(parts[1])
+	if nil != err || 0 >= d {
+		return nil, fmt.Errorf("invalid interval %q", parts[1])
+	}
+	return &stormLimit{
+		max:      n,
+		interval: d,
+		dst:      dst,
+		peers:    make(map[string]*stormPeer),
+	}, nil
+}
+
+/* Allow returns true if the peer at a hasn't yet made too many connections
+this interval. */
+func (s *stormLimit) Allow(a net.Addr) bool {
+	if nil == s {
+		return true
+	}
+	h, _, err := net.SplitHostPort(a.String())
+	if nil != err {
+		h = a.String()
+	}
+	now := time.Now()
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.expire(now)
+	p, ok := s.peers[h]
+	if !ok {
+		p = &stormPeer{start: now}
+		s.peers[h] = p
+	}
+	p.n++
+	if p.n <= s.max {
+		return true
+	}
+	/* Note the storm, and make sure it's summarized even if it stops */
+	if 0 == p.dropped {
+		log.Printf(
+			"Connection storm from %v to %v, dropping "+
+				"connections over %v per %v",
+			h,
+			s.dst,
+			s.max,
+			s.interval,
+		)
+		time.AfterFunc(p.start.Add(s.interval).Sub(now), func() {
+			s.l.Lock()
+			defer s.l.Unlock()
+			s.expire(time.Now())
+		})
+	}
+	p.dropped++
+	return false
+}
+
+/* expire forgets peers whose intervals have finished, logging how many of
+their connections were dropped.  The caller must hold s.l. */
+func (s *stormLimit) expire(now time.Time) {
+	for h, p := range s.peers {
+		if now.Sub(p.start) < s.interval {
+			continue
+		}
+		if 0 != p.dropped {
+			log.Printf(
+				"Dropped %v/%v connections from %v to %v "+
+					"in %v",
+				p.dropped,
+				p.n,
+				h,
+				s.dst,
+				s.interval,
+			)
+		}
+		delete(s.peers, h)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+/*
+ * subcommand.go
+ * Bits common to subcommands which need a chain
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* chainFlags holds the flags needed by a subcommand to build a chain */
+type chainFlags struct {
+	jumpfile    *string
+	njump       *uint
+	hsto        *time.Duration
+	connto      *time.Duration
+	keyDir      *string
+	passFile    *string
+	showSecrets *bool
+}
+
+/* addChainFlags adds the flags needed to build a chain to fs.  The jumpfile
+is named by the flag named jf. */
+func addChainFlags(fs *flag.FlagSet, jf string) *chainFlags {
+	return &chainFlags{
+		jumpfile: fs.String(
+			jf,
+			"",
+			"Name of `file` containing SSH jumps for the chain",
+		),
+		njump: fs.Uint(
+			"njump",
+			5,
+			"The first `N` working jumps in the jumpfile will be "+
+				"used, or 0 to use all of the jumps",
+		),
+		hsto: fs.Duration(
+			"hsto",
+			15*time.Second,
+			"SSH handshake `timeout`",
+		),
+		connto: fs.Duration(
+			"connto",
+			10*time.Second,
+			"TCP connection `timeout`",
+		),
+		keyDir: fs.String(
+			"keydir",
+			".",
+			"Top-level directory for keys with a "+
+				"non-absolute path",
+		),
+		passFile: fs.String(
+			"passfile",
+			"",
+			"Name of `file` containing the passphrase for "+
+				"encrypted keys (or set "+PASSPHRASEENV+")",
+		),
+		showSecrets: fs.Bool(
+			"showsecrets",
+			false,
+			"Log passwords and key paths instead of masking them",
+		),
+	}
+}
+
+/* makeChain reads the jumpfile and makes a chain from the jumps in it, with
+no exit test.  It is an error for the jumpfile to be unset. */
+func (cf *chainFlags) makeChain(
+	ctx context.Context,
+	cancel context.CancelFunc,
+) ([]*ssh.Client, error) {
+	ShowSecrets(*cf.showSecrets)
+	if "" == *cf.jumpfile {
+		return nil, fmt.Errorf("no jumpfile given")
+	}
+	if "" != *cf.passFile {
+		if err := SetPassFile(*cf.passFile); nil != err {
+			return nil, fmt.Errorf("reading passphrase: %v", err)
+		}
+	}
+	jumps, _, err := ReadJumps(*cf.jumpfile, *cf.keyDir)
+	if nil != err {
+		return nil, err
+	}
+	return MakeSSHConns(
+		ctx,
+		jumps,
+		chainConfig{
+			njump:      *cf.njump,
+			connto:     *cf.connto,
+			hsto:       *cf.hsto,
+			kaint:      time.Minute,
+			katimeout:  10 * time.Second,
+			exitPolicy: EXITSKIP,
+		},
+		cancel,
+	)
+}
@@ -0,0 +1,169 @@
+package main
+
+/*
+ * tail.go
+ * Follow a file on one of the jumps
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* TAILRETRY is how long to wait before rebuilding a lost chain */
+const TAILRETRY = 5 * time.Second
+
+/* TailMain is the entry point for the tail subcommand, which follows a file
+on one of the jumps, rebuilding the chain if it's lost. */
+func TailMain(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	nLines := fs.Uint(
+		"n",
+		10,
+		"Print the last `N` lines of the file before following it",
+	)
+	cf := addChainFlags(fs, "jumps")
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v tail [options] hopN:file
+
+Makes a chain and follows file on the Nth jump (or the last jump, with
+exit:file) with tail -F, much like tail -F would locally.  If the chain is
+lost, it's rebuilt and following resumes, though anything written to the file
+in the meantime is missed.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 1 != fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+	hop, fname, err := parseTailTarget(fs.Arg(0))
+	if nil != err {
+		log.Fatalf("Invalid file %q: %v", fs.Arg(0), err)
+	}
+
+	/* Stop on ^C */
+	ctx, cancel := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+	)
+	defer cancel()
+
+	n := *nLines
+	for nil == ctx.Err() {
+		/* Get to the jump */
+		cctx, ccancel := context.WithCancel(ctx)
+		cs, err := cf.makeChain(cctx, ccancel)
+		if nil != err {
+			ccancel()
+			log.Printf("Unable to make SSH connections: %v", err)
+			sleepContext(ctx, TAILRETRY)
+			continue
+		}
+		h := hop
+		if 0 == h {
+			h = len(cs)
+		}
+		if len(cs) < h {
+			CloseJumps(cs)
+			ccancel()
+			log.Fatalf("Only made %v jumps, need %v", len(cs), h)
+		}
+
+		/* Follow the file until something goes wrong */
+		log.Printf("Following %v on jump %v", fname, h)
+		err = tailFile(cctx, cs[h-1], fname, n)
+		CloseJumps(cs)
+		ccancel()
+		var ee *ssh.ExitError
+		switch {
+		case nil != ctx.Err():
+			return
+		case errors.As(err, &ee):
+			log.Fatalf("Unable to follow %v: %v", fname, err)
+		case nil == err:
+			return
+		}
+		log.Printf("Lost chain while following %v: %v", fname, err)
+		n = 0
+	}
+}
+
+/* parseTailTarget splits s, of the form hopN:file or exit:file, into the jump
+number and file.  The number is 0 for exit. */
+func parseTailTarget(s string) (int, string, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if 2 != len(parts) || "" == parts[1] {
+		return 0, "", fmt.Errorf("not of the form hopN:file")
+	}
+	if "exit" == parts[0] {
+		return 0, parts[1], nil
+	}
+	if !strings.HasPrefix(parts[0], "hop") {
+		return 0, "", fmt.Errorf("jump must be hopN or exit")
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(parts[0], "hop"))
+	if nil != err || 1 > n {
+		return 0, "", fmt.Errorf("invalid jump number in %q", parts[0])
+	}
+	return n, parts[1], nil
+}
+
+/* tailFile runs tail -F on fname on sc, sending the output to stdout, until
+tail exits, the connection dies, or ctx is done.  The last n lines of the file
+are printed first. */
+func tailFile(
+	ctx context.Context,
+	sc *ssh.Client,
+	fname string,
+	n uint,
+) error {
+	s, err := sc.NewSession()
+	if nil != err {
+		return err
+	}
+	defer s.Close()
+	s.Stdout = os.Stdout
+	s.Stderr = os.Stderr
+
+	/* Give up when we're told */
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+
+	return s.Run(fmt.Sprintf("tail -n %v -F %v", n, shellQuote(fname)))
+}
+
+/* sleepContext sleeps for d or until ctx is done, whichever is first */
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+/*
+ * tcpmd5.go
+ * TCP MD5 signatures for forwards to BGP-ish targets
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/* MD5MAXKEYLEN is the longest key the kernel takes, TCP_MD5SIG_MAXKEYLEN */
+const MD5MAXKEYLEN = 80
+
+/* helperDialer connects to targets of L forwards with TCP MD5 signatures or
+from a particular source address.  The SSH server on the exit jump can't set
+socket options or bind, so the helper dials the target and passes the
+connection back via a Unix socket. */
+type helperDialer struct {
+	c   *Chain
+	key string /* TCP MD5 key, if any */
+	src string /* Source address, if any */
+}
+
+/* Dial connects to addr via the helper */
+func (d helperDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+/* DialContext connects to addr via the helper.  The helper's dial is limited
+by d.c.DialTimeout, or HELPERTIMEOUT if there's none. */
+func (d helperDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (net.Conn, error) {
+	if nil == d.c.Helper {
+		return nil, errors.New("md5 and srcvia=helper need a helper")
+	}
+	if err := scope.Check(addr); nil != err {
+		return nil, err
+	}
+	to := d.c.DialTimeout
+	if 0 == to {
+		to = HELPERTIMEOUT
+	}
+	path, err := d.c.Helper.DialTCP(addr, d.key, d.src, to)
+	if nil != err {
+		return nil, err
+	}
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	return d.c.Exit().Dial("unix", path)
+}
+
+/* helperDialTCP connects to addr, with TCP MD5 signatures using key if it's
+not empty and from src if it's not empty, and makes a Unix socket, readable
+only by us, through which the connection may be used.  The socket accepts one
+connection within to and is then removed. */
+func helperDialTCP(
+	addr string,
+	key []byte,
+	src string,
+	to time.Duration,
+) (string, error) {
+	d := net.Dialer{Timeout: to}
+	if 0 != len(key) {
+		d.Control = md5Control(string(key))
+	}
+	if "" != src {
+		la, err := net.ResolveTCPAddr("tcp", src)
+		if nil != err {
+			return "", fmt.Errorf("source address: %w", err)
+		}
+		d.LocalAddr = la
+	}
+	tc, err := d.Dial("tcp", addr)
+	if nil != err {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "sshjump")
+	if nil != err {
+		tc.Close()
+		return "", err
+	}
+	path := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if nil != err {
+		tc.Close()
+		os.RemoveAll(dir)
+		return "", err
+	}
+	go func() {
+		l.SetDeadline(time.Now().Add(to))
+		uc, err := l.Accept()
+		l.Close()
+		os.RemoveAll(dir)
+		if nil != err {
+			tc.Close()
+			return
+		}
+		spliceConns(uc, tc)
+	}()
+	return path, nil
+}
+
+/* spliceConns copies between a and b until both directions are finished, and
+closes them. */
+func spliceConns(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	done := make(chan struct{})
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package main
+
+/*
+ * tcpmd5_linux.go
+ * TCP MD5 signatures on Linux
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+/* tcpMD5Supported indicates md5Control works here */
+const tcpMD5Supported = true
+
+/* md5Control returns a net.Dialer Control function which sets up TCP MD5
+signatures (RFC 2385) with key for the address being dialed. */
+func md5Control(key string) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		h, _, err := net.SplitHostPort(address)
+		if nil != err {
+			return err
+		}
+		ip := net.ParseIP(h)
+		if nil == ip {
+			return fmt.Errorf("invalid address %q", h)
+		}
+		/* The kernel wants a sockaddr, less the port */
+		sig := unix.TCPMD5Sig{Keylen: uint16(len(key))}
+		copy(sig.Key[:], key)
+		if ip4 := ip.To4(); nil != ip4 {
+			sig.Addr.Family = unix.AF_INET
+			copy(sig.Addr.Data[2:], ip4)
+		} else {
+			sig.Addr.Family = unix.AF_INET6
+			copy(sig.Addr.Data[6:], ip.To16())
+		}
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptTCPMD5Sig(
+				int(fd),
+				unix.IPPROTO_TCP,
+				unix.TCP_MD5SIG,
+				&sig,
+			)
+		}); nil != err {
+			return err
+		}
+		return serr
+	}
+}
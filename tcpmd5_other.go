@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+/*
+ * tcpmd5_other.go
+ * TCP MD5 signature stub for platforms which don't do them
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"syscall"
+)
+
+/* tcpMD5Supported indicates md5Control works here */
+const tcpMD5Supported = false
+
+/* md5Control returns a net.Dialer Control function which returns an error, as
+TCP MD5 signatures are only supported on Linux. */
+func md5Control(key string) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New(
+			"TCP MD5 signatures are only supported on Linux",
+		)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package main
+
+/*
+ * tfo_linux.go
+ * TCP Fast Open on Linux
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/* tcpFastOpenConnect is TCP_FASTOPEN_CONNECT, which syscall doesn't have */
+const tcpFastOpenConnect = 0x1E
+
+/* TFOSYSCTL is where the kernel says whether clients may use TCP Fast Open */
+const TFOSYSCTL = "/proc/sys/net/ipv4/tcp_fastopen"
+
+/* CheckFastOpen returns an error if TCP Fast Open can't be used to connect,
+either because the kernel's too old for TCP_FASTOPEN_CONNECT (4.11) or
+because it's been turned off for clients. */
+func CheckFastOpen() error {
+	/* Does the kernel know about it at all? */
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if nil != err {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.SetsockoptInt(
+		fd,
+		syscall.IPPROTO_TCP,
+		tcpFastOpenConnect,
+		1,
+	); nil != err {
+		return fmt.Errorf("kernel doesn't support it: %w", err)
+	}
+
+	/* Is it turned on for clients? */
+	b, err := ioutil.ReadFile(TFOSYSCTL)
+	if os.IsNotExist(err) {
+		return errors.New("kernel doesn't support it")
+	} else if nil != err {
+		return err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if nil != err {
+		return fmt.Errorf("unexpected %v %q", TFOSYSCTL, b)
+	}
+	if 0 == n&1 {
+		return fmt.Errorf("disabled for clients in %v", TFOSYSCTL)
+	}
+	return nil
+}
+
+/* setFastOpen enables TCP Fast Open on a socket about to connect.  It's meant
+for use as a net.Dialer's Control function. */
+func setFastOpen(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(
+			int(fd),
+			syscall.IPPROTO_TCP,
+			tcpFastOpenConnect,
+			1,
+		)
+	}); nil != err {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+/*
+ * tfo_other.go
+ * TCP Fast Open stub for platforms which don't do it
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"syscall"
+)
+
+/* CheckFastOpen returns an error, as TCP Fast Open is only supported on
+Linux. */
+func CheckFastOpen() error {
+	return fmt.Errorf("TCP Fast Open is only supported on Linux")
+}
+
+/* setFastOpen returns an error, as TCP Fast Open is only supported on
+Linux. */
+func setFastOpen(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("TCP Fast Open is only supported on Linux")
+}
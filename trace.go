@@ -0,0 +1,200 @@
+package main
+
+/*
+ * trace.go
+ * Record and replay chain construction
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/* Trace events */
+const (
+	TRACEATTEMPT   = "attempt"        /* About to try a jump */
+	TRACESKIP      = "skip"           /* Jump skipped without trying */
+	TRACEDIALFAIL  = "dial-fail"      /* Couldn't connect to the jump */
+	TRACENOFORWARD = "no-forwarding"  /* Previous jump won't forward */
+	TRACEHSFAIL    = "handshake-fail" /* SSH handshake failed */
+	TRACEBANNER    = "banner"         /* Jump sent a pre-auth banner */
+	TRACEJUMP      = "jump"           /* Jump added to the chain */
+	TRACEEXITPASS  = "exit-pass"      /* Exit test passed */
+	TRACEEXITFAIL  = "exit-fail"      /* Exit test failed */
+	TRACEDROP      = "drop"           /* Last jump removed */
+	TRACECHAIN     = "chain"          /* Chain finished */
+	TRACECHAINFAIL = "chain-fail"     /* Chain couldn't be made */
+	TRACELOST      = "chain-lost"     /* Keepalives to the exit failed */
+)
+
+/* traceEvent is a single event in a trace.  Secrets are never recorded. */
+type traceEvent struct {
+	Time    time.Time
+	Event   string
+	Depth   int    /* Number of jumps in the chain at the time */
+	User    string `json:",omitempty"`
+	Host    string `json:",omitempty"`
+	Version string `json:",omitempty"`
+	Label   string `json:",omitempty"`
+	Detail  string `json:",omitempty"`
+
+	/* How long the event took, e.g. a handshake */
+	Duration time.Duration `json:",omitempty"`
+}
+
+/* tracer writes trace events, if we're tracing */
+var tracer struct {
+	l   sync.Mutex
+	enc *json.Encoder
+}
+
+/* OpenTrace starts recording trace events to the file named fname, which is
+appended to.  The returned function stops tracing. */
+func OpenTrace(fname string) (func(), error) {
+	f, err := os.OpenFile(
+		fname,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if nil != err {
+		return nil, err
+	}
+	tracer.l.Lock()
+	defer tracer.l.Unlock()
+	tracer.enc = json.NewEncoder(f)
+	return func() {
+		tracer.l.Lock()
+		defer tracer.l.Unlock()
+		tracer.enc = nil
+		f.Close()
+	}, nil
+}
+
+/* Trace records an event about j, if we're tracing.  Detail may be used for
+a reason or error. */
+func Trace(event string, j jump, depth int, detail string) {
+	TraceTimed(event, j, depth, detail, 0)
+}
+
+/* TraceTimed is like Trace, but also records how long the event took. */
+func TraceTimed(
+	event string,
+	j jump,
+	depth int,
+	detail string,
+	took time.Duration,
+) {
+	tracer.l.Lock()
+	defer tracer.l.Unlock()
+	if nil == tracer.enc {
+		return
+	}
+	if err := tracer.enc.Encode(traceEvent{
+		Time:    time.Now(),
+		Event:   event,
+		Depth:   depth,
+		User:    j.username,
+		Host:    j.host,
+		Version: j.version,
+		Label:   j.label,
+		Detail:  Redact(detail),
+
+		Duration: took,
+	}); nil != err {
+		log.Printf("Unable to write trace event: %v", err)
+	}
+}
+
+/* ReplayMain is the entry point for the replay subcommand, which prints a
+trace as a timeline. */
+func ReplayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v replay tracefile
+
+Prints the chain construction events recorded with -trace as a timeline, with
+the time since the previous event.
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 1 != fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err := Replay(os.Stdout, f); nil != err {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+/* Replay writes the trace read from r to w as a timeline */
+func Replay(w io.Writer, r io.Reader) error {
+	var (
+		last time.Time
+		n    int
+	)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		n++
+		var ev traceEvent
+		if err := json.Unmarshal(s.Bytes(), &ev); nil != err {
+			return fmt.Errorf("line %v: %v", n, err)
+		}
+		/* Gaps between runs get a blank line */
+		var since time.Duration
+		if !last.IsZero() {
+			since = ev.Time.Sub(last)
+			if time.Minute < since {
+				fmt.Fprintf(w, "\n")
+			}
+		}
+		last = ev.Time
+		fmt.Fprintf(
+			w,
+			"%v %12v %-14v %2v",
+			ev.Time.Format("2006-01-02 15:04:05.000000"),
+			"+"+since.Round(time.Microsecond).String(),
+			ev.Event,
+			ev.Depth,
+		)
+		if "" != ev.Host {
+			fmt.Fprintf(w, " %v@%v", ev.User, ev.Host)
+		}
+		if "" != ev.Version {
+			fmt.Fprintf(w, " (%v)", ev.Version)
+		}
+		if "" != ev.Label {
+			fmt.Fprintf(w, " [%v]", ev.Label)
+		}
+		if "" != ev.Detail {
+			fmt.Fprintf(w, ": %v", ev.Detail)
+		}
+		if 0 != ev.Duration {
+			fmt.Fprintf(w, " (took %v)", ev.Duration)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return s.Err()
+}
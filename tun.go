@@ -0,0 +1,140 @@
+package main
+
+/*
+ * tun.go
+ * Forward IP packets over OpenSSH tunnel channels
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	/* TUNANY asks the server to pick its tunnel device */
+	TUNANY = 0x7FFFFFFF
+	/* tunModePointToPoint requests a layer 3 tunnel */
+	tunModePointToPoint = 1
+	/* maxTunPacket is the biggest packet we'll accept from either side */
+	maxTunPacket = 65535 + 4
+)
+
+/* Address families as OpenSSH puts them on the wire, which are OpenBSD's */
+const (
+	tunAFInet  = 2
+	tunAFInet6 = 24
+)
+
+/* ForwardTun opens a tun@openssh.com channel via c, asking for the remote
+tunnel device unit, and shuttles packets between it and dev, which is expected
+to read and write one raw IP packet at a time.  The exit jump's sshd must allow
+tunneling (PermitTunnel) and will need its end of the tunnel configured.  Fatal
+errors are sent to ec.  When ctx is done, the channel is closed; dev isn't, but
+won't be read from after the next packet. */
+func ForwardTun(
+	ctx context.Context,
+	c *ssh.Client,
+	dev io.ReadWriteCloser,
+	unit uint32,
+	ec chan<- error,
+) error {
+	ch, reqs, err := c.OpenChannel(
+		"tun@openssh.com",
+		ssh.Marshal(struct {
+			Mode uint32
+			Unit uint32
+		}{tunModePointToPoint, unit}),
+	)
+	if nil != err {
+		return err
+	}
+	go ssh.DiscardRequests(reqs)
+	log.Printf("Opened tunnel to exit jump")
+
+	/* Stop when we're told */
+	context.AfterFunc(ctx, func() { ch.Close() })
+	fail := func(err error) {
+		ch.Close()
+		if nil != ctx.Err() {
+			return
+		}
+		select {
+		case ec <- err:
+		case <-ctx.Done():
+		}
+	}
+
+	/* Local packets to the remote side */
+	go func() {
+		err := tunToChannel(ch, dev)
+		fail(fmt.Errorf("sending tunneled packets: %v", err))
+	}()
+	/* Remote packets to the local device */
+	go func() {
+		err := channelToTun(dev, ch)
+		fail(fmt.Errorf("receiving tunneled packets: %v", err))
+	}()
+
+	return nil
+}
+
+/* tunToChannel reads packets from dev, frames them, and sends them to ch. */
+func tunToChannel(ch io.Writer, dev io.Reader) error {
+	buf := make([]byte, 8+maxTunPacket)
+	for {
+		n, err := dev.Read(buf[8:])
+		if nil != err {
+			return err
+		}
+		if 0 == n {
+			continue
+		}
+		/* Work out the address family from the IP version */
+		var af uint32
+		switch buf[8] >> 4 {
+		case 4:
+			af = tunAFInet
+		case 6:
+			af = tunAFInet6
+		default:
+			log.Printf("Dropping non-IP tunnel packet")
+			continue
+		}
+		/* Length, address family, packet */
+		binary.BigEndian.PutUint32(buf[0:], uint32(n+4))
+		binary.BigEndian.PutUint32(buf[4:], af)
+		if _, err := ch.Write(buf[:8+n]); nil != err {
+			return err
+		}
+	}
+}
+
+/* channelToTun reads framed packets from ch and writes them to dev. */
+func channelToTun(dev io.Writer, ch io.Reader) error {
+	buf := make([]byte, maxTunPacket)
+	for {
+		/* Packet length */
+		if _, err := io.ReadFull(ch, buf[:4]); nil != err {
+			return err
+		}
+		l := binary.BigEndian.Uint32(buf)
+		if 4 > l || maxTunPacket < l {
+			return fmt.Errorf("invalid tunnel packet length %v", l)
+		}
+		/* Address family and packet */
+		if _, err := io.ReadFull(ch, buf[:l]); nil != err {
+			return err
+		}
+		if _, err := dev.Write(buf[4:l]); nil != err {
+			return err
+		}
+	}
+}
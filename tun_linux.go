@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+/*
+ * tun_linux.go
+ * Open a tun device on Linux
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/* tunSupported indicates OpenTun works on this platform */
+const tunSupported = true
+
+const (
+	tunSetIFF = 0x400454CA /* TUNSETIFF ioctl */
+	iffTun    = 0x0001     /* IFF_TUN */
+	iffNoPI   = 0x1000     /* IFF_NO_PI */
+)
+
+/* OpenTun opens or creates the tun device named name and returns it.  Each
+read or write is a single IP packet. */
+func OpenTun(name string) (io.ReadWriteCloser, error) {
+	if syscall.IFNAMSIZ <= len(name) {
+		return nil, fmt.Errorf("device name too long")
+	}
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if nil != err {
+		return nil, err
+	}
+	/* struct ifreq, more or less */
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [24 - 2]byte
+	}
+	copy(ifr.name[:], name)
+	ifr.flags = iffTun | iffNoPI
+	if _, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		f.Fd(),
+		tunSetIFF,
+		uintptr(unsafe.Pointer(&ifr)),
+	); 0 != errno {
+		f.Close()
+		return nil, errno
+	}
+	return f, nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+/*
+ * tun_other.go
+ * Stub for platforms without tun support
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"io"
+)
+
+/* tunSupported indicates OpenTun works on this platform */
+const tunSupported = false
+
+/* OpenTun returns an error, as tun devices are only supported on Linux */
+func OpenTun(name string) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("tun devices are only supported on Linux")
+}
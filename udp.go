@@ -0,0 +1,120 @@
+package main
+
+/*
+ * udp.go
+ * Forward UDP datagrams via the helper
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+/* UDPTIMEOUT is how long the helper waits for a reply to a datagram */
+const UDPTIMEOUT = 5 * time.Second
+
+/* ForwardUDP listens on the local UDP ports in the UDP forwards and sends
+datagrams received to their targets via the helper h.  The first reply to each
+datagram is sent back to its sender.  Fatal errors will be sent on errChan,
+unless ctx is done, in which case forwarding stops.  The caller is responsible
+for closing the returned PacketConns. */
+func ForwardUDP(
+	ctx context.Context,
+	h *helperClient,
+	forwards []fwdspec,
+	errChan chan<- error,
+) ([]net.PacketConn, error) {
+	var pcs []net.PacketConn
+	for _, f := range forwards {
+		if !f.isUDP {
+			continue
+		}
+		pc, err := net.ListenPacket("udp", f.laddr)
+		if nil != err {
+			CloseUDP(pcs)
+			return nil, err
+		}
+		go forwardUDP(ctx, pc, h, f, errChan)
+		fwdMap.Add(f, pc.LocalAddr().String(), "")
+		log.Printf(
+			"Listening on %v for UDP datagrams to %v",
+			pc.LocalAddr(),
+			withLabel(f.caddr, f.label),
+		)
+		pcs = append(pcs, pc)
+	}
+	return pcs, nil
+}
+
+/* CloseUDP closes the UDP listeners in pcs.  Listeners already closed, e.g.
+by the kill switch, are skipped. */
+func CloseUDP(pcs []net.PacketConn) {
+	for _, pc := range pcs {
+		if err := pc.Close(); errors.Is(err, net.ErrClosed) {
+			continue
+		} else if nil != err {
+			log.Printf(
+				"Unable to close UDP listener %v: %v",
+				pc.LocalAddr(),
+				err,
+			)
+			continue
+		}
+		log.Printf("Closed UDP listener %v", pc.LocalAddr())
+	}
+}
+
+/* forwardUDP reads datagrams from pc and proxies them to f.caddr via h until
+ctx is done.  Fatal errors are sent to ec. */
+func forwardUDP(
+	ctx context.Context,
+	pc net.PacketConn,
+	h *helperClient,
+	f fwdspec,
+	ec chan<- error,
+) {
+	defer context.AfterFunc(ctx, func() {
+		pc.SetReadDeadline(time.Now())
+	})()
+	buf := make([]byte, 65536)
+	for {
+		n, a, err := pc.ReadFrom(buf)
+		if nil != err {
+			if nil == ctx.Err() {
+				select {
+				case ec <- err:
+				case <-ctx.Done():
+				}
+			}
+			return
+		}
+		b := make([]byte, n)
+		copy(b, buf)
+		go func() {
+			r, err := h.UDP(f.caddr, b, UDPTIMEOUT)
+			if nil != err {
+				log.Printf(
+					"Unable to forward datagram %v->%v: %v",
+					a,
+					f.caddr,
+					err,
+				)
+				return
+			}
+			if _, err := pc.WriteTo(r, a); nil != err {
+				log.Printf(
+					"Unable to send reply %v->%v: %v",
+					f.caddr,
+					a,
+					err,
+				)
+			}
+		}()
+	}
+}
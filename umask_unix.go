@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+/*
+ * umask_unix.go
+ * Set the umask with umask(2)
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import "syscall"
+
+/* setUmask sets the process's umask to m and returns the old one */
+func setUmask(m int) int {
+	return syscall.Umask(m)
+}
@@ -0,0 +1,14 @@
+package main
+
+/*
+ * umask_windows.go
+ * Windows has no umask
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+/* setUmask does nothing, as there's no umask on Windows */
+func setUmask(m int) int {
+	return 0
+}
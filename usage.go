@@ -0,0 +1,117 @@
+package main
+
+/*
+ * usage.go
+ * Count the bytes and connections which cross each jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* Per-jump usage, keyed by user@host, for hop providers who bill by traffic.
+These last for the life of the process, across chain rebuilds, and are served
+from /debug/vars with -pprof. */
+var (
+	/* jumpBytes is the number of bytes relayed across each jump */
+	jumpBytes = expvar.NewMap("jump_bytes")
+	/* jumpConns is the number of connections made across each jump */
+	jumpConns = expvar.NewMap("jump_connections")
+)
+
+/* usageKey names the jump to which c is connected in the usage counters */
+func usageKey(c *ssh.Client) string {
+	if j, ok := state.JumpOf(c); ok {
+		return j.username + "@" + j.host
+	}
+	return c.User() + "@" + c.RemoteAddr().String()
+}
+
+/* usageConn counts the bytes read and written on a conn against the jumps it
+crosses */
+type usageConn struct {
+	net.Conn
+	keys []string
+}
+
+/* CountUsage counts a connection against each jump in cs, which the
+connection crosses, and wraps c to count its bytes against them as well. */
+func CountUsage(c net.Conn, cs []*ssh.Client) net.Conn {
+	keys := make([]string, len(cs))
+	for i, sc := range cs {
+		keys[i] = usageKey(sc)
+		jumpConns.Add(keys[i], 1)
+	}
+	return &usageConn{Conn: c, keys: keys}
+}
+
+/* Read reads from the underlying conn and counts the bytes read */
+func (c *usageConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(n)
+	return n, err
+}
+
+/* Write writes to the underlying conn and counts the bytes written */
+func (c *usageConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(n)
+	return n, err
+}
+
+/* NetConn returns the underlying conn */
+func (c *usageConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+/* count adds n bytes to each of c's jumps */
+func (c *usageConn) count(n int) {
+	if 0 == n {
+		return
+	}
+	countQuota(n)
+	for _, k := range c.keys {
+		jumpBytes.Add(k, int64(n))
+	}
+}
+
+/* usageListener counts the connections it accepts, and their bytes, against
+the jumps they cross */
+type usageListener struct {
+	net.Listener
+	cs []*ssh.Client
+}
+
+/* Accept accepts a connection and wraps it with CountUsage */
+func (l *usageListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+	return CountUsage(c, l.cs), nil
+}
+
+/* WriteUsage writes how much has crossed each jump to w */
+func WriteUsage(w io.Writer) {
+	jumpConns.Do(func(kv expvar.KeyValue) {
+		var nb int64
+		if b, ok := jumpBytes.Get(kv.Key).(*expvar.Int); ok {
+			nb = b.Value()
+		}
+		fmt.Fprintf(
+			w,
+			"  %v: %v bytes in %v connections\n",
+			kv.Key,
+			nb,
+			kv.Value,
+		)
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+/*
+ * vault.go
+ * Get passwords and keys from HashiCorp Vault
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* VAULTPREFIX is the password prefix to indicate a secret in Vault, of the
+form vault:path#field */
+const VAULTPREFIX = "vault:"
+
+/* Environment variables used to talk to Vault, as with the vault CLI */
+const (
+	VAULTADDRENV      = "VAULT_ADDR"
+	VAULTTOKENENV     = "VAULT_TOKEN"
+	VAULTNAMESPACEENV = "VAULT_NAMESPACE"
+	VAULTCACERTENV    = "VAULT_CACERT"
+)
+
+/* VAULTTIMEOUT is how long Vault has to give us a secret */
+const VAULTTIMEOUT = 30 * time.Second
+
+func init() {
+	RegisterSecretBackend(VAULTPREFIX, vaultSecret)
+}
+
+/* vaultSecret gets the secret named by ref, of the form path#field, from
+Vault.  Secrets in version 2 KV engines need the data/ in the path, e.g.
+secret/data/jumps/target1#password.  If there's no #field and the secret only
+has one field, that field is used. */
+func vaultSecret(ctx context.Context, ref string) ([]byte, error) {
+	path, field := ref, ""
+	if i := strings.LastIndex(ref, "#"); -1 != i {
+		path, field = ref[:i], ref[i+1:]
+	}
+	addr := os.Getenv(VAULTADDRENV)
+	if "" == addr {
+		return nil, fmt.Errorf("%v not set", VAULTADDRENV)
+	}
+	token, err := vaultToken()
+	if nil != err {
+		return nil, err
+	}
+	hc, err := vaultClient()
+	if nil != err {
+		return nil, err
+	}
+
+	/* Ask for the secret */
+	ctx, cancel := context.WithTimeout(ctx, VAULTTIMEOUT)
+	defer cancel()
+	u := strings.TrimSuffix(addr, "/") + "/v1/" +
+		strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv(VAULTNAMESPACEENV); "" != ns {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	res, err := hc.Do(req)
+	if nil != err {
+		return nil, fmt.Errorf("requesting %v: %w", path, err)
+	}
+	defer res.Body.Close()
+	var r struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(
+		res.Body,
+		1024*1024,
+	)).Decode(&r); nil != err && http.StatusOK == res.StatusCode {
+		return nil, fmt.Errorf("decoding %v: %w", path, err)
+	}
+	if http.StatusOK != res.StatusCode {
+		msg := res.Status
+		if 0 != len(r.Errors) {
+			msg += ": " + strings.Join(r.Errors, ", ")
+		}
+		return nil, fmt.Errorf("getting %v: %v", path, msg)
+	}
+
+	/* Version 2 KV engines nest the secret */
+	data := r.Data
+	if d, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = d
+		}
+	}
+
+	/* Get the field we want */
+	if "" == field {
+		if 1 != len(data) {
+			return nil, fmt.Errorf(
+				"%v has %v fields, pick one with #field",
+				path,
+				len(data),
+			)
+		}
+		for k := range data {
+			field = k
+		}
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("%v has no string field %q", path, field)
+	}
+	return []byte(v), nil
+}
+
+/* vaultToken gets the Vault token from the environment or, failing that, the
+file the vault CLI leaves in the home directory. */
+func vaultToken() (string, error) {
+	if t := os.Getenv(VAULTTOKENENV); "" != t {
+		return t, nil
+	}
+	h, err := os.UserHomeDir()
+	if nil != err {
+		return "", fmt.Errorf("%v not set", VAULTTOKENENV)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(h, ".vault-token"))
+	if nil != err {
+		return "", fmt.Errorf(
+			"%v not set and no token file: %w",
+			VAULTTOKENENV,
+			err,
+		)
+	}
+	t := strings.TrimSpace(string(b))
+	if "" == t {
+		return "", errors.New("empty token file")
+	}
+	return t, nil
+}
+
+/* vaultClient returns an HTTP client which trusts the CA certificates in the
+file named by VAULTCACERTENV, if it's set.  The client won't follow redirects
+to other hosts or from HTTPS to HTTP, as the token goes with them. */
+func vaultClient() (*http.Client, error) {
+	cf := os.Getenv(VAULTCACERTENV)
+	if "" == cf {
+		return &http.Client{CheckRedirect: vaultRedirect}, nil
+	}
+	b, err := ioutil.ReadFile(cf)
+	if nil != err {
+		return nil, fmt.Errorf("reading %v: %w", VAULTCACERTENV, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates in %v", cf)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+		CheckRedirect: vaultRedirect,
+	}, nil
+}
+
+/* vaultRedirect refuses redirects which would send the Vault token somewhere
+it wasn't sent to begin with. */
+func vaultRedirect(req *http.Request, via []*http.Request) error {
+	if 10 <= len(via) {
+		return errors.New("too many redirects")
+	}
+	o := via[0].URL
+	if !strings.EqualFold(req.URL.Host, o.Host) {
+		return fmt.Errorf("refusing redirect to %v", req.URL.Host)
+	}
+	if "https" == o.Scheme && "https" != req.URL.Scheme {
+		return fmt.Errorf("refusing redirect to %v", req.URL.Scheme)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+/*
+ * versions.go
+ * Rotate through client version strings
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+/* COMMONVERSIONS are client versions which are common in the wild, picked
+from with -randversions if there's no -versions. */
+var COMMONVERSIONS = []string{
+	"SSH-2.0-OpenSSH_7.4",
+	"SSH-2.0-OpenSSH_8.0",
+	"SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.13",
+	"SSH-2.0-OpenSSH_8.4p1 Debian-5+deb11u3",
+	"SSH-2.0-OpenSSH_8.7",
+	"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.13",
+	"SSH-2.0-OpenSSH_9.2p1 Debian-2+deb12u6",
+	"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13.12",
+	"SSH-2.0-OpenSSH_9.9",
+	"SSH-2.0-OpenSSH_for_Windows_9.5",
+	"SSH-2.0-PuTTY_Release_0.78",
+	"SSH-2.0-PuTTY_Release_0.81",
+	"SSH-2.0-PuTTY_Release_0.83",
+}
+
+/* versionRotation holds a list of client versions, one of which is used at
+any given time.  The version in use changes every interval, based on the wall
+clock, so chains built at different times, even by different runs, present
+different versions.  If random is set, each jump without its own version is
+instead given one from the list by hashing its user@host, so it sees the same
+version every time it's tried, but different jumps likely see different
+versions. */
+type versionRotation struct {
+	versions []string
+	interval time.Duration
+	random   bool
+}
+
+/* ReadVersions reads a list of client versions, one per line, from the file
+named fname, for rotation every interval. */
+func ReadVersions(fname string, interval time.Duration) (
+	*versionRotation,
+	error,
+) {
+	if 0 >= interval {
+		return nil, fmt.Errorf("rotation interval must be positive")
+	}
+	vs, err := readVersions(fname)
+	if nil != err {
+		return nil, err
+	}
+	return &versionRotation{versions: vs, interval: interval}, nil
+}
+
+/* RandomVersions returns a versionRotation which gives each jump without its
+own version one from the file named fname or, if fname is empty,
+COMMONVERSIONS, the same one every time. */
+func RandomVersions(fname string) (*versionRotation, error) {
+	vs := COMMONVERSIONS
+	if "" != fname {
+		var err error
+		if vs, err = readVersions(fname); nil != err {
+			return nil, err
+		}
+	}
+	return &versionRotation{versions: vs, random: true}, nil
+}
+
+/* readVersions reads a list of client versions, one per line, from the file
+named fname. */
+func readVersions(fname string) ([]string, error) {
+	/* Slurp the file */
+	b, err := ioutil.ReadFile(fname)
+	if nil != err {
+		return nil, err
+	}
+	/* Grab the versions */
+	var vs []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		/* Ignore blanks and comments */
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if !strings.HasPrefix(l, "SSH-") {
+			return nil, fmt.Errorf("invalid version %q", l)
+		}
+		vs = append(vs, l)
+	}
+	if 0 == len(vs) {
+		return nil, fmt.Errorf("no versions in %v", fname)
+	}
+	return vs, nil
+}
+
+/* For returns the version to use now for j, or the empty string if j should
+use its own.  If v is nil, the empty string is returned. */
+func (v *versionRotation) For(j jump) string {
+	if nil == v {
+		return ""
+	}
+	if v.random {
+		if !j.defVer {
+			return ""
+		}
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%v@%v", j.username, j.host)
+		return v.versions[h.Sum32()%uint32(len(v.versions))]
+	}
+	n := time.Now().UnixNano() / int64(v.interval)
+	return v.versions[n%int64(len(v.versions))]
+}
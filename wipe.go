@@ -0,0 +1,41 @@
+package main
+
+/*
+ * wipe.go
+ * Don't leave used secrets lying around in memory
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+/* wipe overwrites each of bs with zeros, so key material, fetched
+credentials, and the like don't linger in memory, waiting for a memory dump,
+once they've been used.  Secrets kept as strings can't be wiped, so plain
+passwords from the jumpfile are kept in jumps' secrets. */
+func wipe(bs ...[]byte) {
+	for _, b := range bs {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+}
+
+/* WipePasswords wipes the passwords got at connect time for j and its cred=
+credentials. */
+func WipePasswords(j jump) {
+	wipe(j.pw)
+	for _, a := range j.alts {
+		wipe(a.pw)
+	}
+}
+
+/* WipeSecrets wipes the plain passwords from the jumpfile held by the jumps
+in js and their cred= credentials, once they'll not be needed again. */
+func WipeSecrets(js []jump) {
+	for _, j := range js {
+		wipe(j.secret)
+		for _, a := range j.alts {
+			wipe(a.secret)
+		}
+	}
+}
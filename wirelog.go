@@ -0,0 +1,172 @@
+package main
+
+/*
+ * wirelog.go
+ * Log the SSH messages exchanged with a jump
+ * By J. Stuart McMurray
+ * Created 20261017
+ * Last Modified 20261017
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* WIREMAXPACKET is the largest cleartext packet we'll believe, which is
+OpenSSH's limit */
+const WIREMAXPACKET = 256 * 1024
+
+/* wireMsgNames are the names of the SSH messages which may be seen before
+the connection's encrypted, from RFC 4250 and RFC 8308 */
+var wireMsgNames = map[byte]string{
+	1:  "DISCONNECT",
+	2:  "IGNORE",
+	3:  "UNIMPLEMENTED",
+	4:  "DEBUG",
+	5:  "SERVICE_REQUEST",
+	6:  "SERVICE_ACCEPT",
+	7:  "EXT_INFO",
+	20: "KEXINIT",
+	21: "NEWKEYS",
+	/* Which of the KEXDH, KEX_ECDH, or KEX_DH_GEX messages these are
+	depends on the key exchange */
+	30: "KEX_INIT",
+	31: "KEX_REPLY",
+	32: "KEX_DH_GEX_INIT",
+	33: "KEX_DH_GEX_REPLY",
+	34: "KEX_DH_GEX_REQUEST",
+}
+
+/* msgNewKeys is the message after which a direction is encrypted */
+const msgNewKeys = 21
+
+/* wireLogMatches returns true if spec, from -wirelog, selects j, which is
+at the given depth in the chain.  spec may be a depth, label, or address. */
+func wireLogMatches(spec string, j jump, depth int) bool {
+	if "" == spec {
+		return false
+	}
+	if n, err := strconv.Atoi(spec); nil == err {
+		return n == depth
+	}
+	if spec == j.label || spec == j.host {
+		return true
+	}
+	h, _, err := net.SplitHostPort(j.host)
+	return nil == err && spec == h
+}
+
+/* wireLogConn logs the SSH message types read and written on the underlying
+net.Conn.  Only the version exchange and key exchange are cleartext; once
+each direction's encrypted, all that's logged is that it is. */
+type wireLogConn struct {
+	net.Conn
+	rd *wireParser
+	wr *wireParser
+}
+
+/* NewWireLogConn wraps c to log SSH messages to and from a jump, described in
+logs as name. */
+func NewWireLogConn(c net.Conn, name string) net.Conn {
+	log.Printf("Logging SSH messages with %v", name)
+	return wireLogConn{
+		Conn: c,
+		rd:   &wireParser{name: name, dir: "<-"},
+		wr:   &wireParser{name: name, dir: "->"},
+	}
+}
+
+/* Read reads from the underlying conn and logs messages read */
+func (c wireLogConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.rd.Add(b[:n])
+	if nil != err {
+		c.rd.Log("read error: %v", err)
+	}
+	return n, err
+}
+
+/* Write logs the messages in b and writes it to the underlying conn */
+func (c wireLogConn) Write(b []byte) (int, error) {
+	c.wr.Add(b)
+	n, err := c.Conn.Write(b)
+	if nil != err {
+		c.wr.Log("write error: %v", err)
+	}
+	return n, err
+}
+
+/* wireParser picks SSH messages out of one direction of an SSH connection */
+type wireParser struct {
+	sync.Mutex
+	name      string
+	dir       string /* Arrow pointing which way the bytes go */
+	buf       []byte
+	versioned bool /* Version exchange finished */
+	encrypted bool /* NEWKEYS seen, so nothing more can be parsed */
+}
+
+/* Log logs a message about p's direction */
+func (p *wireParser) Log(f string, a ...interface{}) {
+	log.Printf("Wire %v %v %v", p.name, p.dir, fmt.Sprintf(f, a...))
+}
+
+/* Add adds b to the bytes seen and logs any complete messages */
+func (p *wireParser) Add(b []byte) {
+	p.Lock()
+	defer p.Unlock()
+	if p.encrypted || 0 == len(b) {
+		return
+	}
+	p.buf = append(p.buf, b...)
+
+	/* Version exchange, possibly after other lines from the server */
+	for !p.versioned {
+		i := bytes.IndexByte(p.buf, '\n')
+		if -1 == i {
+			return
+		}
+		l := strings.TrimRight(string(p.buf[:i]), "\r")
+		p.buf = p.buf[i+1:]
+		if strings.HasPrefix(l, "SSH-") {
+			p.Log("version %q", l)
+			p.versioned = true
+		} else {
+			p.Log("pre-version line %q", l)
+		}
+	}
+
+	/* Binary packets, until NEWKEYS */
+	for 6 <= len(p.buf) {
+		pl := binary.BigEndian.Uint32(p.buf)
+		if WIREMAXPACKET < pl || 2 > pl {
+			p.Log("garbled packet length %v, giving up", pl)
+			p.encrypted = true
+			p.buf = nil
+			return
+		}
+		if uint32(len(p.buf)-4) < pl {
+			return
+		}
+		t := p.buf[5]
+		name, ok := wireMsgNames[t]
+		if !ok {
+			name = fmt.Sprintf("unexpected message type %v", t)
+		}
+		p.Log("%v (%v bytes)", name, pl)
+		p.buf = p.buf[4+pl:]
+		if msgNewKeys == t {
+			p.Log("encrypted from here on")
+			p.encrypted = true
+			p.buf = nil
+			return
+		}
+	}
+}